@@ -0,0 +1,637 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Package api defines the request and response types of Nixery's
+// extended HTTP API, which is served under `/v1/` next to the registry
+// protocol.
+//
+// The types are shared between the server and Go clients of the API.
+package api
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/nixery/manifest"
+)
+
+// SpecAnnotation is the manifest annotation under which the spec an
+// image was built from is recorded.
+const SpecAnnotation = "dev.nixery.spec"
+
+// TTLAnnotation is the manifest annotation under which the intended
+// lifetime of an image is recorded, as a Go duration (e.g. `168h0m0s`).
+// Garbage collection stops treating such images as roots once their
+// lifetime has passed.
+const TTLAnnotation = "dev.nixery.ttl"
+
+// ImageSpec describes an image in a structured form, as an
+// alternative to encoding everything in the image name. Specs can be
+// checked into repositories and reviewed like any other lock file.
+type ImageSpec struct {
+	// Names of the packages to include, in the same form as in
+	// image names (including meta-packages such as `shell`).
+	Packages []string `json:"packages"`
+
+	// Revision of the package set to build from. This corresponds
+	// to the image tag and defaults to `latest`.
+	Pin string `json:"pin,omitempty"`
+
+	// Architecture to build for (`amd64` or `arm64`), defaults to
+	// `amd64`.
+	Arch string `json:"arch,omitempty"`
+
+	// Overrides of the image's runtime configuration.
+	Cmd []string `json:"cmd,omitempty"`
+	Env []string `json:"env,omitempty"`
+
+	// Shell snippet run by login shells, which implies the
+	// `profile` meta-package.
+	Activation string `json:"activation,omitempty"`
+
+	// Intended lifetime of the image (e.g. `7d` or `12h`), after
+	// which it may be garbage-collected. Images with a lifetime are
+	// not cached.
+	TTL string `json:"ttl,omitempty"`
+}
+
+// SpecResponse is returned after an image has been built from a spec.
+type SpecResponse struct {
+	// Repository name and tag under which the image is available.
+	// Note that only the digest reference is guaranteed to refer
+	// to this exact image.
+	Name string `json:"name"`
+	Tag  string `json:"tag"`
+
+	// Digest of the image manifest
+	Digest string `json:"digest"`
+
+	// Short name standing for the spec, if an alias was requested
+	Alias string `json:"alias,omitempty"`
+
+	// Pullable reference in the form `name@digest`, using the
+	// alias if there is one. It is qualified with the registry host
+	// (`host[:port]/name@digest`) if the external URL of the
+	// instance is configured.
+	Reference string `json:"reference"`
+}
+
+// StorePathsRequest describes an image built from raw store paths
+// instead of packages.
+type StorePathsRequest struct {
+	// Top-level store paths to include (e.g.
+	// `/nix/store/<hash>-hello-2.12`), which must be present in the
+	// Nix store of the instance. Their closures are included.
+	StorePaths []string `json:"storePaths"`
+
+	// Architecture of the store paths (`amd64` or `arm64`),
+	// defaults to `amd64`.
+	Arch string `json:"arch,omitempty"`
+
+	// Runtime configuration of the image.
+	Cmd []string `json:"cmd,omitempty"`
+	Env []string `json:"env,omitempty"`
+}
+
+// ImageContents lists the store paths included in an image.
+type ImageContents struct {
+	// Digest of the image manifest
+	Digest string `json:"digest"`
+
+	// Sorted store paths of the image's runtime closure
+	StorePaths []string `json:"storePaths"`
+
+	// Hash components of the store paths, in the same order
+	Hashes []string `json:"hashes"`
+}
+
+// DriftReport compares the runtime closure of an image with that of
+// the same spec built from the current package set.
+type DriftReport struct {
+	// Digest of the compared image
+	Digest string `json:"digest"`
+
+	// Revision of the package set from which the spec was built
+	// again, and a reference to the resulting image
+	Tag       string `json:"tag"`
+	Current   string `json:"current"`
+	Reference string `json:"reference"`
+
+	// Whether the closures of the two images differ
+	Drifted bool `json:"drifted"`
+
+	// Store paths only present in the current image, only present
+	// in the compared image, and present in different versions or
+	// builds in both
+	Added   []string     `json:"added"`
+	Removed []string     `json:"removed"`
+	Changed []PathChange `json:"changed"`
+}
+
+// PathChange is a package whose store path differs between two
+// images.
+type PathChange struct {
+	Package string `json:"package"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// ReplicationRecord is a single local cache entry that is streamed
+// from an instance to its standby replicas. Exactly one of the
+// manifest or layer fields is set.
+type ReplicationRecord struct {
+	Key      string          `json:"key"`
+	Manifest json.RawMessage `json:"manifest,omitempty"`
+	Layer    *manifest.Entry `json:"layer,omitempty"`
+}
+
+// SizeResponse reports how much data has to be transferred to pull an
+// image, which lets clients display meaningful progress.
+type SizeResponse struct {
+	Name   string `json:"name"`
+	Tag    string `json:"tag"`
+	Digest string `json:"digest"`
+
+	// Number of layers in the image
+	Layers int `json:"layers"`
+
+	// Total size (in bytes) of the manifest, configuration and all
+	// layers, as transferred over the network.
+	TransferSize int64 `json:"transferSize"`
+
+	// Size (in bytes) of the image contents once unpacked, if known.
+	UnpackedSize uint64 `json:"unpackedSize,omitempty"`
+}
+
+// CacheKeyExplanation describes every input from which the cache key
+// of an image is derived, to debug why seemingly identical requests
+// do not share a cache entry.
+type CacheKeyExplanation struct {
+	Name string `json:"name"`
+	Tag  string `json:"tag"`
+
+	// Revision of the package set that the tag is pinned to, if any
+	Pin string `json:"pin,omitempty"`
+
+	// Normalised package list, including the contents of
+	// meta-packages and package groups
+	Packages []string `json:"packages"`
+	Arch     string   `json:"arch"`
+	Wasm     bool     `json:"wasm,omitempty"`
+	Layout   string   `json:"layout,omitempty"`
+	BinOnly  bool     `json:"binOnly,omitempty"`
+
+	// Runtime configuration and annotations, which are part of the key
+	Cmd         []string          `json:"cmd,omitempty"`
+	Env         []string          `json:"env,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Tenant for which the image is encrypted, if encryption is used
+	EncryptedFor string `json:"encryptedFor,omitempty"`
+
+	// Tenant whose credentials are used for fetching sources, if any
+	CredentialsOf string `json:"credentialsOf,omitempty"`
+
+	// Type of the package source and the key it derived from the
+	// packages and tag, before any of the above are added
+	Source    string `json:"source"`
+	SourceKey string `json:"sourceKey,omitempty"`
+
+	// Resulting cache key, or the reason why the image is not
+	// cacheable
+	Key    string `json:"key,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// LoggingSettings are the runtime logging settings managed through
+// the admin API. Fields that are not set are left unchanged.
+type LoggingSettings struct {
+	// Log level, e.g. `info` or `debug`. Debug logging includes
+	// cache misses for each request.
+	Level string `json:"level,omitempty"`
+
+	// Whether Nix is invoked with verbose output
+	VerboseNix *bool `json:"verboseNix,omitempty"`
+}
+
+// BuildInfo identifies the build of Nixery serving an instance, so
+// that images can be correlated with the build that produced them.
+type BuildInfo struct {
+	// Version of Nixery, as set when it was built
+	Version string `json:"version"`
+
+	// Version of the Go module, if built from a module release
+	Module string `json:"module,omitempty"`
+
+	// Commit of the Nixery repository, and whether the working tree
+	// had uncommitted changes
+	Revision string `json:"revision,omitempty"`
+	Modified bool   `json:"modified,omitempty"`
+
+	// Time of the commit, in RFC 3339 format
+	CommitTime string `json:"commitTime,omitempty"`
+
+	// Version of Go that Nixery was built with
+	GoVersion string `json:"goVersion"`
+}
+
+// Status describes the running instance.
+type Status struct {
+	Build   BuildInfo `json:"build"`
+	Started time.Time `json:"started"`
+}
+
+// PinStatus describes the revision of the package set that the
+// `latest` tag is pinned to, and the progress of its rollout.
+type PinStatus struct {
+	Current string `json:"current"`
+
+	// Set while images are being migrated from a previous pin
+	Previous    string     `json:"previous,omitempty"`
+	RolloutEnds *time.Time `json:"rolloutEnds,omitempty"`
+	Migrated    int        `json:"migrated"`
+	Pending     int        `json:"pending"`
+
+	// Migrated images whose closure did not change, and which kept
+	// their manifest
+	Unchanged int `json:"unchanged"`
+}
+
+// PinRequest advances the pin of the `latest` tag to a new revision.
+type PinRequest struct {
+	Revision string `json:"revision"`
+}
+
+// NamedPin is a revision of the package set saved under a name, which
+// can be used as an image tag until it is advanced.
+type NamedPin struct {
+	Name     string `json:"name"`
+	Revision string `json:"revision"`
+
+	// Tenant that created the pin and may change it, if any
+	Tenant string `json:"tenant,omitempty"`
+
+	Created  time.Time `json:"created"`
+	Advanced time.Time `json:"advanced"`
+}
+
+// NamedPinRequest creates a named pin, or advances an existing one.
+type NamedPinRequest struct {
+	Name string `json:"name"`
+
+	// Revision to pin, defaults to the current pin of `latest`
+	Revision string `json:"revision,omitempty"`
+}
+
+// CuratedImages describes the image definitions synced from a Git
+// repository, which are served under their names.
+type CuratedImages struct {
+	Repo string `json:"repo"`
+	Ref  string `json:"ref,omitempty"`
+
+	// Commit that the definitions were read from
+	Revision string     `json:"revision,omitempty"`
+	Synced   *time.Time `json:"synced,omitempty"`
+
+	// Reason the last sync failed, in which case the definitions of
+	// the previous sync are still served
+	Error string `json:"error,omitempty"`
+
+	Images map[string]ImageSpec `json:"images"`
+}
+
+// PromoteRequest copies cached images from the storage prefix of
+// another environment into that of the serving instance.
+type PromoteRequest struct {
+	// Environment (storage prefix) to promote images from
+	From string `json:"from"`
+
+	// Cache keys of the images to promote (see `/v1/explain`). All
+	// cached images are promoted if empty.
+	Keys []string `json:"keys,omitempty"`
+}
+
+// PromoteReport summarises the outcome of a promotion.
+type PromoteReport struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Manifests int    `json:"manifests"`
+	Copied    int    `json:"copiedBlobs"`
+	Existing  int    `json:"existingBlobs"`
+	Bytes     int64  `json:"copiedBytes"`
+}
+
+// InvalidateRequest announces changes to the package source, e.g. by
+// CI after merging changes to the package repository.
+type InvalidateRequest struct {
+	// Branch or tag of the package repository that changed, or the
+	// `latest` tag. All of them are invalidated if empty.
+	Ref string `json:"ref,omitempty"`
+}
+
+// InvalidateReport summarises the outcome of an invalidation.
+type InvalidateReport struct {
+	Ref string `json:"ref,omitempty"`
+
+	// Number of background builds from the invalidated source whose
+	// results were dropped
+	Builds int `json:"droppedBuilds"`
+}
+
+// PullTokenRequest requests a short-lived token for pulling an image.
+type PullTokenRequest struct {
+	// Repository name of the image, e.g. `shell/git`
+	Image string `json:"image"`
+
+	// Lifetime of the token as a duration (e.g. `30m`), defaults
+	// to 15 minutes and may be at most 24 hours
+	TTL string `json:"ttl,omitempty"`
+}
+
+// PullToken grants access to a single image until it expires.
+type PullToken struct {
+	Token   string    `json:"token"`
+	Image   string    `json:"image"`
+	Expires time.Time `json:"expires"`
+}
+
+// TokenResponse is returned by the token endpoint of the Docker token
+// authentication flow.
+type TokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Capabilities describes the features of an instance, which is served
+// at `/.well-known/nixery.json` so that tooling can adapt to it.
+type Capabilities struct {
+	// Version of Nixery serving the instance
+	Version string `json:"version"`
+
+	// Version of the image name grammar (meta-packages, package
+	// flags and groups) understood by the instance
+	GrammarVersion int `json:"grammarVersion"`
+
+	// Platforms for which images can be requested, e.g.
+	// `linux/arm64`
+	Platforms []string `json:"platforms"`
+
+	// Meta-packages understood at the start of image names
+	MetaPackages []string `json:"metaPackages"`
+
+	// Maximum number of layers of built images
+	MaxLayers int `json:"maxLayers"`
+
+	// Authentication accepted for pulls, `anonymous` or
+	// `pull-token` (see `/v1/token`)
+	Auth []string `json:"auth"`
+
+	// Request header identifying tenants, if tenants are used
+	TenantHeader string `json:"tenantHeader,omitempty"`
+
+	// Optional features enabled on the instance, such as
+	// `async-builds`, `package-flags` or `encryption`
+	Features []string `json:"features"`
+}
+
+// CacheStats describes the contents of the local cache of an instance.
+type CacheStats struct {
+	Manifests   int `json:"manifests"`
+	Layers      int `json:"layers"`
+	ScanResults int `json:"scanResults"`
+
+	// Disk usage of the manifest cache, its limit (if any) and the
+	// number of manifests evicted to stay within it
+	ManifestBytes    int64 `json:"manifestBytes"`
+	ManifestLimit    int64 `json:"manifestLimit,omitempty"`
+	ManifestsEvicted int64 `json:"manifestsEvicted"`
+}
+
+// GCReport summarises the outcome of a garbage collection run.
+type GCReport struct {
+	Roots      int   `json:"roots"`
+	Referenced int   `json:"referenced"`
+	Grace      int   `json:"grace"`
+	Deleted    int   `json:"deleted"`
+	Freed      int64 `json:"freedBytes"`
+	Builds     int   `json:"buildsDeleted"`
+	Staging    int   `json:"stagingDeleted"`
+	Chunks     int   `json:"chunksDeleted,omitempty"`
+	Expired    int   `json:"expiredImages"`
+	DryRun     bool  `json:"dryRun"`
+}
+
+// CommandRecord describes a single invocation of a Nix process.
+type CommandRecord struct {
+	Image    string            `json:"image"`
+	Tag      string            `json:"tag"`
+	Program  string            `json:"program"`
+	Args     []string          `json:"args"`
+	Env      map[string]string `json:"env"`
+	Started  time.Time         `json:"started"`
+	Duration float64           `json:"durationSeconds"`
+	ExitCode int               `json:"exitCode"`
+	Error    string            `json:"error,omitempty"`
+
+	// Duration of the individual stages of the command, if it has
+	// multiple stages
+	Stages map[string]float64 `json:"stageSeconds,omitempty"`
+
+	// Last lines of the output of the command
+	Output []string `json:"output,omitempty"`
+
+	// Time spent on the slowest derivations built or downloaded by
+	// the command, slowest first
+	Derivations []DerivationTiming `json:"derivations,omitempty"`
+}
+
+// DerivationTiming describes the time Nix spent on building or
+// downloading a single derivation.
+type DerivationTiming struct {
+	// Derivation (for builds) or store path (for downloads)
+	Path string `json:"path"`
+
+	// Either `build` or `download`
+	Action  string  `json:"action"`
+	Seconds float64 `json:"seconds"`
+
+	// Set if the command exited before the derivation was finished
+	Unfinished bool `json:"unfinished,omitempty"`
+}
+
+// Usage describes the storage used by a single tenant.
+type Usage struct {
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// StorageOperations counts the calls made to the storage backend by
+// operation (e.g. `read` or `list`) and object class (e.g. `layers`).
+type StorageOperations struct {
+	Since   time.Time                    `json:"since"`
+	Counts  map[string]map[string]uint64 `json:"counts"`
+	Uploads UploadBuffers                `json:"uploads"`
+}
+
+// UploadBuffers describes the memory used by the buffers of chunked
+// uploads to the storage backend.
+type UploadBuffers struct {
+	Reserved int64  `json:"reserved"`         // Bytes reserved by running uploads
+	Budget   int64  `json:"budget,omitempty"` // Bytes available to all uploads (0 = unlimited)
+	Waits    uint64 `json:"waits"`            // Uploads that waited for the budget since startup
+}
+
+// TaskStatus describes a periodic background task and its recent
+// runs.
+type TaskStatus struct {
+	Name        string  `json:"name"`
+	Interval    float64 `json:"intervalSeconds"`
+	ClusterWide bool    `json:"clusterWide,omitempty"`
+
+	// Number of runs, failed runs, and runs skipped because this
+	// replica was not the leader
+	Runs     int `json:"runs"`
+	Failures int `json:"failures"`
+	Skipped  int `json:"skipped,omitempty"`
+
+	LastRun      *time.Time `json:"lastRun,omitempty"`
+	LastDuration float64    `json:"lastDurationSeconds,omitempty"`
+	LastError    string     `json:"lastError,omitempty"`
+	NextRun      *time.Time `json:"nextRun,omitempty"`
+}
+
+// SchedulerStatus describes the periodic tasks of an instance.
+type SchedulerStatus struct {
+	// Whether this replica runs cluster-wide tasks
+	Leader bool         `json:"leader"`
+	Tasks  []TaskStatus `json:"tasks"`
+}
+
+// BuilderPoolStatus describes a pool of remote builders and the image
+// builds delegated to it since startup.
+type BuilderPoolStatus struct {
+	Platform    string          `json:"platform"`
+	Builders    []BuilderStatus `json:"builders"`
+	Concurrency int             `json:"concurrency"`
+
+	// Builds currently running on the pool and waiting for it
+	Running int `json:"running"`
+	Queued  int `json:"queued"`
+
+	// Number of finished and failed builds, and builds rejected
+	// because the pool was unavailable or its queue was full
+	Builds   uint64 `json:"builds"`
+	Failures uint64 `json:"failures"`
+	Rejected uint64 `json:"rejected"`
+
+	// Total time builds waited for the pool
+	QueueSeconds float64 `json:"queueSeconds"`
+}
+
+// BuilderStatus describes the health of a remote builder.
+type BuilderStatus struct {
+	URI       string     `json:"uri"`
+	Healthy   bool       `json:"healthy"`
+	CheckedAt *time.Time `json:"checkedAt,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// StoreUsage describes the disk usage of the local Nix store and the
+// state of its garbage collection.
+type StoreUsage struct {
+	Path       string `json:"path"`
+	TotalBytes uint64 `json:"totalBytes"`
+	UsedBytes  uint64 `json:"usedBytes"`
+	FreeBytes  uint64 `json:"freeBytes"`
+
+	// Fractions of the disk usage at which garbage is collected, and
+	// down to which it is collected (0 if collection is disabled)
+	Threshold float64 `json:"threshold,omitempty"`
+	Target    float64 `json:"target,omitempty"`
+
+	// Store paths of recent builds that are protected from collection
+	Protected int `json:"protectedPaths"`
+
+	// Outcome of the last collection, if any
+	LastCollection *time.Time `json:"lastCollection,omitempty"`
+	LastFreed      uint64     `json:"lastFreedBytes,omitempty"`
+}
+
+// Profile describes an image that was imported into Nixery instead of
+// being built, and is served under its name and tag.
+type Profile struct {
+	Name string `json:"name"`
+	Tag  string `json:"tag"`
+	Arch string `json:"arch"`
+
+	// Registry reference the image was imported from, or `archive`
+	Source string `json:"source"`
+
+	Digest   string    `json:"digest"`
+	Imported time.Time `json:"imported"`
+	Layers   int       `json:"layers"`
+	Size     int64     `json:"size"`
+}
+
+// PopularityStatus describes the package popularity derived from the
+// registry's access logs.
+type PopularityStatus struct {
+	// Image pulls counted across all ingested logs
+	Pulls int `json:"pulls"`
+
+	// Number of packages with a popularity, and the most popular
+	// ones, most pulled first
+	Packages int                 `json:"packages"`
+	Top      []PackagePopularity `json:"top"`
+
+	// Time of the last ingestion, zero if none
+	Updated time.Time `json:"updated"`
+}
+
+// PackagePopularity is the number of pulled images containing a package.
+type PackagePopularity struct {
+	Package string `json:"package"`
+	Pulls   int    `json:"pulls"`
+}
+
+// PopularityReport summarises the ingestion of an access log.
+type PopularityReport struct {
+	Lines int `json:"lines"`
+
+	// Pulls of images with a known closure that were counted, and
+	// the number of distinct images among them
+	Pulls  int `json:"pulls"`
+	Images int `json:"images"`
+
+	// Pulls of manifests without a contents record, which were
+	// skipped
+	Unresolved int `json:"unresolved"`
+
+	Status PopularityStatus `json:"status"`
+}
+
+// HookContext is passed to operator-supplied build hooks on their
+// standard input.
+type HookContext struct {
+	// Hook point at which the hook is invoked (`pre-build` or
+	// `post-publish`)
+	Hook string `json:"hook"`
+
+	Name     string   `json:"name"`
+	Packages []string `json:"packages"`
+	Arch     string   `json:"arch"`
+	Tenant   string   `json:"tenant,omitempty"`
+
+	// Revision of the package set the image is built from, after
+	// resolving the pin of the `latest` tag
+	Pin string `json:"pin"`
+
+	// Cache key of the image, if it is cacheable
+	CacheKey string `json:"cacheKey,omitempty"`
+
+	// Digests of the manifest and the blobs it references, only set
+	// after publication
+	Digest string   `json:"digest,omitempty"`
+	Blobs  []string `json:"blobs,omitempty"`
+}
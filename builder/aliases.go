@@ -0,0 +1,31 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements image aliases, which let operators keep legacy
+// or friendlier image names (e.g. `golang`) working by mapping them to
+// the image names they stand for (e.g. `shell/go_1_22/git`).
+//
+// Aliases match the leading components of image names, which means
+// that further packages can be added to aliased images (e.g.
+// `golang/curl`). Aliased images are built exactly like their targets
+// and share their manifests.
+
+import "strings"
+
+// ResolveAlias returns the image name that an image name stands for,
+// and whether it matched an alias. The longest matching alias wins.
+func ResolveAlias(aliases map[string]string, name string) (string, bool) {
+	components := strings.Split(name, "/")
+	for n := len(components); n > 0; n-- {
+		target, ok := aliases[strings.Join(components[:n], "/")]
+		if !ok {
+			continue
+		}
+
+		resolved := append([]string{strings.Trim(target, "/")}, components[n:]...)
+		return strings.Join(resolved, "/"), true
+	}
+
+	return name, false
+}
@@ -0,0 +1,27 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import "testing"
+
+func TestResolveAlias(t *testing.T) {
+	aliases := map[string]string{
+		"golang":        "shell/go_1_22/git",
+		"legacy/python": "python311",
+	}
+
+	cases := map[string]string{
+		"golang":             "shell/go_1_22/git",
+		"golang/curl":        "shell/go_1_22/git/curl",
+		"legacy/python/jq":   "python311/jq",
+		"legacy/ruby":        "legacy/ruby",
+		"shell/golang":       "shell/golang",
+		"golangci-lint/curl": "golangci-lint/curl",
+	}
+
+	for name, expected := range cases {
+		if resolved, _ := ResolveAlias(aliases, name); resolved != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, resolved)
+		}
+	}
+}
@@ -8,6 +8,13 @@ package builder
 // The tarball is written straight to the supplied reader, which makes it
 // possible to create an image layer from the specified store paths, hash it and
 // upload it in one reading pass.
+//
+// Files that are hardlinked to each other (e.g. by Nix store optimisation) are
+// only written once per layer, and extended attributes are preserved. Special
+// files (sockets, fifos and devices) can not be part of a store path built by
+// Nix and are skipped. After packing, the store paths are walked again and
+// compared against the written entries, which catches files that changed or
+// disappeared while they were packed.
 import (
 	"archive/tar"
 	"compress/gzip"
@@ -16,10 +23,43 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/google/nixery/layers"
+	log "github.com/sirupsen/logrus"
 )
 
+// Extended attributes that are not preserved, as they describe the
+// host rather than the file.
+var skippedXattrs = map[string]bool{
+	"security.selinux": true,
+}
+
+// fileID identifies a file across its hardlinks.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// tarEntry describes an entry written to a layer, for validation.
+type tarEntry struct {
+	typeflag byte
+	size     int64
+	link     string
+}
+
+// layerPacker writes store paths to a tarball and records the entries
+// it wrote.
+type layerPacker struct {
+	w *tar.Writer
+
+	// Path under which each file with several hardlinks was first
+	// written
+	links map[fileID]string
+
+	written map[string]tarEntry
+}
+
 // Create a new compressed tarball from each of the paths in the list
 // and write it to the supplied writer.
 //
@@ -29,16 +69,21 @@ func packStorePaths(l *layers.Layer, w io.Writer) (string, error) {
 	shasum := sha256.New()
 	gz := gzip.NewWriter(w)
 	multi := io.MultiWriter(shasum, gz)
-	t := tar.NewWriter(multi)
+
+	p := &layerPacker{
+		w:       tar.NewWriter(multi),
+		links:   make(map[fileID]string),
+		written: make(map[string]tarEntry),
+	}
 
 	for _, path := range l.Contents {
-		err := filepath.Walk(path, tarStorePath(t))
+		err := filepath.Walk(path, p.tarStorePath)
 		if err != nil {
 			return "", err
 		}
 	}
 
-	if err := t.Close(); err != nil {
+	if err := p.w.Close(); err != nil {
 		return "", err
 	}
 
@@ -46,59 +91,152 @@ func packStorePaths(l *layers.Layer, w io.Writer) (string, error) {
 		return "", err
 	}
 
+	if err := p.validate(l.Contents); err != nil {
+		return "", err
+	}
+
 	return fmt.Sprintf("sha256:%x", shasum.Sum([]byte{})), nil
 }
 
-func tarStorePath(w *tar.Writer) filepath.WalkFunc {
-	return func(path string, info os.FileInfo, err error) error {
+// packable reports whether a file is written to layers. Directories
+// are created implicitly by the files they contain.
+func packable(info os.FileInfo) bool {
+	return info.Mode()&os.ModeSymlink != 0 || info.Mode().IsRegular()
+}
+
+func (p *layerPacker) tarStorePath(path string, info os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&(os.ModeSocket|os.ModeNamedPipe|os.ModeDevice|os.ModeCharDevice) != 0 {
+		log.WithField("path", path).Debug("skipped special file in store path")
+		return nil
+	}
+
+	if !packable(info) {
+		return nil
+	}
+
+	// the symlink target is read if this entry is a symlink, as it
+	// is required when creating the file header
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err = os.Readlink(path)
 		if err != nil {
 			return err
 		}
+	}
 
-		// If the entry is not a symlink or regular file, skip it.
-		if info.Mode()&os.ModeSymlink == 0 && !info.Mode().IsRegular() {
-			return nil
-		}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
 
-		// the symlink target is read if this entry is a symlink, as it
-		// is required when creating the file header
-		var link string
-		if info.Mode()&os.ModeSymlink != 0 {
-			link, err = os.Readlink(path)
-			if err != nil {
-				return err
-			}
+	// The name retrieved from os.FileInfo only contains the file's
+	// basename, but the full path is required within the layer
+	// tarball.
+	header.Name = path
+
+	// Further hardlinks to a file that was already written refer
+	// to it instead of repeating its contents.
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && st.Nlink > 1 {
+		id := fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+		if first, ok := p.links[id]; ok {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = first
+			header.Size = 0
+		} else {
+			p.links[id] = path
 		}
+	}
 
-		header, err := tar.FileInfoHeader(info, link)
+	if info.Mode().IsRegular() {
+		xattrs, err := readXattrs(path)
 		if err != nil {
 			return err
 		}
 
-		// The name retrieved from os.FileInfo only contains the file's
-		// basename, but the full path is required within the layer
-		// tarball.
-		header.Name = path
-		if err = w.WriteHeader(header); err != nil {
-			return err
+		for name, value := range xattrs {
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
+			}
+			header.PAXRecords["SCHILY.xattr."+name] = value
 		}
+	}
 
-		// At this point, return if no file content needs to be written
-		if !info.Mode().IsRegular() {
-			return nil
-		}
+	if err = p.w.WriteHeader(header); err != nil {
+		return err
+	}
+	p.written[path] = tarEntry{
+		typeflag: header.Typeflag,
+		size:     header.Size,
+		link:     header.Linkname,
+	}
+
+	// At this point, return if no file content needs to be written
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(p.w, f)
+	return err
+}
 
-		f, err := os.Open(path)
+// validate walks the store paths again and compares them against the
+// entries written to the layer, so that files which changed while they
+// were packed do not silently produce an incomplete layer.
+func (p *layerPacker) validate(paths []string) error {
+	seen := 0
+	check := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		if _, err := io.Copy(w, f); err != nil {
-			return err
+		if !packable(info) {
+			return nil
 		}
+		seen++
 
-		f.Close()
+		entry, ok := p.written[path]
+		if !ok {
+			return fmt.Errorf("layer is missing %s", path)
+		}
+
+		switch entry.typeflag {
+		case tar.TypeReg:
+			if !info.Mode().IsRegular() || info.Size() != entry.size {
+				return fmt.Errorf("%s changed while it was packed", path)
+			}
+		case tar.TypeLink:
+			if !info.Mode().IsRegular() || info.Size() != p.written[entry.link].size {
+				return fmt.Errorf("%s changed while it was packed", path)
+			}
+		case tar.TypeSymlink:
+			link, err := os.Readlink(path)
+			if err != nil || link != entry.link {
+				return fmt.Errorf("%s changed while it was packed", path)
+			}
+		}
 
 		return nil
 	}
+
+	for _, path := range paths {
+		if err := filepath.Walk(path, check); err != nil {
+			return fmt.Errorf("layer does not match store path: %w", err)
+		}
+	}
+
+	if seen != len(p.written) {
+		return fmt.Errorf("layer does not match store path: %d entries were written, but %d files exist", len(p.written), seen)
+	}
+
+	return nil
 }
@@ -0,0 +1,52 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements reading the extended attributes of files that
+// are written to layers on Linux, where Nix builds happen.
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of a file.
+func readXattrs(path string) (map[string]string, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list extended attributes of %s: %w", path, err)
+	}
+
+	names := make([]byte, size)
+	size, err = unix.Listxattr(path, names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list extended attributes of %s: %w", path, err)
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 || skippedXattrs[string(name)] {
+			continue
+		}
+
+		size, err := unix.Getxattr(path, string(name), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read extended attribute %s of %s: %w", name, path, err)
+		}
+
+		value := make([]byte, size)
+		size, err = unix.Getxattr(path, string(name), value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read extended attribute %s of %s: %w", name, path, err)
+		}
+
+		xattrs[string(name)] = string(value[:size])
+	}
+
+	return xattrs, nil
+}
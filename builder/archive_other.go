@@ -0,0 +1,16 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !linux
+// +build !linux
+
+package builder
+
+// Store paths are only built on Linux, so extended attributes are not
+// preserved in layers packed on other platforms (e.g. during local
+// development).
+
+// readXattrs returns no extended attributes.
+func readXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/google/nixery/layers"
+)
+
+func TestPackStorePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nixery-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkg := filepath.Join(dir, "abc-hello")
+	os.MkdirAll(filepath.Join(pkg, "bin"), 0755)
+	ioutil.WriteFile(filepath.Join(pkg, "bin", "hello"), []byte("hello"), 0755)
+	os.Link(filepath.Join(pkg, "bin", "hello"), filepath.Join(pkg, "bin", "hi"))
+	os.Symlink("hello", filepath.Join(pkg, "bin", "greet"))
+	if err := syscall.Mkfifo(filepath.Join(pkg, "fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := packStorePaths(&layers.Layer{Contents: []string{pkg}}, &buf); err != nil {
+		t.Fatalf("failed to pack store path: %s", err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := make(map[string]*tar.Header)
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[h.Name] = h
+	}
+
+	if len(entries) != 3 {
+		t.Errorf("expected 3 entries, got %d", len(entries))
+	}
+
+	if h := entries[filepath.Join(pkg, "bin", "hello")]; h == nil || h.Typeflag != tar.TypeReg || h.Size != 5 {
+		t.Errorf("file was not packed with its contents: %+v", h)
+	}
+
+	if h := entries[filepath.Join(pkg, "bin", "hi")]; h == nil || h.Typeflag != tar.TypeLink || h.Linkname != filepath.Join(pkg, "bin", "hello") {
+		t.Errorf("hardlink was not packed as a link: %+v", h)
+	}
+
+	if h := entries[filepath.Join(pkg, "bin", "greet")]; h == nil || h.Typeflag != tar.TypeSymlink || h.Linkname != "hello" {
+		t.Errorf("symlink was not packed: %+v", h)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the auditing of Nix processes spawned by
+// Nixery. Each invocation is recorded with its arguments, the parts
+// of the environment that influence Nix and its exit code, which
+// makes it possible to reproduce an evaluation outside of Nixery.
+//
+// Secrets (credentials in URLs and variables that look like they
+// contain keys or tokens) are redacted before anything is recorded.
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nixery/api"
+)
+
+const redacted = "<redacted>"
+
+// Number of lines of Nix output retained per command.
+const outputLines = 200
+
+// Environment variables (or prefixes thereof) that influence the
+// behaviour of spawned Nix processes.
+var auditedEnv = []string{
+	"NIX_", "NIXERY_", "GIT_", "SSL_CERT_FILE", "HOME", "PATH", "TMPDIR",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY",
+	"http_proxy", "https_proxy", "no_proxy",
+}
+
+var (
+	// Matches the user information in URLs, e.g. `user:pass@`
+	urlCredentials = regexp.MustCompile(`://[^/@\s"]+@`)
+
+	// Matches environment variable names that are likely to hold
+	// secrets
+	secretName = regexp.MustCompile(`(?i)token|secret|password|passwd|credential|key`)
+)
+
+// CommandRecord describes a single invocation of a Nix process.
+type CommandRecord = api.CommandRecord
+
+// AuditLog retains the most recent command records in memory.
+//
+// A nil *AuditLog is valid and records nothing.
+type AuditLog struct {
+	mu      sync.Mutex
+	size    int
+	records []CommandRecord
+}
+
+// NewAuditLog creates an audit log retaining up to size records.
+func NewAuditLog(size int) *AuditLog {
+	return &AuditLog{size: size}
+}
+
+func (a *AuditLog) add(r CommandRecord) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.records = append(a.records, r)
+	if len(a.records) > a.size {
+		a.records = a.records[len(a.records)-a.size:]
+	}
+}
+
+// Records returns the retained command records, optionally filtered
+// to the ones for a single image name.
+func (a *AuditLog) Records(image string) []CommandRecord {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	records := []CommandRecord{}
+	for _, r := range a.records {
+		if image == "" || r.Image == image {
+			records = append(records, r)
+		}
+	}
+
+	return records
+}
+
+// RedactCredentials removes credentials embedded in URLs from a string.
+func RedactCredentials(s string) string {
+	return redactArg(s)
+}
+
+// redactArg removes credentials embedded in URLs from an argument.
+func redactArg(arg string) string {
+	return urlCredentials.ReplaceAllString(arg, "://"+redacted+"@")
+}
+
+// auditEnv returns the redacted subset of the environment that is
+// relevant to Nix.
+func auditEnv(environ []string) map[string]string {
+	env := make(map[string]string)
+
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		for _, prefix := range auditedEnv {
+			if !strings.HasPrefix(parts[0], prefix) {
+				continue
+			}
+
+			if secretName.MatchString(parts[0]) {
+				env[parts[0]] = redacted
+			} else {
+				env[parts[0]] = redactArg(parts[1])
+			}
+			break
+		}
+	}
+
+	return env
+}
+
+// newCommandRecord creates the record for a command that is about to
+// be started. Variables of the secret environment are recorded without
+// their values.
+func newCommandRecord(image *Image, program string, args []string, secretEnv []string) CommandRecord {
+	var redactedArgs []string
+	for _, arg := range args {
+		redactedArgs = append(redactedArgs, redactArg(arg))
+	}
+
+	env := auditEnv(os.Environ())
+	for _, kv := range secretEnv {
+		env[strings.SplitN(kv, "=", 2)[0]] = redacted
+	}
+
+	return CommandRecord{
+		Image:   image.Name,
+		Tag:     image.Tag,
+		Program: program,
+		Args:    redactedArgs,
+		Env:     env,
+		Started: time.Now().UTC(),
+	}
+}
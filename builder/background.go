@@ -0,0 +1,149 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the group of background tasks started by builds
+// and requests, such as writes to the caches, which must not delay the
+// response they belong to.
+//
+// Tasks are tracked so that pending writes are completed before the
+// process exits, and their number is capped so that a burst of
+// requests can not start an unbounded number of concurrent writes.
+// Callers starting a task while the cap is reached wait for a slot.
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Background runs and tracks background tasks.
+//
+// A nil *Background is valid and runs tasks in untracked goroutines.
+type Background struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	slots  chan struct{}
+	wg     sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewBackground creates a group running at most the given number of
+// tasks concurrently.
+func NewBackground(limit int) *Background {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Background{
+		ctx:    ctx,
+		cancel: cancel,
+		slots:  make(chan struct{}, limit),
+	}
+}
+
+// taskContext carries the values (e.g. storage metadata) of the context
+// that started a task, but is only cancelled with the background group
+// instead of when the request that started it has finished.
+type taskContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c taskContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
+
+// Go runs a task in the background with a context carrying the values
+// of ctx. Tasks started after shutdown has begun are skipped.
+//
+// Tasks must not start other tasks, as they could wait for a slot
+// forever if all slots are taken by such tasks.
+func (b *Background) Go(ctx context.Context, name string, task func(ctx context.Context)) {
+	if b == nil {
+		go runTask(name, func() { task(ctx) })
+		return
+	}
+
+	// The task is added to the wait group under the lock, so that it
+	// is either skipped or waited for by Shutdown. The lock must not
+	// be held while waiting for a slot, as Shutdown could otherwise
+	// not begin while all slots are taken.
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		log.WithField("task", name).Debug("skipping background task during shutdown")
+		return
+	}
+	b.wg.Add(1)
+	b.mu.RUnlock()
+
+	select {
+	case b.slots <- struct{}{}:
+	case <-b.ctx.Done():
+		b.wg.Done()
+		return
+	}
+
+	// A slot may have been freed by a task that was cancelled.
+	if b.ctx.Err() != nil {
+		<-b.slots
+		b.wg.Done()
+		return
+	}
+
+	go func() {
+		defer b.wg.Done()
+		defer func() { <-b.slots }()
+
+		runTask(name, func() { task(taskContext{b.ctx, ctx}) })
+	}()
+}
+
+// runTask runs a task, recovering from panics, which would otherwise
+// take down the whole process.
+func runTask(name string, task func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{
+				"task":  name,
+				"panic": r,
+				"stack": string(debug.Stack()),
+			}).Error("background task panicked")
+		}
+	}()
+
+	task()
+}
+
+// Shutdown stops accepting new tasks and waits for the running ones.
+// If they do not finish before ctx is done, their context is cancelled
+// and ctx's error is returned.
+func (b *Background) Shutdown(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	start := time.Now()
+	select {
+	case <-done:
+		log.WithField("seconds", time.Since(start).Seconds()).Info("finished background tasks")
+		return nil
+	case <-ctx.Done():
+		b.cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackgroundLimitsTasks(t *testing.T) {
+	b := NewBackground(2)
+	ctx := context.Background()
+
+	var running, peak, finished int32
+	for i := 0; i < 8; i++ {
+		b.Go(ctx, "test", func(context.Context) {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&finished, 1)
+		})
+	}
+
+	// Panics are recovered instead of crashing the test.
+	b.Go(ctx, "panic", func(context.Context) {
+		panic("oops")
+	})
+
+	if err := b.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if finished != 8 {
+		t.Errorf("shutdown did not wait for all tasks, %d finished", finished)
+	}
+	if peak > 2 {
+		t.Errorf("%d tasks ran concurrently, expected at most 2", peak)
+	}
+
+	b.Go(ctx, "late", func(context.Context) {
+		t.Error("task started after shutdown was run")
+	})
+}
+
+func TestBackgroundShutdownTimeout(t *testing.T) {
+	b := NewBackground(1)
+	b.Go(context.Background(), "slow", func(ctx context.Context) {
+		<-ctx.Done()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := b.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected shutdown to time out, got %v", err)
+	}
+}
+
+func TestBackgroundShutdownWithSaturatedSlots(t *testing.T) {
+	b := NewBackground(1)
+	ctx := context.Background()
+
+	release := make(chan struct{})
+	b.Go(ctx, "blocking", func(context.Context) {
+		<-release
+	})
+
+	// The second task waits for the slot of the first one.
+	var ran int32
+	started := make(chan struct{})
+	go func() {
+		close(started)
+		b.Go(ctx, "waiting", func(context.Context) {
+			atomic.StoreInt32(&ran, 1)
+		})
+	}()
+	<-started
+	time.Sleep(10 * time.Millisecond)
+
+	shutdown := make(chan error)
+	go func() { shutdown <- b.Shutdown(ctx) }()
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown blocked on task waiting for a slot")
+	}
+
+	if atomic.LoadInt32(&ran) != 1 {
+		t.Error("task waiting for a slot was not run before shutdown finished")
+	}
+}
+
+func TestBackgroundShutdownTimeoutWithSaturatedSlots(t *testing.T) {
+	b := NewBackground(1)
+	b.Go(context.Background(), "slow", func(ctx context.Context) {
+		<-ctx.Done()
+	})
+
+	waiting := make(chan struct{})
+	go func() {
+		b.Go(context.Background(), "waiting", func(context.Context) {
+			t.Error("task waiting for a slot was run after shutdown timed out")
+		})
+		close(waiting)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := b.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected shutdown to time out, got %v", err)
+	}
+
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task waiting for a slot was not released by shutdown")
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the `bin-only` meta-package, which produces the
+// smallest possible images for tools such as those written in Go or
+// Rust.
+//
+// Instead of the complete output of each requested package, only its
+// main program (`meta.mainProgram`, or the package name if unset) is
+// copied into the image. The runtime closure is then determined by
+// what that program references, which leaves out propagated build
+// inputs, man pages and documentation.
+
+import "encoding/json"
+
+// binOnlyPackages returns the JSON list of packages of an image whose
+// main program is included instead of the whole package. The packages
+// added to every image are included completely, as they contain no
+// programs.
+func binOnlyPackages(image *Image) []byte {
+	pkgs := []string{}
+	for _, p := range image.Packages {
+		if !basePackages[p] {
+			pkgs = append(pkgs, p)
+		}
+	}
+
+	j, _ := json.Marshal(pkgs)
+	return j
+}
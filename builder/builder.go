@@ -9,11 +9,12 @@ package builder
 
 import (
 	"bufio"
-	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -21,10 +22,17 @@ import (
 	"os/exec"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/nixery/config"
+	"github.com/google/nixery/credentials"
+	"github.com/google/nixery/events"
 	"github.com/google/nixery/layers"
+	"github.com/google/nixery/logs"
 	"github.com/google/nixery/manifest"
+	"github.com/google/nixery/scan"
+	"github.com/google/nixery/scheduler"
 	"github.com/google/nixery/storage"
 	log "github.com/sirupsen/logrus"
 )
@@ -41,8 +49,85 @@ type State struct {
 	Cache   *LocalCache
 	Cfg     config.Config
 	Pop     layers.Popularity
+	Events  *events.Bus
+
+	// Public keys for which encrypted images are encrypted, keyed
+	// by tenant. Requests without a tenant use the "default" key.
+	Recipients map[string][]*rsa.PublicKey
+
+	// Standby replicas to which local cache updates are streamed
+	Replicator *Replicator
+
+	// Record of recently spawned Nix processes
+	Audit *AuditLog
+
+	// Malware scanner checking layers before publication, if any
+	Scanner scan.Scanner
+
+	// Source of per-tenant credentials for the Nix fetchers, if any
+	Credentials credentials.Provider
+
+	// Pin of the `latest` tag, if pinning is enabled
+	Pins *PinTracker
+
+	// Per-tenant storage quotas, if configured
+	Quotas *QuotaTracker
+
+	// Background fetching of cached images' store paths, if enabled
+	Prefetch *Prefetcher
+
+	// Garbage collection of the local Nix store, if enabled
+	StoreGC *StoreCollector
+
+	// Images imported by operators, served instead of building
+	Profiles *ProfileStore
+
+	// Names and tags of served images, for registry discovery
+	Catalog *Catalog
+
+	// Image specs synced from a Git repository, if configured
+	Curated *CuratedImages
+
+	// Package sources that changed since they were last fetched
+	Invalidations *Invalidations
+
+	// Package popularity derived from access logs, which replaces
+	// Pop once logs have been ingested
+	Popularity *PullPopularity
+
+	// Worker processes packing layers, if enabled
+	LayerWorkers *LayerWorkers
+
+	// Slowest recent builds, if they are logged
+	SlowBuilds *SlowBuilds
+
+	// Memory ceiling of evaluations, if enabled
+	EvalCgroups *EvalCgroups
+
+	// Remote builders of foreign platforms, if configured
+	Pools *BuilderPools
+
+	// Updates of referrers lists in progress
+	referrers referrerLocks
+
+	// Periodic background tasks
+	Scheduler *scheduler.Scheduler
+
+	// Background tasks of builds, such as cache writes
+	Background *Background
+
+	// Record of in-progress builds, if enabled
+	Journal *BuildJournal
+
+	// Only serve images that are already cached, without invoking
+	// Nix. This is used for conformance testing.
+	CacheOnly bool
 }
 
+// ErrNotCached is returned for images that are not cached if only
+// cached images are served.
+var ErrNotCached = errors.New("image is not cached")
+
 // Architecture represents the possible CPU architectures for which
 // container images can be built.
 //
@@ -59,6 +144,48 @@ type Architecture struct {
 var amd64 = Architecture{"x86_64-linux", "amd64"}
 var arm64 = Architecture{"aarch64-linux", "arm64"}
 
+// MetaPackages lists the names of all meta-packages.
+var MetaPackages = []string{"shell", "arm64", "encrypted", "wasm", "profile", "fhs", "bin-only"}
+
+// NameGrammarVersion is the version of the image name grammar, which is
+// incremented whenever image names gain new syntax (such as package
+// flags), so that clients can tell which names an instance understands.
+const NameGrammarVersion = 1
+
+func isMetaPackage(p string) bool {
+	for _, m := range MetaPackages {
+		if p == m {
+			return true
+		}
+	}
+	return false
+}
+
+// Platforms lists the platforms (in the `os/arch` form used by
+// container tooling) for which images can be built.
+var Platforms = []string{"linux/amd64", "linux/arm64"}
+
+// SetPlatform selects the architecture of an image from a platform
+// specifier such as `linux/arm64` or `linux/arm64/v8`, overriding any
+// architecture set by meta-packages.
+func (image *Image) SetPlatform(platform string) error {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != "linux" {
+		return fmt.Errorf("unsupported platform %q", platform)
+	}
+
+	switch {
+	case parts[1] == "amd64" && len(parts) == 2:
+		image.Arch = &amd64
+	case parts[1] == "arm64" && (len(parts) == 2 || parts[2] == "v8"):
+		image.Arch = &arm64
+	default:
+		return fmt.Errorf("unsupported platform %q", platform)
+	}
+
+	return nil
+}
+
 // Image represents the information necessary for building a container image.
 // This can be either a list of package names (corresponding to keys in the
 // nixpkgs set) or a Nix expression that results in a *list* of derivations.
@@ -73,8 +200,64 @@ type Image struct {
 	// Architecture for which to build the image. Nixery defaults
 	// this to amd64 if not specified via meta-packages.
 	Arch *Architecture
+
+	// Optional overrides of the image's runtime configuration. If no
+	// command is set, a shell is used if the image contains one.
+	Cmd []string
+	Env []string
+
+	// Additional annotations to attach to the image manifest.
+	Annotations map[string]string
+
+	// Tenant on whose behalf the image is built, if any.
+	Tenant string
+
+	// Whether the image layers should be encrypted for the
+	// recipients configured for the tenant.
+	Encrypt bool
+
+	// Whether to package the WebAssembly files of the packages as
+	// an OCI artifact instead of building a container image.
+	Wasm bool
+
+	// Override arguments of the packages requested with flags,
+	// keyed by their canonical name.
+	Overrides map[string]config.Override
+
+	// Layout of the image's root filesystem (see LayoutProfile and
+	// LayoutFHS), empty for the default symlink forest.
+	Layout string
+
+	// Shell snippet run by login shells of images with the profile
+	// layout.
+	Activation string
+
+	// Whether only the main program of each requested package is
+	// included, instead of the package's complete output.
+	BinOnly bool
+
+	// Whether the image is built for all supported platforms and
+	// served as an image index (see buildIndex).
+	MultiArch bool
+
+	// Store paths to include in the image instead of packages, for
+	// images built from raw store paths (see ImageFromStorePaths).
+	StorePaths []string
 }
 
+// Layouts of the image root filesystem.
+const (
+	// LayoutProfile is the layout of images whose root is a
+	// `buildEnv` profile, with an `/etc/profile` that initialises
+	// login shells.
+	LayoutProfile = "profile"
+
+	// LayoutFHS is the layout of images with a conventional FHS
+	// structure (e.g. `/usr/lib`) and dynamic loader, for binaries
+	// that were not built with Nix.
+	LayoutFHS = "fhs"
+)
+
 // BuildResult represents the data returned from the server to the
 // HTTP handlers. Error information is propagated straight from Nix
 // for errors inside of the build that should be fed back to the
@@ -83,6 +266,14 @@ type BuildResult struct {
 	Error    string          `json:"error"`
 	Pkgs     []string        `json:"pkgs"`
 	Manifest json.RawMessage `json:"manifest"`
+
+	// Digest under which the manifest has been published, set
+	// whenever a manifest is returned.
+	Digest string `json:"digest"`
+
+	// Whether the manifest of an earlier build with the same
+	// closure was reused
+	Reused bool `json:"reused,omitempty"`
 }
 
 // ImageFromName parses an image name into the corresponding structure which can
@@ -96,18 +287,26 @@ type BuildResult struct {
 // only the order of requested packages has changed.
 func ImageFromName(name string, tag string) Image {
 	pkgs := strings.Split(name, "/")
-	arch, expanded := metaPackages(pkgs)
-	expanded = append(expanded, "cacert", "iana-etc")
+	image := Image{
+		Tag:  tag,
+		Arch: &amd64,
+	}
+
+	expanded := metaPackages(&image, pkgs)
+
+	// WebAssembly artifacts only contain the requested modules, so
+	// the usual container contents are not needed.
+	if !image.Wasm {
+		expanded = append(expanded, "cacert", "iana-etc")
+	}
 
 	sort.Strings(pkgs)
 	sort.Strings(expanded)
 
-	return Image{
-		Name:     strings.Join(pkgs, "/"),
-		Tag:      tag,
-		Packages: expanded,
-		Arch:     arch,
-	}
+	image.Name = strings.Join(pkgs, "/")
+	image.Packages = expanded
+
+	return image
 }
 
 // ImageResult represents the output of calling the Nix derivation
@@ -124,6 +323,12 @@ type ImageResult struct {
 		TarHash string `json:"tarHash"`
 		Path    string `json:"path"`
 	} `json:"symlinkLayer"`
+
+	// Store paths added for the FHS layout, if used
+	FHSPaths []string `json:"fhsPaths"`
+
+	// Requested packages whose licenses forbid redistribution
+	Nondistributable []nondistributablePackage `json:"nondistributable"`
 }
 
 // metaPackages expands package names defined by Nixery which either
@@ -137,13 +342,16 @@ type ImageResult struct {
 //
 // * `shell`: Includes bash, coreutils and other common command-line tools
 // * `arm64`: Causes Nixery to build images for the ARM64 architecture
-func metaPackages(packages []string) (*Architecture, []string) {
-	arch := &amd64
-
+// * `encrypted`: Encrypts all image layers for the tenant's recipients
+// * `wasm`: Packages WebAssembly files as an OCI artifact (experimental)
+// * `profile`: Builds the image root as a profile with `/etc/profile`
+// * `fhs`: Builds the image root with an FHS structure and loader
+// * `bin-only`: Includes only the main program of each package
+func metaPackages(image *Image, packages []string) []string {
 	var metapkgs []string
 	lastMeta := 0
 	for idx, p := range packages {
-		if p == "shell" || p == "arm64" {
+		if isMetaPackage(p) {
 			metapkgs = append(metapkgs, p)
 			lastMeta = idx + 1
 		} else {
@@ -160,77 +368,172 @@ func metaPackages(packages []string) (*Architecture, []string) {
 		case "shell":
 			packages = append(packages, "bashInteractive", "coreutils", "moreutils", "nano")
 		case "arm64":
-			arch = &arm64
+			image.Arch = &arm64
+		case "encrypted":
+			image.Encrypt = true
+		case "wasm":
+			image.Wasm = true
+		case "profile":
+			image.Layout = LayoutProfile
+		case "fhs":
+			image.Layout = LayoutFHS
+		case "bin-only":
+			image.BinOnly = true
 		}
 	}
 
-	return arch, packages
+	return packages
 }
 
 // logNix logs each output line from Nix. It runs in a goroutine per
 // output channel that should be live-logged.
-func logNix(image, cmd string, r io.ReadCloser) {
+//
+// The last lines of output are retained in the command record.
+func logNix(image, cmd string, r io.ReadCloser, record *CommandRecord) {
+	parser := newNixLogParser()
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
+		line, ok := parser.parse(scanner.Text())
+		if !ok {
+			continue
+		}
+
 		log.WithFields(log.Fields{
 			"image": image,
 			"cmd":   cmd,
-		}).Info("[nix] " + scanner.Text())
+		}).Info("[nix] " + line)
+
+		recordStage(record, line)
+		record.Output = append(record.Output, redactArg(line))
+		if len(record.Output) > outputLines {
+			record.Output = record.Output[1:]
+		}
 	}
+
+	record.Derivations = parser.finish()
 }
 
-func callNix(program, image string, args []string) ([]byte, error) {
+// runNix runs a Nix program for the given image and returns its
+// output, as well as the durations of its stages (see stages.go). The
+// invocation is recorded in the audit log.
+func runNix(s *State, program string, image *Image, args []string, secretEnv ...string) ([]byte, map[string]float64, error) {
+	record := newCommandRecord(image, program, args, secretEnv)
+	defer func() {
+		if record.Duration == 0 {
+			record.Duration = time.Since(record.Started).Seconds()
+		}
+		s.Audit.add(record)
+
+		log.WithFields(log.Fields{
+			"image":    image.Name,
+			"cmd":      program,
+			"args":     record.Args,
+			"env":      record.Env,
+			"exitCode": record.ExitCode,
+		}).Debug("audited Nix invocation")
+
+		if len(record.Derivations) > 0 {
+			slowest := record.Derivations[0]
+			log.WithFields(log.Fields{
+				"image":       image.Name,
+				"cmd":         program,
+				"derivation":  slowest.Path,
+				"action":      slowest.Action,
+				"seconds":     slowest.Seconds,
+				"derivations": len(record.Derivations),
+			}).Info("slowest derivation of Nix invocation")
+		}
+	}()
+
 	cmd := exec.Command(program, args...)
+	if len(secretEnv) > 0 {
+		cmd.Env = append(os.Environ(), secretEnv...)
+	}
 
 	outpipe, err := cmd.StdoutPipe()
 	if err != nil {
-		return nil, err
+		record.ExitCode, record.Error = -1, err.Error()
+		return nil, nil, err
 	}
 
 	errpipe, err := cmd.StderrPipe()
 	if err != nil {
-		return nil, err
+		record.ExitCode, record.Error = -1, err.Error()
+		return nil, nil, err
 	}
-	go logNix(image, program, errpipe)
+
+	// All output must be read before waiting for the process.
+	var output sync.WaitGroup
+	output.Add(1)
+	go func() {
+		logNix(image.Name, program, errpipe, &record)
+		output.Done()
+	}()
 
 	if err = cmd.Start(); err != nil {
 		log.WithError(err).WithFields(log.Fields{
-			"image": image,
+			"image": image.Name,
 			"cmd":   program,
 		}).Error("error invoking Nix")
 
-		return nil, err
+		output.Wait()
+		record.ExitCode, record.Error = -1, err.Error()
+		return nil, nil, err
 	}
 
 	log.WithFields(log.Fields{
 		"cmd":   program,
-		"image": image,
+		"image": image.Name,
 	}).Info("invoked Nix build")
 
 	stdout, _ := ioutil.ReadAll(outpipe)
+	output.Wait()
 
-	if err = cmd.Wait(); err != nil {
+	err = cmd.Wait()
+	record.Duration = time.Since(record.Started).Seconds()
+	record.ExitCode = cmd.ProcessState.ExitCode()
+	err = finishStages(&record, err)
+
+	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
-			"image":  image,
+			"image":  image.Name,
 			"cmd":    program,
 			"stdout": stdout,
 		}).Info("failed to invoke Nix")
 
-		return nil, err
+		record.Error = err.Error()
+		return nil, record.Stages, err
 	}
 
-	resultFile := strings.TrimSpace(string(stdout))
+	return stdout, record.Stages, nil
+}
+
+// callNix runs a Nix program for the given image like runNix, and
+// returns the contents of the result file it prints.
+func callNix(s *State, program string, image *Image, args []string, secretEnv ...string) ([]byte, map[string]float64, error) {
+	stdout, stages, err := runNix(s, program, image, args, secretEnv...)
+	if err != nil {
+		return nil, stages, err
+	}
+
+	// Depending on the Nix version, additional output may precede
+	// the path of the result file.
+	lines := strings.Fields(string(stdout))
+	resultFile := ""
+	if len(lines) > 0 {
+		resultFile = lines[len(lines)-1]
+	}
 	buildOutput, err := ioutil.ReadFile(resultFile)
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
-			"image": image,
+			"image": image.Name,
 			"file":  resultFile,
 		}).Info("failed to read Nix result file")
 
-		return nil, err
+		return nil, stages, err
 	}
 
-	return buildOutput, nil
+	return buildOutput, stages, nil
 }
 
 // Call out to Nix and request metadata for the image to be built. All
@@ -239,7 +542,7 @@ func callNix(program, image string, args []string) ([]byte, error) {
 //
 // This function is only invoked if the manifest is not found in any
 // cache.
-func prepareImage(s *State, image *Image) (*ImageResult, error) {
+func prepareImage(ctx context.Context, s *State, image *Image) (*ImageResult, error) {
 	packages, err := json.Marshal(image.Packages)
 	if err != nil {
 		return nil, err
@@ -247,15 +550,123 @@ func prepareImage(s *State, image *Image) (*ImageResult, error) {
 
 	srcType, srcArgs := s.Cfg.Pkgs.Render(image.Tag)
 
+	// Arguments for the evaluation are separated from those for the
+	// realisation by `--`.
 	args := []string{
-		"--timeout", s.Cfg.Timeout,
 		"--argstr", "packages", string(packages),
 		"--argstr", "srcType", srcType,
 		"--argstr", "srcArgs", srcArgs,
 		"--argstr", "system", image.Arch.nixSystem,
 	}
 
-	output, err := callNix("nixery-prepare-image", image.Name, args)
+	if len(image.Overrides) > 0 {
+		overrides, _ := json.Marshal(image.Overrides)
+		args = append(args, "--argstr", "overrides", string(overrides))
+	}
+
+	// Sources that were invalidated are fetched again, instead of
+	// using the revision Nix cached for the branch.
+	if s.Invalidations.refetch(srcArgs) {
+		args = append(args, "--option", "tarball-ttl", "0")
+	}
+
+	if image.Layout != "" {
+		args = append(args, "--argstr", "layout", image.Layout)
+	}
+
+	if image.Activation != "" {
+		args = append(args, "--argstr", "activation", image.Activation)
+	}
+
+	if image.BinOnly {
+		args = append(args, "--argstr", "binOnly", string(binOnlyPackages(image)))
+	}
+
+	if len(image.StorePaths) > 0 {
+		paths, _ := json.Marshal(image.StorePaths)
+		args = append(args, "--argstr", "storePaths", string(paths))
+	}
+
+	// Nix logs in its JSON format during the realisation, which is
+	// used to time the individual derivations.
+	realiseArgs := []string{"--timeout", s.Cfg.Timeout, "--log-format", "internal-json"}
+
+	// Verbose output can be enabled at runtime to debug
+	// evaluation issues.
+	if logs.VerboseNix() {
+		args = append(args, "--verbose")
+		realiseArgs = append(realiseArgs, "--verbose")
+	}
+
+	// Paths built locally by Nix can be pushed to a binary cache by
+	// the post-build-hook, which lets other instances substitute
+	// them instead of building them again.
+	if s.Cfg.PostBuildHook != "" {
+		realiseArgs = append(realiseArgs, "--option", "post-build-hook", s.Cfg.PostBuildHook)
+	}
+
+	if s.Cfg.ContentAddressed {
+		args = append(args,
+			"--option", "extra-experimental-features", "ca-derivations",
+			"--arg", "contentAddressed", "true",
+		)
+		realiseArgs = append(realiseArgs, "--option", "extra-experimental-features", "ca-derivations")
+	}
+
+	args = append(append(args, "--"), realiseArgs...)
+
+	// Fetchers use the credentials of the tenant on whose behalf
+	// the image is built, if any.
+	var secretEnv []string
+	if s.Credentials != nil && image.Tenant != "" {
+		creds, err := s.Credentials.Credentials(ctx, image.Tenant)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"image":    image.Name,
+				"tenant":   image.Tenant,
+				"provider": s.Credentials.Name(),
+			}).Error("failed to retrieve credentials")
+
+			return nil, err
+		}
+
+		secretEnv = creds.Env(os.Environ())
+	}
+
+	cgroup, err := s.EvalCgroups.create()
+	if err != nil {
+		return nil, err
+	}
+	if cgroup != "" {
+		secretEnv = append(secretEnv, "NIXERY_EVAL_CGROUP="+cgroup)
+	}
+
+	// Builds for platforms with a builder pool are realised on its
+	// builders only. These options follow the realisation arguments.
+	var releasePool func(error)
+	if pool := s.Pools.pool(image.Arch); pool != nil {
+		machines, release, err := pool.acquire(ctx)
+		if err != nil {
+			s.EvalCgroups.release(cgroup, image)
+			return nil, err
+		}
+		releasePool = release
+
+		args = append(args,
+			"--option", "builders", machines,
+			"--option", "builders-use-substitutes", "true",
+			"--option", "max-jobs", "0",
+		)
+	}
+
+	output, stages, err := callNix(s, prepareProgram, image, args, secretEnv...)
+	if releasePool != nil {
+		releasePool(err)
+	}
+	buildStagesFrom(ctx).nix(stages)
+	if oom := s.EvalCgroups.release(cgroup, image); oom != nil {
+		return nil, oom
+	}
 	if err != nil {
 		// granular error logging is performed in callNix already
 		return nil, err
@@ -282,7 +693,7 @@ func prepareImage(s *State, image *Image) (*ImageResult, error) {
 // added only after successful uploads, which guarantees that entries
 // retrieved from the cache are present in the bucket.
 func prepareLayers(ctx context.Context, s *State, image *Image, result *ImageResult) ([]manifest.Entry, error) {
-	grouped := layers.GroupLayers(&result.Graph, &s.Pop, LayerBudget)
+	grouped := groupImageLayers(s, image, &result.Graph)
 
 	var entries []manifest.Entry
 
@@ -291,8 +702,11 @@ func prepareLayers(ctx context.Context, s *State, image *Image, result *ImageRes
 	//
 	// Missing layers are built and uploaded to the storage
 	// bucket.
+	restricted := restrictedPaths(result)
+
 	for _, l := range grouped {
 		if entry, cached := layerFromCache(ctx, s, l.Hash()); cached {
+			entry.Nondistributable = restrictedPackages(restricted, l.Contents)
 			entries = append(entries, *entry)
 		} else {
 			lh := l.Hash()
@@ -306,11 +720,11 @@ func prepareLayers(ctx context.Context, s *State, image *Image, result *ImageRes
 			var tarhash string
 			lw := func(w io.Writer) error {
 				var err error
-				tarhash, err = packStorePaths(&l, w)
+				tarhash, err = s.LayerWorkers.pack(ctx, &l, w)
 				return err
 			}
 
-			entry, err := uploadHashLayer(ctx, s, lh, lw)
+			entry, err := uploadImageLayer(ctx, s, lh, lw)
 			if err != nil {
 				return nil, err
 			}
@@ -328,15 +742,27 @@ func prepareLayers(ctx context.Context, s *State, image *Image, result *ImageRes
 				"tarhash":  tarhash,
 			}).Info("created image layer")
 
-			go cacheLayer(ctx, s, l.Hash(), *entry)
+			journalFrom(ctx).layer(lh, *entry)
+			cached := *entry
+			s.Background.Go(ctx, "cache-layer", func(ctx context.Context) {
+				cacheLayer(ctx, s, lh, cached)
+			})
+
+			entry.Nondistributable = restrictedPackages(restricted, l.Contents)
 			entries = append(entries, *entry)
 		}
 	}
 
 	// Symlink layer (built in the first Nix build) needs to be
-	// included here manually:
+	// included here manually. It is keyed by the hash of its
+	// contents, so a cached upload is reused.
 	slkey := result.SymlinkLayer.TarHash
-	entry, err := uploadHashLayer(ctx, s, slkey, func(w io.Writer) error {
+	if entry, cached := layerFromCache(ctx, s, slkey); cached {
+		entries = append(entries, *entry)
+		return entries, nil
+	}
+
+	entry, err := uploadImageLayer(ctx, s, slkey, func(w io.Writer) error {
 		f, err := os.Open(result.SymlinkLayer.Path)
 		if err != nil {
 			log.WithError(err).WithFields(log.Fields{
@@ -369,7 +795,11 @@ func prepareLayers(ctx context.Context, s *State, image *Image, result *ImageRes
 	}
 
 	entry.TarHash = "sha256:" + result.SymlinkLayer.TarHash
-	go cacheLayer(ctx, s, slkey, *entry)
+	journalFrom(ctx).layer(slkey, *entry)
+	cached := *entry
+	s.Background.Go(ctx, "cache-layer", func(ctx context.Context) {
+		cacheLayer(ctx, s, slkey, cached)
+	})
 	entries = append(entries, *entry)
 
 	return entries, nil
@@ -409,7 +839,41 @@ func (b *byteCounter) Write(p []byte) (n int, err error) {
 // The return value is the layer's SHA256 hash, which is used in the
 // image manifest.
 func uploadHashLayer(ctx context.Context, s *State, key string, lw layerWriter) (*manifest.Entry, error) {
+	return uploadLayer(ctx, s, key, lw, false)
+}
+
+// uploadImageLayer uploads a layer with the contents of an image like
+// uploadHashLayer, but scans it while it is staged (if a scanner is
+// configured). Layers that fail the scan never reach `layers/`.
+func uploadImageLayer(ctx context.Context, s *State, key string, lw layerWriter) (*manifest.Entry, error) {
+	return uploadLayer(ctx, s, key, lw, true)
+}
+
+func uploadLayer(ctx context.Context, s *State, key string, lw layerWriter, scan bool) (*manifest.Entry, error) {
+	start := time.Now()
+	lw = withTimeout(lw, "packing", s.Cfg.Timeouts.Pack)
+
+	var packed time.Duration
+	if s.Cfg.ScratchDir != "" {
+		assembled, f, err := assembleLayer(s, key, lw)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		lw = assembled
+		packed = time.Since(start)
+	}
+
+	if t := s.Cfg.Timeouts.Upload; t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t)
+		defer cancel()
+		lw = withTimeout(lw, "upload", t)
+	}
+
+	uploadStart := time.Now()
 	path := "staging/" + key
+	journalFrom(ctx).staged(path)
 	sha256sum, size, err := s.Storage.Persist(ctx, path, manifest.LayerType, func(sw io.Writer) (string, int64, error) {
 		// Sets up a "multiwriter" that simultaneously runs both hash
 		// algorithms and uploads to the storage backend.
@@ -423,6 +887,10 @@ func uploadHashLayer(ctx context.Context, s *State, key string, lw layerWriter)
 		return sha256sum, counter.count, err
 	})
 
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && s.Cfg.Timeouts.Upload > 0 {
+		err = fmt.Errorf("upload %w", ErrStageTimeout)
+	}
+
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"layer":   key,
@@ -432,6 +900,12 @@ func uploadHashLayer(ctx context.Context, s *State, key string, lw layerWriter)
 		return nil, err
 	}
 
+	if scan {
+		if err := scanStaged(ctx, s, path, sha256sum); err != nil {
+			return nil, err
+		}
+	}
+
 	// Hashes are now known and the object is in the bucket, what
 	// remains is to move it to the correct location and cache it.
 	err = s.Storage.Move(ctx, "staging/"+key, "layers/"+sha256sum)
@@ -441,12 +915,20 @@ func uploadHashLayer(ctx context.Context, s *State, key string, lw layerWriter)
 
 		return nil, err
 	}
-
-	log.WithFields(log.Fields{
-		"layer":  key,
-		"sha256": sha256sum,
-		"size":   size,
-	}).Info("created and persisted layer")
+	journalFrom(ctx).unstaged(path)
+
+	// Layers are packed during the upload if they are not
+	// assembled in the scratch directory.
+	fields := log.Fields{
+		"layer":         key,
+		"sha256":        sha256sum,
+		"size":          size,
+		"uploadSeconds": time.Since(uploadStart).Seconds(),
+	}
+	if s.Cfg.ScratchDir != "" {
+		fields["packSeconds"] = packed.Seconds()
+	}
+	log.WithFields(fields).Info("created and persisted layer")
 
 	entry := manifest.Entry{
 		Digest: "sha256:" + sha256sum,
@@ -457,16 +939,124 @@ func uploadHashLayer(ctx context.Context, s *State, key string, lw layerWriter)
 }
 
 func BuildImage(ctx context.Context, s *State, image *Image) (*BuildResult, error) {
-	key := s.Cfg.Pkgs.CacheKey(image.Packages, image.Tag)
+	if image.MultiArch && !image.Wasm && *image.Arch == amd64 {
+		return buildIndex(ctx, s, image)
+	}
+
+	ctx = storage.WithMetadata(ctx, ObjectMetadata(s, image))
+	expandGroups(s.Cfg.Groups, image)
+	if err := resolveFlags(s.Cfg.Overrides, image); err != nil {
+		return nil, err
+	}
+	if err := resolveDuplicates(s.Cfg.Duplicates, image); err != nil {
+		return nil, err
+	}
+
+	key := imageCacheKey(s, image)
+	if log.IsLevelEnabled(log.DebugLevel) {
+		e := explainCacheKey(s, image)
+		log.WithFields(log.Fields{
+			"image":    e.Name,
+			"tag":      e.Tag,
+			"packages": e.Packages,
+			"arch":     e.Arch,
+			"salted":   key != e.SourceKey,
+			"key":      key,
+			"reason":   e.Reason,
+		}).Debug("derived image cache key")
+	}
+
 	if key != "" {
 		if m, c := manifestFromCache(ctx, s, key); c {
+			s.Prefetch.manifest(image, m)
+
+			digest, err := publishCachedManifest(ctx, s, m)
+			if err != nil {
+				return nil, err
+			}
+
 			return &BuildResult{
 				Manifest: m,
+				Digest:   digest,
 			}, nil
 		}
 	}
 
-	imageResult, err := prepareImage(s, image)
+	if s.CacheOnly {
+		return nil, ErrNotCached
+	}
+
+	if err := checkEmulation(s, image); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"image": image.Name,
+			"arch":  image.Arch.imageArch,
+		}).Warn("rejecting build that requires emulation")
+
+		return nil, err
+	}
+
+	// Quotas only prevent new builds, cached images remain
+	// available to tenants over their quota.
+	if err := s.Quotas.check(image.Tenant); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"image":  image.Name,
+			"tenant": image.Tenant,
+		}).Warn("rejecting build of tenant over quota")
+
+		return nil, err
+	}
+
+	// Only builds that actually need to do work are announced on
+	// the event bus, cache hits are not considered builds.
+	start := time.Now()
+	s.Events.Publish(events.Event{
+		Type:  events.BuildStarted,
+		Image: image.Name,
+		Tag:   image.Tag,
+		Arch:  image.Arch.imageArch,
+	})
+
+	build := s.Journal.start(image, key)
+	var stages *buildStages
+	if s.SlowBuilds != nil {
+		stages = newBuildStages()
+	}
+
+	result, err := buildImage(withBuildStages(withJournal(ctx, build), stages), s, image, key)
+	build.finish()
+
+	finished := events.Event{
+		Type:     events.BuildSucceeded,
+		Image:    image.Name,
+		Tag:      image.Tag,
+		Arch:     image.Arch.imageArch,
+		Duration: time.Since(start).Seconds(),
+	}
+
+	if err != nil {
+		finished.Type = events.BuildFailed
+		finished.Error = err.Error()
+	} else if result.Error != "" {
+		finished.Type = events.BuildFailed
+		finished.Error = result.Error
+	} else {
+		finished.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(result.Manifest))
+	}
+	s.Events.Publish(finished)
+	s.SlowBuilds.record(image, time.Since(start), finished.Type == events.BuildFailed, stages.finish())
+
+	return result, err
+}
+
+// buildImage performs the actual image build after a cache miss.
+func buildImage(ctx context.Context, s *State, image *Image, key string) (*BuildResult, error) {
+	if err := runHook(ctx, s.Cfg.Hooks, s.Cfg.Hooks.PreBuild, hookContext("pre-build", image, key)); err != nil {
+		return nil, err
+	}
+
+	journal := journalFrom(ctx)
+	stages := buildStagesFrom(ctx)
+	imageResult, err := prepareImage(ctx, s, image)
 	if err != nil {
 		return nil, err
 	}
@@ -477,43 +1067,116 @@ func BuildImage(ctx context.Context, s *State, image *Image) (*BuildResult, erro
 			Pkgs:  imageResult.Pkgs,
 		}, nil
 	}
+	s.StoreGC.built(imageResult.Graph.References.Graph)
+
+	// Images whose closure is unchanged since an earlier build (e.g.
+	// from a previous pin) reuse the manifest of that build.
+	if result, ok := reuseManifest(ctx, s, image, key, closurePaths(&imageResult.Graph)); ok {
+		return result, nil
+	}
+
+	annotations := make(map[string]string)
+	for k, v := range image.Annotations {
+		annotations[k] = v
+	}
+	sizeAnnotations(s, image, &imageResult.Graph, annotations)
+	storePathsAnnotation(&imageResult.Graph, annotations)
+	if image.Layout == LayoutFHS {
+		fhsAnnotation(image, imageResult, annotations)
+	}
+
+	if emulated(s, image.Arch) {
+		annotations[EmulationAnnotation] = hostArch.nixSystem
+	}
+	annotations[BuiltByAnnotation] = builtByAnnotation()
+
+	journal.stage("layers")
+	stages.enter("layers")
+	if image.Wasm {
+		return buildWasm(ctx, s, image, key, imageResult, annotations)
+	}
 
 	layers, err := prepareLayers(ctx, s, image, imageResult)
 	if err != nil {
 		return nil, err
 	}
 
-	// If the requested packages include a shell,
-	// set cmd accordingly.
-	cmd := ""
-	for _, pkg := range image.Packages {
-		if pkg == "bashInteractive" {
-			cmd = "bash"
+	if err := scanLayers(ctx, s, image, layers); err != nil {
+		return nil, err
+	}
+
+	if image.Encrypt {
+		layers, err = encryptLayers(ctx, s, image, layers)
+		if err != nil {
+			return nil, err
 		}
 	}
-	m, c := manifest.Manifest(image.Arch.imageArch, layers, cmd)
 
-	lw := func(w io.Writer) error {
-		r := bytes.NewReader(c.Config)
-		_, err := io.Copy(w, r)
-		return err
+	if err := layerSizeAnnotation(image, layers, annotations); err != nil {
+		return nil, err
 	}
 
-	if _, err = uploadHashLayer(ctx, s, c.SHA256, lw); err != nil {
-		log.WithError(err).WithFields(log.Fields{
-			"image": image.Name,
-			"tag":   image.Tag,
-		}).Error("failed to upload config")
+	if s.Cfg.NondistributableUrl != "" {
+		layers = nondistributableLayers(s.Cfg.NondistributableUrl, layers)
+	}
+
+	// Encrypted layers are only meant for the tenant that requested
+	// them and are never delegated to a public CDN.
+	if s.Cfg.ForeignLayersUrl != "" && !image.Encrypt {
+		layers = foreignLayers(s.Cfg.ForeignLayersUrl, layers)
+	}
 
+	rc := manifest.RuntimeConfig{
+		Cmd: image.Cmd,
+		Env: image.Env,
+	}
+
+	// The loader of the FHS runtime ignores the system library
+	// directories, which are added to its search path instead.
+	if image.Layout == LayoutFHS {
+		rc.Env = append([]string{fhsLibraryPath}, rc.Env...)
+	}
+
+	// If the requested packages include a shell and no other
+	// command was requested, set cmd accordingly. Shells of images
+	// with a profile are login shells, which read /etc/profile.
+	if len(rc.Cmd) == 0 {
+		for _, pkg := range image.Packages {
+			if pkg == "bashInteractive" {
+				rc.Cmd = []string{"bash"}
+				if image.Layout == LayoutProfile {
+					rc.Cmd = append(rc.Cmd, "--login")
+				}
+			}
+		}
+	}
+	manifest.SortLayers(layers, s.Cfg.LayerOrder)
+	m, c := manifest.Manifest(image.Arch.imageArch, layers, rc, annotations)
+	journal.stage("publishing")
+	stages.enter("publishing")
+	return publishManifest(ctx, s, image, key, m, c, closurePaths(&imageResult.Graph))
+}
+
+// buildWasm packages the WebAssembly files of an image's packages as
+// an OCI artifact.
+func buildWasm(ctx context.Context, s *State, image *Image, key string, result *ImageResult, annotations map[string]string) (*BuildResult, error) {
+	if image.Encrypt {
+		return nil, fmt.Errorf("WebAssembly artifacts can not be encrypted")
+	}
+
+	layers, wasmOS, err := prepareWasmLayers(ctx, s, image, result)
+	if err != nil {
 		return nil, err
 	}
 
-	if key != "" {
-		go cacheManifest(ctx, s, key, m)
+	if err := scanLayers(ctx, s, image, layers); err != nil {
+		return nil, err
 	}
 
-	result := BuildResult{
-		Manifest: m,
+	if err := layerSizeAnnotation(image, layers, annotations); err != nil {
+		return nil, err
 	}
-	return &result, nil
+
+	m, c := manifest.WasmManifest(wasmOS, layers, annotations)
+	return publishManifest(ctx, s, image, key, m, c, closurePaths(&result.Graph))
 }
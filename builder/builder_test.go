@@ -3,9 +3,13 @@
 package builder
 
 import (
+	"testing"
+	"time"
+
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
-	"testing"
+	"github.com/google/nixery/config"
+	"github.com/google/nixery/storage"
 )
 
 var ignoreArch = cmpopts.IgnoreFields(Image{}, "Arch")
@@ -66,6 +70,38 @@ func TestImageFromNameShell(t *testing.T) {
 	}
 }
 
+func TestImageFromNameProfile(t *testing.T) {
+	image := ImageFromName("profile/git", "latest")
+	expected := Image{
+		Name:     "git/profile",
+		Tag:      "latest",
+		Packages: []string{"cacert", "git", "iana-etc"},
+		Layout:   LayoutProfile,
+	}
+
+	if diff := cmp.Diff(expected, image, ignoreArch); diff != "" {
+		t.Fatalf("Image(\"profile/git\", \"latest\") mismatch:\n%s", diff)
+	}
+}
+
+func TestImageFromNameBinOnly(t *testing.T) {
+	image := ImageFromName("bin-only/ripgrep", "latest")
+	expected := Image{
+		Name:     "bin-only/ripgrep",
+		Tag:      "latest",
+		Packages: []string{"cacert", "iana-etc", "ripgrep"},
+		BinOnly:  true,
+	}
+
+	if diff := cmp.Diff(expected, image, ignoreArch); diff != "" {
+		t.Fatalf("Image(\"bin-only/ripgrep\", \"latest\") mismatch:\n%s", diff)
+	}
+
+	if pkgs := string(binOnlyPackages(&image)); pkgs != `["ripgrep"]` {
+		t.Errorf("unexpected bin-only packages: %s", pkgs)
+	}
+}
+
 func TestImageFromNameShellMultiple(t *testing.T) {
 	image := ImageFromName("shell/htop", "latest")
 	expected := Image{
@@ -110,3 +146,79 @@ func TestImageFromNameShellArm64(t *testing.T) {
 		t.Fatal("Image(\"shell/arm64\"): Expected arch arm64")
 	}
 }
+
+func TestSetPlatform(t *testing.T) {
+	image := ImageFromName("hello", "latest")
+
+	if err := image.SetPlatform("linux/arm64/v8"); err != nil {
+		t.Fatalf("SetPlatform(linux/arm64/v8) failed: %s", err)
+	}
+
+	if *image.Arch != arm64 {
+		t.Fatalf("expected arm64 architecture, got %v", image.Arch)
+	}
+
+	if err := image.SetPlatform("windows/amd64"); err == nil {
+		t.Fatal("SetPlatform(windows/amd64) should fail")
+	}
+}
+
+// commitSource is a package source that caches images for tags that
+// look like commits, like git sources do.
+type commitSource struct{}
+
+func (commitSource) Render(tag string) (string, string) {
+	return "git", "{}"
+}
+
+func (commitSource) CacheKey(pkgs []string, tag string) string {
+	if len(tag) != 40 {
+		return ""
+	}
+
+	return "key:" + tag
+}
+
+// newTestState returns a state with an in-memory storage backend and a
+// local cache in a temporary directory.
+func newTestState(t *testing.T) *State {
+	t.Helper()
+	t.Setenv("TMPDIR", t.TempDir())
+
+	cache, err := NewCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &State{Storage: storage.NewMemoryBackend(), Cache: &cache}
+}
+
+func TestExplainCacheKey(t *testing.T) {
+	s := &State{
+		Cfg:  config.Config{Pkgs: commitSource{}},
+		Pins: NewPinTracker(oldPin, time.Hour),
+	}
+
+	image := ImageFromName("shell/git", "latest")
+	e := ExplainCacheKey(s, &image)
+	if e.Tag != "latest" || e.Pin != oldPin || e.Key != "key:"+oldPin || e.Reason != "" {
+		t.Errorf("unexpected explanation of pinned image: %+v", e)
+	}
+
+	if len(s.Pins.pulls) != 0 {
+		t.Errorf("explaining a cache key must not record a pull")
+	}
+
+	image = ImageFromName("shell/git", "unstable")
+	e = ExplainCacheKey(s, &image)
+	if e.Pin != "" || e.Key != "" || e.Reason == "" {
+		t.Errorf("unexpected explanation of uncacheable image: %+v", e)
+	}
+}
+
+func TestStorePathHash(t *testing.T) {
+	hash := storePathHash("/nix/store/4ahr5w0c0s3b1mk4f6p6rqxgmq6p0v1r-git-2.44.0")
+	if hash != "4ahr5w0c0s3b1mk4f6p6rqxgmq6p0v1r" {
+		t.Errorf("unexpected hash: %s", hash)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the identity of the Nixery build serving an
+// instance. It is read from the build information embedded by the Go
+// toolchain, reported by the status API and recorded in the manifests
+// of built images, so that operators can tell which build of Nixery
+// produced an image.
+
+import (
+	"encoding/json"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/google/nixery/api"
+)
+
+// BuiltByAnnotation records the build of Nixery that built an image.
+const BuiltByAnnotation = "dev.nixery.built-by"
+
+var buildInfo = api.BuildInfo{
+	Version:   "devel",
+	GoVersion: runtime.Version(),
+}
+
+// ConfigureBuildInfo sets the identity of the running build, given the
+// version it was built as.
+func ConfigureBuildInfo(version string) {
+	info, _ := debug.ReadBuildInfo()
+	buildInfo = buildInfoFrom(version, info)
+}
+
+// ServerBuildInfo returns the identity of the running build.
+func ServerBuildInfo() api.BuildInfo {
+	return buildInfo
+}
+
+func buildInfoFrom(version string, info *debug.BuildInfo) api.BuildInfo {
+	b := api.BuildInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+	}
+
+	if info == nil {
+		return b
+	}
+
+	if info.GoVersion != "" {
+		b.GoVersion = info.GoVersion
+	}
+	if info.Main.Version != "(devel)" {
+		b.Module = info.Main.Version
+	}
+
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			b.Revision = s.Value
+		case "vcs.time":
+			b.CommitTime = s.Value
+		case "vcs.modified":
+			b.Modified = s.Value == "true"
+		}
+	}
+
+	return b
+}
+
+// builtByAnnotation returns the value of BuiltByAnnotation.
+func builtByAnnotation() string {
+	j, _ := json.Marshal(buildInfo)
+	return string(j)
+}
@@ -0,0 +1,33 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestBuildInfoFrom(t *testing.T) {
+	info := &debug.BuildInfo{
+		GoVersion: "go1.22.2",
+		Main:      debug.Module{Path: "github.com/google/nixery", Version: "(devel)"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs", Value: "git"},
+			{Key: "vcs.revision", Value: "3f7a0c8e1b5d4a6f9e2c7b8d1a0f3e5c6b9d2a4e"},
+			{Key: "vcs.time", Value: "2024-05-02T09:14:11Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+
+	b := buildInfoFrom("1.2.0", info)
+	if b.Version != "1.2.0" || b.Module != "" || b.GoVersion != "go1.22.2" {
+		t.Errorf("unexpected build info: %+v", b)
+	}
+	if b.Revision != "3f7a0c8e1b5d4a6f9e2c7b8d1a0f3e5c6b9d2a4e" || b.CommitTime != "2024-05-02T09:14:11Z" || !b.Modified {
+		t.Errorf("unexpected VCS information: %+v", b)
+	}
+
+	if b := buildInfoFrom("devel", nil); b.Version != "devel" || b.GoVersion == "" {
+		t.Errorf("unexpected build info without embedded information: %+v", b)
+	}
+}
@@ -5,13 +5,27 @@ package builder
 import (
 	"bytes"
 	"context"
+	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/events"
 	"github.com/google/nixery/manifest"
+	"github.com/google/nixery/scan"
+	"github.com/google/nixery/storage"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -22,11 +36,49 @@ type LocalCache struct {
 	mmtx sync.RWMutex
 	mdir string
 
-	// Layer cache
+	// Size (in bytes) above which the oldest manifests are evicted
+	// from the manifest cache, and the number of evicted manifests
+	mlimit   int64
+	mevicted int64
+
+	// Layer cache, and the time after which its entries are
+	// validated against the storage backend again
 	lmtx   sync.RWMutex
-	lcache map[string]manifest.Entry
+	lcache map[string]cachedLayer
+	lttl   time.Duration
+
+	// Scan result cache, keyed by layer digest
+	smtx   sync.RWMutex
+	scache map[string]scan.Result
+
+	// Digests of cached manifests published by this instance, with
+	// the time at which they were
+	pmtx      sync.RWMutex
+	published map[string]time.Time
+
+	// Storage paths recently found to be missing, with the time at
+	// which they were, and the time for which this is remembered
+	nmtx    sync.Mutex
+	missing map[string]time.Time
+	nttl    time.Duration
+
+	// Bus on which evictions are announced
+	events *events.Bus
+}
+
+// cachedLayer is an entry of the local layer cache.
+type cachedLayer struct {
+	entry manifest.Entry
+
+	// Time at which the entry was last known to refer to an
+	// existing blob
+	validated time.Time
 }
 
+// Prefix of the temporary files to which manifests are written before
+// they are moved into the local cache.
+const tempManifestPrefix = ".tmp-"
+
 // Creates an in-memory cache and ensures that the local file path for
 // manifest caching exists.
 func NewCache() (LocalCache, error) {
@@ -36,19 +88,202 @@ func NewCache() (LocalCache, error) {
 		return LocalCache{}, err
 	}
 
+	// Temporary files are left behind if the process exits while
+	// a manifest is being written, and are never completed.
+	if stale, err := filepath.Glob(filepath.Join(path, tempManifestPrefix+"*")); err == nil {
+		for _, f := range stale {
+			os.Remove(f)
+		}
+	}
+
 	return LocalCache{
 		mdir:   path + "/",
-		lcache: make(map[string]manifest.Entry),
+		lcache: make(map[string]cachedLayer),
+		scache: make(map[string]scan.Result),
+
+		published: make(map[string]time.Time),
+		missing:   make(map[string]time.Time),
 	}, nil
 }
 
+// imageCacheKey returns the key under which the manifest of an image
+// is cached, or the empty string if it is not cacheable.
+//
+// Images with custom runtime configuration, annotations or encryption
+// are keyed separately from plain images with the same packages, as
+// are images built with the credentials of a tenant. Images with a
+// lifetime are never cached.
+func imageCacheKey(s *State, image *Image) string {
+	if hasTTL(image) {
+		return ""
+	}
+
+	if len(image.StorePaths) > 0 {
+		return storePathsCacheKey(image)
+	}
+
+	key := s.Cfg.Pkgs.CacheKey(image.Packages, image.Tag)
+
+	// Images for the default architecture keep the unsalted key,
+	// which retains the existing cache entries for them.
+	var arch string
+	if image.Arch != nil && *image.Arch != amd64 {
+		arch = image.Arch.imageArch
+	}
+
+	credentials := usesCredentials(s, image)
+	if key == "" || (len(image.Cmd) == 0 && len(image.Env) == 0 && len(image.Annotations) == 0 && !image.Encrypt && !image.Wasm && arch == "" && !credentials && len(image.Overrides) == 0 && image.Layout == "" && !image.BinOnly) {
+		return key
+	}
+
+	// Encrypted images differ per tenant, as they are encrypted
+	// for different recipients. Images built with credentials may
+	// contain sources that other tenants have no access to.
+	var tenant string
+	if image.Encrypt {
+		tenant = "encrypted:" + image.Tenant
+	} else if credentials {
+		tenant = "credentials:" + image.Tenant
+	}
+
+	fields := []interface{}{image.Cmd, image.Env, image.Annotations, tenant, arch, image.Wasm}
+
+	// Overrides are only appended if set, which retains the keys
+	// of images cached before they were introduced.
+	if len(image.Overrides) > 0 {
+		fields = append(fields, image.Overrides)
+	}
+	if image.Layout != "" {
+		fields = append(fields, image.Layout, image.Activation)
+	}
+	if image.BinOnly {
+		fields = append(fields, "bin-only")
+	}
+
+	extra, _ := json.Marshal(fields)
+	return fmt.Sprintf("%x", sha1.Sum(append([]byte(key), extra...)))
+}
+
+// ExplainCacheKey describes how the cache key of a requested image is
+// derived. Pins and package groups are resolved as they would be for
+// a build, but no pull is recorded.
+func ExplainCacheKey(s *State, image *Image) api.CacheKeyExplanation {
+	resolved := *image
+	s.Pins.Resolve(&resolved)
+	expandGroups(s.Cfg.Groups, &resolved)
+
+	// Rejected images have no cache key, which is reported when
+	// they are built.
+	resolveFlags(s.Cfg.Overrides, &resolved)
+	resolveDuplicates(s.Cfg.Duplicates, &resolved)
+
+	e := explainCacheKey(s, &resolved)
+	e.Tag = image.Tag
+	if resolved.Tag != image.Tag {
+		e.Pin = resolved.Tag
+	}
+
+	return e
+}
+
+// explainCacheKey describes the cache key of an image whose pin and
+// groups are already resolved.
+func explainCacheKey(s *State, image *Image) api.CacheKeyExplanation {
+	source, _ := s.Cfg.Pkgs.Render(image.Tag)
+	e := api.CacheKeyExplanation{
+		Name:        image.Name,
+		Tag:         image.Tag,
+		Packages:    image.Packages,
+		Arch:        image.Arch.imageArch,
+		Wasm:        image.Wasm,
+		Layout:      image.Layout,
+		BinOnly:     image.BinOnly,
+		Cmd:         image.Cmd,
+		Env:         image.Env,
+		Annotations: image.Annotations,
+		Source:      source,
+		SourceKey:   s.Cfg.Pkgs.CacheKey(image.Packages, image.Tag),
+		Key:         imageCacheKey(s, image),
+	}
+
+	if image.Encrypt {
+		e.EncryptedFor = image.Tenant
+	}
+
+	if usesCredentials(s, image) {
+		e.CredentialsOf = image.Tenant
+	}
+
+	if e.Key == "" {
+		switch {
+		case hasTTL(image):
+			e.Reason = "images with a lifetime are not cached"
+		case source == "git":
+			e.Reason = fmt.Sprintf("tag %q is not a full commit hash", image.Tag)
+		case source == "nixpkgs":
+			e.Reason = "the configured channel is not a full commit hash"
+		default:
+			e.Reason = fmt.Sprintf("%s package sources are not cacheable", source)
+		}
+	}
+
+	return e
+}
+
+// usesCredentials reports whether an image is built with the
+// credentials of its tenant.
+func usesCredentials(s *State, image *Image) bool {
+	return s.Credentials != nil && image.Tenant != ""
+}
+
+// errCorruptManifest is returned for files in the local manifest cache
+// that do not match their checksum.
+var errCorruptManifest = errors.New("checksum mismatch in cached manifest")
+
+// Files in the local manifest cache start with the checksum of the
+// manifest on a separate line, which is validated when reading them.
+func checksumLine(m []byte) string {
+	return fmt.Sprintf("sha256:%x\n", sha256.Sum256(m))
+}
+
+// readCachedManifest reads a manifest from the local cache directory
+// and validates its checksum.
+func readCachedManifest(path string) (json.RawMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// The file is read into a buffer of its exact size, as
+	// manifests of large images can be several megabytes.
+	var m []byte
+	info, err := f.Stat()
+	if err == nil {
+		m = make([]byte, info.Size())
+		_, err = io.ReadFull(f, m)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Files written by older versions have no checksum and are
+	// treated like corrupt files.
+	nl := bytes.IndexByte(m, '\n')
+	if nl < 0 || checksumLine(m[nl+1:]) != string(m[:nl+1]) {
+		return nil, errCorruptManifest
+	}
+
+	return json.RawMessage(m[nl+1:]), nil
+}
+
 // Retrieve a cached manifest if the build is cacheable and it exists.
 func (c *LocalCache) manifestFromLocalCache(key string) (json.RawMessage, bool) {
 	c.mmtx.RLock()
-	defer c.mmtx.RUnlock()
+	m, err := readCachedManifest(c.mdir + key)
+	c.mmtx.RUnlock()
 
-	f, err := os.Open(c.mdir + key)
-	if err != nil {
+	if os.IsNotExist(err) {
 		// This is a debug log statement because failure to
 		// read the manifest key is currently expected if it
 		// is not cached.
@@ -57,9 +292,13 @@ func (c *LocalCache) manifestFromLocalCache(key string) (json.RawMessage, bool)
 
 		return nil, false
 	}
-	defer f.Close()
 
-	m, err := ioutil.ReadAll(f)
+	if errors.Is(err, errCorruptManifest) {
+		log.WithField("manifest", key).Warn("discarding corrupt manifest from local cache")
+		c.removeManifest(key)
+		return nil, false
+	}
+
 	if err != nil {
 		log.WithError(err).WithField("manifest", key).
 			Error("failed to read manifest from local cache")
@@ -67,41 +306,257 @@ func (c *LocalCache) manifestFromLocalCache(key string) (json.RawMessage, bool)
 		return nil, false
 	}
 
-	return json.RawMessage(m), true
+	return m, true
+}
+
+// removeManifest deletes a manifest from the local cache.
+func (c *LocalCache) removeManifest(key string) {
+	c.mmtx.Lock()
+	defer c.mmtx.Unlock()
+
+	if err := os.Remove(c.mdir + key); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("manifest", key).
+			Warn("failed to remove manifest from local cache")
+	}
 }
 
 // Adds the result of a manifest build to the local cache, if the
 // manifest is considered cacheable.
 //
 // Manifests can be quite large and are cached on disk instead of in
-// memory.
+// memory. They are written to a temporary file that is renamed once
+// complete, so that readers (including other processes sharing the
+// directory) never see partially written manifests, even if this
+// process exits during the write.
 func (c *LocalCache) localCacheManifest(key string, m json.RawMessage) {
+	c.clearMissing("manifests/" + key)
+
 	c.mmtx.Lock()
 	defer c.mmtx.Unlock()
 
-	err := ioutil.WriteFile(c.mdir+key, []byte(m), 0644)
-	if err != nil {
+	err := writeCachedManifest(c.mdir, key, m)
+	if errors.Is(err, syscall.ENOSPC) {
+		log.WithError(err).WithFields(log.Fields{
+			"manifest": key,
+			"dir":      c.mdir,
+		}).Error("disk of the local manifest cache is full, consider setting NIXERY_MANIFEST_CACHE_MB")
+	} else if err != nil {
 		log.WithError(err).WithField("manifest", key).
 			Error("failed to locally cache manifest")
 	}
+
+	c.evictManifests()
+}
+
+// SetEvents sets the bus on which evictions of manifests from the local
+// cache are announced.
+func (c *LocalCache) SetEvents(bus *events.Bus) {
+	c.mmtx.Lock()
+	defer c.mmtx.Unlock()
+
+	c.events = bus
+}
+
+// SetManifestLimit sets the size (in bytes) of the manifest cache above
+// which the oldest manifests are evicted. The limit is soft, as it is
+// only enforced after manifests are written. Zero disables the limit.
+func (c *LocalCache) SetManifestLimit(limit int64) {
+	c.mmtx.Lock()
+	defer c.mmtx.Unlock()
+
+	c.mlimit = limit
+	c.evictManifests()
+}
+
+// cachedManifests lists the manifests in the local cache, excluding
+// temporary files, and returns their total size.
+func (c *LocalCache) cachedManifests() ([]os.FileInfo, int64, error) {
+	files, err := ioutil.ReadDir(c.mdir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var manifests []os.FileInfo
+	var size int64
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), tempManifestPrefix) {
+			continue
+		}
+
+		manifests = append(manifests, f)
+		size += f.Size()
+	}
+
+	return manifests, size, nil
+}
+
+// evictManifests removes the least recently written manifests from the
+// local cache until it is within its size limit. The caller must hold
+// the write lock of the manifest cache.
+func (c *LocalCache) evictManifests() {
+	if c.mlimit <= 0 {
+		return
+	}
+
+	manifests, size, err := c.cachedManifests()
+	if err != nil {
+		log.WithError(err).Error("failed to list local manifest cache")
+		return
+	}
+
+	if size <= c.mlimit {
+		return
+	}
+
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].ModTime().Before(manifests[j].ModTime())
+	})
+
+	before := size
+	evicted := 0
+	for _, f := range manifests {
+		if size <= c.mlimit {
+			break
+		}
+
+		if err := os.Remove(filepath.Join(c.mdir, f.Name())); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).WithField("manifest", f.Name()).
+				Warn("failed to evict manifest from local cache")
+			continue
+		}
+
+		size -= f.Size()
+		evicted++
+
+		c.events.Publish(events.Event{
+			Type: events.CacheEvicted,
+			Key:  f.Name(),
+		})
+	}
+
+	atomic.AddInt64(&c.mevicted, int64(evicted))
+	log.WithFields(log.Fields{
+		"evicted": evicted,
+		"before":  before,
+		"after":   size,
+		"limit":   c.mlimit,
+	}).Info("evicted oldest manifests from local cache")
 }
 
-// Retrieve a layer build from the local cache.
+func writeCachedManifest(dir, key string, m json.RawMessage) error {
+	f, err := ioutil.TempFile(dir, tempManifestPrefix+key+"-")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(f, checksumLine(m))
+	if err == nil {
+		_, err = f.Write(m)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, key))
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// SetLayerTTL sets the time after which entries of the local layer
+// cache are validated against the storage backend again. Zero keeps
+// entries forever.
+func (c *LocalCache) SetLayerTTL(ttl time.Duration) {
+	c.lmtx.Lock()
+	c.lttl = ttl
+	c.lmtx.Unlock()
+}
+
+// Retrieve a layer build from the local cache. Entries that have not
+// been validated within the TTL are not returned.
 func (c *LocalCache) layerFromLocalCache(key string) (*manifest.Entry, bool) {
 	c.lmtx.RLock()
-	e, ok := c.lcache[key]
+	l, ok := c.lcache[key]
+	fresh := c.lttl == 0 || time.Since(l.validated) < c.lttl
 	c.lmtx.RUnlock()
 
-	return &e, ok
+	return &l.entry, ok && fresh
 }
 
 // Add a layer build result to the local cache.
 func (c *LocalCache) localCacheLayer(key string, e manifest.Entry) {
+	c.clearMissing("builds/" + key)
+
 	c.lmtx.Lock()
-	c.lcache[key] = e
+	c.lcache[key] = cachedLayer{entry: e, validated: time.Now()}
 	c.lmtx.Unlock()
 }
 
+// layerTTL returns the time after which cached layers are validated.
+func (c *LocalCache) layerTTL() time.Duration {
+	c.lmtx.RLock()
+	defer c.lmtx.RUnlock()
+	return c.lttl
+}
+
+// Remove a layer build from the local cache.
+func (c *LocalCache) removeLayer(key string) {
+	c.lmtx.Lock()
+	delete(c.lcache, key)
+	c.lmtx.Unlock()
+}
+
+// Time for which manifests published by this instance are not
+// published again, after which they may have been deleted (e.g. by
+// garbage collection), and the number of remembered manifests.
+const (
+	publishedTTL   = 10 * time.Minute
+	publishedLimit = 10000
+)
+
+// publishedManifest returns the digest of a manifest, and whether it
+// was recently published by this instance.
+func (c *LocalCache) publishedManifest(m json.RawMessage) (string, bool) {
+	digest := manifest.Descriptor(m).Digest
+
+	c.pmtx.RLock()
+	defer c.pmtx.RUnlock()
+	published, ok := c.published[digest]
+	return digest, ok && time.Since(published) < publishedTTL
+}
+
+// Record that the manifest with the given digest was published. Once
+// the limit is reached, expired entries are removed, and arbitrary ones
+// if none have expired.
+func (c *LocalCache) markPublished(digest string) {
+	c.pmtx.Lock()
+	defer c.pmtx.Unlock()
+
+	if len(c.published) >= publishedLimit {
+		for d, published := range c.published {
+			if time.Since(published) >= publishedTTL {
+				delete(c.published, d)
+			}
+		}
+
+		for d := range c.published {
+			if len(c.published) < publishedLimit {
+				break
+			}
+			delete(c.published, d)
+		}
+	}
+
+	c.published[digest] = time.Now()
+}
+
 // Retrieve a manifest from the cache(s). First the local cache is
 // checked, then the storage backend.
 func manifestFromCache(ctx context.Context, s *State, key string) (json.RawMessage, bool) {
@@ -109,7 +564,15 @@ func manifestFromCache(ctx context.Context, s *State, key string) (json.RawMessa
 		return m, true
 	}
 
-	r, err := s.Storage.Fetch(ctx, "manifests/"+key)
+	path := "manifests/" + key
+	if s.Cache.knownMissing(path) {
+		return nil, false
+	}
+
+	r, err := s.Storage.Fetch(ctx, path)
+	if storage.IsNotExist(err) {
+		s.Cache.markMissing(path)
+	}
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"manifest": key,
@@ -130,20 +593,26 @@ func manifestFromCache(ctx context.Context, s *State, key string) (json.RawMessa
 		return nil, false
 	}
 
-	go s.Cache.localCacheManifest(key, m)
+	s.Background.Go(ctx, "local-cache-manifest", func(context.Context) {
+		s.Cache.localCacheManifest(key, m)
+	})
+	s.Replicator.manifest(key, m)
 	log.WithField("manifest", key).Info("retrieved manifest from GCS")
 
 	return json.RawMessage(m), true
 }
 
-// Add a manifest to the bucket & local caches
+// Add a manifest to the bucket & local caches. This is usually run as
+// a background task.
 func cacheManifest(ctx context.Context, s *State, key string, m json.RawMessage) {
-	go s.Cache.localCacheManifest(key, m)
+	s.Cache.localCacheManifest(key, m)
+	s.Replicator.manifest(key, m)
 
 	path := "manifests/" + key
+	ctx = storage.WithSizeHint(ctx, int64(len(m)))
 	_, size, err := s.Storage.Persist(ctx, path, manifest.ManifestType, func(w io.Writer) (string, int64, error) {
-		size, err := io.Copy(w, bytes.NewReader([]byte(m)))
-		return "", size, err
+		n, err := w.Write(m)
+		return "", int64(n), err
 	})
 
 	if err != nil {
@@ -164,12 +633,25 @@ func cacheManifest(ctx context.Context, s *State, key string, m json.RawMessage)
 
 // Retrieve a layer build from the cache, first checking the local
 // cache followed by the bucket cache.
+//
+// Layers in the bucket cache may refer to blobs that have since been
+// garbage-collected. Unless the layer TTL is disabled, they are only
+// returned if their blob still exists, and their local cache entries
+// expire after the TTL so that they are fetched and validated again.
 func layerFromCache(ctx context.Context, s *State, key string) (*manifest.Entry, bool) {
 	if entry, cached := s.Cache.layerFromLocalCache(key); cached {
 		return entry, true
 	}
 
-	r, err := s.Storage.Fetch(ctx, "builds/"+key)
+	path := "builds/" + key
+	if s.Cache.knownMissing(path) {
+		return nil, false
+	}
+
+	r, err := s.Storage.Fetch(ctx, path)
+	if storage.IsNotExist(err) {
+		s.Cache.markMissing(path)
+	}
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"layer":   key,
@@ -200,12 +682,19 @@ func layerFromCache(ctx context.Context, s *State, key string) (*manifest.Entry,
 		return nil, false
 	}
 
-	go s.Cache.localCacheLayer(key, entry)
+	if s.Cache.layerTTL() > 0 && !validCachedLayer(ctx, s, key, entry.Digest) {
+		s.Cache.removeLayer(key)
+		return nil, false
+	}
+
+	s.Cache.localCacheLayer(key, entry)
+	s.Replicator.layer(key, entry)
 	return &entry, true
 }
 
 func cacheLayer(ctx context.Context, s *State, key string, entry manifest.Entry) {
 	s.Cache.localCacheLayer(key, entry)
+	s.Replicator.layer(key, entry)
 
 	j, _ := json.Marshal(&entry)
 	path := "builds/" + key
@@ -223,3 +712,66 @@ func cacheLayer(ctx context.Context, s *State, key string, entry manifest.Entry)
 
 	return
 }
+
+// validCachedLayer checks whether the blob referenced by a cached layer
+// still exists in the storage backend. If it was deleted, the stale
+// cache record is deleted as well, so that the layer is built again.
+func validCachedLayer(ctx context.Context, s *State, key, digest string) bool {
+	path := "layers/" + strings.TrimPrefix(digest, "sha256:")
+	objects, err := s.Storage.List(ctx, path)
+	if err != nil {
+		// The blob is assumed to exist if this can not be
+		// determined, as rebuilding layers is expensive.
+		log.WithError(err).WithFields(log.Fields{
+			"layer":   key,
+			"backend": s.Storage.Name(),
+		}).Warn("failed to validate cached layer")
+
+		return true
+	}
+
+	for _, obj := range objects {
+		if obj.Path == path {
+			return true
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"layer":  key,
+		"digest": digest,
+	}).Warn("cached layer refers to missing blob, discarding it")
+
+	if err := s.Storage.Delete(ctx, "builds/"+key); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.WithError(err).WithField("layer", key).Warn("failed to delete stale layer cache record")
+	}
+
+	return false
+}
+
+// CacheStats describes the contents of the local cache.
+type CacheStats = api.CacheStats
+
+// Stats returns the number of entries in the local cache, and the disk
+// usage of its manifests.
+func (c *LocalCache) Stats() CacheStats {
+	var stats CacheStats
+
+	c.mmtx.RLock()
+	if manifests, size, err := c.cachedManifests(); err == nil {
+		stats.Manifests = len(manifests)
+		stats.ManifestBytes = size
+	}
+	stats.ManifestLimit = c.mlimit
+	c.mmtx.RUnlock()
+	stats.ManifestsEvicted = atomic.LoadInt64(&c.mevicted)
+
+	c.lmtx.RLock()
+	stats.Layers = len(c.lcache)
+	c.lmtx.RUnlock()
+
+	c.smtx.RLock()
+	stats.ScanResults = len(c.scache)
+	c.smtx.RUnlock()
+
+	return stats
+}
@@ -0,0 +1,181 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/nixery/events"
+	"github.com/google/nixery/manifest"
+)
+
+func TestCachedManifestChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nixery-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := []byte(`{"schemaVersion":2}`)
+	if err := writeCachedManifest(dir, "key", m); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := readCachedManifest(filepath.Join(dir, "key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(read) != string(m) {
+		t.Errorf("unexpected manifest: %s", read)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("expected no temporary files to remain, found %d files", len(files))
+	}
+
+	// Truncated files and files without checksum are rejected.
+	path := filepath.Join(dir, "key")
+	data, _ := ioutil.ReadFile(path)
+	for _, corrupt := range [][]byte{data[:len(data)-3], m} {
+		ioutil.WriteFile(path, corrupt, 0644)
+		if _, err := readCachedManifest(path); !errors.Is(err, errCorruptManifest) {
+			t.Errorf("expected corrupt manifest to be rejected, got %v", err)
+		}
+	}
+}
+
+// eventRecorder returns a bus delivering events to a webhook, and the
+// channel on which the webhook receives them.
+func eventRecorder(t *testing.T) (*events.Bus, chan events.Event) {
+	received := make(chan events.Event, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e events.Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err == nil {
+			received <- e
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	bus, err := events.New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bus, received
+}
+
+func TestManifestEviction(t *testing.T) {
+	s := newTestState(t)
+	bus, received := eventRecorder(t)
+	s.Cache.SetEvents(bus)
+
+	m := json.RawMessage(`{"schemaVersion":2}`)
+	for _, key := range []string{"old", "new"} {
+		s.Cache.localCacheManifest(key, m)
+	}
+
+	// Modification times may be identical on coarse filesystems.
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(s.Cache.mdir, "old"), old, old)
+
+	stats := s.Cache.Stats()
+	if stats.Manifests != 2 {
+		t.Fatalf("expected 2 cached manifests, got %d", stats.Manifests)
+	}
+
+	// The limit only leaves room for one manifest.
+	s.Cache.SetManifestLimit(stats.ManifestBytes - 1)
+
+	if _, ok := s.Cache.manifestFromLocalCache("old"); ok {
+		t.Error("oldest manifest was not evicted")
+	}
+	if _, ok := s.Cache.manifestFromLocalCache("new"); !ok {
+		t.Error("newest manifest was evicted")
+	}
+
+	if stats := s.Cache.Stats(); stats.ManifestsEvicted != 1 {
+		t.Errorf("expected 1 evicted manifest, got %d", stats.ManifestsEvicted)
+	}
+
+	select {
+	case e := <-received:
+		if e.Type != events.CacheEvicted || e.Key != "old" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("eviction was not announced")
+	}
+}
+
+func TestStaleLayerCache(t *testing.T) {
+	s := newTestState(t)
+	s.Cache.SetLayerTTL(time.Hour)
+
+	ctx := context.Background()
+	entry := manifest.Entry{Digest: "sha256:abc", Size: 3}
+	cacheLayer(ctx, s, "layer", entry)
+
+	// Entries are served locally until they expire.
+	if _, ok := layerFromCache(ctx, s, "layer"); !ok {
+		t.Fatal("expected fresh entry to be served from the local cache")
+	}
+
+	s.Cache.lcache["layer"] = cachedLayer{entry: entry, validated: time.Now().Add(-2 * time.Hour)}
+	if _, ok := layerFromCache(ctx, s, "layer"); ok {
+		t.Error("expected expired entry referring to a missing blob to be discarded")
+	}
+	if _, err := s.Storage.Fetch(ctx, "builds/layer"); err == nil {
+		t.Error("expected stale layer cache record to be deleted")
+	}
+
+	cacheLayer(ctx, s, "layer", entry)
+	s.Storage.Persist(ctx, "layers/abc", "", func(w io.Writer) (string, int64, error) {
+		n, err := w.Write([]byte("abc"))
+		return "", int64(n), err
+	})
+	s.Cache.lcache["layer"] = cachedLayer{entry: entry, validated: time.Now().Add(-2 * time.Hour)}
+	if _, ok := layerFromCache(ctx, s, "layer"); !ok {
+		t.Error("expected expired entry referring to an existing blob to be served")
+	}
+}
+
+func TestPublishedManifestsExpire(t *testing.T) {
+	s := newTestState(t)
+
+	m := json.RawMessage(`{"schemaVersion":2}`)
+	digest, published := s.Cache.publishedManifest(m)
+	if published {
+		t.Fatal("unpublished manifest was reported as published")
+	}
+
+	s.Cache.markPublished(digest)
+	if _, published := s.Cache.publishedManifest(m); !published {
+		t.Error("published manifest was not remembered")
+	}
+
+	// Manifests are published again after a while, as their blob may
+	// have been deleted meanwhile.
+	s.Cache.published[digest] = time.Now().Add(-publishedTTL)
+	if _, published := s.Cache.publishedManifest(m); published {
+		t.Error("expired manifest was reported as published")
+	}
+
+	for i := 0; i <= publishedLimit; i++ {
+		s.Cache.markPublished(fmt.Sprintf("sha256:%d", i))
+	}
+	if len(s.Cache.published) > publishedLimit {
+		t.Errorf("%d published manifests are remembered, expected at most %d", len(s.Cache.published), publishedLimit)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the catalog of image names and tags that were
+// pulled from the instance, which backs the registry's discovery
+// endpoints (`/v2/_catalog` and `/v2/<name>/tags/list`).
+//
+// Cache entries do not record the names of the images they belong to,
+// and names are rewritten by aliases, namespaces and pins before an
+// image is built. The name and tag requested by the client are
+// therefore recorded separately, at `catalog/<escaped name>/<tag>`,
+// with the digest of the served manifest as content. Images of tenants
+// and images with a TTL are not recorded.
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/nixery/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+func catalogPath(name, tag string) string {
+	return "catalog/" + url.PathEscape(name) + "/" + tag
+}
+
+// Catalog records the names and tags of served images.
+//
+// A nil *Catalog is valid and does not record any images.
+type Catalog struct {
+	mu sync.Mutex
+
+	// Tags recorded (or being recorded) by this process, which are
+	// not written again.
+	recorded map[string]bool
+}
+
+// NewCatalog creates an empty catalog.
+func NewCatalog() *Catalog {
+	return &Catalog{
+		recorded: make(map[string]bool),
+	}
+}
+
+// Record adds the name and tag under which an image was requested to
+// the catalog, in the background.
+func (c *Catalog) Record(ctx context.Context, s *State, name, tag string, image *Image, digest string) {
+	if c == nil || image.Tenant != "" || hasTTL(image) {
+		return
+	}
+
+	path := catalogPath(name, tag)
+	c.mu.Lock()
+	if c.recorded[path] {
+		c.mu.Unlock()
+		return
+	}
+	c.recorded[path] = true
+	c.mu.Unlock()
+
+	s.Background.Go(ctx, "catalog", func(ctx context.Context) {
+		_, _, err := s.Storage.Persist(ctx, path, "text/plain", func(w io.Writer) (string, int64, error) {
+			n, err := io.Copy(w, bytes.NewReader([]byte(digest)))
+			return "", n, err
+		})
+
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"image": name,
+				"tag":   tag,
+			}).Warn("failed to record image in catalog")
+
+			c.mu.Lock()
+			delete(c.recorded, path)
+			c.mu.Unlock()
+		}
+	})
+}
+
+// CatalogNames returns the sorted names of all images in the catalog.
+func CatalogNames(ctx context.Context, b storage.Backend) ([]string, error) {
+	objects, err := b.List(ctx, "catalog/")
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, obj := range objects {
+		parts := strings.Split(strings.TrimPrefix(obj.Path, "catalog/"), "/")
+		if len(parts) != 2 {
+			continue
+		}
+
+		name, err := url.PathUnescape(parts[0])
+		if err != nil || seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// CatalogTags returns the sorted tags of an image in the catalog,
+// which are empty for images that are not in the catalog.
+func CatalogTags(ctx context.Context, b storage.Backend, name string) ([]string, error) {
+	prefix := "catalog/" + url.PathEscape(name) + "/"
+	objects, err := b.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []string{}
+	for _, obj := range objects {
+		if tag := strings.TrimPrefix(obj.Path, prefix); tag != "" && !strings.Contains(tag, "/") {
+			tags = append(tags, tag)
+		}
+	}
+
+	sort.Strings(tags)
+	return tags, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/nixery/storage"
+)
+
+func TestCatalog(t *testing.T) {
+	s := &State{Storage: storage.NewMemoryBackend()}
+	c := NewCatalog()
+	ctx := context.Background()
+
+	c.Record(ctx, s, "shell/git", "latest", &Image{}, "sha256:a")
+	c.Record(ctx, s, "shell/git", "v1", &Image{}, "sha256:b")
+	c.Record(ctx, s, "shell", "latest", &Image{}, "sha256:c")
+
+	// Images of tenants are not listed.
+	c.Record(ctx, s, "private", "latest", &Image{Tenant: "acme"}, "sha256:d")
+
+	var names []string
+	for i := 0; i < 100 && len(names) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		names, _ = CatalogNames(ctx, s.Storage)
+	}
+
+	if !reflect.DeepEqual(names, []string{"shell", "shell/git"}) {
+		t.Errorf("unexpected catalog %v", names)
+	}
+
+	var tags []string
+	for i := 0; i < 100 && len(tags) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		tags, _ = CatalogTags(ctx, s.Storage, "shell/git")
+	}
+
+	if !reflect.DeepEqual(tags, []string{"latest", "v1"}) {
+		t.Errorf("unexpected tags %v", tags)
+	}
+
+	// Names are escaped, so tags of nested names are not listed
+	// for their parents.
+	if tags, _ := CatalogTags(ctx, s.Storage, "shell"); !reflect.DeepEqual(tags, []string{"latest"}) {
+		t.Errorf("unexpected tags of parent %v", tags)
+	}
+}
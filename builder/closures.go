@@ -0,0 +1,125 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the reuse of manifests across revisions of the
+// package set. Cache keys contain the revision, so every image misses
+// the cache when the pin advances, even though the closures of many
+// images are identical across revisions.
+//
+// Once an image has been evaluated, its closure is known and is used
+// as a second key: `closures/<hash>` records the cache key of the
+// manifest last built for the same closure and configuration. If that
+// manifest is still cached, it is cached under the new key as well
+// instead of packing and publishing the image again, which also keeps
+// the digest of the image unchanged for clients.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func closurePath(key string) string {
+	return "closures/" + key
+}
+
+// closureKey returns the key under which the manifest of an image with
+// the given (sorted) closure is recorded. Everything that goes into
+// the manifest besides the closure is part of the key, except for the
+// revision of the package set.
+func closureKey(s *State, image *Image, paths []string) string {
+	var arch, tenant string
+	if image.Arch != nil {
+		arch = image.Arch.imageArch
+	}
+	if image.Encrypt {
+		tenant = "encrypted:" + image.Tenant
+	} else if usesCredentials(s, image) {
+		tenant = "credentials:" + image.Tenant
+	}
+
+	j, _ := json.Marshal([]interface{}{
+		paths, image.Packages, image.Cmd, image.Env, image.Annotations, tenant,
+		arch, image.Wasm, image.Overrides, image.Layout, image.Activation,
+	})
+
+	return fmt.Sprintf("%x", sha1.Sum(j))
+}
+
+// recordClosure records the cache key of a newly built manifest under
+// the key of its closure. Failures are only logged, as the record is
+// only used to avoid rebuilds.
+func recordClosure(ctx context.Context, s *State, image *Image, key string, paths []string) {
+	if key == "" || len(paths) == 0 {
+		return
+	}
+
+	_, _, err := s.Storage.Persist(ctx, closurePath(closureKey(s, image, paths)), "text/plain", func(w io.Writer) (string, int64, error) {
+		n, err := io.Copy(w, bytes.NewReader([]byte(key)))
+		return "", n, err
+	})
+
+	if err != nil {
+		log.WithError(err).WithField("image", image.Name).Warn("failed to record image closure")
+	}
+}
+
+// reuseManifest returns the cached manifest of an earlier build of the
+// image's closure, and caches it under the image's key. Manifests are
+// only reused for cacheable images.
+func reuseManifest(ctx context.Context, s *State, image *Image, key string, paths []string) (*BuildResult, bool) {
+	if key == "" || len(paths) == 0 {
+		return nil, false
+	}
+
+	path := closurePath(closureKey(s, image, paths))
+	objects, err := s.Storage.List(ctx, path)
+	if err != nil || len(objects) == 0 {
+		return nil, false
+	}
+
+	r, err := s.Storage.Fetch(ctx, path)
+	if err != nil {
+		return nil, false
+	}
+	defer r.Close()
+
+	previous, err := ioutil.ReadAll(r)
+	if err != nil || len(previous) == 0 || string(previous) == key {
+		return nil, false
+	}
+
+	m, ok := manifestFromCache(ctx, s, string(previous))
+	if !ok {
+		return nil, false
+	}
+
+	digest, err := PersistManifest(ctx, s, m)
+	if err != nil {
+		return nil, false
+	}
+
+	log.WithFields(log.Fields{
+		"image":    image.Name,
+		"tag":      image.Tag,
+		"previous": string(previous),
+		"digest":   digest,
+	}).Info("reused manifest of unchanged closure")
+
+	s.Background.Go(ctx, "cache-manifest", func(ctx context.Context) {
+		cacheManifest(ctx, s, key, m)
+	})
+
+	return &BuildResult{
+		Manifest: m,
+		Digest:   digest,
+		Reused:   true,
+	}, true
+}
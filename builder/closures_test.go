@@ -0,0 +1,40 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestReuseManifest(t *testing.T) {
+	s := newTestState(t)
+
+	ctx := context.Background()
+	image := ImageFromName("shell/git", "latest")
+	paths := []string{"/nix/store/aaa-bash-5.2", "/nix/store/bbb-git-2.44.0"}
+	m := json.RawMessage(`{"schemaVersion":2}`)
+
+	cacheManifest(ctx, s, "old-pin", m)
+	recordClosure(ctx, s, &image, "old-pin", paths)
+
+	result, ok := reuseManifest(ctx, s, &image, "new-pin", paths)
+	if !ok {
+		t.Fatal("expected manifest of unchanged closure to be reused")
+	}
+	if !result.Reused || !bytes.Equal(result.Manifest, m) {
+		t.Errorf("unexpected result of reused manifest: %+v", result)
+	}
+
+	changed := append([]string{"/nix/store/ccc-curl-8.7.1"}, paths...)
+	if _, ok := reuseManifest(ctx, s, &image, "new-pin", changed); ok {
+		t.Error("manifest of changed closure was reused")
+	}
+
+	image.Env = []string{"EDITOR=nano"}
+	if _, ok := reuseManifest(ctx, s, &image, "new-pin", paths); ok {
+		t.Error("manifest of image with different configuration was reused")
+	}
+}
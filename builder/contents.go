@@ -0,0 +1,95 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the contents records of images, which list the
+// store paths (i.e. the full runtime closure) included in an image.
+// They let runtime security tools, such as admission controllers that
+// restrict executable paths, be configured from the images they admit.
+//
+// Contents records are stored at `contents/<digest>` when an image is
+// built. Images that were imported or built by older versions have no
+// contents record.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+func contentsPath(digest string) string {
+	return "contents/" + strings.TrimPrefix(digest, "sha256:")
+}
+
+// closurePaths returns the sorted store paths of an image's runtime
+// closure.
+func closurePaths(graph *layers.RuntimeGraph) []string {
+	paths := make([]string, 0, len(graph.Graph))
+	for _, p := range graph.Graph {
+		paths = append(paths, p.Path)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+// storePathHash returns the hash component of a store path, e.g.
+// `4ahr...` for `/nix/store/4ahr...-git-2.44.0`.
+func storePathHash(p string) string {
+	return strings.SplitN(path.Base(p), "-", 2)[0]
+}
+
+// recordContents persists the contents record of the image with the
+// given manifest digest. Failures are only logged, as the record is
+// not required to serve the image.
+func recordContents(ctx context.Context, s *State, digest string, paths []string) {
+	contents := api.ImageContents{
+		Digest:     digest,
+		StorePaths: paths,
+		Hashes:     make([]string, len(paths)),
+	}
+	for i, p := range paths {
+		contents.Hashes[i] = storePathHash(p)
+	}
+
+	j, _ := json.Marshal(contents)
+	_, _, err := s.Storage.Persist(ctx, contentsPath(digest), "application/json", func(w io.Writer) (string, int64, error) {
+		size, err := io.Copy(w, bytes.NewReader(j))
+		return "", size, err
+	})
+
+	if err != nil {
+		log.WithError(err).WithField("digest", digest).Warn("failed to persist image contents")
+	}
+}
+
+// ImageContents returns the contents record of the image with the
+// given manifest digest (`sha256:<hex>`).
+func ImageContents(ctx context.Context, s *State, digest string) (*api.ImageContents, error) {
+	r, err := s.Storage.Fetch(ctx, contentsPath(digest))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	j, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var contents api.ImageContents
+	if err := json.Unmarshal(j, &contents); err != nil {
+		return nil, err
+	}
+
+	return &contents, nil
+}
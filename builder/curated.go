@@ -0,0 +1,258 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements curated images, which are image specs defined
+// in a Git repository and served under their names. Curating images as
+// code means that changes to them are reviewed like any other change,
+// and that the images offered by an instance can be bootstrapped from
+// nothing but the repository.
+//
+// Each JSON file in the repository defines one image, named after the
+// path of the file without its extension (e.g. `data/python.json`
+// defines `data/python`). Files are image specs (see api.ImageSpec)
+// listing the packages and runtime configuration of the image.
+//
+// The repository is synced periodically and whenever its CI calls the
+// sync endpoint. If any definition is invalid, the sync fails and the
+// definitions of the previous sync are kept.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// Image names of curated images, following the repository name grammar
+// of the distribution specification.
+var curatedNameRegex = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$`)
+
+// CuratedImages keeps the curated image definitions in memory.
+//
+// A nil *CuratedImages is valid and has no images.
+type CuratedImages struct {
+	repo string
+	ref  string
+	dir  string
+
+	// Serialises syncs, which share the checkout
+	syncing sync.Mutex
+
+	mu     sync.RWMutex
+	status api.CuratedImages
+}
+
+// NewCuratedImages prepares the checkout of the configured repository,
+// or returns nil if curated images are disabled.
+func NewCuratedImages(cfg config.CuratedImages) (*CuratedImages, error) {
+	if cfg.Repo == "" {
+		return nil, nil
+	}
+
+	dir, err := ioutil.TempDir("", "nixery-curated")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create checkout of curated images: %w", err)
+	}
+
+	return &CuratedImages{
+		repo: cfg.Repo,
+		ref:  cfg.Ref,
+		dir:  dir,
+		status: api.CuratedImages{
+			Repo: cfg.Repo,
+			Ref:  cfg.Ref,
+		},
+	}, nil
+}
+
+// Lookup returns the spec of the curated image with the given name.
+func (c *CuratedImages) Lookup(name string) (*api.ImageSpec, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	spec, ok := c.status.Images[name]
+	return &spec, ok
+}
+
+// Status returns the curated images and the state of the last sync.
+func (c *CuratedImages) Status() api.CuratedImages {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.status
+}
+
+// Sync fetches the repository and replaces the curated images with its
+// definitions.
+func (c *CuratedImages) Sync(ctx context.Context) error {
+	c.syncing.Lock()
+	defer c.syncing.Unlock()
+
+	revision, err := c.fetch(ctx)
+	var images map[string]api.ImageSpec
+	if err == nil {
+		images, err = parseCuratedImages(c.dir)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		c.status.Error = err.Error()
+		return err
+	}
+
+	if revision != c.status.Revision {
+		log.WithFields(log.Fields{
+			"repo":     c.repo,
+			"revision": revision,
+			"images":   len(images),
+		}).Info("synced curated images")
+	}
+
+	now := time.Now()
+	c.status.Revision = revision
+	c.status.Synced = &now
+	c.status.Error = ""
+	c.status.Images = images
+
+	return nil
+}
+
+// fetch checks out the configured ref of the repository and returns
+// the commit it points to. Only the commit itself is fetched, as the
+// history of the definitions is not needed.
+func (c *CuratedImages) fetch(ctx context.Context) (string, error) {
+	if _, err := os.Stat(filepath.Join(c.dir, ".git")); os.IsNotExist(err) {
+		if _, err := c.git(ctx, "init", "--quiet"); err != nil {
+			return "", err
+		}
+	}
+
+	ref := c.ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	if _, err := c.git(ctx, "fetch", "--quiet", "--depth", "1", c.repo, ref); err != nil {
+		return "", err
+	}
+
+	if _, err := c.git(ctx, "checkout", "--quiet", "--force", "--detach", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+
+	return c.git(ctx, "rev-parse", "HEAD")
+}
+
+func (c *CuratedImages) git(ctx context.Context, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", c.dir}, args...)...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if i := strings.IndexByte(msg, '\n'); i >= 0 {
+			msg = msg[:i]
+		}
+		return "", fmt.Errorf("git %s failed: %s: %s", args[0], err, msg)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// parseCuratedImages reads the image definitions from a checkout of
+// the repository. Hidden files and directories are ignored.
+func parseCuratedImages(root string) (map[string]api.ImageSpec, error) {
+	images := make(map[string]api.ImageSpec)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(info.Name(), ".") && path != root {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		name := strings.TrimSuffix(filepath.ToSlash(rel), ".json")
+		if !curatedNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid curated image name %q (defined in %s)", name, rel)
+		}
+
+		j, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		// Unknown fields are rejected, as they are most likely
+		// misspelled settings that would otherwise be ignored.
+		var spec api.ImageSpec
+		dec := json.NewDecoder(bytes.NewReader(j))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&spec); err != nil {
+			return fmt.Errorf("invalid definition of curated image %q: %w", name, err)
+		}
+
+		if err := validateCuratedSpec(&spec); err != nil {
+			return fmt.Errorf("invalid definition of curated image %q: %w", name, err)
+		}
+
+		images[name] = spec
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// validateCuratedSpec rejects definitions that could never be built,
+// so that they fail the sync instead of every pull.
+func validateCuratedSpec(spec *api.ImageSpec) error {
+	if len(spec.Packages) == 0 {
+		return fmt.Errorf("at least one package must be specified")
+	}
+
+	for _, p := range spec.Packages {
+		if p == "" || strings.Contains(p, "/") {
+			return fmt.Errorf("invalid package name: %q", p)
+		}
+	}
+
+	switch spec.Arch {
+	case "", "amd64", "arm64":
+	default:
+		return fmt.Errorf("unsupported architecture: %q", spec.Arch)
+	}
+
+	return nil
+}
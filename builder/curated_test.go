@@ -0,0 +1,66 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nixery/api"
+)
+
+func writeDefinition(t *testing.T, root, name, contents string) {
+	path := filepath.Join(root, name)
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseCuratedImages(t *testing.T) {
+	root, err := ioutil.TempDir("", "nixery-curated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	writeDefinition(t, root, "python.json", `{"packages": ["shell", "python3"]}`)
+	writeDefinition(t, root, "data/notebook.json", `{"packages": ["jupyter"], "cmd": ["jupyter", "lab"]}`)
+	writeDefinition(t, root, "README.md", "# Curated images")
+	writeDefinition(t, root, ".github/ci.json", `{}`)
+
+	images, err := parseCuratedImages(root)
+	if err != nil {
+		t.Fatalf("failed to parse definitions: %s", err)
+	}
+
+	expected := map[string]api.ImageSpec{
+		"python":        {Packages: []string{"shell", "python3"}},
+		"data/notebook": {Packages: []string{"jupyter"}, Cmd: []string{"jupyter", "lab"}},
+	}
+	if diff := cmp.Diff(expected, images); diff != "" {
+		t.Errorf("unexpected curated images (-want +got):\n%s", diff)
+	}
+
+	for name, definition := range map[string]string{
+		"Python.json":    `{"packages": ["python3"]}`,
+		"empty.json":     `{"packages": []}`,
+		"typo.json":      `{"packages": ["git"], "enviroment": ["A=1"]}`,
+		"riscv.json":     `{"packages": ["git"], "arch": "riscv64"}`,
+		"slashes.json":   `{"packages": ["git/curl"]}`,
+		"malformed.json": `{"packages": [`,
+	} {
+		dir, err := ioutil.TempDir(root, "invalid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeDefinition(t, dir, name, definition)
+
+		if _, err := parseCuratedImages(dir); err == nil {
+			t.Errorf("invalid definition %s was accepted", name)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements drift detection, which compares the closure of
+// a previously built image with that of the same spec built from the
+// current package set. Teams use it to decide whether deployments
+// should be rolled to pick up (e.g. security) updates.
+//
+// Closures are compared through the contents records of both images,
+// so images without a contents record can not be compared.
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/storage"
+)
+
+// ErrContentsUnknown is returned for images without a contents record.
+var ErrContentsUnknown = errors.New("no contents are known for this image")
+
+// ClosureDrift compares the contents of the image with the given
+// digest to those of the current image built from the same spec.
+func ClosureDrift(ctx context.Context, s *State, digest, current string) (*api.DriftReport, error) {
+	var closures [2][]string
+	for i, d := range []string{digest, current} {
+		contents, err := ImageContents(ctx, s, d)
+		if storage.IsNotExist(err) {
+			return nil, ErrContentsUnknown
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		closures[i] = contents.StorePaths
+	}
+
+	report := api.DriftReport{
+		Digest:  digest,
+		Current: current,
+	}
+	report.Added, report.Removed, report.Changed = diffClosures(closures[0], closures[1])
+	report.Drifted = len(report.Added)+len(report.Removed)+len(report.Changed) > 0
+
+	return &report, nil
+}
+
+// diffClosures compares two closures. Store paths that are only present
+// in one of them are paired by package name, so that updated packages
+// are reported as changes.
+func diffClosures(from, to []string) ([]string, []string, []api.PathChange) {
+	present := make(map[string]bool, len(from))
+	for _, p := range from {
+		present[p] = true
+	}
+
+	removed := make(map[string][]string)
+	added := make(map[string][]string)
+	for _, p := range to {
+		if present[p] {
+			delete(present, p)
+			continue
+		}
+		pkg := storePathPackage(p)
+		added[pkg] = append(added[pkg], p)
+	}
+	for _, p := range from {
+		if present[p] {
+			pkg := storePathPackage(p)
+			removed[pkg] = append(removed[pkg], p)
+		}
+	}
+
+	addedPaths, removedPaths, changed := []string{}, []string{}, []api.PathChange{}
+	for pkg, paths := range added {
+		old := removed[pkg]
+		sort.Strings(paths)
+		sort.Strings(old)
+
+		for i, p := range paths {
+			if i < len(old) {
+				changed = append(changed, api.PathChange{Package: pkg, From: old[i], To: p})
+			} else {
+				addedPaths = append(addedPaths, p)
+			}
+		}
+
+		if len(old) > len(paths) {
+			removedPaths = append(removedPaths, old[len(paths):]...)
+		}
+		delete(removed, pkg)
+	}
+	for _, paths := range removed {
+		removedPaths = append(removedPaths, paths...)
+	}
+
+	sort.Strings(addedPaths)
+	sort.Strings(removedPaths)
+	sort.Slice(changed, func(i, j int) bool { return changed[i].From < changed[j].From })
+
+	return addedPaths, removedPaths, changed
+}
+
+// storePathPackage returns the package name of a store path, without
+// its version but with its output, e.g. `openssl-bin` for
+// `/nix/store/...-openssl-3.0.13-bin`.
+//
+// Like Nix, the version is assumed to start at the first dash that
+// is not followed by a letter.
+func storePathPackage(p string) string {
+	parts := strings.SplitN(path.Base(p), "-", 2)
+	if len(parts) < 2 {
+		return parts[0]
+	}
+
+	components := strings.Split(parts[1], "-")
+	for i := 1; i < len(components); i++ {
+		c := components[i]
+		if c == "" || unicode.IsLetter(rune(c[0])) {
+			continue
+		}
+
+		pkg := strings.Join(components[:i], "-")
+		if last := components[len(components)-1]; len(components)-1 > i && isOutputName(last) {
+			pkg += "-" + last
+		}
+		return pkg
+	}
+
+	return parts[1]
+}
+
+// isOutputName reports whether the last component of a store path
+// names a derivation output (e.g. `bin` or `dev`), which consists of
+// letters only.
+func isOutputName(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/storage"
+)
+
+func TestStorePathPackage(t *testing.T) {
+	for p, expected := range map[string]string{
+		"/nix/store/4ahr-git-2.44.0":                  "git",
+		"/nix/store/9x0p-glibc-2.39-5":                "glibc",
+		"/nix/store/a1b2-openssl-3.0.13-bin":          "openssl-bin",
+		"/nix/store/c3d4-python3.11-requests-2.31.0":  "python3.11-requests",
+		"/nix/store/e5f6-nixery-layer-tarball-source": "nixery-layer-tarball-source",
+	} {
+		if pkg := storePathPackage(p); pkg != expected {
+			t.Errorf("expected package %q for %s, got %q", expected, p, pkg)
+		}
+	}
+}
+
+func TestDiffClosures(t *testing.T) {
+	from := []string{
+		"/nix/store/aaaa-bash-5.2",
+		"/nix/store/bbbb-openssl-3.0.12",
+		"/nix/store/cccc-openssl-3.0.12-bin",
+		"/nix/store/dddd-zlib-1.3",
+	}
+	to := []string{
+		"/nix/store/aaaa-bash-5.2",
+		"/nix/store/eeee-openssl-3.0.13",
+		"/nix/store/ffff-openssl-3.0.13-bin",
+		"/nix/store/gggg-curl-8.6.0",
+	}
+
+	added, removed, changed := diffClosures(from, to)
+	if !reflect.DeepEqual(added, []string{"/nix/store/gggg-curl-8.6.0"}) {
+		t.Errorf("unexpected added paths %v", added)
+	}
+	if !reflect.DeepEqual(removed, []string{"/nix/store/dddd-zlib-1.3"}) {
+		t.Errorf("unexpected removed paths %v", removed)
+	}
+
+	expected := []api.PathChange{
+		{Package: "openssl", From: "/nix/store/bbbb-openssl-3.0.12", To: "/nix/store/eeee-openssl-3.0.13"},
+		{Package: "openssl-bin", From: "/nix/store/cccc-openssl-3.0.12-bin", To: "/nix/store/ffff-openssl-3.0.13-bin"},
+	}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("unexpected changes %+v", changed)
+	}
+
+	if added, removed, changed := diffClosures(from, from); len(added)+len(removed)+len(changed) != 0 {
+		t.Errorf("identical closures differ: %v %v %v", added, removed, changed)
+	}
+}
+
+func TestClosureDrift(t *testing.T) {
+	ctx := context.Background()
+	s := &State{Storage: storage.NewMemoryBackend()}
+
+	old := "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	current := "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	recordContents(ctx, s, old, []string{"/nix/store/aaaa-bash-5.2"})
+
+	if _, err := ClosureDrift(ctx, s, old, current); !errors.Is(err, ErrContentsUnknown) {
+		t.Errorf("expected unknown contents to be reported, got %v", err)
+	}
+
+	recordContents(ctx, s, current, []string{"/nix/store/bbbb-bash-5.2"})
+	report, err := ClosureDrift(ctx, s, old, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !report.Drifted || len(report.Changed) != 1 || report.Changed[0].Package != "bash" {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	report, _ = ClosureDrift(ctx, s, old, old)
+	if report.Drifted {
+		t.Errorf("image drifted from itself: %+v", report)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the handling of conflicting packages in image
+// names, i.e. several versions of the same package (such as
+// `python39/python311`), which would otherwise silently produce images
+// with colliding symlinks in `/bin`.
+//
+// Conflicts are detected by stripping version suffixes from package
+// names (`python311` -> `python`, `go_1_22` -> `go`), and are handled
+// according to the configured policy. Packages that are requested more
+// than once are always deduplicated.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/nixery/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// DuplicatesAnnotation records how conflicting packages of an image
+// were resolved.
+const DuplicatesAnnotation = "dev.nixery.duplicates"
+
+// ErrConflictingPackages is returned for images requesting conflicting
+// packages if such images are rejected.
+var ErrConflictingPackages = errors.New("conflicting packages requested")
+
+var versionedName = regexp.MustCompile(`^([a-zA-Z][a-zA-Z-]*?)[_-]?(\d+(?:[_.]\d+)*)$`)
+
+// conflict describes the versions of a package requested for an image,
+// and which of them are included.
+type conflict struct {
+	Kept    []string `json:"kept"`
+	Dropped []string `json:"dropped,omitempty"`
+}
+
+// packageVersion splits a package name into its base name and the
+// components of its version suffix, if any.
+func packageVersion(pkg string) (string, []int) {
+	m := versionedName.FindStringSubmatch(pkg)
+	if m == nil {
+		return pkg, nil
+	}
+
+	var version []int
+	for _, c := range strings.FieldsFunc(m[2], func(r rune) bool { return r == '_' || r == '.' }) {
+		n, _ := strconv.Atoi(c)
+		version = append(version, n)
+	}
+
+	return m[1], version
+}
+
+// newer reports whether version a is newer than version b. Unversioned
+// packages are considered older than all versioned ones.
+func newer(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+
+	return len(a) > len(b)
+}
+
+// resolveDuplicates deduplicates the packages of an image and applies
+// the duplicate policy to conflicting packages.
+func resolveDuplicates(policy config.DuplicatePolicy, image *Image) error {
+	seen := make(map[string]bool)
+	bases := make(map[string][]string)
+	var pkgs []string
+
+	for _, p := range image.Packages {
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		pkgs = append(pkgs, p)
+
+		base, _ := packageVersion(p)
+		bases[base] = append(bases[base], p)
+	}
+	image.Packages = pkgs
+
+	conflicts := make(map[string]conflict)
+	for base, versions := range bases {
+		if len(versions) > 1 {
+			conflicts[base] = conflict{Kept: versions}
+		}
+	}
+
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	var names []string
+	for base := range conflicts {
+		names = append(names, strings.Join(conflicts[base].Kept, ", "))
+	}
+	sort.Strings(names)
+
+	switch policy {
+	case config.DuplicatesError:
+		return fmt.Errorf("%w: %s", ErrConflictingPackages, strings.Join(names, "; "))
+
+	case config.DuplicatesPreferLatest:
+		dropped := make(map[string]bool)
+		for base, c := range conflicts {
+			latest := c.Kept[0]
+			for _, p := range c.Kept[1:] {
+				_, v := packageVersion(p)
+				if _, l := packageVersion(latest); newer(v, l) {
+					latest = p
+				}
+			}
+
+			var drop []string
+			for _, p := range c.Kept {
+				if p != latest {
+					drop = append(drop, p)
+					dropped[p] = true
+				}
+			}
+			conflicts[base] = conflict{Kept: []string{latest}, Dropped: drop}
+		}
+
+		pkgs = nil
+		for _, p := range image.Packages {
+			if !dropped[p] {
+				pkgs = append(pkgs, p)
+			}
+		}
+		image.Packages = pkgs
+	}
+
+	log.WithFields(log.Fields{
+		"image":     image.Name,
+		"policy":    policy,
+		"conflicts": names,
+	}).Warn("image requests conflicting packages")
+
+	// The annotations may be shared with the caller, so a copy is
+	// modified.
+	annotations := make(map[string]string)
+	for k, v := range image.Annotations {
+		annotations[k] = v
+	}
+
+	j, _ := json.Marshal(conflicts)
+	annotations[DuplicatesAnnotation] = string(j)
+	image.Annotations = annotations
+
+	return nil
+}
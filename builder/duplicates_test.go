@@ -0,0 +1,45 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/nixery/config"
+)
+
+func TestResolveDuplicates(t *testing.T) {
+	image := func() *Image {
+		return &Image{Packages: []string{"git", "go_1_21", "go_1_22", "python311", "python39", "git", "x264"}}
+	}
+
+	i := image()
+	if err := resolveDuplicates(config.DuplicatesKeepBoth, i); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(i.Packages, []string{"git", "go_1_21", "go_1_22", "python311", "python39", "x264"}) {
+		t.Errorf("unexpected packages: %v", i.Packages)
+	}
+	if i.Annotations[DuplicatesAnnotation] == "" {
+		t.Errorf("expected conflicts to be annotated")
+	}
+
+	i = image()
+	if err := resolveDuplicates(config.DuplicatesPreferLatest, i); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(i.Packages, []string{"git", "go_1_22", "python311", "x264"}) {
+		t.Errorf("unexpected packages: %v", i.Packages)
+	}
+
+	if err := resolveDuplicates(config.DuplicatesError, image()); !errors.Is(err, ErrConflictingPackages) {
+		t.Errorf("expected conflict to be rejected, got %v", err)
+	}
+
+	i = &Image{Packages: []string{"git", "git", "curl"}}
+	if err := resolveDuplicates(config.DuplicatesError, i); err != nil || len(i.Annotations) != 0 {
+		t.Errorf("expected repeated packages to be deduplicated silently, got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the detection of builds that require emulation,
+// i.e. images for an architecture other than the host's. Nix can only
+// build such images if their store paths are substituted from a binary
+// cache, if remote builders are configured, or through qemu registered
+// with binfmt_misc, which is 10-50x slower than native builds.
+//
+// Images built for foreign architectures are annotated, and operators
+// can disable such builds entirely to fail fast instead of occupying
+// the instance for a long time.
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// EmulationAnnotation records the system of the host that built an
+// image for a foreign architecture.
+const EmulationAnnotation = "dev.nixery.emulated-on"
+
+// ErrEmulationDisabled is returned for builds that would require
+// emulation if emulated builds are disabled.
+var ErrEmulationDisabled = errors.New("emulated builds are disabled")
+
+// hostArch is the architecture of the host, if it is supported.
+var hostArch = map[string]*Architecture{
+	"amd64": &amd64,
+	"arm64": &arm64,
+}[runtime.GOARCH]
+
+// requiresEmulation reports whether building for an architecture
+// requires emulation on this host.
+func requiresEmulation(arch *Architecture) bool {
+	return hostArch != nil && arch != nil && *arch != *hostArch
+}
+
+// binfmtRegistered reports whether an emulator for an architecture is
+// registered with binfmt_misc, either under the name used by qemu's
+// scripts or by NixOS.
+func binfmtRegistered(arch *Architecture) bool {
+	entries, err := ioutil.ReadDir("/proc/sys/fs/binfmt_misc")
+	if err != nil {
+		return false
+	}
+
+	cpu := strings.TrimSuffix(arch.nixSystem, "-linux")
+	for _, e := range entries {
+		if e.Name() == "qemu-"+cpu || e.Name() == arch.nixSystem {
+			return true
+		}
+	}
+
+	return false
+}
+
+// emulated reports whether images for an architecture are built
+// through emulation, which is not the case for architectures built by
+// a remote builder pool.
+func emulated(s *State, arch *Architecture) bool {
+	return requiresEmulation(arch) && s.Pools.pool(arch) == nil
+}
+
+// checkEmulation rejects builds that require emulation if emulated
+// builds are disabled.
+func checkEmulation(s *State, image *Image) error {
+	if !emulated(s, image.Arch) || !s.Cfg.DisableEmulation {
+		return nil
+	}
+
+	return fmt.Errorf("%w: building %s images on this %s instance would require emulation, use an instance running on %s instead",
+		ErrEmulationDisabled, image.Arch.imageArch, hostArch.imageArch, image.Arch.imageArch)
+}
+
+// LogEmulation logs which foreign architectures can be built on this
+// host, for use on startup.
+func LogEmulation(disabled bool) {
+	if hostArch == nil {
+		return
+	}
+
+	for _, arch := range []*Architecture{&amd64, &arm64} {
+		if !requiresEmulation(arch) {
+			continue
+		}
+
+		entry := log.WithFields(log.Fields{
+			"host":   hostArch.imageArch,
+			"arch":   arch.imageArch,
+			"binfmt": binfmtRegistered(arch),
+		})
+
+		if disabled {
+			entry.Info("emulated builds are disabled, only cached images are served for this architecture")
+		} else {
+			entry.Info("images for this architecture are built with emulation unless all store paths are substituted")
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/nixery/encryption"
+	"github.com/google/nixery/manifest"
+	log "github.com/sirupsen/logrus"
+)
+
+// recipientsFor returns the encryption recipients configured for a
+// tenant, falling back to the default recipients for requests without
+// a tenant.
+func recipientsFor(s *State, tenant string) ([]*rsa.PublicKey, error) {
+	if tenant == "" {
+		tenant = "default"
+	}
+
+	recipients := s.Recipients[tenant]
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no encryption recipients configured for tenant %q", tenant)
+	}
+
+	return recipients, nil
+}
+
+// encryptLayers creates encrypted copies of the (already persisted)
+// layers of an image and returns the entries for the encrypted layers.
+//
+// Encrypted layers use a new random key on every build and are thus
+// never shared between images.
+func encryptLayers(ctx context.Context, s *State, image *Image, entries []manifest.Entry) ([]manifest.Entry, error) {
+	recipients, err := recipientsFor(s, image.Tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	var encrypted []manifest.Entry
+	for _, plain := range entries {
+		var annotations map[string]string
+		lw := func(w io.Writer) error {
+			r, err := s.Storage.Fetch(ctx, "layers/"+strings.TrimPrefix(plain.Digest, "sha256:"))
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+
+			ew, err := encryption.NewWriter(w)
+			if err != nil {
+				return err
+			}
+
+			if _, err = io.Copy(ew, r); err != nil {
+				return err
+			}
+
+			annotations, err = ew.Annotations(plain.Digest, recipients)
+			return err
+		}
+
+		// Concurrent builds of the same layer must not share a
+		// staging location, as their output differs.
+		suffix := make([]byte, 8)
+		rand.Read(suffix)
+		key := fmt.Sprintf("%s-%x", strings.TrimPrefix(plain.Digest, "sha256:"), suffix)
+
+		entry, err := uploadHashLayer(ctx, s, key, lw)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"image": image.Name,
+				"layer": plain.Digest,
+			}).Error("failed to encrypt layer")
+
+			return nil, err
+		}
+
+		entry.MediaType = encryption.LayerType
+		entry.Annotations = annotations
+		entry.TarHash = plain.TarHash
+		entry.MergeRating = plain.MergeRating
+		entry.Nondistributable = plain.Nondistributable
+		encrypted = append(encrypted, *entry)
+	}
+
+	log.WithFields(log.Fields{
+		"image":      image.Name,
+		"tenant":     image.Tenant,
+		"layers":     len(encrypted),
+		"recipients": len(recipients),
+	}).Info("encrypted image layers")
+
+	return encrypted, nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the memory ceiling of evaluations. Evaluating a
+// large package set can use more memory than the container of Nixery
+// has, in which case the kernel would kill the whole container instead
+// of failing the one build.
+//
+// Each evaluation is run in its own cgroup (v2) below the cgroup
+// delegated to Nixery, whose memory is limited. Once the evaluation
+// has finished, the memory events of its cgroup tell whether it was
+// killed for exceeding the limit, which is reported to the client as
+// an error instead of a generic build failure.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrEvalOutOfMemory is returned if the evaluation of an image was
+// killed for exceeding its memory limit.
+var ErrEvalOutOfMemory = errors.New("package set too large to evaluate")
+
+// EvalCgroups creates the cgroups limiting the memory of evaluations.
+//
+// A nil *EvalCgroups is valid and does not limit evaluations.
+type EvalCgroups struct {
+	parent string
+	memory int
+	next   uint64
+}
+
+// NewEvalCgroups limits evaluations to the given memory (in MiB) in
+// cgroups below the given parent, or returns nil if the memory is 0.
+// The memory controller is enabled for children of the parent if it
+// is not already.
+func NewEvalCgroups(parent string, memory int) (*EvalCgroups, error) {
+	if memory == 0 {
+		return nil, nil
+	}
+
+	control := filepath.Join(parent, "cgroup.subtree_control")
+	controllers, err := ioutil.ReadFile(control)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a cgroup (v2): %w", parent, err)
+	}
+
+	if !hasField(controllers, "memory") {
+		if err := ioutil.WriteFile(control, []byte("+memory"), 0644); err != nil {
+			return nil, fmt.Errorf("failed to enable memory controller in %s: %w", parent, err)
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"cgroup":     parent,
+		"memory_mib": memory,
+	}).Info("limiting memory of evaluations")
+
+	return &EvalCgroups{
+		parent: parent,
+		memory: memory,
+	}, nil
+}
+
+func hasField(b []byte, field string) bool {
+	for _, f := range strings.Fields(string(b)) {
+		if f == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// create creates the cgroup of a single evaluation and returns its
+// path, which is empty if evaluations are not limited.
+func (c *EvalCgroups) create() (string, error) {
+	if c == nil {
+		return "", nil
+	}
+
+	dir := filepath.Join(c.parent, fmt.Sprintf("eval-%d-%d", os.Getpid(), atomic.AddUint64(&c.next, 1)))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create evaluation cgroup: %w", err)
+	}
+
+	limit := strconv.FormatInt(int64(c.memory)<<20, 10)
+	if err := ioutil.WriteFile(filepath.Join(dir, "memory.max"), []byte(limit), 0644); err != nil {
+		os.Remove(dir)
+		return "", fmt.Errorf("failed to limit memory of evaluation cgroup: %w", err)
+	}
+
+	// Without swap accounting, the evaluation is only limited by
+	// memory.max.
+	ioutil.WriteFile(filepath.Join(dir, "memory.swap.max"), []byte("0"), 0644)
+
+	return dir, nil
+}
+
+// release removes the cgroup of a finished evaluation, and returns an
+// error wrapping ErrEvalOutOfMemory if it was killed for exceeding the
+// limit.
+func (c *EvalCgroups) release(dir string, image *Image) error {
+	if dir == "" {
+		return nil
+	}
+
+	events, _ := ioutil.ReadFile(filepath.Join(dir, "memory.events"))
+	if err := os.Remove(dir); err != nil {
+		log.WithError(err).WithField("cgroup", dir).Warn("failed to remove evaluation cgroup")
+	}
+
+	if oomKills(events) == 0 {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"image":      image.Name,
+		"tag":        image.Tag,
+		"packages":   len(image.Packages),
+		"memory_mib": c.memory,
+	}).Warn("evaluation exceeded its memory limit")
+
+	return fmt.Errorf("%w: evaluating %d packages exceeded the memory limit of %d MiB, try splitting the image into several smaller images",
+		ErrEvalOutOfMemory, len(image.Packages), c.memory)
+}
+
+// oomKills returns the number of processes killed by the OOM killer
+// according to the contents of a memory.events file.
+func oomKills(events []byte) int {
+	scanner := bufio.NewScanner(bytes.NewReader(events))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+
+	return 0
+}
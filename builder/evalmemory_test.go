@@ -0,0 +1,46 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestOOMKills(t *testing.T) {
+	events := []byte("low 0\nhigh 0\nmax 12\noom 3\noom_kill 2\noom_group_kill 0\n")
+	if n := oomKills(events); n != 2 {
+		t.Errorf("expected 2 OOM kills, got %d", n)
+	}
+
+	if n := oomKills(nil); n != 0 {
+		t.Errorf("expected no OOM kills without events, got %d", n)
+	}
+}
+
+func TestEvalCgroupRelease(t *testing.T) {
+	c := &EvalCgroups{parent: t.TempDir(), memory: 512}
+	image := ImageFromName("shell/git", "latest")
+
+	dir, err := c.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limit, _ := ioutil.ReadFile(filepath.Join(dir, "memory.max"))
+	if string(limit) != "536870912" {
+		t.Errorf("unexpected memory limit: %q", limit)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "memory.events"), []byte("oom 1\noom_kill 1\n"), 0644)
+	if err := c.release(dir, &image); !errors.Is(err, ErrEvalOutOfMemory) {
+		t.Errorf("expected out of memory error, got %v", err)
+	}
+
+	var disabled *EvalCgroups
+	if dir, err := disabled.create(); dir != "" || err != nil {
+		t.Errorf("disabled cgroups created %q (%v)", dir, err)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements image lifetimes, which let requests (e.g. of CI
+// jobs) mark images as throwaway. The lifetime is recorded as an
+// annotation of the manifest, and the reference record of the manifest
+// expires after it, at which point garbage collection no longer
+// considers the image's blobs referenced by it.
+//
+// Images with a lifetime are not cached, as cached manifests are
+// garbage collection roots and would keep their blobs alive forever.
+// Pulling such an image again builds it again (reusing its cached
+// layers) and extends its lifetime.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/nixery/api"
+)
+
+// MaxTTL is the longest lifetime that can be requested for an image.
+const MaxTTL = 365 * 24 * time.Hour
+
+// ParseTTL parses the lifetime of an image, which is a duration that
+// may additionally be given in days (e.g. `7d`).
+func ParseTTL(s string) (time.Duration, error) {
+	var ttl time.Duration
+	var err error
+
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		var n int
+		n, err = strconv.Atoi(days)
+		ttl = time.Duration(n) * 24 * time.Hour
+	} else {
+		ttl, err = time.ParseDuration(s)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid lifetime %q", s)
+	}
+
+	if ttl <= 0 || ttl > MaxTTL {
+		return 0, fmt.Errorf("lifetime must be positive and at most %d days", MaxTTL/(24*time.Hour))
+	}
+
+	return ttl, nil
+}
+
+// SetTTL records the lifetime of an image in its annotations.
+func SetTTL(image *Image, ttl time.Duration) {
+	annotations := map[string]string{
+		api.TTLAnnotation: ttl.String(),
+	}
+	for k, v := range image.Annotations {
+		annotations[k] = v
+	}
+	image.Annotations = annotations
+}
+
+// hasTTL reports whether an image has a lifetime.
+func hasTTL(image *Image) bool {
+	_, ok := image.Annotations[api.TTLAnnotation]
+	return ok
+}
@@ -0,0 +1,44 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTTL(t *testing.T) {
+	valid := map[string]time.Duration{
+		"7d":  7 * 24 * time.Hour,
+		"12h": 12 * time.Hour,
+		"90m": 90 * time.Minute,
+	}
+
+	for s, expected := range valid {
+		ttl, err := ParseTTL(s)
+		if err != nil {
+			t.Errorf("%q was rejected: %s", s, err)
+		} else if ttl != expected {
+			t.Errorf("%q parsed as %s, expected %s", s, ttl, expected)
+		}
+	}
+
+	for _, s := range []string{"", "d", "-1d", "0h", "7w", "366d"} {
+		if _, err := ParseTTL(s); err == nil {
+			t.Errorf("%q was accepted", s)
+		}
+	}
+}
+
+func TestTTLImagesAreNotCached(t *testing.T) {
+	image := ImageFromName("hello", "latest")
+	SetTTL(&image, time.Hour)
+
+	if !hasTTL(&image) {
+		t.Fatal("lifetime was not recorded")
+	}
+
+	if key := imageCacheKey(&State{}, &image); key != "" {
+		t.Errorf("image with a lifetime has cache key %q", key)
+	}
+}
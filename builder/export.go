@@ -0,0 +1,295 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the export of the cache into a static registry
+// mirror: a directory that any HTTP server (or a bucket configured for
+// website hosting) can serve as a read-only registry, e.g. at edge
+// sites that have no compute to run Nixery.
+//
+// The export is an OCI image layout containing all cached images, with
+// the registry routes of the images named when exporting added to it:
+//
+// * `blobs/sha256/<hex>`: manifests, configuration and layers
+// * `index.json`: all exported manifests, named images annotated with their name
+// * `v2/<name>/manifests/<tag>` and `v2/<name>/manifests/sha256:<hex>`
+// * `v2/<name>/blobs/sha256:<hex>`, hard links to the files in `blobs/`
+//
+// Cache entries do not record the names of the images they belong to,
+// so registry routes can only be written for images named explicitly.
+// Images of tenants are never exported.
+//
+// Exports are incremental, blobs that already exist in the directory
+// are not copied again.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// Annotation of the OCI image layout naming an image in its index.
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// MirrorTag is a named image whose registry routes are exported.
+type MirrorTag struct {
+	Name     string
+	Tag      string
+	Manifest json.RawMessage
+}
+
+// MirrorReport summarises an export.
+type MirrorReport struct {
+	Manifests int   // Number of exported manifests
+	Tags      int   // Number of exported image names
+	Copied    int   // Number of blobs copied from the storage backend
+	Existing  int   // Number of blobs that were already exported
+	Bytes     int64 // Size of the copied blobs
+}
+
+type mirrorExport struct {
+	s      *State
+	dir    string
+	report MirrorReport
+
+	// Manifests in the index, by digest
+	exported map[string]bool
+	index    []manifest.Entry
+}
+
+// ExportMirror exports all cached images and the given named images
+// into a static registry mirror in the given directory.
+func ExportMirror(ctx context.Context, s *State, dir string, tags []MirrorTag) (MirrorReport, error) {
+	e := mirrorExport{
+		s:        s,
+		dir:      dir,
+		exported: make(map[string]bool),
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return e.report, err
+	}
+
+	cached, err := storage.ListWithMetadata(ctx, s.Storage, "manifests/")
+	if err != nil {
+		return e.report, fmt.Errorf("failed to list cached manifests: %w", err)
+	}
+
+	for _, obj := range cached {
+		if obj.Metadata[storage.MetadataTenant] != "" {
+			continue
+		}
+
+		key := strings.TrimPrefix(obj.Path, "manifests/")
+		m, err := fetchObject(ctx, s.Storage, obj.Path)
+		if err != nil {
+			return e.report, fmt.Errorf("failed to fetch cached manifest %s: %w", key, err)
+		}
+
+		if _, err := e.manifest(ctx, m, ""); err != nil {
+			return e.report, fmt.Errorf("failed to export cached manifest %s: %w", key, err)
+		}
+	}
+
+	for _, t := range tags {
+		if err := e.tag(ctx, t); err != nil {
+			return e.report, fmt.Errorf("failed to export %s:%s: %w", t.Name, t.Tag, err)
+		}
+	}
+
+	// The index is written last, so that it only lists manifests
+	// whose blobs are complete.
+	if err := writeMirrorData(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return e.report, err
+	}
+	if err := writeMirrorData(filepath.Join(dir, "index.json"), manifest.Index(e.index)); err != nil {
+		return e.report, err
+	}
+
+	log.WithFields(log.Fields{
+		"directory": dir,
+		"manifests": e.report.Manifests,
+		"tags":      e.report.Tags,
+		"copied":    e.report.Copied,
+		"existing":  e.report.Existing,
+		"bytes":     e.report.Bytes,
+	}).Info("exported registry mirror")
+
+	return e.report, nil
+}
+
+// manifest exports a manifest and all blobs it references, and adds it
+// to the index under the given name (if any). It returns the digests
+// of the manifest's blobs.
+func (e *mirrorExport) manifest(ctx context.Context, m json.RawMessage, name string) ([]string, error) {
+	refs, err := manifest.References(m)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := manifest.Descriptor(m)
+	if !e.exported[desc.Digest] {
+		for _, ref := range refs {
+			if err := e.blob(ctx, ref); err != nil {
+				return nil, fmt.Errorf("failed to export blob %s: %w", ref, err)
+			}
+		}
+
+		if _, err := os.Stat(e.blobPath(desc.Digest)); err != nil {
+			if err := writeMirrorData(e.blobPath(desc.Digest), m); err != nil {
+				return nil, err
+			}
+		}
+
+		e.exported[desc.Digest] = true
+		e.report.Manifests++
+
+		// Named manifests are listed with their name instead.
+		if name == "" {
+			e.index = append(e.index, desc)
+		}
+	}
+
+	if name != "" {
+		desc.Annotations = map[string]string{refNameAnnotation: name}
+		e.index = append(e.index, desc)
+	}
+
+	return refs, nil
+}
+
+// tag exports a named image and adds its registry routes.
+func (e *mirrorExport) tag(ctx context.Context, t MirrorTag) error {
+	refs, err := e.manifest(ctx, t.Manifest, t.Name+":"+t.Tag)
+	if err != nil {
+		return err
+	}
+
+	digest := manifest.Descriptor(t.Manifest).Digest
+	repo := filepath.Join(e.dir, "v2", filepath.FromSlash(t.Name))
+
+	links := map[string]string{
+		filepath.Join(repo, "manifests", t.Tag):  digest,
+		filepath.Join(repo, "manifests", digest): digest,
+	}
+	for _, ref := range refs {
+		links[filepath.Join(repo, "blobs", ref)] = ref
+	}
+
+	for path, digest := range links {
+		if err := e.link(digest, path); err != nil {
+			return err
+		}
+	}
+
+	e.report.Tags++
+	return nil
+}
+
+func (e *mirrorExport) blobPath(digest string) string {
+	return filepath.Join(e.dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// blob copies a blob from the storage backend, unless it was already
+// exported. Its digest is verified while copying.
+func (e *mirrorExport) blob(ctx context.Context, digest string) error {
+	path := e.blobPath(digest)
+	if _, err := os.Stat(path); err == nil {
+		e.report.Existing++
+		return nil
+	}
+
+	r, err := e.s.Storage.Fetch(ctx, "layers/"+strings.TrimPrefix(digest, "sha256:"))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var size int64
+	err = writeMirrorFile(path, func(w io.Writer) error {
+		h := sha256.New()
+		size, err = io.Copy(io.MultiWriter(w, h), r)
+		if err != nil {
+			return err
+		}
+
+		if actual := fmt.Sprintf("sha256:%x", h.Sum(nil)); actual != digest {
+			return fmt.Errorf("blob has digest %s", actual)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	e.report.Copied++
+	e.report.Bytes += size
+	return nil
+}
+
+// link makes an exported blob available at a registry route. Routes
+// are hard links, so that blobs are only stored once and can be served
+// without following symlinks.
+func (e *mirrorExport) link(digest, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	blob, err := os.Stat(e.blobPath(digest))
+	if err != nil {
+		return err
+	}
+	if existing, err := os.Stat(path); err == nil && os.SameFile(blob, existing) {
+		return nil
+	}
+
+	// Tags may point to another manifest than in a previous export.
+	tmp := filepath.Join(filepath.Dir(path), ".link-"+filepath.Base(path))
+	os.Remove(tmp)
+	if err := os.Link(e.blobPath(digest), tmp); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func writeMirrorData(path string, data []byte) error {
+	return writeMirrorFile(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeMirrorFile atomically replaces a file of the export with the
+// data written by the given function.
+func writeMirrorFile(path string, write func(io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".export-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
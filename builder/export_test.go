@@ -0,0 +1,80 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/nixery/storage"
+)
+
+func persistBlob(t *testing.T, ctx context.Context, s *State, data string) string {
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+	_, _, err := s.Storage.Persist(ctx, "layers/"+sum, "", func(w io.Writer) (string, int64, error) {
+		n, err := io.WriteString(w, data)
+		return sum, int64(n), err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return "sha256:" + sum
+}
+
+func TestExportMirror(t *testing.T) {
+	s := newTestState(t)
+
+	ctx := context.Background()
+
+	config := persistBlob(t, ctx, s, "{}")
+	layer := persistBlob(t, ctx, s, "layer")
+	m := json.RawMessage(fmt.Sprintf(`{"schemaVersion":2,"config":{"digest":%q},"layers":[{"digest":%q}]}`, config, layer))
+	cacheManifest(ctx, s, "public", m)
+
+	tenant := json.RawMessage(`{"schemaVersion":2,"config":{"digest":"sha256:0000"}}`)
+	cacheManifest(storage.WithMetadata(ctx, storage.Metadata{storage.MetadataTenant: "acme"}), s, "private", tenant)
+
+	dir := t.TempDir()
+	report, err := ExportMirror(ctx, s, dir, []MirrorTag{{Name: "shell/git", Tag: "latest", Manifest: m}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Manifests != 1 || report.Tags != 1 || report.Copied != 2 {
+		t.Errorf("unexpected export report: %+v", report)
+	}
+
+	tagged, err := ioutil.ReadFile(filepath.Join(dir, "v2", "shell", "git", "manifests", "latest"))
+	if err != nil || string(tagged) != string(m) {
+		t.Errorf("tagged manifest was not exported: %v", err)
+	}
+
+	for _, digest := range []string{config, layer} {
+		route, err := os.Stat(filepath.Join(dir, "v2", "shell", "git", "blobs", digest))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		blob, err := os.Stat(filepath.Join(dir, "blobs", "sha256", digest[len("sha256:"):]))
+		if err != nil || !os.SameFile(route, blob) {
+			t.Errorf("blob route of %s is not linked to the exported blob", digest)
+		}
+	}
+
+	// Exporting again only reuses the exported blobs.
+	report, err = ExportMirror(ctx, s, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 0 || report.Existing != 2 {
+		t.Errorf("blobs were exported again: %+v", report)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the size accounting of images with the FHS
+// layout. Such images contain a C runtime (the dynamic loader, libc
+// and libstdc++) in addition to the requested packages, so that
+// binaries built outside of Nix can run in them. Most packages depend
+// on libc anyway, but the additional size is recorded in a manifest
+// annotation so that users can judge the trade-off.
+
+import (
+	"strconv"
+
+	"github.com/google/nixery/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+// FHSOverheadAnnotation records the size (in bytes) of the store paths
+// that are only included in an image for its FHS runtime.
+const FHSOverheadAnnotation = "dev.nixery.fhs-overhead"
+
+// Library search path of images with the FHS layout.
+const fhsLibraryPath = "LD_LIBRARY_PATH=/lib"
+
+// fhsOverhead returns the total size of the store paths that are only
+// reachable from the given runtime paths, and not from any of the
+// other top-level paths of the image.
+func fhsOverhead(graph *layers.RuntimeGraph, runtime []string) uint64 {
+	isRuntime := make(map[string]bool)
+	for _, p := range runtime {
+		isRuntime[p] = true
+	}
+
+	refs := make(map[string][]string)
+	for _, c := range graph.Graph {
+		refs[c.Path] = c.Refs
+	}
+
+	// Everything in the closures of the requested packages would be
+	// included in the image regardless of its layout.
+	needed := make(map[string]bool)
+	var visit func(p string)
+	visit = func(p string) {
+		if needed[p] {
+			return
+		}
+		needed[p] = true
+		for _, r := range refs[p] {
+			visit(r)
+		}
+	}
+
+	for _, p := range graph.References.Graph {
+		if !isRuntime[p] {
+			visit(p)
+		}
+	}
+
+	var overhead uint64
+	for _, c := range graph.Graph {
+		if !needed[c.Path] {
+			overhead += c.NarSize
+		}
+	}
+
+	return overhead
+}
+
+// fhsAnnotation records the size overhead of the FHS layout.
+func fhsAnnotation(image *Image, result *ImageResult, annotations map[string]string) {
+	overhead := fhsOverhead(&result.Graph, result.FHSPaths)
+	annotations[FHSOverheadAnnotation] = strconv.FormatUint(overhead, 10)
+
+	log.WithFields(log.Fields{
+		"image":    image.Name,
+		"tag":      image.Tag,
+		"overhead": overhead,
+	}).Info("added FHS runtime to image")
+}
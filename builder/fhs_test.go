@@ -0,0 +1,33 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/nixery/layers"
+)
+
+func TestFHSOverhead(t *testing.T) {
+	var graph layers.RuntimeGraph
+	err := json.Unmarshal([]byte(`{
+		"exportReferencesGraph": {"graph": ["/nix/store/a-git", "/nix/store/b-glibc", "/nix/store/c-gcc-lib"]},
+		"graph": [
+			{"path": "/nix/store/a-git", "narSize": 100, "references": ["/nix/store/a-git", "/nix/store/b-glibc"]},
+			{"path": "/nix/store/b-glibc", "narSize": 30, "references": []},
+			{"path": "/nix/store/c-gcc-lib", "narSize": 5, "references": ["/nix/store/b-glibc", "/nix/store/d-zlib"]},
+			{"path": "/nix/store/d-zlib", "narSize": 2, "references": []}
+		]
+	}`), &graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// glibc is required by git and does not count towards the
+	// overhead.
+	overhead := fhsOverhead(&graph, []string{"/nix/store/b-glibc", "/nix/store/c-gcc-lib"})
+	if overhead != 7 {
+		t.Errorf("expected overhead of 7 bytes, got %d", overhead)
+	}
+}
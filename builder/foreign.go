@@ -0,0 +1,36 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the (experimental) delegation of blob serving
+// to an external CDN.
+//
+// Layers are still created and persisted as usual, but are described
+// as foreign layers whose descriptors point at a CDN serving the
+// `layers/` directory of the storage backend. Clients then download
+// layers from the CDN, and Nixery only serves manifests and image
+// configurations.
+
+import (
+	"strings"
+
+	"github.com/google/nixery/manifest"
+)
+
+// foreignLayers returns the entries of an image's layers as foreign
+// layers hosted under the given base URL. Layers that are already
+// foreign (see nondistributableLayers) keep their URLs.
+func foreignLayers(baseURL string, entries []manifest.Entry) []manifest.Entry {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	foreign := make([]manifest.Entry, len(entries))
+	for i, e := range entries {
+		if len(e.URLs) == 0 {
+			e.MediaType = manifest.ForeignLayerType
+			e.URLs = []string{baseURL + "/" + strings.TrimPrefix(e.Digest, "sha256:")}
+		}
+		foreign[i] = e
+	}
+
+	return foreign
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the expansion of curated package groups, which
+// lets users request a maintained set of packages (e.g. `devtools.go`)
+// instead of listing each package in the image name.
+//
+// Requesting the prefix of group names (e.g. `devtools`) expands to
+// all groups under it. Groups take precedence over packages of the
+// same name in the package set.
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// GroupsAnnotation records the packages that each group requested for
+// an image expanded to.
+const GroupsAnnotation = "dev.nixery.groups"
+
+// Maximum depth of groups containing other groups, which guards
+// against cycles in the group definitions.
+const maxGroupDepth = 8
+
+// groupMembers returns the packages of a group, or of all groups under
+// a prefix, and whether the name refers to a group at all.
+func groupMembers(groups map[string][]string, name string) ([]string, bool) {
+	if members, ok := groups[name]; ok {
+		return members, true
+	}
+
+	var names []string
+	for group := range groups {
+		if strings.HasPrefix(group, name+".") {
+			names = append(names, group)
+		}
+	}
+	sort.Strings(names)
+
+	var members []string
+	for _, group := range names {
+		members = append(members, groups[group]...)
+	}
+
+	return members, len(names) > 0
+}
+
+func expandGroup(groups map[string][]string, name string, depth int) []string {
+	members, ok := groupMembers(groups, name)
+	if !ok || depth >= maxGroupDepth {
+		return []string{name}
+	}
+
+	var pkgs []string
+	for _, m := range members {
+		pkgs = append(pkgs, expandGroup(groups, m, depth+1)...)
+	}
+
+	return pkgs
+}
+
+// expandGroups replaces package groups in an image with their
+// packages and records the expansion in the image annotations.
+func expandGroups(groups map[string][]string, image *Image) {
+	if len(groups) == 0 {
+		return
+	}
+
+	expansions := make(map[string][]string)
+	seen := make(map[string]bool)
+	var pkgs []string
+
+	for _, p := range image.Packages {
+		expanded := expandGroup(groups, p, 0)
+		if len(expanded) != 1 || expanded[0] != p {
+			expansions[p] = expanded
+		}
+
+		for _, e := range expanded {
+			if !seen[e] {
+				seen[e] = true
+				pkgs = append(pkgs, e)
+			}
+		}
+	}
+
+	if len(expansions) == 0 {
+		return
+	}
+
+	sort.Strings(pkgs)
+	image.Packages = pkgs
+
+	// The annotations may be shared with the caller, so a copy is
+	// modified.
+	annotations := make(map[string]string)
+	for k, v := range image.Annotations {
+		annotations[k] = v
+	}
+
+	j, _ := json.Marshal(expansions)
+	annotations[GroupsAnnotation] = string(j)
+	image.Annotations = annotations
+}
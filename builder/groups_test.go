@@ -0,0 +1,30 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExpandGroups(t *testing.T) {
+	groups := map[string][]string{
+		"devtools.go":   {"go", "gopls"},
+		"devtools.rust": {"cargo", "rustc"},
+		"ci":            {"git", "devtools.go"},
+		"loop":          {"loop"},
+	}
+
+	image := ImageFromName("ci/devtools/htop/loop", "latest")
+	expandGroups(groups, &image)
+
+	expected := []string{"cacert", "cargo", "git", "go", "gopls", "htop", "iana-etc", "loop", "rustc"}
+	if diff := cmp.Diff(expected, image.Packages); diff != "" {
+		t.Errorf("unexpected packages after expansion (-want +got):\n%s", diff)
+	}
+
+	if image.Annotations[GroupsAnnotation] == "" {
+		t.Error("group expansion was not recorded in annotations")
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the build hooks, which invoke operator-supplied
+// executables at fixed points of an image build to integrate with
+// external compliance or inventory systems:
+//
+// * `pre-build` hooks run after a cache miss, before the image's packages are evaluated
+// * `post-publish` hooks run once the manifest and its blobs are stored, before the image is cached
+//
+// Hooks receive the build context as JSON (see api.HookContext) on
+// their standard input, and the hook point as their only argument. A
+// hook fails if it exits with a non-zero status or times out, in which
+// case its output is used as the error message.
+//
+// Hooks are not invoked for cache hits.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrHookRejected is returned if a build hook failed and failing
+// hooks abort builds.
+var ErrHookRejected = errors.New("build rejected by hook")
+
+// Amount of hook output included in error messages.
+const hookOutputLimit = 1024
+
+// hookContext returns the context of an image build passed to hooks.
+func hookContext(hook string, image *Image, key string) api.HookContext {
+	return api.HookContext{
+		Hook:     hook,
+		Name:     image.Name,
+		Packages: image.Packages,
+		Arch:     image.Arch.imageArch,
+		Tenant:   image.Tenant,
+		Pin:      image.Tag,
+		CacheKey: key,
+	}
+}
+
+// runHook invokes the hook executable, if it is configured, and applies
+// the configured failure policy.
+func runHook(ctx context.Context, hooks config.BuildHooks, program string, hc api.HookContext) error {
+	if program == "" {
+		return nil
+	}
+
+	start := time.Now()
+	err := execHook(ctx, hooks.Timeout, program, hc)
+
+	fields := log.Fields{
+		"hook":     hc.Hook,
+		"image":    hc.Name,
+		"tag":      hc.Pin,
+		"duration": time.Since(start).Seconds(),
+	}
+
+	if err == nil {
+		log.WithFields(fields).Debug("build hook succeeded")
+		return nil
+	}
+
+	if hooks.Policy == config.HookWarn {
+		log.WithError(err).WithFields(fields).Warn("build hook failed, continuing build")
+		return nil
+	}
+
+	log.WithError(err).WithFields(fields).Error("build hook failed, aborting build")
+	return fmt.Errorf("%w (%s): %s", ErrHookRejected, hc.Hook, err)
+}
+
+func execHook(ctx context.Context, timeout time.Duration, program string, hc api.HookContext) error {
+	input, err := json.Marshal(hc)
+	if err != nil {
+		return err
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var output bytes.Buffer
+	cmd := exec.Command(program, hc.Hook)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Env = append(os.Environ(), "NIXERY_HOOK="+hc.Hook)
+
+	// Hooks are commonly shell scripts, whose child processes would
+	// keep running (and holding on to the output) if only the script
+	// itself was killed. They are therefore run in their own process
+	// group, which is killed as a whole.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	err = cmd.Wait()
+	close(done)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+
+	if err != nil {
+		out := strings.TrimSpace(output.String())
+		if len(out) > hookOutputLimit {
+			out = "..." + out[len(out)-hookOutputLimit:]
+		}
+
+		if out == "" {
+			return err
+		}
+		return fmt.Errorf("%s: %s", err, out)
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/config"
+)
+
+func writeHook(t *testing.T, script string) string {
+	path := filepath.Join(t.TempDir(), "hook")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatalf("failed to write hook: %s", err)
+	}
+
+	return path
+}
+
+func TestRunHook(t *testing.T) {
+	ctx := context.Background()
+	hc := api.HookContext{Hook: "pre-build", Name: "shell", Pin: "latest"}
+	hooks := config.BuildHooks{Policy: config.HookAbort, Timeout: time.Minute}
+
+	// The context is passed on stdin, and the hook point as argument.
+	ok := writeHook(t, `test "$1" = pre-build && grep -q '"name":"shell"'`)
+	if err := runHook(ctx, hooks, ok, hc); err != nil {
+		t.Errorf("expected hook to succeed, got: %s", err)
+	}
+
+	failing := writeHook(t, "echo 'package not approved' >&2; exit 1")
+	err := runHook(ctx, hooks, failing, hc)
+	if !errors.Is(err, ErrHookRejected) || !strings.Contains(err.Error(), "package not approved") {
+		t.Errorf("expected rejection with hook output, got: %v", err)
+	}
+
+	hooks.Timeout = 100 * time.Millisecond
+	slow := writeHook(t, "sleep 5")
+	if err := runHook(ctx, hooks, slow, hc); !errors.Is(err, ErrHookRejected) {
+		t.Errorf("expected timed out hook to reject build, got: %v", err)
+	}
+
+	hooks.Policy = config.HookWarn
+	if err := runHook(ctx, hooks, failing, hc); err != nil {
+		t.Errorf("expected failure to be ignored, got: %s", err)
+	}
+}
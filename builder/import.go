@@ -0,0 +1,463 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the import of existing images as profiles, from
+// OCI image layout archives (as written by `docker save` or
+// `skopeo copy ... oci-archive:`) or from other registries.
+//
+// Blobs are verified against their digest before they are stored, and
+// multi-platform images are imported for a single architecture.
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	mf "github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrInvalidImport is returned for images that can not be imported.
+var ErrInvalidImport = errors.New("image can not be imported")
+
+// Media types of multi-platform image indices.
+const (
+	ociIndexType     = "application/vnd.oci.image.index.v1+json"
+	manifestListType = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// Blobs up to this size are kept in memory while importing archives,
+// which covers the index, manifests and configuration.
+const smallBlobSize = 4 * 1024 * 1024
+
+// descriptor references a manifest in an image index.
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Platform  *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+func isIndex(mediaType string) bool {
+	return mediaType == ociIndexType || mediaType == manifestListType
+}
+
+// selectManifest selects the manifest for the given architecture from
+// an image index. Indices with a single manifest without platform
+// (such as the `index.json` of OCI archives) select that manifest.
+func selectManifest(index []byte, arch string) (*descriptor, error) {
+	var parsed struct {
+		Manifests []descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(index, &parsed); err != nil {
+		return nil, fmt.Errorf("%w: invalid image index: %s", ErrInvalidImport, err)
+	}
+
+	if len(parsed.Manifests) == 1 && parsed.Manifests[0].Platform == nil {
+		return &parsed.Manifests[0], nil
+	}
+
+	for _, d := range parsed.Manifests {
+		if d.Platform != nil && d.Platform.OS == "linux" && d.Platform.Architecture == arch {
+			return &d, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: no manifest for linux/%s", ErrInvalidImport, arch)
+}
+
+// importBlob stores a blob under its digest, verifying its content.
+func importBlob(ctx context.Context, s *State, digest string, size int64, r io.Reader) error {
+	hex := strings.TrimPrefix(digest, "sha256:")
+	if !strings.HasPrefix(digest, "sha256:") || len(hex) != 64 {
+		return fmt.Errorf("%w: unsupported digest %q", ErrInvalidImport, digest)
+	}
+
+	staging := "staging/import-" + hex
+	ctx = storage.WithSizeHint(ctx, size)
+	sum, _, err := s.Storage.Persist(ctx, staging, mf.LayerType, func(w io.Writer) (string, int64, error) {
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(w, h), r)
+		return fmt.Sprintf("%x", h.Sum(nil)), n, err
+	})
+	if err != nil {
+		return err
+	}
+
+	if sum != hex {
+		s.Storage.Delete(ctx, staging)
+		return fmt.Errorf("%w: blob %s has digest sha256:%s", ErrInvalidImport, digest, sum)
+	}
+
+	return s.Storage.Move(ctx, staging, "layers/"+hex)
+}
+
+// blobExists reports whether a blob is already stored.
+func blobExists(ctx context.Context, s *State, digest string) bool {
+	p := "layers/" + strings.TrimPrefix(digest, "sha256:")
+	objects, err := s.Storage.List(ctx, p)
+	if err != nil {
+		return false
+	}
+
+	for _, obj := range objects {
+		if obj.Path == p {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ImportArchive imports an image from an OCI image layout archive,
+// which may be gzip-compressed, as the profile name:tag.
+func ImportArchive(ctx context.Context, s *State, name, tag, arch string, archive io.Reader) (*Profile, error) {
+	if err := validProfileName(name, tag); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidImport, err)
+	}
+
+	br := bufio.NewReader(archive)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidImport, err)
+		}
+		defer gz.Close()
+		archive = gz
+	} else {
+		archive = br
+	}
+
+	var index []byte
+	small := make(map[string][]byte)
+	imported := make(map[string]bool)
+
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid archive: %s", ErrInvalidImport, err)
+		}
+
+		file := path.Clean(hdr.Name)
+		switch {
+		case file == "index.json":
+			if index, err = ioutil.ReadAll(io.LimitReader(tr, smallBlobSize)); err != nil {
+				return nil, err
+			}
+
+		case strings.HasPrefix(file, "blobs/sha256/") && hdr.Typeflag == tar.TypeReg:
+			digest := "sha256:" + path.Base(file)
+
+			var r io.Reader = tr
+			if hdr.Size <= smallBlobSize {
+				data, err := ioutil.ReadAll(tr)
+				if err != nil {
+					return nil, err
+				}
+				small[digest] = data
+				r = bytes.NewReader(data)
+			}
+
+			if err := importBlob(ctx, s, digest, hdr.Size, r); err != nil {
+				return nil, err
+			}
+			imported[digest] = true
+		}
+	}
+
+	if index == nil {
+		return nil, fmt.Errorf("%w: archive has no index.json, only OCI image layouts are supported", ErrInvalidImport)
+	}
+
+	// The index of the layout may itself reference an index of a
+	// multi-platform image.
+	d, err := selectManifest(index, arch)
+	for err == nil && isIndex(d.MediaType) {
+		d, err = selectManifest(small[d.Digest], arch)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := small[d.Digest]
+	if !ok {
+		return nil, fmt.Errorf("%w: manifest %s is missing from the archive", ErrInvalidImport, d.Digest)
+	}
+
+	refs, err := mf.References(m)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid manifest: %s", ErrInvalidImport, err)
+	}
+
+	for _, ref := range refs {
+		if !imported[ref] && !blobExists(ctx, s, ref) {
+			return nil, fmt.Errorf("%w: blob %s is missing from the archive", ErrInvalidImport, ref)
+		}
+	}
+
+	return saveProfile(ctx, s, Profile{
+		Name:   name,
+		Tag:    tag,
+		Arch:   arch,
+		Source: "archive",
+	}, m)
+}
+
+// registryImport pulls an image from a registry, authenticating with
+// anonymous bearer tokens if the registry asks for them.
+type registryImport struct {
+	host  string
+	repo  string
+	token string
+}
+
+// parseReference splits an image reference into registry host,
+// repository and tag or digest, following the conventions of Docker.
+func parseReference(ref string) (*registryImport, string, error) {
+	r := &registryImport{host: "registry-1.docker.io"}
+
+	if i := strings.Index(ref, "/"); i > 0 {
+		first := ref[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			r.host = first
+			ref = ref[i+1:]
+		}
+	}
+
+	// Docker Hub's registry API is not served under its usual name.
+	if r.host == "docker.io" {
+		r.host = "registry-1.docker.io"
+	}
+
+	// The host has been removed, so any colon before the digest
+	// separates the tag. References with both a tag and a digest
+	// are resolved by the digest.
+	reference := "latest"
+	if i := strings.Index(ref, "@"); i > 0 {
+		ref, reference = ref[:i], ref[i+1:]
+		if j := strings.LastIndex(ref, ":"); j > 0 {
+			ref = ref[:j]
+		}
+	} else if i := strings.LastIndex(ref, ":"); i > 0 {
+		ref, reference = ref[:i], ref[i+1:]
+	}
+
+	if ref == "" || reference == "" {
+		return nil, "", fmt.Errorf("%w: invalid image reference", ErrInvalidImport)
+	}
+
+	if r.host == "registry-1.docker.io" && !strings.Contains(ref, "/") {
+		ref = "library/" + ref
+	}
+	r.repo = ref
+
+	return r, reference, nil
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authenticate fetches an anonymous token as described by the
+// challenge of a registry.
+func (r *registryImport) authenticate(ctx context.Context, challenge string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return fmt.Errorf("%w: unsupported registry authentication %q", ErrInvalidImport, challenge)
+	}
+
+	params := make(map[string]string)
+	for _, m := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+
+	query := url.Values{}
+	for _, p := range []string{"service", "scope"} {
+		if v, ok := params[p]; ok {
+			query.Set(p, v)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("token request failed with status %d", resp.StatusCode)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+
+	return nil
+}
+
+// get fetches an object from the registry API of the repository.
+func (r *registryImport) get(ctx context.Context, kind, reference string, accept ...string) (*http.Response, error) {
+	target := fmt.Sprintf("https://%s/v2/%s/%s/%s", r.host, r.repo, kind, reference)
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+		if r.token != "" {
+			req.Header.Set("Authorization", "Bearer "+r.token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == 401 && attempt == 0 {
+			resp.Body.Close()
+			if err := r.authenticate(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%w: fetching %s %s from %s/%s failed with status %d",
+				ErrInvalidImport, kind, reference, r.host, r.repo, resp.StatusCode)
+		}
+
+		return resp, nil
+	}
+}
+
+// manifest fetches a manifest, verifying its digest if it is
+// referenced by digest.
+func (r *registryImport) manifest(ctx context.Context, reference string) ([]byte, string, error) {
+	resp, err := r.get(ctx, "manifests", reference,
+		mf.ManifestType, mf.OCIManifestType, manifestListType, ociIndexType)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	m, err := ioutil.ReadAll(io.LimitReader(resp.Body, smallBlobSize))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if strings.HasPrefix(reference, "sha256:") {
+		if sum := fmt.Sprintf("sha256:%x", sha256.Sum256(m)); sum != reference {
+			return nil, "", fmt.Errorf("%w: manifest %s has digest %s", ErrInvalidImport, reference, sum)
+		}
+	}
+
+	mediaType := mf.MediaType(m)
+	if ct := resp.Header.Get("Content-Type"); isIndex(ct) {
+		mediaType = ct
+	}
+
+	return m, mediaType, nil
+}
+
+// ImportRegistry imports an image from another registry (e.g.
+// `docker.io/library/alpine:3.19`) as the profile name:tag.
+func ImportRegistry(ctx context.Context, s *State, name, tag, arch, ref string) (*Profile, error) {
+	if err := validProfileName(name, tag); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidImport, err)
+	}
+
+	r, reference, err := parseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	m, mediaType, err := r.manifest(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+
+	if isIndex(mediaType) {
+		d, err := selectManifest(m, arch)
+		if err != nil {
+			return nil, err
+		}
+
+		if m, _, err = r.manifest(ctx, d.Digest); err != nil {
+			return nil, err
+		}
+	}
+
+	refs, err := mf.References(m)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid manifest: %s", ErrInvalidImport, err)
+	}
+
+	start := time.Now()
+	for _, digest := range refs {
+		if blobExists(ctx, s, digest) {
+			continue
+		}
+
+		resp, err := r.get(ctx, "blobs", digest)
+		if err != nil {
+			return nil, err
+		}
+
+		err = importBlob(ctx, s, digest, resp.ContentLength, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"source":   ref,
+		"blobs":    len(refs),
+		"duration": time.Since(start),
+	}).Info("fetched image blobs from registry")
+
+	return saveProfile(ctx, s, Profile{
+		Name:   name,
+		Tag:    tag,
+		Arch:   arch,
+		Source: ref,
+	}, m)
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+)
+
+// ociArchive writes an OCI image layout archive with the given blobs
+// and an index referencing the manifest m.
+func ociArchive(m []byte, blobs ...[]byte) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	add := func(name string, data []byte) {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		tw.Write(data)
+	}
+
+	index, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []map[string]interface{}{{
+			"mediaType": manifest.ManifestType,
+			"digest":    fmt.Sprintf("sha256:%x", sha256.Sum256(m)),
+			"size":      len(m),
+		}},
+	})
+	add("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`))
+	add("index.json", index)
+
+	for _, b := range append(blobs, m) {
+		add(fmt.Sprintf("blobs/sha256/%x", sha256.Sum256(b)), b)
+	}
+
+	tw.Close()
+	return &buf
+}
+
+func TestImportArchive(t *testing.T) {
+	ctx := context.Background()
+	s := &State{Storage: storage.NewMemoryBackend(), Profiles: NewProfileStore()}
+
+	layer := []byte("layer")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+	m, c := manifest.Manifest("amd64", []manifest.Entry{{Digest: digest, Size: int64(len(layer))}}, manifest.RuntimeConfig{}, nil)
+
+	profile, err := ImportArchive(ctx, s, "tools/legacy", "v1", "amd64", ociArchive(m, layer, c.Config))
+	if err != nil {
+		t.Fatalf("import failed: %s", err)
+	}
+
+	if profile.Layers != 1 || profile.Digest != fmt.Sprintf("sha256:%x", sha256.Sum256(m)) {
+		t.Errorf("unexpected profile: %+v", profile)
+	}
+
+	served, _, ok := s.Profiles.Lookup("tools/legacy", "v1")
+	if !ok || !bytes.Equal(served, m) {
+		t.Errorf("expected imported manifest to be served unchanged")
+	}
+
+	// Profiles are loaded from storage on other replicas.
+	other := NewProfileStore()
+	if err := other.Refresh(ctx, s.Storage); err != nil {
+		t.Fatalf("refresh failed: %s", err)
+	}
+	if _, _, ok := other.Lookup("tools/legacy", "v1"); !ok {
+		t.Errorf("expected profile to be loaded from storage")
+	}
+
+	// Archives missing blobs are rejected.
+	other = NewProfileStore()
+	s = &State{Storage: storage.NewMemoryBackend(), Profiles: other}
+	if _, err := ImportArchive(ctx, s, "broken", "v1", "amd64", ociArchive(m, c.Config)); err == nil {
+		t.Errorf("expected archive without layer to be rejected")
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	for ref, want := range map[string]string{
+		"alpine":                        "registry-1.docker.io library/alpine latest",
+		"docker.io/library/alpine:3":    "registry-1.docker.io library/alpine 3",
+		"ghcr.io/org/tool@sha256:abcd":  "ghcr.io org/tool sha256:abcd",
+		"localhost:5000/app:dev":        "localhost:5000 app dev",
+		"localhost:5000/app":            "localhost:5000 app latest",
+		"[::1]:5000/team/app:v1":        "[::1]:5000 team/app v1",
+		"[fd00::1]/app":                 "[fd00::1] app latest",
+		"ghcr.io/org/tool:v1@sha256:ab": "ghcr.io org/tool sha256:ab",
+	} {
+		r, reference, err := parseReference(ref)
+		if err != nil {
+			t.Errorf("failed to parse %s: %s", ref, err)
+			continue
+		}
+
+		if got := r.host + " " + r.repo + " " + reference; got != want {
+			t.Errorf("parsed %s as %q, expected %q", ref, got, want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the invalidation of package sources, which lets
+// CI of the package repository announce that a branch has changed.
+//
+// Manifests of images built from branches (rather than commits) are
+// not cached, but Nix itself caches the revision a branch resolved to
+// for `tarball-ttl` (an hour by default). Until it expires, new
+// packages on the branch can not be found. After an invalidation, the
+// next build of each invalidated source ignores this cache.
+
+import (
+	"sync"
+	"time"
+)
+
+// Invalidations tracks the package sources that were invalidated since
+// they were last fetched.
+//
+// A nil *Invalidations is valid and never requires a refetch.
+type Invalidations struct {
+	mu sync.Mutex
+
+	// Time of the last invalidation of all sources, and of each
+	// source, keyed by its rendered arguments
+	all     time.Time
+	sources map[string]time.Time
+
+	// Time at which each source was last refetched
+	refetched map[string]time.Time
+}
+
+// NewInvalidations creates a tracker with no invalidated sources.
+func NewInvalidations() *Invalidations {
+	return &Invalidations{
+		sources:   make(map[string]time.Time),
+		refetched: make(map[string]time.Time),
+	}
+}
+
+// SourceScope returns the scope of the package source that images with
+// the given tag are built from. Tags resolving to the same branch (e.g.
+// `latest` and `master`) share a scope.
+func SourceScope(s *State, tag string) string {
+	_, args := s.Cfg.Pkgs.Render(tag)
+	return args
+}
+
+// Invalidate marks the package source of the given scope as changed,
+// or all sources if the scope is empty.
+func (i *Invalidations) Invalidate(scope string) {
+	if i == nil {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if scope == "" {
+		i.all = time.Now()
+	} else {
+		i.sources[scope] = time.Now()
+	}
+}
+
+// refetch reports whether the package source of the given scope was
+// invalidated since it was last refetched, and records the refetch.
+func (i *Invalidations) refetch(scope string) bool {
+	if i == nil {
+		return false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	invalidated := i.sources[scope]
+	if i.all.After(invalidated) {
+		invalidated = i.all
+	}
+
+	if invalidated.IsZero() || i.refetched[scope].After(invalidated) {
+		return false
+	}
+
+	i.refetched[scope] = time.Now()
+	return true
+}
@@ -0,0 +1,37 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"testing"
+)
+
+func TestInvalidationRefetchesOnce(t *testing.T) {
+	i := NewInvalidations()
+
+	if i.refetch("main") {
+		t.Error("source was refetched without being invalidated")
+	}
+
+	i.Invalidate("main")
+	if i.refetch("other") {
+		t.Error("invalidation of another source caused a refetch")
+	}
+	if !i.refetch("main") {
+		t.Error("invalidated source was not refetched")
+	}
+	if i.refetch("main") {
+		t.Error("invalidated source was refetched twice")
+	}
+
+	i.Invalidate("")
+	if !i.refetch("main") || !i.refetch("other") {
+		t.Error("invalidating all sources did not refetch each of them")
+	}
+
+	var none *Invalidations
+	none.Invalidate("main")
+	if none.refetch("main") {
+		t.Error("nil tracker requested a refetch")
+	}
+}
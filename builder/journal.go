@@ -0,0 +1,293 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the build journal, which records the progress
+// of in-progress builds in a local directory. If Nixery crashes during
+// a build, the journal is used on the next start to clean up after it:
+//
+// * uploads that were still in the staging area are deleted
+// * layers that were uploaded, but possibly not yet cached, are cached
+//
+// The latter lets the next build of the image (or of images sharing its
+// layers) reuse them instead of uploading them again. Manifests are not
+// recovered, as they have to pass the post-publish hooks.
+//
+// Each build is recorded in its own file, which is removed once the
+// build finishes. The journal directory must not be shared between
+// instances.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nixery/manifest"
+	log "github.com/sirupsen/logrus"
+)
+
+// journalEntry is the record of an in-progress build.
+type journalEntry struct {
+	Image   string                    `json:"image"`
+	Tag     string                    `json:"tag"`
+	Key     string                    `json:"key,omitempty"`
+	Started time.Time                 `json:"started"`
+	Updated time.Time                 `json:"updated"`
+	Stage   string                    `json:"stage"`
+	Staging []string                  `json:"staging"`
+	Layers  map[string]manifest.Entry `json:"layers"`
+}
+
+// BuildJournal records in-progress builds in a directory.
+//
+// A nil *BuildJournal is valid and records nothing.
+type BuildJournal struct {
+	dir string
+}
+
+// NewBuildJournal creates a journal in the given directory.
+func NewBuildJournal(dir string) (*BuildJournal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &BuildJournal{dir: dir}, nil
+}
+
+// journalBuild is the journal of a single build.
+//
+// A nil *journalBuild is valid and records nothing.
+type journalBuild struct {
+	path string
+
+	mu    sync.Mutex
+	entry journalEntry
+	done  bool
+}
+
+// start records the start of a build.
+func (j *BuildJournal) start(image *Image, key string) *journalBuild {
+	if j == nil {
+		return nil
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	b := &journalBuild{
+		path: filepath.Join(j.dir, hex.EncodeToString(id)+".json"),
+		entry: journalEntry{
+			Image:   image.Name,
+			Tag:     image.Tag,
+			Key:     key,
+			Started: time.Now(),
+			Stage:   "evaluation",
+			Layers:  make(map[string]manifest.Entry),
+		},
+	}
+
+	b.mu.Lock()
+	b.write()
+	b.mu.Unlock()
+
+	return b
+}
+
+// write persists the journal entry of a build. Failures are only
+// logged, as the journal must not fail builds.
+func (b *journalBuild) write() {
+	b.entry.Updated = time.Now()
+	j, _ := json.Marshal(&b.entry)
+
+	if err := writeFileAtomic(b.path, j); err != nil {
+		log.WithError(err).WithField("journal", b.path).Warn("failed to write build journal")
+	}
+}
+
+// update modifies the journal entry of a build, unless it already
+// finished.
+func (b *journalBuild) update(f func(e *journalEntry)) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.done {
+		return
+	}
+
+	f(&b.entry)
+	b.write()
+}
+
+// stage records the stage a build entered.
+func (b *journalBuild) stage(stage string) {
+	b.update(func(e *journalEntry) {
+		e.Stage = stage
+	})
+}
+
+// staged records an upload to the staging area.
+func (b *journalBuild) staged(path string) {
+	b.update(func(e *journalEntry) {
+		e.Staging = append(e.Staging, path)
+	})
+}
+
+// unstaged records that an upload left the staging area.
+func (b *journalBuild) unstaged(path string) {
+	b.update(func(e *journalEntry) {
+		for i, p := range e.Staging {
+			if p == path {
+				e.Staging = append(e.Staging[:i], e.Staging[i+1:]...)
+				break
+			}
+		}
+	})
+}
+
+// layer records a layer that was uploaded.
+func (b *journalBuild) layer(key string, entry manifest.Entry) {
+	b.update(func(e *journalEntry) {
+		e.Layers[key] = entry
+	})
+}
+
+// finish removes the journal entry of a finished build.
+func (b *journalBuild) finish() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.done = true
+	if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("journal", b.path).Warn("failed to remove build journal")
+	}
+}
+
+// writeFileAtomic replaces a file with the given contents, without
+// leaving partially written files behind.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), tempManifestPrefix)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+type journalKey struct{}
+
+// withJournal attaches the journal of a build to a context.
+func withJournal(ctx context.Context, b *journalBuild) context.Context {
+	return context.WithValue(ctx, journalKey{}, b)
+}
+
+// journalFrom returns the journal of the build a context belongs to,
+// which is nil outside of builds.
+func journalFrom(ctx context.Context) *journalBuild {
+	b, _ := ctx.Value(journalKey{}).(*journalBuild)
+	return b
+}
+
+// Recover cleans up after the builds that were in progress when the
+// previous Nixery process exited, and removes their journal entries.
+//
+// Staged uploads are only deleted if they were written before the
+// journal entry was last updated, as other replicas may have uploaded
+// the same layer since.
+func (j *BuildJournal) Recover(ctx context.Context, s *State) error {
+	if j == nil {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		path := filepath.Join(j.dir, f.Name())
+
+		if strings.HasPrefix(f.Name(), tempManifestPrefix) {
+			os.Remove(path)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var entry journalEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			log.WithError(err).WithField("journal", path).Warn("discarding invalid build journal")
+			os.Remove(path)
+			continue
+		}
+
+		deleted := 0
+		for _, staged := range entry.Staging {
+			objects, err := s.Storage.List(ctx, staged)
+			if err != nil {
+				return err
+			}
+
+			for _, obj := range objects {
+				if obj.Path != staged || obj.Updated.After(entry.Updated) {
+					continue
+				}
+
+				if err := s.Storage.Delete(ctx, obj.Path); err != nil {
+					return err
+				}
+				deleted++
+			}
+		}
+
+		for key, layer := range entry.Layers {
+			cacheLayer(ctx, s, key, layer)
+		}
+
+		log.WithFields(log.Fields{
+			"image":   entry.Image,
+			"tag":     entry.Tag,
+			"stage":   entry.Stage,
+			"started": entry.Started,
+			"staging": deleted,
+			"layers":  len(entry.Layers),
+		}).Warn("recovered interrupted build")
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+)
+
+func TestJournalRecover(t *testing.T) {
+	ctx := context.Background()
+	backend := storage.NewMemoryBackend()
+	backend.Persist(ctx, "staging/partial", manifest.LayerType, func(w io.Writer) (string, int64, error) {
+		n, err := io.Copy(w, strings.NewReader("partial"))
+		return "", n, err
+	})
+
+	s := newTestState(t)
+	s.Storage = backend
+
+	journal, err := NewBuildJournal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The build is never finished, as if Nixery had crashed.
+	build := journal.start(&Image{Name: "hello", Tag: "latest"}, "key")
+	build.stage("layers")
+	build.staged("staging/partial")
+	build.layer("uploaded", manifest.Entry{Digest: "sha256:abc", Size: 42})
+
+	if err := journal.Recover(ctx, s); err != nil {
+		t.Fatalf("recovery failed: %s", err)
+	}
+
+	if objects, _ := backend.List(ctx, "staging/"); len(objects) != 0 {
+		t.Errorf("staged upload was not deleted: %v", objects)
+	}
+
+	if entry, ok := s.Cache.layerFromLocalCache("uploaded"); !ok || entry.Digest != "sha256:abc" {
+		t.Errorf("uploaded layer was not cached: %v", entry)
+	}
+
+	if files, _ := ioutil.ReadDir(journal.dir); len(files) != 0 {
+		t.Errorf("journal entries were not removed: %d left", len(files))
+	}
+}
+
+func TestJournalFinish(t *testing.T) {
+	journal, err := NewBuildJournal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	build := journal.start(&Image{Name: "hello", Tag: "latest"}, "key")
+	build.finish()
+
+	// Updates after the build finished must not recreate its entry.
+	build.layer("late", manifest.Entry{})
+
+	if files, _ := ioutil.ReadDir(journal.dir); len(files) != 0 {
+		t.Errorf("journal entry was not removed: %d left", len(files))
+	}
+
+	var nilBuild *journalBuild
+	nilBuild.stage("layers")
+	nilBuild.finish()
+}
@@ -0,0 +1,174 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements layer workers, which pack the store paths of
+// layers in separate processes instead of the server process.
+//
+// Packing walks arbitrary store paths, and a pathological path (e.g.
+// huge sparse files or unreadable directories) could otherwise exhaust
+// the memory of the server or crash it. A worker is a copy of the
+// server binary started in worker mode, whose memory is limited and
+// which only fails the build of the affected layer when it dies.
+//
+// Workers read the store paths from standard input and write the
+// compressed layer to standard output. The hash of the uncompressed
+// layer is written to file descriptor 3 once the layer is complete.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/google/nixery/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+// LayerWorkerFlag is the command-line flag starting the server binary
+// as a layer worker.
+const LayerWorkerFlag = "layer-worker"
+
+// layerWorkerRequest is passed to a worker on its standard input.
+type layerWorkerRequest struct {
+	Paths  []string `json:"paths"`
+	Memory int      `json:"memoryMiB"`
+}
+
+// layerWorkerResult is written by a worker once the layer is complete.
+type layerWorkerResult struct {
+	TarHash string `json:"tarHash"`
+}
+
+// LayerWorkers starts the worker processes packing layers, of which
+// only a limited number run at the same time.
+//
+// A nil *LayerWorkers is valid and packs layers in the server process.
+type LayerWorkers struct {
+	executable string
+	memory     int
+	slots      chan struct{}
+}
+
+// NewLayerWorkers configures the given number of concurrent layer
+// workers, each limited to the given memory (in MiB).
+func NewLayerWorkers(workers, memory int) (*LayerWorkers, error) {
+	if workers == 0 {
+		return nil, nil
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate server binary: %w", err)
+	}
+
+	log.WithFields(log.Fields{
+		"workers":    workers,
+		"memory_mib": memory,
+	}).Info("packing layers in worker processes")
+
+	return &LayerWorkers{
+		executable: executable,
+		memory:     memory,
+		slots:      make(chan struct{}, workers),
+	}, nil
+}
+
+// pack writes the compressed layer of the given store paths to w, and
+// returns the hash of the uncompressed layer.
+func (p *LayerWorkers) pack(ctx context.Context, l *layers.Layer, w io.Writer) (string, error) {
+	if p == nil {
+		return packStorePaths(l, w)
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		defer func() { <-p.slots }()
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	results, resultWriter, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	defer results.Close()
+
+	req, _ := json.Marshal(layerWorkerRequest{
+		Paths:  l.Contents,
+		Memory: p.memory,
+	})
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.executable, "-"+LayerWorkerFlag)
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	cmd.ExtraFiles = []*os.File{resultWriter}
+
+	err = cmd.Start()
+	resultWriter.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to start layer worker: %w", err)
+	}
+
+	// The result pipe is closed when the worker exits, at the
+	// latest.
+	j, _ := ioutil.ReadAll(results)
+	if err := cmd.Wait(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if i := strings.IndexByte(msg, '\n'); i >= 0 {
+			msg = msg[:i]
+		}
+
+		log.WithError(err).WithFields(log.Fields{
+			"layer":  l.Hash(),
+			"output": msg,
+		}).Error("layer worker failed")
+
+		return "", fmt.Errorf("layer worker failed: %s: %s", err, msg)
+	}
+
+	var result layerWorkerResult
+	if err := json.Unmarshal(j, &result); err != nil || result.TarHash == "" {
+		return "", fmt.Errorf("layer worker returned no result")
+	}
+
+	return result.TarHash, nil
+}
+
+// RunLayerWorker packs a single layer as a worker process. It is
+// invoked by the server binary when started with LayerWorkerFlag, and
+// must not write anything else to standard output.
+func RunLayerWorker() error {
+	var req layerWorkerRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		return fmt.Errorf("invalid layer worker request: %w", err)
+	}
+
+	// Allocations beyond the limit make the Go runtime abort, which
+	// only terminates this worker. The address space can not be
+	// limited instead, as the runtime reserves far more of it than
+	// it uses.
+	if req.Memory > 0 {
+		limit := uint64(req.Memory) << 20
+		if err := syscall.Setrlimit(syscall.RLIMIT_DATA, &syscall.Rlimit{Cur: limit, Max: limit}); err != nil {
+			return fmt.Errorf("failed to limit memory: %w", err)
+		}
+	}
+
+	tarhash, err := packStorePaths(&layers.Layer{Contents: req.Paths}, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	j, _ := json.Marshal(layerWorkerResult{TarHash: tarhash})
+	_, err = os.NewFile(3, "result").Write(j)
+	return err
+}
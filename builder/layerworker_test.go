@@ -0,0 +1,97 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/nixery/layers"
+)
+
+// The test binary doubles as the layer worker, like the server binary
+// does.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == "-"+LayerWorkerFlag {
+		if msg := os.Getenv("NIXERY_TEST_WORKER_CRASH"); msg != "" {
+			fmt.Fprintln(os.Stderr, msg)
+			os.Exit(2)
+		}
+
+		if err := RunLayerWorker(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func testWorkerLayer(t *testing.T) *layers.Layer {
+	dir := filepath.Join(t.TempDir(), "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa-hello-1.0")
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "bin", "hello"), []byte("#!/bin/sh\necho hello\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return &layers.Layer{Contents: []string{dir}}
+}
+
+func TestLayerWorker(t *testing.T) {
+	l := testWorkerLayer(t)
+
+	var expected bytes.Buffer
+	expectedHash, err := packStorePaths(l, &expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workers, err := NewLayerWorkers(1, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packed bytes.Buffer
+	tarhash, err := workers.pack(context.Background(), l, &packed)
+	if err != nil {
+		t.Fatalf("layer worker failed: %s", err)
+	}
+
+	if tarhash != expectedHash {
+		t.Errorf("worker returned tar hash %s, expected %s", tarhash, expectedHash)
+	}
+	if !bytes.Equal(packed.Bytes(), expected.Bytes()) {
+		t.Error("layer packed by worker differs from layer packed in process")
+	}
+}
+
+func TestLayerWorkerFailure(t *testing.T) {
+	t.Setenv("NIXERY_TEST_WORKER_CRASH", "fatal error: runtime: out of memory")
+	l := testWorkerLayer(t)
+
+	workers, err := NewLayerWorkers(1, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The failure of a worker only fails the affected layer, and
+	// releases its slot for other layers.
+	for i := 0; i < 2; i++ {
+		_, err := workers.pack(context.Background(), l, ioutil.Discard)
+		if err == nil {
+			t.Fatal("failed worker was not reported")
+		}
+		if !strings.Contains(err.Error(), "out of memory") {
+			t.Errorf("worker output is missing from error: %s", err)
+		}
+	}
+}
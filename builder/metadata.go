@@ -0,0 +1,51 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/nixery/storage"
+)
+
+// ObjectMetadata returns the metadata with which objects stored for
+// an image are labeled.
+//
+// Layers are shared between images, and are only labeled with the
+// metadata of the image for which they were first created.
+func ObjectMetadata(s *State, image *Image) storage.Metadata {
+	md := storage.Metadata{
+		storage.MetadataImage:    fmt.Sprintf("%x", sha1.Sum([]byte(image.Name))),
+		storage.MetadataRevision: packageRevision(s, image.Tag),
+		storage.MetadataCreated:  time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if image.Tenant != "" {
+		md[storage.MetadataTenant] = image.Tenant
+	}
+
+	return md
+}
+
+// packageRevision determines the revision of the package set from
+// which an image with the given tag is built.
+func packageRevision(s *State, tag string) string {
+	srcType, srcArgs := s.Cfg.Pkgs.Render(tag)
+
+	switch srcType {
+	case "git":
+		var args map[string]string
+		json.Unmarshal([]byte(srcArgs), &args)
+		if rev, ok := args["rev"]; ok {
+			return rev
+		}
+		return args["ref"]
+	case "nixpkgs":
+		return srcArgs
+	default:
+		return srcType
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements multi-architecture images, which are served as
+// an OCI image index referring to one image per supported platform.
+// Clients pick the image of their own platform from the index, which
+// lets the same image name be used on amd64 and arm64 hosts.
+//
+// Each platform is built (and cached) exactly like an image requested
+// for that platform, so the index only adds the cost of building the
+// images of other platforms. Platforms that this instance refuses to
+// build (see ErrEmulationDisabled) are left out of the index.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/nixery/manifest"
+	log "github.com/sirupsen/logrus"
+)
+
+// buildIndex builds an image for each supported platform and publishes
+// an image index referring to them.
+func buildIndex(ctx context.Context, s *State, image *Image) (*BuildResult, error) {
+	results := make([]*BuildResult, len(Platforms))
+	errs := make([]error, len(Platforms))
+	archs := make([]string, len(Platforms))
+
+	var wg sync.WaitGroup
+	for i, platform := range Platforms {
+		platformImage := *image
+		platformImage.MultiArch = false
+		if err := platformImage.SetPlatform(platform); err != nil {
+			return nil, err
+		}
+		archs[i] = platformImage.Arch.imageArch
+
+		wg.Add(1)
+		go func(i int, platformImage Image) {
+			defer wg.Done()
+			results[i], errs[i] = BuildImage(ctx, s, &platformImage)
+		}(i, platformImage)
+	}
+	wg.Wait()
+
+	var manifests []manifest.Entry
+	var skipped error
+	for i, result := range results {
+		if errors.Is(errs[i], ErrEmulationDisabled) {
+			log.WithFields(log.Fields{
+				"image":    image.Name,
+				"tag":      image.Tag,
+				"platform": Platforms[i],
+			}).Debug("leaving platform out of image index")
+
+			skipped = errs[i]
+			continue
+		}
+
+		if errs[i] != nil {
+			return nil, fmt.Errorf("failed to build image for %s: %w", Platforms[i], errs[i])
+		}
+
+		// Packages that can not be found are reported like for
+		// single images.
+		if result.Error != "" {
+			return result, nil
+		}
+
+		d := manifest.Descriptor(result.Manifest)
+		d.Platform = &manifest.Platform{
+			Architecture: archs[i],
+			OS:           "linux",
+		}
+		manifests = append(manifests, d)
+	}
+
+	if len(manifests) == 0 {
+		return nil, skipped
+	}
+
+	index := manifest.Index(manifests)
+	digest, published := s.Cache.publishedManifest(index)
+	if !published {
+		var err error
+		if digest, err = PersistManifest(ctx, s, index); err != nil {
+			return nil, err
+		}
+		s.Cache.markPublished(digest)
+	}
+
+	return &BuildResult{
+		Manifest: index,
+		Digest:   digest,
+	}, nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/nixery/config"
+	"github.com/google/nixery/manifest"
+)
+
+func TestBuildIndex(t *testing.T) {
+	ctx := context.Background()
+	s := newTestState(t)
+	s.Cfg = config.Config{Pkgs: commitSource{}}
+	tag := strings.Repeat("a", 40)
+
+	// The images of both platforms are cached, so that no builds are
+	// required.
+	expected := make(map[string]string)
+	for _, platform := range Platforms {
+		image := ImageFromName("shell", tag)
+		image.SetPlatform(platform)
+
+		m, _ := manifest.Manifest(image.Arch.imageArch, nil, manifest.RuntimeConfig{}, nil)
+		cacheManifest(ctx, s, imageCacheKey(s, &image), m)
+		expected[image.Arch.imageArch] = manifest.Descriptor(m).Digest
+	}
+
+	image := ImageFromName("shell", tag)
+	image.MultiArch = true
+
+	result, err := BuildImage(ctx, s, &image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := manifest.ParseIndex(result.Manifest)
+	if err != nil {
+		t.Fatalf("invalid index %s: %s", result.Manifest, err)
+	}
+	if len(index.Manifests) != len(Platforms) {
+		t.Fatalf("expected %d manifests in %s", len(Platforms), result.Manifest)
+	}
+
+	for _, d := range index.Manifests {
+		if d.Platform == nil || d.Platform.OS != "linux" || d.Digest != expected[d.Platform.Architecture] {
+			t.Errorf("unexpected manifest in index: %+v", d)
+		}
+	}
+
+	// The index is published, so that clients can fetch it by digest.
+	if _, published := s.Cache.publishedManifest(result.Manifest); !published {
+		t.Error("index was not published")
+	}
+	if result.Digest != manifest.Descriptor(result.Manifest).Digest {
+		t.Errorf("unexpected digest %s of index", result.Digest)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements named pins, which save a revision of the package
+// set under a name chosen by a team (e.g. `team-x-2024-06`). The name
+// can be used as an image tag and keeps resolving to the same revision
+// until the pin is explicitly advanced, which lets teams decide when to
+// absorb changes to the package set.
+//
+// Named pins are stored at `pins/<name>` in the storage backend, and
+// kept in memory for resolving tags. Pins created by a tenant can only
+// be changed by that tenant (or with the admin token).
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// NamedPinRefreshInterval is the interval at which named pins changed
+// on other replicas are loaded.
+const NamedPinRefreshInterval = 5 * time.Minute
+
+// NamedPin describes a revision saved under a name.
+type NamedPin = api.NamedPin
+
+var (
+	// ErrInvalidPin is returned for named pins that can not be saved.
+	ErrInvalidPin = errors.New("invalid named pin")
+
+	// ErrUnknownPin is returned for named pins that do not exist.
+	ErrUnknownPin = errors.New("unknown named pin")
+
+	// ErrPinOwner is returned when changing a named pin of another
+	// tenant.
+	ErrPinOwner = errors.New("named pin belongs to another tenant")
+)
+
+// Names of named pins follow the syntax of image tags.
+var pinNameRegex = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+func namedPinPath(name string) string {
+	return "pins/" + name
+}
+
+// resolveNamed resolves the tag of an image if it is the name of a
+// named pin, and reports whether it was resolved.
+func (t *PinTracker) resolveNamed(image *Image) bool {
+	if t == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pin, ok := t.named[image.Tag]
+	if ok {
+		image.Tag = pin.Revision
+	}
+
+	return ok
+}
+
+// NamedPins returns all named pins, sorted by name.
+func (t *PinTracker) NamedPins() []NamedPin {
+	pins := []NamedPin{}
+	if t == nil {
+		return pins
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, pin := range t.named {
+		pins = append(pins, pin)
+	}
+
+	sort.Slice(pins, func(i, j int) bool {
+		return pins[i].Name < pins[j].Name
+	})
+
+	return pins
+}
+
+// RefreshNamed loads all named pins from the storage backend.
+func (t *PinTracker) RefreshNamed(ctx context.Context, s storage.Backend) error {
+	if t == nil {
+		return nil
+	}
+
+	objects, err := s.List(ctx, "pins/")
+	if err != nil {
+		return fmt.Errorf("failed to list named pins: %w", err)
+	}
+
+	named := make(map[string]NamedPin)
+	for _, obj := range objects {
+		r, err := s.Fetch(ctx, obj.Path)
+		if err != nil {
+			return fmt.Errorf("failed to fetch named pin %s: %w", obj.Path, err)
+		}
+
+		var pin NamedPin
+		err = json.NewDecoder(r).Decode(&pin)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("invalid named pin %s: %w", obj.Path, err)
+		}
+
+		named[pin.Name] = pin
+	}
+
+	t.mu.Lock()
+	t.named = named
+	t.mu.Unlock()
+
+	return nil
+}
+
+// owned returns the named pin of the given name, if the tenant may
+// change it.
+func (t *PinTracker) owned(name, tenant string, admin bool) (NamedPin, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pin, ok := t.named[name]
+	if ok && !admin && pin.Tenant != tenant {
+		return pin, ok, ErrPinOwner
+	}
+
+	return pin, ok, nil
+}
+
+// SaveNamedPin creates a named pin or advances an existing one to the
+// given revision, or to the current pin of `latest` if it is empty.
+func (t *PinTracker) SaveNamedPin(ctx context.Context, s *State, name, revision, tenant string, admin bool) (*NamedPin, error) {
+	if t == nil {
+		return nil, fmt.Errorf("%w: pinning is not supported by the package source", ErrInvalidPin)
+	}
+
+	if !pinNameRegex.MatchString(name) || name == "latest" || pinRegex.MatchString(name) {
+		return nil, fmt.Errorf("%w: invalid name %q", ErrInvalidPin, name)
+	}
+
+	if revision == "" {
+		t.mu.Lock()
+		revision = t.current
+		t.mu.Unlock()
+
+		if revision == "" {
+			return nil, fmt.Errorf("%w: `latest` is not pinned, a revision must be given", ErrInvalidPin)
+		}
+	}
+
+	if !pinRegex.MatchString(revision) {
+		return nil, fmt.Errorf("%w: revision must be a full commit hash: %q", ErrInvalidPin, revision)
+	}
+
+	pin, exists, err := t.owned(name, tenant, admin)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !exists {
+		pin = NamedPin{
+			Name:    name,
+			Tenant:  tenant,
+			Created: now,
+		}
+	}
+	pin.Revision = revision
+	pin.Advanced = now
+
+	j, _ := json.Marshal(pin)
+	_, _, err = s.Storage.Persist(ctx, namedPinPath(name), "application/json", func(w io.Writer) (string, int64, error) {
+		n, err := io.Copy(w, bytes.NewReader(j))
+		return "", n, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to persist named pin: %w", err)
+	}
+
+	t.mu.Lock()
+	t.named[name] = pin
+	t.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"name":     name,
+		"revision": revision,
+		"tenant":   tenant,
+	}).Info("saved named pin")
+
+	return &pin, nil
+}
+
+// DeleteNamedPin deletes a named pin, after which its name no longer
+// resolves.
+func (t *PinTracker) DeleteNamedPin(ctx context.Context, s *State, name, tenant string, admin bool) error {
+	if t == nil {
+		return ErrUnknownPin
+	}
+
+	_, exists, err := t.owned(name, tenant, admin)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUnknownPin
+	}
+
+	if err := s.Storage.Delete(ctx, namedPinPath(name)); err != nil {
+		return fmt.Errorf("failed to delete named pin: %w", err)
+	}
+
+	t.mu.Lock()
+	delete(t.named, name)
+	t.mu.Unlock()
+
+	log.WithField("name", name).Info("deleted named pin")
+	return nil
+}
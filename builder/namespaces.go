@@ -0,0 +1,84 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements repository namespaces, which separate the images
+// of organisational units (e.g. teams) under a common prefix such as
+// `team-a/shell/git`. The namespace determines the tenant of its
+// images (and thereby their quota), the pin from which `latest` is
+// built and the packages that its images may contain.
+//
+// Only namespaces that are explicitly configured are recognised, so the
+// first component of other image names is still treated as a package.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/nixery/config"
+)
+
+// ErrNamespacePolicy is returned for images containing packages that
+// their namespace does not allow.
+var ErrNamespacePolicy = errors.New("package not allowed in namespace")
+
+// ValidateNamespaces rejects namespaces whose names would be ambiguous
+// with meta-packages.
+func ValidateNamespaces(namespaces map[string]config.Namespace) error {
+	for _, p := range MetaPackages {
+		if _, ok := namespaces[p]; ok {
+			return fmt.Errorf("namespace %q is ambiguous with the meta-package of the same name", p)
+		}
+	}
+
+	return nil
+}
+
+// ResolveNamespace splits a configured namespace off the front of an
+// image name, and returns the rest of the name with the namespace.
+// Other names are returned unchanged with a nil namespace.
+func ResolveNamespace(namespaces map[string]config.Namespace, name string) (string, *config.Namespace) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 {
+		return name, nil
+	}
+
+	ns, ok := namespaces[parts[0]]
+	if !ok {
+		return name, nil
+	}
+
+	return parts[1], &ns
+}
+
+// ApplyNamespace applies the configuration of the namespace in which an
+// image was requested, if any. An error wrapping ErrNamespacePolicy is
+// returned if the namespace does not allow the image's packages.
+func ApplyNamespace(ns *config.Namespace, image *Image) error {
+	if ns == nil {
+		return nil
+	}
+
+	image.Tenant = ns.Tenant
+	if ns.Pin != "" && (image.Tag == "latest" || image.Tag == "") {
+		image.Tag = ns.Pin
+	}
+
+	if len(ns.Packages) == 0 {
+		return nil
+	}
+
+	allowed := make(map[string]bool)
+	for _, p := range ns.Packages {
+		allowed[p] = true
+	}
+
+	for _, p := range image.Packages {
+		if !allowed[p] && !basePackages[p] {
+			return fmt.Errorf("%w: %q is not allowed in namespace %q", ErrNamespacePolicy, p, ns.Name)
+		}
+	}
+
+	return nil
+}
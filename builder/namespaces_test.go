@@ -0,0 +1,59 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/nixery/config"
+)
+
+var testNamespaces = map[string]config.Namespace{
+	"team-a": {Name: "team-a", Tenant: "a", Pin: "stable", Packages: []string{"git", "curl"}},
+}
+
+func TestResolveNamespace(t *testing.T) {
+	name, ns := ResolveNamespace(testNamespaces, "team-a/git/curl")
+	if name != "git/curl" || ns == nil || ns.Name != "team-a" {
+		t.Errorf("namespace was not resolved: %q, %+v", name, ns)
+	}
+
+	for _, n := range []string{"team-a", "git/curl", "team-b/git"} {
+		if name, ns := ResolveNamespace(testNamespaces, n); name != n || ns != nil {
+			t.Errorf("%q was resolved to namespace %+v", n, ns)
+		}
+	}
+}
+
+func TestApplyNamespace(t *testing.T) {
+	ns := testNamespaces["team-a"]
+
+	image := ImageFromName("git/curl", "latest")
+	if err := ApplyNamespace(&ns, &image); err != nil {
+		t.Fatal(err)
+	}
+	if image.Tenant != "a" || image.Tag != "stable" {
+		t.Errorf("namespace was not applied: tenant %q, tag %q", image.Tenant, image.Tag)
+	}
+
+	image = ImageFromName("git", "v1")
+	if err := ApplyNamespace(&ns, &image); err != nil || image.Tag != "v1" {
+		t.Errorf("explicit tag was replaced with %q (%v)", image.Tag, err)
+	}
+
+	image = ImageFromName("git/htop", "latest")
+	if err := ApplyNamespace(&ns, &image); !errors.Is(err, ErrNamespacePolicy) {
+		t.Errorf("package outside of the namespace policy was allowed: %v", err)
+	}
+}
+
+func TestValidateNamespaces(t *testing.T) {
+	if err := ValidateNamespaces(testNamespaces); err != nil {
+		t.Error(err)
+	}
+
+	if err := ValidateNamespaces(map[string]config.Namespace{"shell": {}}); err == nil {
+		t.Error("namespace named like a meta-package was accepted")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the negative cache of the local cache, which
+// remembers for a short time that cache entries do not exist in the
+// storage backend.
+//
+// During a burst of requests for images that are being built, every
+// layer of every request would otherwise be probed in the storage
+// backend (which for GCS takes two billed operations) on every
+// replica, only to find that it does not exist yet. Entries that are
+// cached locally (after a build or through replication) immediately
+// replace negative entries.
+
+import "time"
+
+// Number of negative entries above which expired entries are removed.
+const missingSweepSize = 10000
+
+// SetNegativeTTL sets the time for which storage paths that were not
+// found are remembered as missing (0 disables the negative cache).
+func (c *LocalCache) SetNegativeTTL(ttl time.Duration) {
+	c.nmtx.Lock()
+	c.nttl = ttl
+	c.nmtx.Unlock()
+}
+
+// knownMissing reports whether a storage path was recently found to be
+// missing.
+func (c *LocalCache) knownMissing(path string) bool {
+	c.nmtx.Lock()
+	defer c.nmtx.Unlock()
+
+	at, ok := c.missing[path]
+	if ok && time.Since(at) >= c.nttl {
+		delete(c.missing, path)
+		return false
+	}
+
+	return ok
+}
+
+// markMissing records that a storage path was not found.
+func (c *LocalCache) markMissing(path string) {
+	c.nmtx.Lock()
+	defer c.nmtx.Unlock()
+
+	if c.nttl == 0 {
+		return
+	}
+
+	if len(c.missing) >= missingSweepSize {
+		for p, at := range c.missing {
+			if time.Since(at) >= c.nttl {
+				delete(c.missing, p)
+			}
+		}
+	}
+
+	c.missing[path] = time.Now()
+}
+
+// clearMissing removes the negative entry of a storage path that is
+// known to exist.
+func (c *LocalCache) clearMissing(path string) {
+	c.nmtx.Lock()
+	delete(c.missing, path)
+	c.nmtx.Unlock()
+}
@@ -0,0 +1,50 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/nixery/manifest"
+)
+
+func TestNegativeCache(t *testing.T) {
+	s := newTestState(t)
+	s.Cache.SetLayerTTL(0)
+	s.Cache.SetNegativeTTL(time.Minute)
+
+	ctx := context.Background()
+
+	if _, ok := layerFromCache(ctx, s, "missing"); ok {
+		t.Fatal("missing layer was found")
+	}
+
+	// Entries written by other instances are not seen while the
+	// negative entry is fresh.
+	j, _ := json.Marshal(manifest.Entry{Digest: "sha256:0000"})
+	s.Storage.Persist(ctx, "builds/missing", "", func(w io.Writer) (string, int64, error) {
+		n, err := w.Write(j)
+		return "", int64(n), err
+	})
+	if _, ok := layerFromCache(ctx, s, "missing"); ok {
+		t.Error("negative entry was not used")
+	}
+
+	// Positive results replace negative entries immediately.
+	cacheLayer(ctx, s, "missing", manifest.Entry{Digest: "sha256:0000"})
+	if _, ok := layerFromCache(ctx, s, "missing"); !ok {
+		t.Error("cached layer was hidden by negative entry")
+	}
+
+	if _, ok := manifestFromCache(ctx, s, "missing"); ok {
+		t.Fatal("missing manifest was found")
+	}
+	cacheManifest(ctx, s, "missing", json.RawMessage(`{"schemaVersion":2}`))
+	if _, ok := manifestFromCache(ctx, s, "missing"); !ok {
+		t.Error("cached manifest was hidden by negative entry")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the parsing of Nix's `internal-json` log format,
+// which the realisation stage is invoked with. Its activities are used
+// to time the builds and downloads of individual derivations, so that
+// slow builds can be attributed to the derivations responsible for
+// them.
+//
+// Messages and build logs contained in the JSON log are converted back
+// to the lines Nix would have printed in its regular log format.
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/logs"
+)
+
+// Prefix of the lines written in the `internal-json` log format.
+const internalJSONPrefix = "@nix "
+
+// Number of derivation timings retained per command, slowest first.
+const derivationTimings = 50
+
+// Activity and result types of the `internal-json` log format.
+const (
+	actBuild        = 105
+	actSubstitute   = 108
+	resBuildLogLine = 101
+)
+
+// Verbosity levels of Nix up to which activities are printed in the
+// regular log format, with and without `--verbose`.
+const (
+	lvlInfo      = 3
+	lvlTalkative = 4
+)
+
+// DerivationTiming describes the time spent on a single derivation.
+type DerivationTiming = api.DerivationTiming
+
+// nixLogMessage is a line of the `internal-json` log format.
+type nixLogMessage struct {
+	Action string        `json:"action"`
+	ID     uint64        `json:"id"`
+	Type   int           `json:"type"`
+	Level  int           `json:"level"`
+	Msg    string        `json:"msg"`
+	Text   string        `json:"text"`
+	Fields []interface{} `json:"fields"`
+}
+
+type nixActivity struct {
+	path    string
+	action  string
+	started time.Time
+}
+
+// nixLogParser converts the lines of the `internal-json` log format of
+// a command, and times the activities contained in them.
+type nixLogParser struct {
+	activities map[uint64]nixActivity
+	timings    []DerivationTiming
+}
+
+func newNixLogParser() *nixLogParser {
+	return &nixLogParser{
+		activities: make(map[uint64]nixActivity),
+	}
+}
+
+// parse processes a line of output, and returns the line as it would
+// have been printed in the regular log format. Lines that would not
+// have been printed are dropped.
+func (p *nixLogParser) parse(line string) (string, bool) {
+	if !strings.HasPrefix(line, internalJSONPrefix) {
+		return line, true
+	}
+
+	var msg nixLogMessage
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, internalJSONPrefix)), &msg); err != nil {
+		return line, true
+	}
+
+	level := lvlInfo
+	if logs.VerboseNix() {
+		level = lvlTalkative
+	}
+
+	switch msg.Action {
+	case "msg":
+		return msg.Msg, true
+
+	case "start":
+		var action string
+		switch msg.Type {
+		case actBuild:
+			action = "build"
+		case actSubstitute:
+			action = "download"
+		}
+
+		if path, ok := firstField(msg.Fields); ok && action != "" {
+			p.activities[msg.ID] = nixActivity{
+				path:    path,
+				action:  action,
+				started: time.Now(),
+			}
+		}
+
+		return msg.Text, msg.Text != "" && msg.Level <= level
+
+	case "stop":
+		if a, ok := p.activities[msg.ID]; ok {
+			delete(p.activities, msg.ID)
+			p.record(a, false)
+		}
+
+	case "result":
+		if msg.Type == resBuildLogLine {
+			return firstField(msg.Fields)
+		}
+	}
+
+	return "", false
+}
+
+// firstField returns the first field of a message if it is a string.
+func firstField(fields []interface{}) (string, bool) {
+	if len(fields) == 0 {
+		return "", false
+	}
+
+	s, ok := fields[0].(string)
+	return s, ok
+}
+
+func (p *nixLogParser) record(a nixActivity, unfinished bool) {
+	p.timings = append(p.timings, DerivationTiming{
+		Path:       a.path,
+		Action:     a.action,
+		Seconds:    time.Since(a.started).Seconds(),
+		Unfinished: unfinished,
+	})
+}
+
+// finish returns the timings of the slowest derivations, including the
+// ones that were still in progress when the command exited.
+func (p *nixLogParser) finish() []DerivationTiming {
+	for id, a := range p.activities {
+		delete(p.activities, id)
+		p.record(a, true)
+	}
+
+	sort.SliceStable(p.timings, func(i, j int) bool {
+		return p.timings[i].Seconds > p.timings[j].Seconds
+	})
+
+	if len(p.timings) > derivationTimings {
+		return p.timings[:derivationTimings]
+	}
+
+	return p.timings
+}
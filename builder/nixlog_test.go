@@ -0,0 +1,52 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"testing"
+)
+
+func TestNixLogParser(t *testing.T) {
+	p := newNixLogParser()
+
+	lines := []struct {
+		line     string
+		expected string
+		shown    bool
+	}{
+		{"nixery-stage: evaluated /nix/store/a.drv", "nixery-stage: evaluated /nix/store/a.drv", true},
+		{`@nix {"action":"start","id":1,"level":3,"type":105,"text":"building '/nix/store/b.drv'","fields":["/nix/store/b.drv","",1,1],"parent":0}`, "building '/nix/store/b.drv'", true},
+		{`@nix {"action":"start","id":2,"level":3,"type":108,"text":"copying path '/nix/store/c'","fields":["/nix/store/c","https://cache.nixos.org"],"parent":0}`, "copying path '/nix/store/c'", true},
+		{`@nix {"action":"start","id":3,"level":5,"type":0,"text":"querying info","fields":[],"parent":0}`, "querying info", false},
+		{`@nix {"action":"result","id":1,"type":101,"fields":["compiling"]}`, "compiling", true},
+		{`@nix {"action":"stop","id":2}`, "", false},
+		{`@nix {"action":"msg","level":0,"msg":"error: build failed"}`, "error: build failed", true},
+	}
+
+	for _, l := range lines {
+		line, shown := p.parse(l.line)
+		if shown != l.shown || (shown && line != l.expected) {
+			t.Errorf("%s was converted to (%q, %v), expected (%q, %v)", l.line, line, shown, l.expected, l.shown)
+		}
+	}
+
+	timings := p.finish()
+	if len(timings) != 2 {
+		t.Fatalf("expected 2 timings, got %v", timings)
+	}
+
+	for _, timing := range timings {
+		switch timing.Path {
+		case "/nix/store/b.drv":
+			if timing.Action != "build" || !timing.Unfinished {
+				t.Errorf("unexpected timing of the build: %+v", timing)
+			}
+		case "/nix/store/c":
+			if timing.Action != "download" || timing.Unfinished {
+				t.Errorf("unexpected timing of the download: %+v", timing)
+			}
+		default:
+			t.Errorf("unexpected timing: %+v", timing)
+		}
+	}
+}
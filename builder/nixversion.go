@@ -0,0 +1,119 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the detection of the Nix version installed on
+// the host, which determines how Nix is invoked by Nixery's wrapper
+// scripts.
+//
+// Two invocation strategies are supported:
+//
+// * `legacy` uses nix-build, which is available in all versions of Nix
+// * `nix-command` uses `nix build` with the experimental CLI enabled, for Nix 2.8+ and Lix
+//
+// The wrapper scripts read the selected strategy from the environment.
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Invocation strategies understood by the wrapper scripts.
+const (
+	NixLegacy  = "legacy"
+	NixCommand = "nix-command"
+)
+
+var nixVersionRegex = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// NixVersion describes an installed Nix implementation.
+type NixVersion struct {
+	Implementation string // "nix" or "lix"
+	Major          int
+	Minor          int
+	Patch          int
+}
+
+func (v NixVersion) String() string {
+	return fmt.Sprintf("%s %d.%d.%d", v.Implementation, v.Major, v.Minor, v.Patch)
+}
+
+// parseNixVersion parses the output of `nix --version`, for example
+// `nix (Nix) 2.18.1` or `nix (Lix, like Nix) 2.91.0`.
+func parseNixVersion(output string) (NixVersion, error) {
+	m := nixVersionRegex.FindStringSubmatch(output)
+	if m == nil {
+		return NixVersion{}, fmt.Errorf("unrecognised Nix version: %q", strings.TrimSpace(output))
+	}
+
+	v := NixVersion{Implementation: "nix"}
+	if strings.Contains(output, "Lix") {
+		v.Implementation = "lix"
+	}
+
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	v.Patch, _ = strconv.Atoi(m[3])
+
+	return v, nil
+}
+
+// Strategy returns the invocation strategy suitable for a Nix version.
+func (v NixVersion) Strategy() string {
+	if v.Implementation == "lix" || v.Major > 2 || (v.Major == 2 && v.Minor >= 8) {
+		return NixCommand
+	}
+
+	return NixLegacy
+}
+
+// ConfigureNix detects the Nix installation on the PATH and configures
+// the environment of the wrapper scripts to use it.
+//
+// An explicitly configured strategy (`NIXERY_NIX_CLI`) takes
+// precedence over the detected one. If no Nix is found on the PATH,
+// the wrapper scripts use the Nix they were built with.
+func ConfigureNix() error {
+	nix, err := exec.LookPath("nix")
+	if err != nil {
+		log.Info("no Nix installation found on PATH, using bundled Nix")
+		return nil
+	}
+
+	out, err := exec.Command(nix, "--version").Output()
+	if err != nil {
+		return fmt.Errorf("failed to determine Nix version: %s", err)
+	}
+
+	version, err := parseNixVersion(string(out))
+	if err != nil {
+		return err
+	}
+
+	strategy := os.Getenv("NIXERY_NIX_CLI")
+	switch strategy {
+	case "", "auto":
+		strategy = version.Strategy()
+	case NixLegacy, NixCommand:
+	default:
+		return fmt.Errorf("invalid NIXERY_NIX_CLI: %q", strategy)
+	}
+
+	os.Setenv("NIXERY_NIX_CLI", strategy)
+	os.Setenv("NIXERY_NIX_BIN", filepath.Dir(nix))
+
+	log.WithFields(log.Fields{
+		"version":  version.String(),
+		"path":     nix,
+		"strategy": strategy,
+	}).Info("detected Nix installation")
+
+	return nil
+}
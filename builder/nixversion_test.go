@@ -0,0 +1,32 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import "testing"
+
+func TestParseNixVersion(t *testing.T) {
+	cases := []struct {
+		output   string
+		version  NixVersion
+		strategy string
+	}{
+		{"nix (Nix) 2.3.16\n", NixVersion{"nix", 2, 3, 16}, NixLegacy},
+		{"nix (Nix) 2.24.9\n", NixVersion{"nix", 2, 24, 9}, NixCommand},
+		{"nix (Lix, like Nix) 2.91.1\n", NixVersion{"lix", 2, 91, 1}, NixCommand},
+	}
+
+	for _, c := range cases {
+		v, err := parseNixVersion(c.output)
+		if err != nil {
+			t.Fatalf("parseNixVersion(%q) failed: %s", c.output, err)
+		}
+
+		if v != c.version {
+			t.Errorf("parseNixVersion(%q) = %v, expected %v", c.output, v, c.version)
+		}
+
+		if s := v.Strategy(); s != c.strategy {
+			t.Errorf("strategy for %v = %s, expected %s", v, s, c.strategy)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the handling of packages whose licenses forbid
+// redistribution (`meta.license.redistributable = false` in nixpkgs).
+//
+// If NIXERY_NONDISTRIBUTABLE_URL is set, layers containing such
+// packages are described with Docker's non-distributable (foreign)
+// layer media type, and clients fetch them from the approved source at
+// that URL instead of the registry. The layers are still stored in the
+// storage backend, from which the approved source can be populated.
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/google/nixery/manifest"
+)
+
+// NondistributableAnnotation lists the packages whose licenses forbid
+// redistribution on the descriptors of the layers containing them.
+const NondistributableAnnotation = "dev.nixery.nondistributable"
+
+// nondistributablePackage is a requested package whose license forbids
+// redistribution, as reported by the Nix build.
+type nondistributablePackage struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// restrictedPaths maps the store paths of nondistributable packages to
+// their names.
+func restrictedPaths(result *ImageResult) map[string][]string {
+	paths := make(map[string][]string)
+	for _, p := range result.Nondistributable {
+		paths[p.Path] = append(paths[p.Path], p.Name)
+	}
+	return paths
+}
+
+// restrictedPackages returns the sorted names of the nondistributable
+// packages among the store paths of a layer.
+func restrictedPackages(restricted map[string][]string, contents []string) []string {
+	var pkgs []string
+	for _, p := range contents {
+		pkgs = append(pkgs, restricted[p]...)
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+// nondistributableLayers describes the layers containing
+// nondistributable packages as foreign layers hosted under the given
+// base URL.
+func nondistributableLayers(baseURL string, entries []manifest.Entry) []manifest.Entry {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	result := make([]manifest.Entry, len(entries))
+	for i, e := range entries {
+		if len(e.Nondistributable) > 0 {
+			annotations := map[string]string{
+				NondistributableAnnotation: strings.Join(e.Nondistributable, ","),
+			}
+			for k, v := range e.Annotations {
+				annotations[k] = v
+			}
+
+			e.MediaType = manifest.ForeignLayerType
+			e.URLs = []string{baseURL + "/" + strings.TrimPrefix(e.Digest, "sha256:")}
+			e.Annotations = annotations
+		}
+		result[i] = e
+	}
+
+	return result
+}
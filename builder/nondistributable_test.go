@@ -0,0 +1,43 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/nixery/manifest"
+)
+
+func TestNondistributableLayers(t *testing.T) {
+	result := &ImageResult{
+		Nondistributable: []nondistributablePackage{
+			{Name: "unrar", Path: "/nix/store/aaa-unrar-6.0"},
+		},
+	}
+	restricted := restrictedPaths(result)
+
+	entries := []manifest.Entry{
+		{Digest: "sha256:free", Nondistributable: restrictedPackages(restricted, []string{"/nix/store/bbb-glibc"})},
+		{Digest: "sha256:unfree", Nondistributable: restrictedPackages(restricted, []string{"/nix/store/aaa-unrar-6.0"})},
+	}
+
+	layers := nondistributableLayers("https://internal.example.com/", entries)
+	layers = foreignLayers("https://cdn.example.com", layers)
+
+	if layers[1].MediaType != manifest.ForeignLayerType {
+		t.Errorf("unexpected media type %q", layers[1].MediaType)
+	}
+
+	if expected := []string{"https://internal.example.com/unfree"}; !reflect.DeepEqual(layers[1].URLs, expected) {
+		t.Errorf("nondistributable layer has URLs %v, expected %v", layers[1].URLs, expected)
+	}
+
+	if layers[1].Annotations[NondistributableAnnotation] != "unrar" {
+		t.Errorf("unexpected annotations %v", layers[1].Annotations)
+	}
+
+	if expected := []string{"https://cdn.example.com/free"}; !reflect.DeepEqual(layers[0].URLs, expected) {
+		t.Errorf("distributable layer has URLs %v, expected %v", layers[0].URLs, expected)
+	}
+}
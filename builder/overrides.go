@@ -0,0 +1,86 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements package flags, which let users request packages
+// with some of their build options changed, for example `ffmpeg!vaapi`.
+// Flags are mapped to arguments of the package's `override` function
+// by operators (see NIXERY_OVERRIDES), which keeps users from
+// evaluating arbitrary expressions.
+//
+// Registry image names can not contain `!`, so flags can also be
+// separated by `__` (e.g. `ffmpeg__vaapi`) for packages that have flags.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/nixery/config"
+)
+
+// ErrUnknownFlag is returned for packages requested with flags that
+// are not configured.
+var ErrUnknownFlag = errors.New("unknown package flag")
+
+// splitFlags splits a package name into the package and its flags.
+func splitFlags(pkg string) (string, []string) {
+	parts := strings.Split(strings.ReplaceAll(pkg, "__", "!"), "!")
+	return parts[0], parts[1:]
+}
+
+// resolveFlags replaces packages requested with flags by their
+// canonical name (`<package>!<flag>...` with sorted flags), and records
+// the override arguments of each of them in the image.
+func resolveFlags(overrides map[string]map[string]config.Override, image *Image) error {
+	resolved := make(map[string]config.Override)
+	pkgs := make([]string, 0, len(image.Packages))
+
+	for _, p := range image.Packages {
+		if !strings.Contains(p, "!") && !strings.Contains(p, "__") {
+			pkgs = append(pkgs, p)
+			continue
+		}
+
+		base, flags := splitFlags(p)
+		available, ok := overrides[base]
+
+		// Names containing `__` may be regular packages.
+		if !ok && !strings.Contains(p, "!") {
+			pkgs = append(pkgs, p)
+			continue
+		}
+
+		sort.Strings(flags)
+		args := make(config.Override)
+		var canonical []string
+		for i, flag := range flags {
+			if i > 0 && flag == flags[i-1] {
+				continue
+			}
+
+			o, ok := available[flag]
+			if !ok {
+				return fmt.Errorf("%w: %s has no flag %q", ErrUnknownFlag, base, flag)
+			}
+
+			for k, v := range o {
+				args[k] = v
+			}
+			canonical = append(canonical, flag)
+		}
+
+		name := base + "!" + strings.Join(canonical, "!")
+		resolved[name] = args
+		pkgs = append(pkgs, name)
+	}
+
+	if len(resolved) > 0 {
+		sort.Strings(pkgs)
+		image.Packages = pkgs
+		image.Overrides = resolved
+	}
+
+	return nil
+}
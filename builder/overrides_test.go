@@ -0,0 +1,43 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/nixery/config"
+)
+
+func TestResolveFlags(t *testing.T) {
+	overrides := map[string]map[string]config.Override{
+		"ffmpeg": {
+			"vaapi": {"withVaapi": true},
+			"x265":  {"withX265": false},
+		},
+	}
+
+	i := &Image{Packages: []string{"git", "ffmpeg__x265__vaapi", "ffmpeg!vaapi!x265", "hello__world"}}
+	if err := resolveFlags(overrides, i); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"ffmpeg!vaapi!x265", "ffmpeg!vaapi!x265", "git", "hello__world"}
+	if !reflect.DeepEqual(i.Packages, expected) {
+		t.Errorf("unexpected packages: %v", i.Packages)
+	}
+
+	args := config.Override{"withVaapi": true, "withX265": false}
+	if !reflect.DeepEqual(i.Overrides["ffmpeg!vaapi!x265"], args) {
+		t.Errorf("unexpected overrides: %v", i.Overrides)
+	}
+
+	if err := resolveFlags(overrides, &Image{Packages: []string{"ffmpeg!cuda"}}); !errors.Is(err, ErrUnknownFlag) {
+		t.Errorf("expected unknown flag to be rejected, got %v", err)
+	}
+
+	if err := resolveFlags(overrides, &Image{Packages: []string{"git!cuda"}}); !errors.Is(err, ErrUnknownFlag) {
+		t.Errorf("expected flag on unconfigured package to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file configures the parallel evaluation of the requested
+// packages, which the wrapper script delegates to nix-eval-jobs before
+// evaluating the image itself. nix-eval-jobs evaluates the packages in
+// several worker processes, each of which is restarted once it exceeds
+// its memory limit, so images with dozens of packages are evaluated
+// faster and with bounded memory.
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfigureParallelEval passes the number of evaluation workers and
+// their memory limit (in MiB) to the wrapper script. A nix-eval-jobs on
+// the PATH takes precedence over the one bundled with the wrapper.
+func ConfigureParallelEval(workers, memory int) {
+	if workers == 0 {
+		return
+	}
+
+	os.Setenv("NIXERY_EVAL_WORKERS", strconv.Itoa(workers))
+	os.Setenv("NIXERY_EVAL_WORKER_MEMORY", strconv.Itoa(memory))
+
+	entry := log.WithFields(log.Fields{
+		"workers":    workers,
+		"memory_mib": memory,
+	})
+
+	if path, err := exec.LookPath("nix-eval-jobs"); err == nil {
+		os.Setenv("NIXERY_NIX_EVAL_JOBS", path)
+		entry = entry.WithField("path", path)
+	}
+
+	entry.Info("evaluating packages in parallel")
+}
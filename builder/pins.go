@@ -0,0 +1,409 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the pinning of the `latest` tag to a fixed
+// revision of the package set, and the gradual rollout of new pins.
+//
+// Pinning makes `latest` images cacheable. However, when the pin
+// advances, the cached manifests of all images become stale at once
+// and every request would trigger a build. To avoid this, images are
+// migrated to the new pin over a rollout window:
+//
+// * a background task rebuilds known images one at a time, most frequently pulled first
+// * each image is assigned a deadline within the window, again by popularity
+// * until an image is rebuilt or its deadline passes, it is served from the previous pin
+//
+// Images whose closure is identical in both revisions keep their
+// manifest when they are rebuilt (see closures.go), so only images
+// that actually changed are packed and published again.
+//
+// Pins set through the admin API are stored at `pin/latest` in the
+// storage backend, from where they are picked up by other replicas and
+// after restarts. A stored pin takes precedence over NIXERY_PIN.
+//
+// Pull statistics are kept in memory only, which is sufficient for
+// ordering the rollout. Images that have not been pulled for a while
+// are forgotten, and the number of tracked images is bounded.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+var pinRegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// Location of the stored pin of `latest`.
+const pinPath = "pin/latest"
+
+// PinRefreshInterval is the interval at which pins set on other
+// replicas are picked up.
+const PinRefreshInterval = 5 * time.Minute
+
+const (
+	// Time after which images that were not pulled are no longer
+	// migrated to new pins.
+	pinImageRetention = 30 * 24 * time.Hour
+
+	// Maximum number of images whose pulls are tracked.
+	maxPinImages = 10000
+)
+
+// storedPin is the state of the pin persisted in the storage backend.
+type storedPin struct {
+	Current  string    `json:"current"`
+	Previous string    `json:"previous,omitempty"`
+	Started  time.Time `json:"started"`
+}
+
+// PinTracker resolves the `latest` tag to the current pin and manages
+// rollouts of new pins.
+type PinTracker struct {
+	mu sync.Mutex
+
+	// Serialises pin changes, which are persisted without holding
+	// the main lock.
+	advancing sync.Mutex
+
+	current  string
+	previous string
+	window   time.Duration
+	started  time.Time
+
+	// Incremented on every rollout, which stops the background
+	// task of an outdated rollout.
+	generation int
+
+	// Images requested with the `latest` tag, by name
+	images map[string]Image
+	pulls  map[string]uint64
+	seen   map[string]time.Time
+
+	// State of the current rollout
+	deadlines map[string]time.Time
+	migrated  map[string]bool
+	unchanged int
+
+	// Pins saved under a name, which are used as tags
+	named map[string]NamedPin
+}
+
+// NewPinTracker creates a tracker pinning `latest` to the given
+// revision. If the revision is empty, `latest` is not pinned until a
+// pin is set.
+func NewPinTracker(pin string, window time.Duration) *PinTracker {
+	return &PinTracker{
+		current:   pin,
+		window:    window,
+		images:    make(map[string]Image),
+		pulls:     make(map[string]uint64),
+		seen:      make(map[string]time.Time),
+		deadlines: make(map[string]time.Time),
+		migrated:  make(map[string]bool),
+		named:     make(map[string]NamedPin),
+	}
+}
+
+// WithPin resolves the `latest` tag of an image to the pin it should
+// currently be served from, and records the pull. Tags of named pins
+// are resolved to their revision.
+//
+// A nil *PinTracker leaves all images unchanged.
+func (t *PinTracker) WithPin(image *Image) {
+	if t.resolveNamed(image) || t == nil || (image.Tag != "latest" && image.Tag != "") {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.current == "" {
+		return
+	}
+
+	key := image.Name + "@" + image.Arch.imageArch
+	if _, known := t.images[key]; !known && len(t.images) >= maxPinImages {
+		t.forget()
+	}
+	t.images[key] = *image
+	t.pulls[key]++
+	t.seen[key] = time.Now()
+
+	t.resolve(key, image)
+}
+
+// forget removes images that were not pulled within the retention
+// period, or the least recently pulled image if there are none. The
+// caller must hold t.mu.
+func (t *PinTracker) forget() {
+	cutoff := time.Now().Add(-pinImageRetention)
+	var oldest string
+	for key, seen := range t.seen {
+		if seen.Before(cutoff) {
+			t.remove(key)
+		} else if oldest == "" || seen.Before(t.seen[oldest]) {
+			oldest = key
+		}
+	}
+
+	if len(t.images) >= maxPinImages && oldest != "" {
+		t.remove(oldest)
+	}
+}
+
+func (t *PinTracker) remove(key string) {
+	delete(t.images, key)
+	delete(t.pulls, key)
+	delete(t.seen, key)
+}
+
+// Resolve resolves the `latest` tag of an image like WithPin, but
+// without recording a pull.
+func (t *PinTracker) Resolve(image *Image) {
+	if t.resolveNamed(image) || t == nil || (image.Tag != "latest" && image.Tag != "") {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.current == "" {
+		return
+	}
+
+	t.resolve(image.Name+"@"+image.Arch.imageArch, image)
+}
+
+func (t *PinTracker) resolve(key string, image *Image) {
+	image.Tag = t.current
+	if t.rollingOut() && !t.migrated[key] {
+		if deadline, ok := t.deadlines[key]; ok && time.Now().Before(deadline) {
+			image.Tag = t.previous
+		}
+	}
+}
+
+func (t *PinTracker) rollingOut() bool {
+	return t.previous != "" && time.Since(t.started) < t.window
+}
+
+// Status returns the current pin and rollout progress.
+func (t *PinTracker) Status() api.PinStatus {
+	if t == nil {
+		return api.PinStatus{}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := api.PinStatus{Current: t.current}
+	if t.rollingOut() {
+		ends := t.started.Add(t.window)
+		status.Previous = t.previous
+		status.RolloutEnds = &ends
+		status.Migrated = len(t.migrated)
+		status.Pending = len(t.deadlines) - len(t.migrated)
+		status.Unchanged = t.unchanged
+	}
+
+	return status
+}
+
+// advance switches to a new pin and returns the known images in the
+// order in which they should be migrated.
+func (t *PinTracker) advance(pin string) ([]Image, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.switchPin(storedPin{
+		Current:  pin,
+		Previous: t.current,
+		Started:  time.Now(),
+	})
+}
+
+// switchPin switches to the given pin state. The caller must hold t.mu.
+func (t *PinTracker) switchPin(pin storedPin) ([]Image, int) {
+	t.forget()
+
+	t.previous = pin.Previous
+	t.current = pin.Current
+	t.started = pin.Started
+	t.generation++
+	t.deadlines = make(map[string]time.Time)
+	t.migrated = make(map[string]bool)
+	t.unchanged = 0
+
+	var keys []string
+	for key := range t.images {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return t.pulls[keys[i]] > t.pulls[keys[j]]
+	})
+
+	// Deadlines are spread over the window by popularity, with
+	// some jitter so that images of similar popularity do not all
+	// switch at once.
+	var order []Image
+	slot := t.window / time.Duration(len(keys)+1)
+	for i, key := range keys {
+		jitter := time.Duration(rand.Int63n(int64(slot) + 1))
+		t.deadlines[key] = t.started.Add(time.Duration(i+1)*slot + jitter)
+		order = append(order, t.images[key])
+
+		// Pull statistics decay with every rollout, so that the
+		// order follows recent popularity.
+		t.pulls[key] /= 2
+	}
+
+	return order, t.generation
+}
+
+// Advance switches `latest` to a new pin, stores it and starts
+// migrating known images to it in the background.
+func (t *PinTracker) Advance(ctx context.Context, s *State, pin string) error {
+	if t == nil {
+		return fmt.Errorf("pinning is not enabled")
+	}
+
+	if !pinRegex.MatchString(pin) {
+		return fmt.Errorf("pin must be a full commit hash: %q", pin)
+	}
+
+	t.advancing.Lock()
+	defer t.advancing.Unlock()
+
+	t.mu.Lock()
+	if pin == t.current {
+		t.mu.Unlock()
+		return nil
+	}
+	stored := storedPin{Current: pin, Previous: t.current, Started: time.Now()}
+	t.mu.Unlock()
+
+	j, _ := json.Marshal(stored)
+	_, _, err := s.Storage.Persist(ctx, pinPath, "application/json", func(w io.Writer) (string, int64, error) {
+		n, err := io.Copy(w, bytes.NewReader(j))
+		return "", n, err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to persist pin: %w", err)
+	}
+
+	// The pin may have been loaded from storage in the meantime,
+	// in which case the rollout would start from a stale pin.
+	t.mu.Lock()
+	if t.current != stored.Previous {
+		t.mu.Unlock()
+		return fmt.Errorf("pin was changed concurrently to %s", t.current)
+	}
+	order, generation := t.switchPin(stored)
+	t.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"pin":    pin,
+		"images": len(order),
+		"window": t.window,
+	}).Info("rolling out new package set pin")
+
+	go t.rollout(s, pin, order, generation)
+	return nil
+}
+
+// RefreshPin loads the stored pin, and switches to it if it was set on
+// another replica (or before a restart). Images are migrated to it by
+// the replica that set it, so no rollout is started.
+func (t *PinTracker) RefreshPin(ctx context.Context, s storage.Backend) error {
+	if t == nil {
+		return nil
+	}
+
+	r, err := s.Fetch(ctx, pinPath)
+	if storage.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch pin: %w", err)
+	}
+	defer r.Close()
+
+	var stored storedPin
+	if err := json.NewDecoder(r).Decode(&stored); err != nil || !pinRegex.MatchString(stored.Current) {
+		return fmt.Errorf("invalid stored pin: %v", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Pins fetched before a newer one was set must not replace it.
+	if stored.Current == t.current || !stored.Started.After(t.started) {
+		return nil
+	}
+
+	t.switchPin(stored)
+	log.WithFields(log.Fields{
+		"pin":      stored.Current,
+		"previous": stored.Previous,
+	}).Info("loaded package set pin from storage")
+
+	return nil
+}
+
+// rollout rebuilds images for a new pin one at a time, which keeps the
+// load on the builder bounded.
+func (t *PinTracker) rollout(s *State, pin string, order []Image, generation int) {
+	spacing := t.window / time.Duration(2*(len(order)+1))
+	unchanged := 0
+
+	for _, image := range order {
+		time.Sleep(time.Duration(rand.Int63n(int64(spacing) + 1)))
+
+		t.mu.Lock()
+		outdated := t.generation != generation
+		t.mu.Unlock()
+		if outdated {
+			return
+		}
+
+		key := image.Name + "@" + image.Arch.imageArch
+		image.Tag = pin
+		result, err := BuildImage(context.Background(), s, &image)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"image": image.Name,
+				"pin":   pin,
+			}).Warn("failed to migrate image to new pin")
+			continue
+		}
+
+		if result.Reused {
+			unchanged++
+		}
+
+		t.mu.Lock()
+		if t.generation == generation {
+			t.migrated[key] = true
+			t.unchanged = unchanged
+		}
+		t.mu.Unlock()
+	}
+
+	log.WithFields(log.Fields{
+		"pin":       pin,
+		"images":    len(order),
+		"unchanged": unchanged,
+	}).Info("completed migration of images to new pin")
+}
@@ -0,0 +1,212 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/nixery/storage"
+)
+
+const (
+	oldPin = "1111111111111111111111111111111111111111"
+	newPin = "2222222222222222222222222222222222222222"
+)
+
+func TestPinRolloutOrder(t *testing.T) {
+	tracker := NewPinTracker(oldPin, time.Hour)
+
+	popular := ImageFromName("shell/git", "latest")
+	rare := ImageFromName("hello", "latest")
+
+	for i := 0; i < 10; i++ {
+		image := popular
+		tracker.WithPin(&image)
+	}
+
+	image := rare
+	tracker.WithPin(&image)
+	if image.Tag != oldPin {
+		t.Fatalf("expected image to be pinned to %s, got %s", oldPin, image.Tag)
+	}
+
+	order, _ := tracker.advance(newPin)
+	if len(order) != 2 || order[0].Name != popular.Name {
+		t.Fatalf("expected popular image to be migrated first, got %v", order)
+	}
+
+	// Both images are within their deadlines and not yet migrated,
+	// so they are still served from the previous pin.
+	image = rare
+	tracker.WithPin(&image)
+	if image.Tag != oldPin {
+		t.Fatalf("expected unmigrated image to use %s, got %s", oldPin, image.Tag)
+	}
+
+	// Images that were never seen before have no cache entries for
+	// the previous pin and use the new one immediately.
+	image = ImageFromName("htop", "latest")
+	tracker.WithPin(&image)
+	if image.Tag != newPin {
+		t.Fatalf("expected new image to use %s, got %s", newPin, image.Tag)
+	}
+}
+
+func TestNamedPins(t *testing.T) {
+	ctx := context.Background()
+	s := &State{Storage: storage.NewMemoryBackend()}
+	tracker := NewPinTracker(oldPin, time.Hour)
+
+	if _, err := tracker.SaveNamedPin(ctx, s, "team-x", "", "team-x", false); err != nil {
+		t.Fatalf("failed to save named pin: %v", err)
+	}
+
+	// Advancing `latest` leaves the named pin unchanged.
+	tracker.advance(newPin)
+	image := ImageFromName("shell/git", "team-x")
+	tracker.WithPin(&image)
+	if image.Tag != oldPin {
+		t.Fatalf("expected named pin to resolve to %s, got %s", oldPin, image.Tag)
+	}
+
+	if _, err := tracker.SaveNamedPin(ctx, s, "team-x", "", "team-y", false); !errors.Is(err, ErrPinOwner) {
+		t.Errorf("expected pin of another tenant to be rejected, got %v", err)
+	}
+	if _, err := tracker.SaveNamedPin(ctx, s, "latest", "", "team-x", false); !errors.Is(err, ErrInvalidPin) {
+		t.Errorf("expected reserved name to be rejected, got %v", err)
+	}
+
+	// Other replicas load the pin from storage.
+	other := NewPinTracker(oldPin, time.Hour)
+	if err := other.RefreshNamed(ctx, s.Storage); err != nil {
+		t.Fatalf("failed to refresh named pins: %v", err)
+	}
+	if pins := other.NamedPins(); len(pins) != 1 || pins[0].Revision != oldPin || pins[0].Tenant != "team-x" {
+		t.Fatalf("unexpected named pins after refresh: %v", pins)
+	}
+
+	if err := tracker.DeleteNamedPin(ctx, s, "team-x", "", true); err != nil {
+		t.Fatalf("failed to delete named pin: %v", err)
+	}
+	image = ImageFromName("shell/git", "team-x")
+	tracker.WithPin(&image)
+	if image.Tag != "team-x" {
+		t.Errorf("expected deleted pin not to resolve, got %s", image.Tag)
+	}
+}
+
+func TestPinPersisted(t *testing.T) {
+	ctx := context.Background()
+	s := &State{Storage: storage.NewMemoryBackend()}
+
+	tracker := NewPinTracker(oldPin, time.Hour)
+	if err := tracker.Advance(ctx, s, newPin); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other replicas (and restarted ones) pick up the stored pin,
+	// which takes precedence over the configured one.
+	other := NewPinTracker(oldPin, time.Hour)
+	if err := other.RefreshPin(ctx, s.Storage); err != nil {
+		t.Fatal(err)
+	}
+
+	image := ImageFromName("hello", "latest")
+	other.WithPin(&image)
+	if image.Tag != newPin {
+		t.Errorf("expected stored pin %s, got %s", newPin, image.Tag)
+	}
+
+	if status := other.Status(); status.Current != newPin || status.Previous != oldPin {
+		t.Errorf("unexpected status of refreshed tracker: %+v", status)
+	}
+
+	// Without a stored pin, the configured one is kept.
+	fresh := NewPinTracker(oldPin, time.Hour)
+	if err := fresh.RefreshPin(ctx, storage.NewMemoryBackend()); err != nil || fresh.Status().Current != oldPin {
+		t.Errorf("configured pin was not kept: %+v (%v)", fresh.Status(), err)
+	}
+}
+
+func TestPinAdvanceConcurrent(t *testing.T) {
+	ctx := context.Background()
+	s := &State{Storage: storage.NewMemoryBackend()}
+	tracker := NewPinTracker(oldPin, time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 3; i < 10; i++ {
+		wg.Add(1)
+		go func(pin string) {
+			defer wg.Done()
+			if err := tracker.Advance(ctx, s, pin); err != nil {
+				t.Error(err)
+			}
+		}(strings.Repeat(fmt.Sprint(i), 40))
+	}
+	wg.Wait()
+
+	r, err := s.Storage.Fetch(ctx, pinPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored storedPin
+	json.NewDecoder(r).Decode(&stored)
+	r.Close()
+
+	// The stored pin matches the rollout in progress.
+	status := tracker.Status()
+	if stored.Current != status.Current || stored.Previous != status.Previous || status.Previous == oldPin {
+		t.Errorf("stored pin %+v differs from tracker %+v", stored, status)
+	}
+
+	// Pins fetched before the last change do not replace it.
+	stale, _ := json.Marshal(storedPin{Current: newPin, Previous: oldPin, Started: stored.Started.Add(-time.Minute)})
+	s.Storage.Persist(ctx, pinPath, "application/json", func(w io.Writer) (string, int64, error) {
+		n, err := io.Copy(w, bytes.NewReader(stale))
+		return "", n, err
+	})
+	if err := tracker.RefreshPin(ctx, s.Storage); err != nil {
+		t.Fatal(err)
+	}
+	if current := tracker.Status().Current; current != stored.Current {
+		t.Errorf("stale pin replaced %s with %s", stored.Current, current)
+	}
+}
+
+func TestPinImagesBounded(t *testing.T) {
+	tracker := NewPinTracker(oldPin, time.Hour)
+
+	stale := ImageFromName("stale", "latest")
+	tracker.WithPin(&stale)
+	tracker.mu.Lock()
+	for key := range tracker.seen {
+		tracker.seen[key] = time.Now().Add(-2 * pinImageRetention)
+	}
+	tracker.mu.Unlock()
+
+	// Images that were not pulled for a while are not migrated.
+	order, _ := tracker.advance(newPin)
+	if len(order) != 0 {
+		t.Errorf("stale image was migrated: %v", order)
+	}
+
+	for i := 0; i <= maxPinImages; i++ {
+		image := ImageFromName(fmt.Sprintf("image-%d", i), "latest")
+		tracker.WithPin(&image)
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if len(tracker.images) > maxPinImages || len(tracker.pulls) > maxPinImages || len(tracker.seen) > maxPinImages {
+		t.Errorf("tracked images exceed limit: %d images, %d pulls", len(tracker.images), len(tracker.pulls))
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements pools of remote Nix builders, to which the
+// builds of images for a platform are delegated. For example, an
+// instance running on amd64 can build arm64 images natively on a pool
+// of arm64 machines instead of through emulation.
+//
+// Only the realisation of derivations is delegated: evaluation and the
+// assembly of layers still happen on the instance, which receives the
+// built store paths from the builders. Builds waiting for a pool are
+// queued, and builders failing their periodic health check are left
+// out of builds until they recover.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrPoolUnavailable is returned for builds whose builder pool has no
+// healthy builders or whose queue is full.
+var ErrPoolUnavailable = errors.New("builder pool unavailable")
+
+// Interval at which the health of remote builders is checked.
+const BuilderHealthInterval = time.Minute
+
+// Timeout of the health check of a single builder.
+const builderPingTimeout = 30 * time.Second
+
+// pingBuilder checks that a builder accepts connections from Nix.
+var pingBuilder = func(ctx context.Context, uri, sshKey string) error {
+	if sshKey != "" {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return err
+		}
+		q := u.Query()
+		q.Set("ssh-key", sshKey)
+		u.RawQuery = q.Encode()
+		uri = u.String()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, builderPingTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "nix", "--extra-experimental-features", "nix-command", "store", "ping", "--store", uri).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// BuilderPools holds the remote builder pools of an instance.
+//
+// A nil *BuilderPools has no pools, which builds all images locally.
+type BuilderPools struct {
+	pools map[string]*builderPool // keyed by Nix system
+}
+
+type builderPool struct {
+	cfg    config.BuilderPool
+	system string
+	slots  chan struct{}
+
+	mu       sync.Mutex
+	builders []api.BuilderStatus
+	running  int
+	queued   int
+	builds   uint64
+	failures uint64
+	rejected uint64
+	waited   time.Duration
+}
+
+// NewBuilderPools creates the configured builder pools, rejecting pools
+// for unsupported platforms.
+func NewBuilderPools(cfg map[string]config.BuilderPool) (*BuilderPools, error) {
+	p := &BuilderPools{pools: make(map[string]*builderPool)}
+
+	for platform, pc := range cfg {
+		var image Image
+		if err := image.SetPlatform(platform); err != nil {
+			return nil, fmt.Errorf("invalid builder pool: %w", err)
+		}
+
+		system := image.Arch.nixSystem
+		if _, ok := p.pools[system]; ok {
+			return nil, fmt.Errorf("invalid builder pool: several pools for %s", system)
+		}
+
+		pool := &builderPool{
+			cfg:    pc,
+			system: system,
+			slots:  make(chan struct{}, pc.Concurrency),
+		}
+
+		// Builders are assumed to be healthy until they are
+		// first checked.
+		for _, uri := range pc.Builders {
+			pool.builders = append(pool.builders, api.BuilderStatus{URI: uri, Healthy: true})
+		}
+
+		p.pools[system] = pool
+	}
+
+	return p, nil
+}
+
+// pool returns the builder pool of an architecture, if any.
+func (p *BuilderPools) pool(arch *Architecture) *builderPool {
+	if p == nil || arch == nil {
+		return nil
+	}
+
+	return p.pools[arch.nixSystem]
+}
+
+// CheckHealth checks the health of all builders.
+func (p *BuilderPools) CheckHealth(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+
+	var unhealthy []string
+	for _, pool := range p.pools {
+		unhealthy = append(unhealthy, pool.checkHealth(ctx)...)
+	}
+
+	if len(unhealthy) > 0 {
+		sort.Strings(unhealthy)
+		return fmt.Errorf("unhealthy builders: %s", strings.Join(unhealthy, ", "))
+	}
+
+	return nil
+}
+
+// checkHealth pings the builders of a pool concurrently, and returns
+// the URIs of those that failed.
+func (pool *builderPool) checkHealth(ctx context.Context) []string {
+	results := make([]api.BuilderStatus, len(pool.cfg.Builders))
+
+	var wg sync.WaitGroup
+	for i, uri := range pool.cfg.Builders {
+		wg.Add(1)
+		go func(i int, uri string) {
+			defer wg.Done()
+
+			now := time.Now()
+			results[i] = api.BuilderStatus{URI: uri, Healthy: true, CheckedAt: &now}
+			if err := pingBuilder(ctx, uri, pool.cfg.SSHKey); err != nil {
+				results[i].Healthy = false
+				results[i].Error = err.Error()
+			}
+		}(i, uri)
+	}
+	wg.Wait()
+
+	pool.mu.Lock()
+	previous := pool.builders
+	pool.builders = results
+	pool.mu.Unlock()
+
+	var unhealthy []string
+	for i, b := range results {
+		if b.Healthy != previous[i].Healthy {
+			entry := log.WithFields(log.Fields{
+				"builder": b.URI,
+				"system":  pool.system,
+			})
+			if b.Healthy {
+				entry.Info("remote builder recovered")
+			} else {
+				entry.WithField("error", b.Error).Warn("remote builder failed health check")
+			}
+		}
+
+		if !b.Healthy {
+			unhealthy = append(unhealthy, b.URI)
+		}
+	}
+
+	return unhealthy
+}
+
+// machines returns the specification of the healthy builders of a
+// pool, in the format of Nix's `builders` option.
+func (pool *builderPool) machines() string {
+	key := pool.cfg.SSHKey
+	if key == "" {
+		key = "-"
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var machines []string
+	for _, b := range pool.builders {
+		if b.Healthy {
+			machines = append(machines, fmt.Sprintf("%s %s %s %d", b.URI, pool.system, key, pool.cfg.MaxJobs))
+		}
+	}
+
+	return strings.Join(machines, " ; ")
+}
+
+// acquire waits until the pool can run another build, and returns the
+// specification of its healthy builders. The returned function must be
+// called with the result of the build.
+func (pool *builderPool) acquire(ctx context.Context) (string, func(error), error) {
+	machines := pool.machines()
+
+	pool.mu.Lock()
+	if machines == "" || (pool.cfg.MaxQueue > 0 && pool.queued >= pool.cfg.MaxQueue) {
+		pool.rejected++
+		pool.mu.Unlock()
+
+		if machines == "" {
+			return "", nil, fmt.Errorf("%w: no healthy builders for %s", ErrPoolUnavailable, pool.system)
+		}
+		return "", nil, fmt.Errorf("%w: too many builds waiting for %s builders", ErrPoolUnavailable, pool.system)
+	}
+	pool.queued++
+	pool.mu.Unlock()
+
+	start := time.Now()
+	select {
+	case pool.slots <- struct{}{}:
+	case <-ctx.Done():
+		pool.mu.Lock()
+		pool.queued--
+		pool.mu.Unlock()
+		return "", nil, ctx.Err()
+	}
+
+	pool.mu.Lock()
+	pool.queued--
+	pool.running++
+	pool.waited += time.Since(start)
+	pool.mu.Unlock()
+
+	return machines, func(err error) {
+		<-pool.slots
+
+		pool.mu.Lock()
+		pool.running--
+		pool.builds++
+		if err != nil {
+			pool.failures++
+		}
+		pool.mu.Unlock()
+	}, nil
+}
+
+// Status reports the health and usage of all builder pools.
+func (p *BuilderPools) Status() []api.BuilderPoolStatus {
+	status := []api.BuilderPoolStatus{}
+	if p == nil {
+		return status
+	}
+
+	for _, pool := range p.pools {
+		pool.mu.Lock()
+		status = append(status, api.BuilderPoolStatus{
+			Platform:     pool.cfg.Platform,
+			Builders:     append([]api.BuilderStatus(nil), pool.builders...),
+			Concurrency:  pool.cfg.Concurrency,
+			Running:      pool.running,
+			Queued:       pool.queued,
+			Builds:       pool.builds,
+			Failures:     pool.failures,
+			Rejected:     pool.rejected,
+			QueueSeconds: pool.waited.Seconds(),
+		})
+		pool.mu.Unlock()
+	}
+
+	sort.Slice(status, func(i, j int) bool { return status[i].Platform < status[j].Platform })
+	return status
+}
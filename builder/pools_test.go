@@ -0,0 +1,129 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/nixery/config"
+)
+
+func testPools(t *testing.T, pool config.BuilderPool) (*BuilderPools, *builderPool) {
+	pool.Platform = "linux/arm64"
+	pools, err := NewBuilderPools(map[string]config.BuilderPool{pool.Platform: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pools, pools.pool(&arm64)
+}
+
+func TestBuilderPoolsRejectUnknownPlatform(t *testing.T) {
+	_, err := NewBuilderPools(map[string]config.BuilderPool{
+		"linux/s390x": {Builders: []string{"ssh-ng://s390x"}, MaxJobs: 1, Concurrency: 1},
+	})
+	if err == nil {
+		t.Fatal("pool for unknown platform was accepted")
+	}
+}
+
+func TestBuilderPoolMachines(t *testing.T) {
+	pools, pool := testPools(t, config.BuilderPool{
+		Builders:    []string{"ssh-ng://nix@arm64-1", "ssh-ng://nix@arm64-2"},
+		SSHKey:      "/secrets/key",
+		MaxJobs:     4,
+		Concurrency: 8,
+	})
+
+	if pools.pool(&amd64) != nil {
+		t.Error("amd64 builds were routed to the arm64 pool")
+	}
+
+	expected := "ssh-ng://nix@arm64-1 aarch64-linux /secrets/key 4 ; ssh-ng://nix@arm64-2 aarch64-linux /secrets/key 4"
+	if m := pool.machines(); m != expected {
+		t.Errorf("unexpected machines %q", m)
+	}
+
+	// Unhealthy builders are left out of builds.
+	defer func(ping func(context.Context, string, string) error) { pingBuilder = ping }(pingBuilder)
+	pingBuilder = func(ctx context.Context, uri, key string) error {
+		if uri == "ssh-ng://nix@arm64-1" {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	if err := pools.CheckHealth(context.Background()); err == nil {
+		t.Error("unhealthy builder was not reported")
+	}
+
+	if m := pool.machines(); m != "ssh-ng://nix@arm64-2 aarch64-linux /secrets/key 4" {
+		t.Errorf("unexpected machines %q", m)
+	}
+
+	status := pools.Status()
+	if len(status) != 1 || status[0].Platform != "linux/arm64" || status[0].Builders[0].Healthy || status[0].Builders[0].CheckedAt == nil {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestBuilderPoolQueue(t *testing.T) {
+	pools, pool := testPools(t, config.BuilderPool{
+		Builders:    []string{"ssh-ng://nix@arm64-1"},
+		MaxJobs:     1,
+		Concurrency: 1,
+		MaxQueue:    1,
+	})
+
+	ctx := context.Background()
+	_, release, err := pool.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second build waits for the first one to finish.
+	acquired := make(chan func(error))
+	go func() {
+		_, release, _ := pool.acquire(ctx)
+		acquired <- release
+	}()
+
+	for pools.Status()[0].Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full, so further builds are rejected.
+	if _, _, err := pool.acquire(ctx); !errors.Is(err, ErrPoolUnavailable) {
+		t.Errorf("build beyond queue limit was not rejected: %v", err)
+	}
+
+	release(errors.New("build failed"))
+	second := <-acquired
+	second(nil)
+
+	status := pools.Status()[0]
+	if status.Running != 0 || status.Queued != 0 || status.Builds != 2 || status.Failures != 1 || status.Rejected != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestBuilderPoolWithoutHealthyBuilders(t *testing.T) {
+	pools, pool := testPools(t, config.BuilderPool{
+		Builders:    []string{"ssh-ng://nix@arm64-1"},
+		MaxJobs:     1,
+		Concurrency: 1,
+	})
+
+	defer func(ping func(context.Context, string, string) error) { pingBuilder = ping }(pingBuilder)
+	pingBuilder = func(ctx context.Context, uri, key string) error {
+		return errors.New("connection refused")
+	}
+	pools.CheckHealth(context.Background())
+
+	if _, _, err := pool.acquire(context.Background()); !errors.Is(err, ErrPoolUnavailable) {
+		t.Errorf("build without healthy builders was not rejected: %v", err)
+	}
+}
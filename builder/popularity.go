@@ -0,0 +1,401 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the derivation of package popularity from the
+// access logs of the registry, which replaces the popularity data set
+// (computed from Hydra jobs) once logs have been ingested. Packages
+// that are part of many pulled images are then more likely to be
+// placed in separate layers, which are shared between images.
+//
+// Every pull of a manifest by digest is attributed to the packages in
+// the contents record of the image. Pulls by tag can not be attributed,
+// as the image a tag resolved to is not known from the log. Clients
+// such as containerd fetch manifests by digest after resolving the tag,
+// and Docker only does so for multi-platform images.
+//
+// The following log formats are understood:
+//
+// * the combined log format written by nginx, HAProxy and similar load balancers
+// * JSON logs of Google Cloud load balancers, one entry per line
+// * Google Cloud Storage usage logs, in which manifests are pulled as `layers/<hex>` objects
+//
+// The derived popularity is stored at `popularity/pulls` in the
+// storage backend, from where other replicas load it.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/layers"
+	"github.com/google/nixery/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// PopularityRefreshInterval is the interval at which popularity derived
+// from access logs ingested on other replicas is loaded.
+const PopularityRefreshInterval = 15 * time.Minute
+
+const popularityPath = "popularity/pulls"
+
+// Number of packages listed in the popularity status.
+const topPackages = 20
+
+// Longest line of an access log that is parsed.
+const maxAccessLogLine = 1024 * 1024
+
+var (
+	// Request line and status of the combined log format
+	combinedLogRegex = regexp.MustCompile(`"([A-Z]+) (\S+) HTTP/[0-9.]+" (\d{3}) `)
+
+	// Registry request for a manifest by digest
+	manifestPullRegex = regexp.MustCompile(`^/v2/.+/manifests/sha256:([0-9a-f]{64})$`)
+
+	// Storage object of a blob, which may be a manifest
+	blobObjectRegex = regexp.MustCompile(`(?:^|/)layers/([0-9a-f]{64})$`)
+)
+
+// popularityRecord is the object stored for the derived popularity.
+type popularityRecord struct {
+	Packages layers.Popularity `json:"packages"`
+	Pulls    int               `json:"pulls"`
+	Updated  time.Time         `json:"updated"`
+}
+
+// PullPopularity holds the package popularity derived from access logs.
+//
+// A nil *PullPopularity is valid and has no popularity data.
+type PullPopularity struct {
+	mu     sync.RWMutex
+	record popularityRecord
+
+	// Serialises ingestions, which update the stored record
+	ingest sync.Mutex
+}
+
+// NewPullPopularity creates a tracker without popularity data.
+func NewPullPopularity() *PullPopularity {
+	return &PullPopularity{}
+}
+
+// Refresh loads the derived popularity from the storage backend.
+func (p *PullPopularity) Refresh(ctx context.Context, s storage.Backend) error {
+	objects, err := s.List(ctx, popularityPath)
+	if err != nil {
+		return fmt.Errorf("failed to list popularity: %w", err)
+	}
+
+	var record popularityRecord
+	for _, obj := range objects {
+		if !strings.HasSuffix(obj.Path, popularityPath) {
+			continue
+		}
+
+		r, err := s.Fetch(ctx, obj.Path)
+		if err != nil {
+			return fmt.Errorf("failed to fetch popularity: %w", err)
+		}
+
+		err = json.NewDecoder(r).Decode(&record)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("invalid popularity: %w", err)
+		}
+	}
+
+	p.mu.Lock()
+	p.record = record
+	p.mu.Unlock()
+
+	return nil
+}
+
+// Select returns the popularity used for layering, which is the derived
+// popularity if logs have been ingested and the fallback otherwise.
+func (p *PullPopularity) Select(fallback layers.Popularity) layers.Popularity {
+	if p == nil {
+		return fallback
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.record.Packages) == 0 {
+		return fallback
+	}
+
+	return p.record.Packages
+}
+
+// Status describes the derived popularity.
+func (p *PullPopularity) Status() api.PopularityStatus {
+	status := api.PopularityStatus{
+		Top: []api.PackagePopularity{},
+	}
+	if p == nil {
+		return status
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	status.Pulls = p.record.Pulls
+	status.Packages = len(p.record.Packages)
+	status.Updated = p.record.Updated
+
+	for pkg, pulls := range p.record.Packages {
+		status.Top = append(status.Top, api.PackagePopularity{Package: pkg, Pulls: pulls})
+	}
+
+	sort.Slice(status.Top, func(i, j int) bool {
+		if status.Top[i].Pulls != status.Top[j].Pulls {
+			return status.Top[i].Pulls > status.Top[j].Pulls
+		}
+		return status.Top[i].Package < status.Top[j].Package
+	})
+
+	if len(status.Top) > topPackages {
+		status.Top = status.Top[:topPackages]
+	}
+
+	return status
+}
+
+// IngestAccessLog counts the image pulls in an access log and adds them
+// to the derived popularity, or replaces it with them.
+func IngestAccessLog(ctx context.Context, s *State, r io.Reader, replace bool) (*api.PopularityReport, error) {
+	p := s.Popularity
+	if p == nil {
+		return nil, fmt.Errorf("popularity is not tracked")
+	}
+
+	p.ingest.Lock()
+	defer p.ingest.Unlock()
+
+	// Ingestions on other replicas are picked up first, so that
+	// their counts are not overwritten.
+	if err := p.Refresh(ctx, s.Storage); err != nil {
+		return nil, err
+	}
+
+	var report api.PopularityReport
+	record := popularityRecord{
+		Packages: make(layers.Popularity),
+	}
+
+	if !replace {
+		p.mu.RLock()
+		record.Pulls = p.record.Pulls
+		for pkg, pulls := range p.record.Packages {
+			record.Packages[pkg] = pulls
+		}
+		p.mu.RUnlock()
+	}
+
+	// Closures of the pulled images, nil for digests without a
+	// contents record
+	closures := make(map[string][]string)
+
+	var parser accessLogParser
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxAccessLogLine)
+
+	for scanner.Scan() {
+		report.Lines++
+
+		digest, manifest, ok := parser.parse(scanner.Text())
+		if !ok {
+			continue
+		}
+
+		paths, seen := closures[digest]
+		if !seen {
+			contents, err := ImageContents(ctx, s, digest)
+			if err == nil {
+				paths = contents.StorePaths
+				report.Images++
+			}
+			closures[digest] = paths
+		}
+
+		if paths == nil {
+			// Blob objects without a contents record are layers
+			// rather than manifests.
+			if manifest {
+				report.Unresolved++
+			}
+			continue
+		}
+
+		report.Pulls++
+		for _, path := range paths {
+			record.Packages[layers.PackageFromPath(path)]++
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read access log: %w", err)
+	}
+
+	record.Pulls += report.Pulls
+	record.Updated = time.Now()
+
+	j, _ := json.Marshal(record)
+	_, _, err := s.Storage.Persist(ctx, popularityPath, "application/json", func(w io.Writer) (string, int64, error) {
+		n, err := io.Copy(w, bytes.NewReader(j))
+		return "", n, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to persist popularity: %w", err)
+	}
+
+	p.mu.Lock()
+	p.record = record
+	p.mu.Unlock()
+
+	report.Status = p.Status()
+
+	log.WithFields(log.Fields{
+		"lines":      report.Lines,
+		"pulls":      report.Pulls,
+		"images":     report.Images,
+		"unresolved": report.Unresolved,
+	}).Info("ingested registry access log")
+
+	return &report, nil
+}
+
+// ResetPopularity discards the derived popularity, which reverts to the
+// popularity data set on all replicas.
+func ResetPopularity(ctx context.Context, s *State) error {
+	p := s.Popularity
+	if p == nil {
+		return nil
+	}
+
+	p.ingest.Lock()
+	defer p.ingest.Unlock()
+
+	if err := s.Storage.Delete(ctx, popularityPath); err != nil {
+		return fmt.Errorf("failed to delete popularity: %w", err)
+	}
+
+	p.mu.Lock()
+	p.record = popularityRecord{}
+	p.mu.Unlock()
+
+	return nil
+}
+
+// accessLogParser extracts pulled digests from the lines of an access
+// log.
+type accessLogParser struct {
+	// Column indices of Cloud Storage usage logs, once their header
+	// has been seen
+	columns map[string]int
+}
+
+// parse returns the digest of the blob requested in a line of an
+// access log, and whether it was requested as a manifest. Lines that
+// are not successful downloads of blobs are skipped.
+func (p *accessLogParser) parse(line string) (string, bool, bool) {
+	method, target, status, ok := p.request(line)
+	if !ok || method != "GET" || status < 200 || status >= 400 {
+		return "", false, false
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", false, false
+	}
+
+	if m := manifestPullRegex.FindStringSubmatch(u.Path); m != nil {
+		return "sha256:" + m[1], true, true
+	}
+
+	if m := blobObjectRegex.FindStringSubmatch(u.Path); m != nil {
+		return "sha256:" + m[1], false, true
+	}
+
+	return "", false, false
+}
+
+// request returns the method, target and status of a request in any of
+// the supported log formats.
+func (p *accessLogParser) request(line string) (string, string, int, bool) {
+	if strings.HasPrefix(line, "{") {
+		var entry struct {
+			HTTPRequest struct {
+				RequestMethod string `json:"requestMethod"`
+				RequestURL    string `json:"requestUrl"`
+				Status        int    `json:"status"`
+			} `json:"httpRequest"`
+		}
+
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return "", "", 0, false
+		}
+
+		req := entry.HTTPRequest
+		return req.RequestMethod, req.RequestURL, req.Status, req.RequestURL != ""
+	}
+
+	if strings.HasPrefix(line, `"time_micros"`) {
+		fields, err := csv.NewReader(strings.NewReader(line)).Read()
+		if err != nil {
+			return "", "", 0, false
+		}
+
+		p.columns = make(map[string]int)
+		for i, f := range fields {
+			p.columns[f] = i
+		}
+
+		return "", "", 0, false
+	}
+
+	if p.columns != nil {
+		fields, err := csv.NewReader(strings.NewReader(line)).Read()
+		if err != nil {
+			return "", "", 0, false
+		}
+
+		column := func(name string) string {
+			if i, ok := p.columns[name]; ok && i < len(fields) {
+				return fields[i]
+			}
+			return ""
+		}
+
+		// The object name is preferred over the URI, which
+		// differs between the storage APIs.
+		target := column("cs_uri")
+		if object := column("cs_object"); object != "" {
+			target = object
+		}
+
+		status, _ := strconv.Atoi(column("sc_status"))
+		return column("cs_method"), target, status, target != ""
+	}
+
+	m := combinedLogRegex.FindStringSubmatch(line)
+	if m == nil {
+		return "", "", 0, false
+	}
+
+	status, _ := strconv.Atoi(m[3])
+	return m[1], m[2], status, true
+}
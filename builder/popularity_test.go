@@ -0,0 +1,48 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAccessLogParser(t *testing.T) {
+	hex := strings.Repeat("ab", 32)
+
+	cases := []struct {
+		line     string
+		manifest bool
+		ok       bool
+	}{
+		// Combined log format
+		{`10.0.0.1 - - [15/Oct/2026:10:00:00 +0000] "GET /v2/shell/git/manifests/sha256:` + hex + ` HTTP/1.1" 200 1234 "-" "containerd/1.7"`, true, true},
+		{`10.0.0.1 - - [15/Oct/2026:10:00:00 +0000] "HEAD /v2/shell/git/manifests/sha256:` + hex + ` HTTP/1.1" 200 0 "-" "containerd/1.7"`, false, false},
+		{`10.0.0.1 - - [15/Oct/2026:10:00:00 +0000] "GET /v2/shell/git/manifests/sha256:` + hex + ` HTTP/1.1" 404 0 "-" "containerd/1.7"`, false, false},
+		{`10.0.0.1 - - [15/Oct/2026:10:00:00 +0000] "GET /v2/shell/git/manifests/latest HTTP/1.1" 200 1234 "-" "docker/24.0"`, false, false},
+		{`10.0.0.1 - - [15/Oct/2026:10:00:00 +0000] "GET /v2/shell/git/blobs/sha256:` + hex + ` HTTP/1.1" 307 0 "-" "docker/24.0"`, false, false},
+
+		// Cloud load balancer logs
+		{`{"httpRequest":{"requestMethod":"GET","requestUrl":"https://nixery.dev/v2/shell/manifests/sha256:` + hex + `","status":200}}`, true, true},
+		{`{"httpRequest":{"requestMethod":"GET","requestUrl":"https://nixery.dev/v2/shell/manifests/sha256:` + hex + `","status":503}}`, false, false},
+
+		// Cloud Storage usage logs, with a header preceding them
+		{`"time_micros","c_ip","cs_method","cs_uri","sc_status","cs_bucket","cs_object"`, false, false},
+		{`"1760522400000000","10.0.0.1","GET","/download/storage/v1/b/nixery/o/layers%2F` + hex + `?alt=media","200","nixery","layers/` + hex + `"`, false, true},
+		{`"1760522400000000","10.0.0.1","GET","/download/storage/v1/b/nixery/o/layers%2F` + hex + `?alt=media","200","nixery",""`, false, true},
+		{`"1760522400000000","10.0.0.1","GET","/nixery/builds/` + hex + `","200","nixery","builds/` + hex + `"`, false, false},
+	}
+
+	var p accessLogParser
+	for _, c := range cases {
+		digest, manifest, ok := p.parse(c.line)
+		if ok != c.ok || manifest != c.manifest {
+			t.Errorf("parsed %q as (%v, %v), expected (%v, %v)", c.line, manifest, ok, c.manifest, c.ok)
+			continue
+		}
+
+		if ok && digest != "sha256:"+hex {
+			t.Errorf("parsed %q with digest %q", c.line, digest)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the pre-fetching of store paths for images that
+// are served from the manifest cache.
+//
+// A fresh instance serves cached images without ever realising their
+// contents in the local Nix store, which means that the first build of
+// a related image (for example one with an additional package) has to
+// substitute the entire closure. Pre-fetching the top-level store paths
+// of cached images in the background warms the Nix store for such
+// builds.
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/google/nixery/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+// StorePathsAnnotation lists the top-level store paths of an image.
+const StorePathsAnnotation = "dev.nixery.store-paths"
+
+// prefetchQueue is the number of images that can be waiting for their
+// store paths to be fetched before further images are skipped.
+const prefetchQueue = 64
+
+// storePathsAnnotation records the top-level store paths of an image,
+// which are realised (including their closures) when pre-fetching.
+func storePathsAnnotation(graph *layers.RuntimeGraph, annotations map[string]string) {
+	paths := append([]string{}, graph.References.Graph...)
+	sort.Strings(paths)
+
+	j, _ := json.Marshal(paths)
+	annotations[StorePathsAnnotation] = string(j)
+}
+
+type prefetch struct {
+	image *Image
+	paths []string
+}
+
+// Prefetcher realises the store paths of cached images in the
+// background.
+//
+// A nil *Prefetcher is valid and does not fetch anything.
+type Prefetcher struct {
+	mu    sync.Mutex
+	seen  map[string]bool
+	queue chan prefetch
+}
+
+// NewPrefetcher creates a prefetcher and starts its fetch loop.
+func NewPrefetcher(s *State) *Prefetcher {
+	p := &Prefetcher{
+		seen:  make(map[string]bool),
+		queue: make(chan prefetch, prefetchQueue),
+	}
+	go p.fetch(s)
+
+	return p
+}
+
+// manifest queues the store paths of a cached manifest that are not
+// yet present in the local Nix store. Each path is only queued once.
+func (p *Prefetcher) manifest(image *Image, m json.RawMessage) {
+	if p == nil {
+		return
+	}
+
+	var parsed struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(m, &parsed); err != nil {
+		return
+	}
+
+	// Manifests built before this annotation was introduced can
+	// not be pre-fetched.
+	var paths []string
+	if err := json.Unmarshal([]byte(parsed.Annotations[StorePathsAnnotation]), &paths); err != nil {
+		return
+	}
+
+	var missing []string
+	p.mu.Lock()
+	for _, path := range paths {
+		if p.seen[path] {
+			continue
+		}
+		p.seen[path] = true
+
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			missing = append(missing, path)
+		}
+	}
+	p.mu.Unlock()
+
+	if len(missing) == 0 {
+		return
+	}
+
+	select {
+	case p.queue <- prefetch{image, missing}:
+	default:
+		log.WithField("image", image.Name).Debug("prefetch queue is full, skipping image")
+
+		// Allow the paths to be queued again on a later
+		// request.
+		p.mu.Lock()
+		for _, path := range missing {
+			delete(p.seen, path)
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *Prefetcher) fetch(s *State) {
+	for f := range p.queue {
+		if _, _, err := runNix(s, "nixery-prefetch", f.image, f.paths); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"image": f.image.Name,
+				"paths": len(f.paths),
+			}).Warn("failed to prefetch store paths")
+
+			p.mu.Lock()
+			for _, path := range f.paths {
+				delete(p.seen, path)
+			}
+			p.mu.Unlock()
+
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"image": f.image.Name,
+			"paths": len(f.paths),
+		}).Info("prefetched store paths of cached image")
+	}
+}
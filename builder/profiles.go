@@ -0,0 +1,232 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements profiles, i.e. images that were not built by
+// Nixery but imported by operators (from an OCI archive or another
+// registry). Profiles are served under their name and tag instead of
+// building an image, which allows hand-built exceptions to be pulled
+// through the same registry as Nix-built images.
+//
+// Profiles are stored at `profiles/<name>@<tag>` in the storage
+// backend, and kept in memory for serving. Their blobs are stored with
+// all other blobs, and are protected from garbage collection by the
+// reference record of their manifest.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nixery/api"
+	mf "github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// ProfileRefreshInterval is the interval at which profiles imported
+// on other replicas are loaded.
+const ProfileRefreshInterval = 5 * time.Minute
+
+// Profile describes an imported image.
+type Profile = api.Profile
+
+// profileRecord is the object stored for each profile.
+type profileRecord struct {
+	Profile
+	Manifest json.RawMessage `json:"manifest"`
+}
+
+func profilePath(name, tag string) string {
+	return "profiles/" + name + "@" + tag
+}
+
+// ProfileStore keeps the imported profiles in memory.
+//
+// A nil *ProfileStore is valid and has no profiles.
+type ProfileStore struct {
+	mu       sync.RWMutex
+	profiles map[string]profileRecord
+}
+
+// NewProfileStore creates an empty profile store.
+func NewProfileStore() *ProfileStore {
+	return &ProfileStore{
+		profiles: make(map[string]profileRecord),
+	}
+}
+
+// Refresh loads all profiles from the storage backend.
+func (p *ProfileStore) Refresh(ctx context.Context, s storage.Backend) error {
+	objects, err := s.List(ctx, "profiles/")
+	if err != nil {
+		return fmt.Errorf("failed to list profiles: %w", err)
+	}
+
+	profiles := make(map[string]profileRecord)
+	for _, obj := range objects {
+		r, err := s.Fetch(ctx, obj.Path)
+		if err != nil {
+			return fmt.Errorf("failed to fetch profile %s: %w", obj.Path, err)
+		}
+
+		var record profileRecord
+		err = json.NewDecoder(r).Decode(&record)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("invalid profile %s: %w", obj.Path, err)
+		}
+
+		profiles[profilePath(record.Name, record.Tag)] = record
+	}
+
+	p.mu.Lock()
+	p.profiles = profiles
+	p.mu.Unlock()
+
+	return nil
+}
+
+// Lookup returns the manifest and manifest digest of a profile, if it
+// exists.
+func (p *ProfileStore) Lookup(name, tag string) (json.RawMessage, string, bool) {
+	if p == nil {
+		return nil, "", false
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	record, ok := p.profiles[profilePath(name, tag)]
+	return record.Manifest, record.Digest, ok
+}
+
+// List returns all profiles, sorted by name and tag.
+func (p *ProfileStore) List() []Profile {
+	profiles := []Profile{}
+	if p == nil {
+		return profiles
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, record := range p.profiles {
+		profiles = append(profiles, record.Profile)
+	}
+
+	sort.Slice(profiles, func(i, j int) bool {
+		if profiles[i].Name != profiles[j].Name {
+			return profiles[i].Name < profiles[j].Name
+		}
+		return profiles[i].Tag < profiles[j].Tag
+	})
+
+	return profiles
+}
+
+func (p *ProfileStore) put(record profileRecord) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.profiles[profilePath(record.Name, record.Tag)] = record
+	p.mu.Unlock()
+}
+
+func (p *ProfileStore) remove(name, tag string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	delete(p.profiles, profilePath(name, tag))
+	p.mu.Unlock()
+}
+
+// validProfileName reports whether a name can be used for a profile.
+func validProfileName(name, tag string) error {
+	if name == "" || tag == "" {
+		return fmt.Errorf("profiles require a name and a tag")
+	}
+
+	for _, c := range strings.Split(name, "/") {
+		if c == "" || c == "." || c == ".." || strings.Contains(c, "@") {
+			return fmt.Errorf("invalid profile name %q", name)
+		}
+	}
+
+	if strings.ContainsAny(tag, "/@") {
+		return fmt.Errorf("invalid profile tag %q", tag)
+	}
+
+	return nil
+}
+
+// saveProfile publishes the manifest of an imported image, whose blobs
+// must already be stored, and stores it as a profile.
+func saveProfile(ctx context.Context, s *State, profile Profile, m json.RawMessage) (*Profile, error) {
+	refs, err := mf.References(m)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	size, _ := mf.TransferSize(m)
+	profile.Layers = len(refs) - 1
+	profile.Size = size
+	profile.Imported = time.Now()
+
+	profile.Digest, err = PersistManifest(ctx, s, m)
+	if err != nil {
+		return nil, err
+	}
+
+	j, _ := json.Marshal(profileRecord{
+		Profile:  profile,
+		Manifest: m,
+	})
+
+	path := profilePath(profile.Name, profile.Tag)
+	_, _, err = s.Storage.Persist(ctx, path, "application/json", func(w io.Writer) (string, int64, error) {
+		n, err := io.Copy(w, bytes.NewReader(j))
+		return "", n, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store profile: %w", err)
+	}
+
+	s.Profiles.put(profileRecord{Profile: profile, Manifest: m})
+
+	log.WithFields(log.Fields{
+		"profile": profile.Name,
+		"tag":     profile.Tag,
+		"source":  profile.Source,
+		"digest":  profile.Digest,
+	}).Info("imported profile")
+
+	return &profile, nil
+}
+
+// DeleteProfile removes a profile. Its blobs are kept, as they may be
+// referenced by clients that already pulled it.
+func DeleteProfile(ctx context.Context, s *State, name, tag string) error {
+	if err := s.Storage.Delete(ctx, profilePath(name, tag)); err != nil {
+		return err
+	}
+
+	s.Profiles.remove(name, tag)
+
+	log.WithFields(log.Fields{
+		"profile": name,
+		"tag":     tag,
+	}).Info("deleted profile")
+
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the promotion of cached images between
+// environments, i.e. storage prefixes in the same backend. Promoting an
+// image copies its manifest cache entry and all blobs it references
+// from the other environment, so that it is served without being built
+// again.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// Promote copies the cached images with the given keys (or all cached
+// images, if no keys are given) from another storage backend into the
+// backend of the instance.
+func Promote(ctx context.Context, s *State, from storage.Backend, keys []string) (api.PromoteReport, error) {
+	report := api.PromoteReport{
+		From: from.Name(),
+		To:   s.Storage.Name(),
+	}
+
+	if len(keys) == 0 {
+		cached, err := from.List(ctx, "manifests/")
+		if err != nil {
+			return report, fmt.Errorf("failed to list cached manifests: %w", err)
+		}
+
+		for _, obj := range cached {
+			keys = append(keys, strings.TrimPrefix(obj.Path, "manifests/"))
+		}
+	}
+
+	for _, key := range keys {
+		m, err := fetchObject(ctx, from, "manifests/"+key)
+		if err != nil {
+			return report, fmt.Errorf("failed to fetch cached manifest %s: %w", key, err)
+		}
+
+		refs, err := manifest.References(m)
+		if err != nil {
+			return report, fmt.Errorf("invalid cached manifest %s: %w", key, err)
+		}
+
+		for _, ref := range refs {
+			if err := promoteBlob(ctx, s, from, ref, &report); err != nil {
+				return report, fmt.Errorf("failed to promote blob %s of %s: %w", ref, key, err)
+			}
+		}
+
+		// Blobs are copied first, as the manifest may be served as
+		// soon as it is cached.
+		if _, err := PersistManifest(ctx, s, m); err != nil {
+			return report, err
+		}
+		cacheManifest(ctx, s, key, m)
+		report.Manifests++
+	}
+
+	log.WithFields(log.Fields{
+		"from":      report.From,
+		"to":        report.To,
+		"manifests": report.Manifests,
+		"copied":    report.Copied,
+		"bytes":     report.Bytes,
+	}).Info("promoted cached images")
+
+	return report, nil
+}
+
+// promoteBlob copies a blob, unless it already exists in the target
+// backend.
+func promoteBlob(ctx context.Context, s *State, from storage.Backend, digest string, report *api.PromoteReport) error {
+	path := "layers/" + strings.TrimPrefix(digest, "sha256:")
+	if r, err := s.Storage.Fetch(ctx, path); err == nil {
+		r.Close()
+		report.Existing++
+		return nil
+	}
+
+	size, err := copyBlob(ctx, s.Storage, from, path, digest)
+	if err != nil {
+		return err
+	}
+
+	report.Copied++
+	report.Bytes += size
+	return nil
+}
+
+// copyBlob copies a blob between backends. Between chunked backends,
+// the chunks referenced by the blob's recipe are copied along with it.
+func copyBlob(ctx context.Context, to, from storage.Backend, path, digest string) (int64, error) {
+	if to, ok := to.(*storage.ChunkedBackend); ok {
+		if from, ok := from.(*storage.ChunkedBackend); ok {
+			return to.Copy(ctx, from, path, manifest.LayerType)
+		}
+	}
+
+	r, err := from.Fetch(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	_, size, err := to.Persist(ctx, path, manifest.LayerType, func(w io.Writer) (string, int64, error) {
+		n, err := io.Copy(w, r)
+		return digest, n, err
+	})
+	return size, err
+}
+
+func fetchObject(ctx context.Context, b storage.Backend, path string) (json.RawMessage, error) {
+	r, err := b.Fetch(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
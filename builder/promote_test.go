@@ -0,0 +1,141 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+)
+
+func TestPromote(t *testing.T) {
+	ctx := context.Background()
+
+	bucket := storage.NewMemoryBackend()
+	staging, err := storage.WithPrefix(bucket, "staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	production, _ := staging.Sibling("production")
+
+	put := func(path string, data []byte) {
+		staging.Persist(ctx, path, manifest.LayerType, func(w io.Writer) (string, int64, error) {
+			_, err := io.Copy(w, bytes.NewReader(data))
+			return "", int64(len(data)), err
+		})
+	}
+
+	layer := []byte("layer")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+	m, c := manifest.Manifest("amd64", []manifest.Entry{{Digest: digest, Size: int64(len(layer))}}, manifest.RuntimeConfig{}, nil)
+	put("layers/"+digest[7:], layer)
+	put("layers/"+c.SHA256, c.Config)
+	put("manifests/key", m)
+
+	s := newTestState(t)
+	s.Storage = production
+
+	report, err := Promote(ctx, s, staging, nil)
+	if err != nil {
+		t.Fatalf("promotion failed: %s", err)
+	}
+
+	if report.Manifests != 1 || report.Copied != 2 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	objects, _ := bucket.List(ctx, "production/")
+	paths := make(map[string]bool)
+	for _, obj := range objects {
+		paths[obj.Path] = true
+	}
+
+	for _, p := range []string{"manifests/key", "layers/" + digest[7:], "layers/" + c.SHA256} {
+		if !paths["production/"+p] {
+			t.Errorf("expected %s to be promoted, got %v", p, paths)
+		}
+	}
+
+	// Promoting again only updates the manifest.
+	report, _ = Promote(ctx, s, staging, []string{"key"})
+	if report.Copied != 0 || report.Existing != 2 {
+		t.Errorf("expected existing blobs to be skipped: %+v", report)
+	}
+}
+
+func TestPromoteChunked(t *testing.T) {
+	ctx := context.Background()
+
+	bucket := storage.NewMemoryBackend()
+	prefixed, err := storage.WithPrefix(bucket, "staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging := storage.WithChunking(prefixed)
+
+	// Environments are resolved the same way as by /admin/promote.
+	production, err := storage.Sibling(staging, "production")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer := make([]byte, 3*1024*1024)
+	rand.New(rand.NewSource(1)).Read(layer)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+	m, c := manifest.Manifest("amd64", []manifest.Entry{{Digest: digest, Size: int64(len(layer))}}, manifest.RuntimeConfig{}, nil)
+
+	for path, data := range map[string][]byte{
+		"layers/" + digest[7:]: layer,
+		"layers/" + c.SHA256:   c.Config,
+		"manifests/key":        m,
+	} {
+		_, _, err := staging.Persist(ctx, path, manifest.LayerType, func(w io.Writer) (string, int64, error) {
+			n, err := io.Copy(w, bytes.NewReader(data))
+			return "", n, err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newTestState(t)
+	s.Storage = production
+
+	if _, err := Promote(ctx, s, staging, nil); err != nil {
+		t.Fatalf("promotion failed: %s", err)
+	}
+
+	chunks, _ := bucket.List(ctx, "production/chunks/")
+	if len(chunks) == 0 {
+		t.Fatal("chunks of promoted layer were not copied")
+	}
+
+	// The layer is served from the chunks of the target environment
+	// only.
+	staged, _ := bucket.List(ctx, "staging/chunks/")
+	for _, obj := range staged {
+		bucket.Delete(ctx, obj.Path)
+	}
+
+	r, err := production.Fetch(ctx, "layers/"+digest[7:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	promoted, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to reassemble promoted layer: %s", err)
+	}
+	if !bytes.Equal(promoted, layer) {
+		t.Error("promoted layer differs from the original")
+	}
+}
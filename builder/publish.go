@@ -0,0 +1,190 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the publication of newly built images. The
+// configuration blob and the manifest are uploaded concurrently, and
+// the image only becomes visible (through the response to the client
+// and the manifest cache) once both are confirmed by the storage
+// backend. Layers are always uploaded before this step.
+//
+// Post-publish hooks run between the upload and the caching of the
+// manifest, which means that images rejected by a hook are built again
+// when they are next requested.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/google/nixery/gc"
+	"github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrManifestUpload is returned if a manifest could not be persisted
+// in the storage backend.
+var ErrManifestUpload = errors.New("could not upload manifest to blob store")
+
+// ErrManifestUnknown is returned for digests that do not refer to a
+// manifest published by Nixery.
+var ErrManifestUnknown = errors.New("manifest unknown to registry")
+
+// Maximum size of manifests served by digest, which registries are
+// expected to accept.
+const maxManifestSize = 4 * 1024 * 1024
+
+// PersistManifest stores a manifest as a blob, which makes it available
+// to clients that fetch manifests by their hash (e.g. containerd). The
+// digest of the manifest is returned.
+//
+// Since we have no stable key to address this manifest (it may be
+// uncacheable, yet still addressable by blob) we need to separate out
+// the hashing, uploading and serving phases. The latter is especially
+// important as clients may start to fetch it by digest as soon as they
+// see a response.
+func PersistManifest(ctx context.Context, s *State, m json.RawMessage) (string, error) {
+	sha256sum := fmt.Sprintf("%x", sha256.Sum256(m))
+	path := "layers/" + sha256sum
+	ctx = storage.WithSizeHint(ctx, int64(len(m)))
+
+	_, _, err := s.Storage.Persist(ctx, path, manifest.MediaType(m), func(sw io.Writer) (string, int64, error) {
+		// We already know the hash, so no additional hash needs to be
+		// constructed here.
+		written, err := sw.Write(m)
+		return sha256sum, int64(written), err
+	})
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrManifestUpload, err)
+	}
+
+	// The reference record keeps the manifest and its blobs from
+	// being garbage-collected.
+	digest := "sha256:" + sha256sum
+	if err := gc.RecordReferences(ctx, s.Storage, digest, m); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrManifestUpload, err)
+	}
+
+	return digest, nil
+}
+
+// ManifestByDigest retrieves a manifest (or image index) published by
+// PersistManifest, which clients request after resolving a tag to its
+// digest (e.g. Kubernetes and `docker pull image@sha256:...`).
+//
+// Manifests are stored alongside layers, so blobs that are not
+// manifests are rejected without reading them completely.
+func ManifestByDigest(ctx context.Context, s *State, digest string) (json.RawMessage, error) {
+	if !manifest.ValidDigest(digest) {
+		return nil, ErrManifestUnknown
+	}
+
+	r, err := s.Storage.Fetch(ctx, "layers/"+strings.TrimPrefix(digest, "sha256:"))
+	if storage.IsNotExist(err) {
+		return nil, ErrManifestUnknown
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	m, err := ioutil.ReadAll(io.LimitReader(r, maxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(m) > maxManifestSize {
+		return nil, ErrManifestUnknown
+	}
+
+	if fmt.Sprintf("sha256:%x", sha256.Sum256(m)) != digest {
+		return nil, fmt.Errorf("stored manifest %s does not match its digest", digest)
+	}
+
+	var parsed struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}
+	if json.Unmarshal(m, &parsed) != nil || parsed.SchemaVersion != manifest.SchemaVersion {
+		return nil, ErrManifestUnknown
+	}
+
+	return json.RawMessage(m), nil
+}
+
+// publishManifest uploads the configuration layer and the manifest of
+// a new image, records the store paths it contains and caches the
+// manifest once both are stored.
+func publishManifest(ctx context.Context, s *State, image *Image, key string, m json.RawMessage, c manifest.ConfigLayer, contents []string) (*BuildResult, error) {
+	var wg sync.WaitGroup
+	var configErr, manifestErr error
+	var digest string
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, configErr = uploadHashLayer(ctx, s, c.SHA256, func(w io.Writer) error {
+			_, err := io.Copy(w, bytes.NewReader(c.Config))
+			return err
+		})
+	}()
+
+	go func() {
+		defer wg.Done()
+		digest, manifestErr = PersistManifest(ctx, s, m)
+	}()
+
+	wg.Wait()
+
+	if configErr != nil {
+		log.WithError(configErr).WithFields(log.Fields{
+			"image": image.Name,
+			"tag":   image.Tag,
+		}).Error("failed to upload config")
+
+		return nil, configErr
+	}
+
+	if manifestErr != nil {
+		log.WithError(manifestErr).WithFields(log.Fields{
+			"image": image.Name,
+			"tag":   image.Tag,
+		}).Error("failed to upload manifest")
+
+		return nil, manifestErr
+	}
+
+	recordContents(ctx, s, digest, contents)
+	attachSBOM(ctx, s, image, m, digest, contents)
+
+	if s.Cfg.Hooks.PostPublish != "" {
+		hc := hookContext("post-publish", image, key)
+		hc.Digest = digest
+		hc.Blobs, _ = manifest.References(m)
+
+		if err := runHook(ctx, s.Cfg.Hooks, s.Cfg.Hooks.PostPublish, hc); err != nil {
+			return nil, err
+		}
+	}
+
+	// The cache entry is only written once everything it refers to
+	// is stored, as other instances may serve it right away.
+	if key != "" {
+		s.Cache.markPublished(digest)
+		s.Background.Go(ctx, "cache-manifest", func(ctx context.Context) {
+			cacheManifest(ctx, s, key, m)
+		})
+		recordClosure(ctx, s, image, key, contents)
+	}
+
+	return &BuildResult{
+		Manifest: m,
+		Digest:   digest,
+	}, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements per-tenant storage quotas. Usage is computed
+// periodically from the metadata labels of the stored objects, which
+// means that it can lag behind by up to one refresh interval.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/nixery/config"
+	"github.com/google/nixery/storage"
+)
+
+// ErrQuotaExceeded is returned for builds of tenants whose storage
+// usage exceeds their hard quota.
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// QuotaTracker keeps track of the storage usage of each tenant.
+//
+// A nil *QuotaTracker does not enforce any quotas.
+type QuotaTracker struct {
+	quotas map[string]config.Quota
+
+	mu    sync.RWMutex
+	usage map[string]storage.Usage
+}
+
+// NewQuotaTracker creates a tracker enforcing the given quotas.
+func NewQuotaTracker(quotas map[string]config.Quota) *QuotaTracker {
+	return &QuotaTracker{
+		quotas: quotas,
+		usage:  make(map[string]storage.Usage),
+	}
+}
+
+// Refresh recomputes the storage usage of all tenants.
+func (q *QuotaTracker) Refresh(ctx context.Context, s storage.Backend) error {
+	usage, err := storage.UsageByTenant(ctx, s)
+	if err != nil {
+		return fmt.Errorf("failed to refresh storage usage: %w", err)
+	}
+
+	q.mu.Lock()
+	q.usage = usage
+	q.mu.Unlock()
+
+	return nil
+}
+
+// status returns the usage and quota of a tenant.
+func (q *QuotaTracker) status(tenant string) (uint64, config.Quota) {
+	if tenant == "" {
+		tenant = storage.DefaultTenant
+	}
+
+	quota, ok := q.quotas[tenant]
+	if !ok {
+		quota = q.quotas["*"]
+	}
+
+	q.mu.RLock()
+	used := uint64(q.usage[tenant].Bytes)
+	q.mu.RUnlock()
+
+	return used, quota
+}
+
+// Warning returns a warning for tenants whose usage exceeds their soft
+// quota, or an empty string.
+func (q *QuotaTracker) Warning(tenant string) string {
+	if q == nil {
+		return ""
+	}
+
+	used, quota := q.status(tenant)
+	if quota.Soft == 0 || used <= quota.Soft {
+		return ""
+	}
+
+	return fmt.Sprintf("storage usage of %d MB exceeds soft quota of %d MB", used/1000000, quota.Soft/1000000)
+}
+
+// check returns an error wrapping ErrQuotaExceeded if the tenant's
+// usage exceeds its hard quota.
+func (q *QuotaTracker) check(tenant string) error {
+	if q == nil {
+		return nil
+	}
+
+	used, quota := q.status(tenant)
+	if quota.Hard == 0 || used <= quota.Hard {
+		return nil
+	}
+
+	return fmt.Errorf("%w: usage of %d MB exceeds hard quota of %d MB", ErrQuotaExceeded, used/1000000, quota.Hard/1000000)
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/google/nixery/config"
+	"github.com/google/nixery/storage"
+)
+
+func TestQuotaTracker(t *testing.T) {
+	ctx := context.Background()
+	b := storage.NewMemoryBackend()
+
+	put := func(tenant, path string, size int) {
+		ctx := ctx
+		if tenant != "" {
+			ctx = storage.WithMetadata(ctx, storage.Metadata{storage.MetadataTenant: tenant})
+		}
+
+		_, _, err := b.Persist(ctx, path, "application/octet-stream", func(w io.Writer) (string, int64, error) {
+			n, err := io.Copy(w, bytes.NewReader(make([]byte, size)))
+			return "", n, err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put("ml-team", "layers/a", 3000000)
+	put("web-team", "layers/b", 1500000)
+	put("", "layers/c", 500000)
+
+	q := NewQuotaTracker(map[string]config.Quota{
+		"ml-team": {Soft: 1000000, Hard: 2000000},
+		"*":       {Soft: 1000000, Hard: 0},
+	})
+	if err := q.Refresh(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tenants over their hard quota are rejected.
+	if err := q.check("ml-team"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("build of tenant over hard quota was allowed: %v", err)
+	}
+	if w := q.Warning("ml-team"); w == "" {
+		t.Error("no warning for tenant over soft quota")
+	}
+
+	// The wildcard quota applies to other tenants, and hard quotas
+	// of zero are not enforced.
+	if err := q.check("web-team"); err != nil {
+		t.Errorf("build of tenant without hard quota was rejected: %v", err)
+	}
+	if w := q.Warning("web-team"); w == "" {
+		t.Error("no warning for tenant over wildcard soft quota")
+	}
+
+	// Requests without a tenant are accounted to the default tenant.
+	if w := q.Warning(""); w != "" {
+		t.Errorf("unexpected warning for default tenant: %s", w)
+	}
+
+	var nilTracker *QuotaTracker
+	if nilTracker.check("ml-team") != nil || nilTracker.Warning("ml-team") != "" {
+		t.Error("nil tracker enforced quotas")
+	}
+}
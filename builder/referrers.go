@@ -0,0 +1,183 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements artifacts attached to images (such as SBOMs),
+// which are manifests whose `subject` refers to the manifest of the
+// image. Clients discover them with the OCI referrers API, which lists
+// the artifacts referring to a manifest.
+//
+// The list is maintained by Nixery itself at `referrers/<hex>` in the
+// storage backend, rather than derived from the stored manifests. It
+// is also served under the fallback tag `sha256-<hex>`, which lets
+// tools find the artifacts of images copied to registries that lack
+// the referrers API.
+//
+// Updates of the list are serialised per subject within an instance.
+// Across instances sharing a storage backend, the last writer wins, so
+// an artifact attached concurrently on another instance can be lost.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/google/nixery/manifest"
+)
+
+func referrersPath(digest string) string {
+	return "referrers/" + strings.TrimPrefix(digest, "sha256:")
+}
+
+// referrerLocks serialises updates of the referrers of each subject.
+// The zero value is ready to use.
+type referrerLocks struct {
+	mu    sync.Mutex
+	locks map[string]*referrerLock
+}
+
+type referrerLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock locks the referrers of a subject, and returns the function
+// unlocking them.
+func (l *referrerLocks) lock(subject string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*referrerLock)
+	}
+	rl, ok := l.locks[subject]
+	if !ok {
+		rl = &referrerLock{}
+		l.locks[subject] = rl
+	}
+	rl.users++
+	l.mu.Unlock()
+
+	rl.Lock()
+	return func() {
+		rl.Unlock()
+
+		l.mu.Lock()
+		if rl.users--; rl.users == 0 {
+			delete(l.locks, subject)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// AttachArtifact stores a single-blob artifact of the given type that
+// refers to the manifest m, and adds it to the referrers of m. The
+// digest of the artifact manifest is returned.
+func AttachArtifact(ctx context.Context, s *State, m json.RawMessage, artifactType, mediaType string, data []byte, annotations map[string]string) (string, error) {
+	sha := fmt.Sprintf("%x", sha256.Sum256(data))
+	blob, err := uploadHashLayer(ctx, s, sha, func(w io.Writer) error {
+		_, err := io.Copy(w, bytes.NewReader(data))
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload artifact: %w", err)
+	}
+	blob.MediaType = mediaType
+
+	_, err = uploadHashLayer(ctx, s, manifest.EmptyConfig.SHA256, func(w io.Writer) error {
+		_, err := w.Write(manifest.EmptyConfig.Config)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload artifact configuration: %w", err)
+	}
+
+	subject := manifest.Descriptor(m)
+	artifact := manifest.ArtifactManifest(artifactType, *blob, subject, annotations)
+	digest, err := PersistManifest(ctx, s, artifact)
+	if err != nil {
+		return "", err
+	}
+
+	descriptor := manifest.Descriptor(artifact)
+	descriptor.ArtifactType = artifactType
+	descriptor.Annotations = annotations
+
+	unlock := s.referrers.lock(subject.Digest)
+	defer unlock()
+
+	referrers, err := readReferrers(ctx, s, subject.Digest)
+	if err != nil {
+		return "", err
+	}
+
+	for _, r := range referrers {
+		if r.Digest == digest {
+			return digest, nil
+		}
+	}
+
+	j, _ := json.Marshal(append(referrers, descriptor))
+	_, _, err = s.Storage.Persist(ctx, referrersPath(subject.Digest), "application/json", func(w io.Writer) (string, int64, error) {
+		n, err := io.Copy(w, bytes.NewReader(j))
+		return "", n, err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to persist referrers: %w", err)
+	}
+
+	return digest, nil
+}
+
+// readReferrers returns the descriptors of the artifacts referring to
+// the manifest with the given digest.
+func readReferrers(ctx context.Context, s *State, digest string) ([]manifest.Entry, error) {
+	objects, err := s.Storage.List(ctx, referrersPath(digest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referrers: %w", err)
+	}
+	if len(objects) == 0 {
+		return nil, nil
+	}
+
+	r, err := s.Storage.Fetch(ctx, referrersPath(digest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch referrers: %w", err)
+	}
+	defer r.Close()
+
+	j, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read referrers: %w", err)
+	}
+
+	var referrers []manifest.Entry
+	if err := json.Unmarshal(j, &referrers); err != nil {
+		return nil, fmt.Errorf("invalid referrers of %s: %w", digest, err)
+	}
+
+	return referrers, nil
+}
+
+// Referrers returns the image index listing the artifacts that refer
+// to the manifest with the given digest (`sha256:<hex>`), optionally
+// restricted to a single artifact type.
+func Referrers(ctx context.Context, s *State, digest, artifactType string) (json.RawMessage, error) {
+	referrers, err := readReferrers(ctx, s, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []manifest.Entry
+	for _, r := range referrers {
+		if artifactType == "" || r.ArtifactType == artifactType {
+			matching = append(matching, r)
+		}
+	}
+
+	return manifest.ReferrersIndex(matching), nil
+}
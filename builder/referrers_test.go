@@ -0,0 +1,123 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+)
+
+func TestAttachArtifact(t *testing.T) {
+	ctx := context.Background()
+	s := &State{Storage: storage.NewMemoryBackend()}
+
+	m, _ := manifest.Manifest("amd64", nil, manifest.RuntimeConfig{}, nil)
+	subject := manifest.Descriptor(m)
+	doc := sbom("shell/git", subject.Digest, []string{"/nix/store/4ahr-git-2.44.0"})
+
+	// Attaching the same artifact again does not list it twice.
+	var digest string
+	for i := 0; i < 2; i++ {
+		var err error
+		digest, err = AttachArtifact(ctx, s, m, SBOMType, SBOMType, doc, nil)
+		if err != nil {
+			t.Fatalf("failed to attach artifact: %s", err)
+		}
+	}
+
+	var index struct {
+		Manifests []manifest.Entry `json:"manifests"`
+	}
+
+	j, err := Referrers(ctx, s, subject.Digest, "")
+	if err != nil {
+		t.Fatalf("failed to list referrers: %s", err)
+	}
+	json.Unmarshal(j, &index)
+	if len(index.Manifests) != 1 || index.Manifests[0].Digest != digest || index.Manifests[0].ArtifactType != SBOMType {
+		t.Fatalf("unexpected referrers: %s", j)
+	}
+
+	j, _ = Referrers(ctx, s, subject.Digest, "application/vnd.dev.sigstore.bundle.v0.3+json")
+	json.Unmarshal(j, &index)
+	if len(index.Manifests) != 0 {
+		t.Errorf("filter by artifact type was not applied: %s", j)
+	}
+}
+
+// slowReferrers delays writes of referrers lists, which widens the
+// window between reading and writing them.
+type slowReferrers struct {
+	storage.Backend
+}
+
+func (b slowReferrers) Persist(ctx context.Context, path, contentType string, f storage.Persister) (string, int64, error) {
+	if strings.HasPrefix(path, "referrers/") {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return b.Backend.Persist(ctx, path, contentType, f)
+}
+
+func TestAttachArtifactConcurrent(t *testing.T) {
+	ctx := context.Background()
+	s := &State{Storage: slowReferrers{storage.NewMemoryBackend()}}
+
+	m, _ := manifest.Manifest("amd64", nil, manifest.RuntimeConfig{}, nil)
+	subject := manifest.Descriptor(m)
+
+	// Artifacts attached at the same time are all listed.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			doc := []byte(fmt.Sprintf(`{"artifact":%d}`, i))
+			if _, err := AttachArtifact(ctx, s, m, SBOMType, SBOMType, doc, nil); err != nil {
+				t.Errorf("failed to attach artifact: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var index struct {
+		Manifests []manifest.Entry `json:"manifests"`
+	}
+
+	j, err := Referrers(ctx, s, subject.Digest, "")
+	if err != nil {
+		t.Fatalf("failed to list referrers: %s", err)
+	}
+	json.Unmarshal(j, &index)
+	if len(index.Manifests) != 8 {
+		t.Errorf("expected 8 referrers, got %d", len(index.Manifests))
+	}
+	if len(s.referrers.locks) != 0 {
+		t.Errorf("locks of finished updates were kept: %d", len(s.referrers.locks))
+	}
+}
+
+func TestSplitPackageName(t *testing.T) {
+	cases := map[string][2]string{
+		"git-2.44.0":          {"git", "2.44.0"},
+		"glibc-2.39-52":       {"glibc", "2.39-52"},
+		"nss-cacert-3.98":     {"nss-cacert", "3.98"},
+		"iana-etc-20231227":   {"iana-etc", "20231227"},
+		"hello":               {"hello", ""},
+		"python3.11-pip-24.0": {"python3.11-pip", "24.0"},
+	}
+
+	for input, expected := range cases {
+		name, version := splitPackageName(input)
+		if name != expected[0] || version != expected[1] {
+			t.Errorf("split %q into (%q, %q), expected (%q, %q)", input, name, version, expected[0], expected[1])
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the replication of local cache entries to
+// standby replicas. Whenever an instance populates its local cache,
+// the entry is streamed to all configured peers, which means that a
+// standby taking over after a failover does not need to fetch every
+// manifest and layer entry from the storage backend again.
+//
+// Replication is best-effort and entries that can not be delivered
+// are dropped. The storage backend remains the source of truth.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/manifest"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Maximum number of records sent to a peer in one request
+	replicationBatch = 100
+
+	// Maximum time a record waits before its batch is sent
+	replicationDelay = time.Second
+)
+
+var replicationClient = &http.Client{Timeout: 30 * time.Second}
+
+// Replicator streams local cache updates to standby replicas.
+//
+// A nil *Replicator is valid and does not replicate anything.
+type Replicator struct {
+	peers []string
+	token string
+	queue chan api.ReplicationRecord
+}
+
+// NewReplicator creates a replicator for the given peers (base URLs of
+// other Nixery instances) and starts its delivery loop.
+func NewReplicator(peers []string, token string) *Replicator {
+	r := &Replicator{
+		peers: peers,
+		token: token,
+		queue: make(chan api.ReplicationRecord, 4*replicationBatch),
+	}
+	go r.deliver()
+
+	return r
+}
+
+func (r *Replicator) send(record api.ReplicationRecord) {
+	if r == nil {
+		return
+	}
+
+	select {
+	case r.queue <- record:
+	default:
+		log.WithField("key", record.Key).Warn("replication queue is full, dropping cache entry")
+	}
+}
+
+func (r *Replicator) manifest(key string, m json.RawMessage) {
+	r.send(api.ReplicationRecord{Key: key, Manifest: m})
+}
+
+func (r *Replicator) layer(key string, e manifest.Entry) {
+	r.send(api.ReplicationRecord{Key: key, Layer: &e})
+}
+
+func (r *Replicator) deliver() {
+	var batch []api.ReplicationRecord
+	timer := time.NewTimer(replicationDelay)
+
+	for {
+		select {
+		case record := <-r.queue:
+			batch = append(batch, record)
+			if len(batch) < replicationBatch {
+				continue
+			}
+		case <-timer.C:
+		}
+
+		if len(batch) > 0 {
+			for _, peer := range r.peers {
+				if err := r.post(peer, batch); err != nil {
+					log.WithError(err).WithFields(log.Fields{
+						"peer":    peer,
+						"records": len(batch),
+					}).Warn("failed to replicate cache entries")
+				}
+			}
+			batch = nil
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(replicationDelay)
+	}
+}
+
+func (r *Replicator) post(peer string, batch []api.ReplicationRecord) error {
+	j, _ := json.Marshal(batch)
+	req, err := http.NewRequest("POST", peer+"/v1/replicate", bytes.NewReader(j))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := replicationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("peer returned status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Warm populates the local cache with a snapshot of the cache of the
+// first reachable peer. This is used on startup, so that new instances
+// start with a warm cache.
+func (r *Replicator) Warm(c *LocalCache) {
+	if r == nil {
+		return
+	}
+
+	for _, peer := range r.peers {
+		req, err := http.NewRequest("GET", peer+"/v1/replicate", nil)
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Authorization", "Bearer "+r.token)
+
+		resp, err := replicationClient.Do(req)
+		if err != nil {
+			log.WithError(err).WithField("peer", peer).Warn("failed to fetch cache snapshot")
+			continue
+		}
+
+		var records []api.ReplicationRecord
+		err = json.NewDecoder(resp.Body).Decode(&records)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"peer":   peer,
+				"status": resp.Status,
+			}).Warn("failed to read cache snapshot")
+			continue
+		}
+
+		c.Apply(records)
+		log.WithFields(log.Fields{
+			"peer":    peer,
+			"records": len(records),
+		}).Info("warmed local cache from peer")
+
+		return
+	}
+}
+
+// Apply adds replicated records to the local cache. Records applied
+// this way are not replicated further.
+func (c *LocalCache) Apply(records []api.ReplicationRecord) {
+	for _, record := range records {
+		if record.Manifest != nil {
+			c.localCacheManifest(record.Key, record.Manifest)
+		} else if record.Layer != nil {
+			c.localCacheLayer(record.Key, *record.Layer)
+		}
+	}
+}
+
+// Snapshot returns all entries in the local cache as replication
+// records.
+func (c *LocalCache) Snapshot() []api.ReplicationRecord {
+	var records []api.ReplicationRecord
+
+	c.lmtx.RLock()
+	for key, l := range c.lcache {
+		e := l.entry
+		records = append(records, api.ReplicationRecord{Key: key, Layer: &e})
+	}
+	c.lmtx.RUnlock()
+
+	files, err := ioutil.ReadDir(c.mdir)
+	if err != nil {
+		log.WithError(err).Error("failed to list local manifest cache")
+		return records
+	}
+
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), tempManifestPrefix) {
+			continue
+		}
+
+		c.mmtx.RLock()
+		m, err := readCachedManifest(filepath.Join(c.mdir, f.Name()))
+		c.mmtx.RUnlock()
+
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.WithError(err).WithField("manifest", f.Name()).Warn("failed to read cached manifest")
+			}
+			continue
+		}
+
+		records = append(records, api.ReplicationRecord{Key: f.Name(), Manifest: m})
+	}
+
+	return records
+}
@@ -0,0 +1,110 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the SBOMs that are attached to newly built
+// images if NIXERY_SBOM is enabled. The SBOM is an SPDX document listing
+// every store path of the image's runtime closure as a package, and is
+// discoverable through the referrers of the image (see referrers.go).
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/google/nixery/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+// Artifact and media type of the SBOMs attached to images.
+const SBOMType = "application/spdx+json"
+
+type spdxPackage struct {
+	SPDXID           string `json:"SPDXID"`
+	Name             string `json:"name"`
+	VersionInfo      string `json:"versionInfo,omitempty"`
+	DownloadLocation string `json:"downloadLocation"`
+	FilesAnalyzed    bool   `json:"filesAnalyzed"`
+	Comment          string `json:"comment"`
+}
+
+type spdxDocument struct {
+	SPDXVersion       string `json:"spdxVersion"`
+	DataLicense       string `json:"dataLicense"`
+	SPDXID            string `json:"SPDXID"`
+	Name              string `json:"name"`
+	DocumentNamespace string `json:"documentNamespace"`
+	CreationInfo      struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	} `json:"creationInfo"`
+	Packages []spdxPackage `json:"packages"`
+}
+
+// splitPackageName splits the name of a store path (without its hash)
+// into the package name and version, like Nix does: the version starts
+// at the first dash that is not followed by a letter.
+func splitPackageName(name string) (string, string) {
+	for i := 0; i < len(name)-1; i++ {
+		c := name[i+1]
+		if name[i] == '-' && !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return name[:i], name[i+1:]
+		}
+	}
+
+	return name, ""
+}
+
+// sbom creates the SPDX document of an image with the given manifest
+// digest and store paths.
+func sbom(name, digest string, paths []string) []byte {
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: "urn:nixery:sbom:" + digest,
+		Packages:          []spdxPackage{},
+	}
+
+	// The creation time is fixed, as the SBOM would otherwise differ
+	// whenever an image is built again.
+	doc.CreationInfo.Created = "1970-01-01T00:00:00Z"
+	doc.CreationInfo.Creators = []string{"Tool: nixery"}
+
+	for _, p := range paths {
+		pkg, version := splitPackageName(layers.PackageFromPath(p))
+		doc.Packages = append(doc.Packages, spdxPackage{
+			SPDXID:           "SPDXRef-Package-" + storePathHash(p),
+			Name:             pkg,
+			VersionInfo:      version,
+			DownloadLocation: "NOASSERTION",
+			Comment:          p,
+		})
+	}
+
+	j, _ := json.Marshal(doc)
+	return j
+}
+
+// attachSBOM attaches the SBOM of a newly built image to it. Failures
+// are only logged, as the SBOM is not required to serve the image.
+func attachSBOM(ctx context.Context, s *State, image *Image, m json.RawMessage, digest string, paths []string) {
+	if !s.Cfg.SBOM || len(paths) == 0 {
+		return
+	}
+
+	artifact, err := AttachArtifact(ctx, s, m, SBOMType, SBOMType, sbom(image.Name, digest, paths), nil)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"image":  image.Name,
+			"digest": digest,
+		}).Warn("failed to attach SBOM to image")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"image":  image.Name,
+		"digest": digest,
+		"sbom":   artifact,
+	}).Info("attached SBOM to image")
+}
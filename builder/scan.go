@@ -0,0 +1,178 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the scanning of image layers with an external
+// malware scanner before they are published in a manifest.
+//
+// Newly built layers are scanned while they are in `staging/`, before
+// they are moved to `layers/` from where they could be pulled. Layers
+// reused from the layer cache are scanned before they are published in
+// another manifest, which covers layers uploaded before a scanner was
+// configured.
+//
+// Scan results are cached by layer digest, both locally and in the
+// storage backend (under `scans/`), which means that layers shared
+// between images are only scanned once. Layers that fail the scan are
+// moved to `quarantine/` and can no longer be pulled.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/google/nixery/manifest"
+	"github.com/google/nixery/scan"
+	log "github.com/sirupsen/logrus"
+)
+
+// scanResult returns the cached scan result for a layer, if any.
+func scanResult(ctx context.Context, s *State, hash string) (scan.Result, bool) {
+	s.Cache.smtx.RLock()
+	result, ok := s.Cache.scache[hash]
+	s.Cache.smtx.RUnlock()
+
+	if ok {
+		return result, true
+	}
+
+	r, err := s.Storage.Fetch(ctx, "scans/"+hash)
+	if err != nil {
+		return result, false
+	}
+	defer r.Close()
+
+	j, err := ioutil.ReadAll(r)
+	if err != nil || json.Unmarshal(j, &result) != nil {
+		return result, false
+	}
+
+	s.Cache.smtx.Lock()
+	s.Cache.scache[hash] = result
+	s.Cache.smtx.Unlock()
+
+	return result, true
+}
+
+func cacheScanResult(ctx context.Context, s *State, hash string, result scan.Result) {
+	s.Cache.smtx.Lock()
+	s.Cache.scache[hash] = result
+	s.Cache.smtx.Unlock()
+
+	j, _ := json.Marshal(result)
+	_, _, err := s.Storage.Persist(ctx, "scans/"+hash, "application/json", func(w io.Writer) (string, int64, error) {
+		size, err := io.Copy(w, bytes.NewReader(j))
+		return "", size, err
+	})
+
+	if err != nil {
+		log.WithError(err).WithField("layer", hash).Warn("failed to persist scan result")
+	}
+}
+
+// scanLayer scans a single layer stored at the given path, unless a
+// result for it is cached.
+func scanLayer(ctx context.Context, s *State, path, hash string) (scan.Result, error) {
+	if result, cached := scanResult(ctx, s, hash); cached {
+		return result, nil
+	}
+
+	r, err := s.Storage.Fetch(ctx, path)
+	if err != nil {
+		return scan.Result{}, err
+	}
+	defer r.Close()
+
+	result, err := s.Scanner.Scan(ctx, "sha256:"+hash, r)
+	if err != nil {
+		return result, err
+	}
+
+	cacheScanResult(ctx, s, hash, result)
+	return result, nil
+}
+
+// scanLayers scans all layers of an image, if a scanner is configured.
+// Layers that fail the scan are quarantined and fail the build.
+func scanLayers(ctx context.Context, s *State, image *Image, entries []manifest.Entry) error {
+	if s.Scanner == nil {
+		return nil
+	}
+
+	for _, entry := range entries {
+		hash := strings.TrimPrefix(entry.Digest, "sha256:")
+		result, err := scanLayer(ctx, s, "layers/"+hash, hash)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"image":   image.Name,
+				"layer":   entry.Digest,
+				"scanner": s.Scanner.Name(),
+			}).Error("failed to scan layer")
+
+			return fmt.Errorf("failed to scan layer %s: %s", entry.Digest, err)
+		}
+
+		if result.Clean {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"image":   image.Name,
+			"tag":     image.Tag,
+			"layer":   entry.Digest,
+			"reason":  result.Reason,
+			"scanner": result.Scanner,
+		}).Error("layer failed malware scan, quarantining")
+
+		// The layer may have been quarantined by a previous
+		// build already, in which case this fails harmlessly.
+		if err := s.Storage.Move(ctx, "layers/"+hash, "quarantine/"+hash); err != nil {
+			log.WithError(err).WithField("layer", entry.Digest).Debug("failed to quarantine layer")
+		}
+
+		return fmt.Errorf("layer %s failed malware scan: %s", entry.Digest, result.Reason)
+	}
+
+	return nil
+}
+
+// scanStaged scans a newly uploaded layer in the staging area, if a
+// scanner is configured. Layers that fail the scan are quarantined
+// straight from the staging area.
+func scanStaged(ctx context.Context, s *State, path, hash string) error {
+	if s.Scanner == nil {
+		return nil
+	}
+
+	result, err := scanLayer(ctx, s, path, hash)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"layer":   "sha256:" + hash,
+			"scanner": s.Scanner.Name(),
+		}).Error("failed to scan layer")
+
+		return fmt.Errorf("failed to scan layer sha256:%s: %s", hash, err)
+	}
+
+	if result.Clean {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"layer":   "sha256:" + hash,
+		"reason":  result.Reason,
+		"scanner": result.Scanner,
+	}).Error("layer failed malware scan, quarantining")
+
+	if err := s.Storage.Move(ctx, path, "quarantine/"+hash); err != nil {
+		log.WithError(err).WithField("layer", "sha256:"+hash).Warn("failed to quarantine layer")
+	} else {
+		journalFrom(ctx).unstaged(path)
+	}
+
+	return fmt.Errorf("layer sha256:%s failed malware scan: %s", hash, result.Reason)
+}
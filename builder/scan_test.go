@@ -0,0 +1,87 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/google/nixery/scan"
+	"github.com/google/nixery/storage"
+)
+
+// testScanner rejects layers containing the word "infected", and
+// records whether scanned layers could already be pulled.
+type testScanner struct {
+	s         *State
+	published []string
+}
+
+func (t *testScanner) Name() string {
+	return "test"
+}
+
+func (t *testScanner) Scan(ctx context.Context, digest string, layer io.Reader) (scan.Result, error) {
+	if r, err := t.s.Storage.Fetch(ctx, "layers/"+strings.TrimPrefix(digest, "sha256:")); err == nil {
+		r.Close()
+		t.published = append(t.published, digest)
+	}
+
+	data, err := ioutil.ReadAll(layer)
+	if err != nil {
+		return scan.Result{}, err
+	}
+
+	if bytes.Contains(data, []byte("infected")) {
+		return scan.Result{Reason: "test signature", Scanner: t.Name()}, nil
+	}
+	return scan.Result{Clean: true, Scanner: t.Name()}, nil
+}
+
+func TestScanStagedLayers(t *testing.T) {
+	ctx := context.Background()
+	s := newTestState(t)
+	scanner := &testScanner{s: s}
+	s.Scanner = scanner
+
+	upload := func(key, content string) (string, error) {
+		_, err := uploadImageLayer(ctx, s, key, func(w io.Writer) error {
+			_, err := w.Write([]byte(content))
+			return err
+		})
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(content))), err
+	}
+
+	clean, err := upload("clean", "clean layer")
+	if err != nil {
+		t.Fatalf("clean layer was rejected: %s", err)
+	}
+	if r, err := s.Storage.Fetch(ctx, "layers/"+clean); err != nil {
+		t.Errorf("clean layer was not published: %s", err)
+	} else {
+		r.Close()
+	}
+
+	infected, err := upload("infected", "infected layer")
+	if err == nil {
+		t.Fatal("infected layer was accepted")
+	}
+	if _, err := s.Storage.Fetch(ctx, "layers/"+infected); !storage.IsNotExist(err) {
+		t.Errorf("infected layer was published: %v", err)
+	}
+	if r, err := s.Storage.Fetch(ctx, "quarantine/"+infected); err != nil {
+		t.Errorf("infected layer was not quarantined: %s", err)
+	} else {
+		r.Close()
+	}
+
+	if len(scanner.published) != 0 {
+		t.Errorf("layers were published before they were scanned: %v", scanner.published)
+	}
+}
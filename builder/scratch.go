@@ -0,0 +1,146 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the assembly of layer tarballs in a scratch
+// directory before they are uploaded to the storage backend.
+//
+// The scratch directory is intended to be a tmpfs, which makes
+// assembling the (usually small) layers of an image faster than
+// streaming them to the storage backend while packing store paths.
+// Layers growing beyond the spill threshold are moved to disk, so that
+// large layers can not exhaust the memory of the host.
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Name of the directories (within the scratch and spill directories)
+// in which layers are assembled. These are owned by Nixery and cleared
+// on startup.
+const scratchName = "nixery-scratch"
+
+// CleanScratch removes layers left behind by a previous Nixery process
+// that did not shut down cleanly, and creates the scratch directories.
+// The scratch directories must not be shared between instances.
+func CleanScratch(dirs ...string) error {
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+
+		path := filepath.Join(dir, scratchName)
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scratchFile is a layer being assembled in the scratch directory,
+// which is moved to the spill directory once it exceeds the threshold.
+type scratchFile struct {
+	f         *os.File
+	size      int64
+	threshold int64
+	spillDir  string
+}
+
+func newScratchFile(dir, spillDir string, threshold int64) (*scratchFile, error) {
+	f, err := ioutil.TempFile(filepath.Join(dir, scratchName), "layer-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &scratchFile{
+		f:         f,
+		threshold: threshold,
+		spillDir:  spillDir,
+	}, nil
+}
+
+func (s *scratchFile) Write(p []byte) (int, error) {
+	if s.spillDir != "" && s.size+int64(len(p)) > s.threshold {
+		if err := s.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := s.f.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+// spill moves the contents of the scratch file to the spill directory,
+// where all further writes go.
+func (s *scratchFile) spill() error {
+	spilled, err := ioutil.TempFile(filepath.Join(s.spillDir, scratchName), "layer-")
+	if err != nil {
+		return err
+	}
+
+	if _, err = s.f.Seek(0, io.SeekStart); err == nil {
+		_, err = io.Copy(spilled, s.f)
+	}
+
+	if err != nil {
+		spilled.Close()
+		os.Remove(spilled.Name())
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"size":      s.size,
+		"threshold": s.threshold,
+	}).Debug("spilling layer from scratch directory to disk")
+
+	s.Close()
+	s.f = spilled
+	s.spillDir = ""
+	return nil
+}
+
+// assembleLayer writes a layer to the scratch directory and returns a
+// layer writer copying the assembled layer. This way, the connection
+// to the storage backend is only opened once the layer is complete.
+//
+// The caller must close the returned file once the layer is uploaded.
+func assembleLayer(s *State, key string, lw layerWriter) (layerWriter, io.Closer, error) {
+	f, err := newScratchFile(s.Cfg.ScratchDir, s.Cfg.SpillDir, s.Cfg.SpillThreshold)
+	if err != nil {
+		log.WithError(err).WithField("layer", key).Error("failed to create layer in scratch directory")
+		return nil, nil, err
+	}
+
+	if err := lw(f); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	copyLayer := func(w io.Writer) error {
+		if _, err := f.f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		_, err := io.Copy(w, f.f)
+		return err
+	}
+
+	return copyLayer, f, nil
+}
+
+// Close closes and removes the file.
+func (s *scratchFile) Close() error {
+	s.f.Close()
+	return os.Remove(s.f.Name())
+}
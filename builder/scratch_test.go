@@ -0,0 +1,47 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScratchSpill(t *testing.T) {
+	scratch, spill := t.TempDir(), t.TempDir()
+	if err := CleanScratch(scratch, spill); err != nil {
+		t.Fatalf("failed to create scratch directories: %s", err)
+	}
+
+	f, err := newScratchFile(scratch, spill, 8)
+	if err != nil {
+		t.Fatalf("failed to create scratch file: %s", err)
+	}
+
+	f.Write([]byte("hello "))
+	if !strings.HasPrefix(f.f.Name(), scratch) {
+		t.Errorf("small layer was spilled to %s", f.f.Name())
+	}
+
+	f.Write([]byte("world"))
+	if !strings.HasPrefix(f.f.Name(), spill) {
+		t.Errorf("large layer was not spilled: %s", f.f.Name())
+	}
+
+	leftover, _ := ioutil.ReadDir(filepath.Join(scratch, scratchName))
+	if len(leftover) != 0 {
+		t.Errorf("spilled layer was not removed from scratch directory")
+	}
+
+	var buf bytes.Buffer
+	f.f.Seek(0, 0)
+	buf.ReadFrom(f.f)
+	if buf.String() != "hello world" {
+		t.Errorf("unexpected layer contents after spill: %q", buf.String())
+	}
+
+	f.Close()
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the fast path for images of a single package
+// (e.g. `nixery.dev/git`), which are the most commonly pulled images.
+//
+// Their closures consist mostly of dependencies shared with other
+// images, so instead of grouping them based on popularity, each store
+// path is placed into its own layer (if they fit into the layer
+// budget). Together with the reuse of cached symlink layers and of
+// manifests that were already published (see publishCachedManifest),
+// this keeps the work of serving such images to a minimum.
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/google/nixery/layers"
+)
+
+// Packages added to every image (see ImageFromName)
+var basePackages = map[string]bool{"cacert": true, "iana-etc": true}
+
+// isSinglePackage reports whether an image consists of a single
+// package (besides the base packages), without any customisation of
+// its layers.
+func isSinglePackage(image *Image) bool {
+	if image.Wasm || image.Layout != "" {
+		return false
+	}
+
+	var pkgs int
+	for _, p := range image.Packages {
+		if !basePackages[p] {
+			pkgs++
+		}
+	}
+
+	return pkgs == 1
+}
+
+// groupImageLayers groups the closure of an image into layers.
+func groupImageLayers(s *State, image *Image, graph *layers.RuntimeGraph) []layers.Layer {
+	if isSinglePackage(image) {
+		if grouped, ok := layers.PathLayers(graph, LayerBudget); ok {
+			return grouped
+		}
+	}
+
+	pop := s.Popularity.Select(s.Pop)
+	return layers.GroupLayers(graph, &pop, LayerBudget)
+}
+
+// publishCachedManifest publishes a manifest retrieved from the cache,
+// unless it was recently published by this instance. Cached manifests
+// are published again, as their blob is not guaranteed to exist (e.g.
+// for cache entries written by older versions, or after garbage
+// collection).
+func publishCachedManifest(ctx context.Context, s *State, m json.RawMessage) (string, error) {
+	if digest, ok := s.Cache.publishedManifest(m); ok {
+		return digest, nil
+	}
+
+	digest, err := PersistManifest(ctx, s, m)
+	if err != nil {
+		return "", err
+	}
+
+	s.Cache.markPublished(digest)
+	return digest, nil
+}
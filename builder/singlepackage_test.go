@@ -0,0 +1,57 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/nixery/layers"
+)
+
+func TestSinglePackageLayers(t *testing.T) {
+	var graph layers.RuntimeGraph
+	err := json.Unmarshal([]byte(`{
+		"exportReferencesGraph": {"graph": ["/nix/store/aaa-git-2.44.0"]},
+		"graph": [
+			{"path": "/nix/store/aaa-git-2.44.0", "closureSize": 300, "references": ["/nix/store/bbb-glibc-2.39"]},
+			{"path": "/nix/store/bbb-glibc-2.39", "closureSize": 200, "references": []}
+		]
+	}`), &graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &State{}
+	image := ImageFromName("git", "latest")
+	grouped := groupImageLayers(s, &image, &graph)
+	if len(grouped) != 2 || grouped[0].Contents[0] != "/nix/store/bbb-glibc-2.39" {
+		t.Errorf("expected one layer per store path, got %+v", grouped)
+	}
+
+	image = ImageFromName("shell/git", "latest")
+	if isSinglePackage(&image) {
+		t.Error("image with several packages was treated as a single package")
+	}
+}
+
+func TestPublishCachedManifest(t *testing.T) {
+	s := newTestState(t)
+
+	ctx := context.Background()
+	m := json.RawMessage(`{"schemaVersion":2,"config":{"digest":"sha256:0000"}}`)
+
+	if _, published := s.Cache.publishedManifest(m); published {
+		t.Fatal("manifest is published before publishing it")
+	}
+
+	digest, err := publishCachedManifest(ctx, s, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d, published := s.Cache.publishedManifest(m); !published || d != digest {
+		t.Errorf("manifest %s was not recorded as published", digest)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/google/nixery/layers"
+	"github.com/google/nixery/manifest"
+	log "github.com/sirupsen/logrus"
+)
+
+// Manifest annotations describing the size of an image's contents.
+const (
+	ClosureSizesAnnotation = "dev.nixery.closure-sizes"
+	TotalSizeAnnotation    = "dev.nixery.total-size"
+	SizeWarningAnnotation  = "dev.nixery.size-warning"
+	LayerSizeAnnotation    = "dev.nixery.layer-size"
+)
+
+// Contributor is a package and the size of its runtime closure.
+type Contributor struct {
+	Package string
+	Size    uint64
+}
+
+// sizeAnnotations computes the per-package closure sizes of an image
+// and checks them against the configured size budget.
+func sizeAnnotations(s *State, image *Image, graph *layers.RuntimeGraph, annotations map[string]string) {
+	sizes := graph.ClosureSizes()
+	total := graph.TotalSize()
+
+	j, _ := json.Marshal(sizes)
+	annotations[ClosureSizesAnnotation] = string(j)
+	annotations[TotalSizeAnnotation] = strconv.FormatUint(total, 10)
+
+	if s.Cfg.SizeBudget == 0 || total <= s.Cfg.SizeBudget {
+		return
+	}
+
+	top := largest(sizes, 3)
+	warning := fmt.Sprintf("image size of %d MB exceeds budget of %d MB", total/1000000, s.Cfg.SizeBudget/1000000)
+	annotations[SizeWarningAnnotation] = warning
+
+	log.WithFields(log.Fields{
+		"image":        image.Name,
+		"tag":          image.Tag,
+		"size":         total,
+		"budget":       s.Cfg.SizeBudget,
+		"contributors": top,
+	}).Warn("image exceeds size budget")
+}
+
+// layerSizeAnnotation records the compressed size of all layers of an
+// image, which is the bulk of what clients download when pulling it.
+// Every layer must have its size set at this point, as clients rely on
+// the sizes in the manifest for progress reporting.
+func layerSizeAnnotation(image *Image, entries []manifest.Entry, annotations map[string]string) error {
+	var total int64
+	for _, e := range entries {
+		if e.Size <= 0 {
+			return fmt.Errorf("layer %s of image %s has no size", e.Digest, image.Name)
+		}
+		total += e.Size
+	}
+
+	annotations[LayerSizeAnnotation] = strconv.FormatInt(total, 10)
+	return nil
+}
+
+// largest returns the n largest contributors from a set of closure
+// sizes, largest first.
+func largest(sizes map[string]uint64, n int) []Contributor {
+	var all []Contributor
+	for pkg, size := range sizes {
+		all = append(all, Contributor{pkg, size})
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Size == all[j].Size {
+			return all[i].Package < all[j].Package
+		}
+		return all[i].Size > all[j].Size
+	})
+
+	if len(all) > n {
+		all = all[:n]
+	}
+
+	return all
+}
+
+// LargestContributors reads the closure sizes from the annotations of
+// a manifest and returns the n largest contributors.
+//
+// Manifests built before size annotations were introduced yield no
+// contributors.
+func LargestContributors(annotations map[string]string, n int) []Contributor {
+	var sizes map[string]uint64
+	if err := json.Unmarshal([]byte(annotations[ClosureSizesAnnotation]), &sizes); err != nil {
+		return nil
+	}
+
+	return largest(sizes, n)
+}
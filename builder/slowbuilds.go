@@ -0,0 +1,173 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the aggregated log of slow builds. Instead of
+// searching the (voluminous) logs of individual builds, operators get
+// a single entry per interval listing the slowest builds of the
+// interval together with the time they spent in each stage:
+//
+// * evaluation and realisation, as reported by the wrapper script (see stages.go)
+// * layers, i.e. packing, scanning and uploading the layers
+// * publishing of the manifest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// buildStages times the stages of a single build.
+//
+// A nil *buildStages is valid and times nothing.
+type buildStages struct {
+	mu        sync.Mutex
+	current   string
+	since     time.Time
+	durations map[string]float64
+}
+
+func newBuildStages() *buildStages {
+	return &buildStages{
+		since:     time.Now(),
+		durations: make(map[string]float64),
+	}
+}
+
+// enter ends the current stage of the build, if any, and starts the
+// given one.
+func (b *buildStages) enter(stage string) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.current != "" {
+		b.durations[b.current] += now.Sub(b.since).Seconds()
+	}
+	b.current = stage
+	b.since = now
+}
+
+// nix records the stages of the Nix invocation preparing the image.
+func (b *buildStages) nix(stages map[string]float64) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for stage, seconds := range stages {
+		b.durations[stage] += seconds
+	}
+}
+
+// finish ends the current stage and returns the durations of all
+// stages.
+func (b *buildStages) finish() map[string]float64 {
+	if b == nil {
+		return nil
+	}
+
+	b.enter("")
+	return b.durations
+}
+
+type buildStagesKey struct{}
+
+func withBuildStages(ctx context.Context, b *buildStages) context.Context {
+	return context.WithValue(ctx, buildStagesKey{}, b)
+}
+
+// buildStagesFrom returns the stage timer of the build a context
+// belongs to, which is nil outside of builds.
+func buildStagesFrom(ctx context.Context) *buildStages {
+	b, _ := ctx.Value(buildStagesKey{}).(*buildStages)
+	return b
+}
+
+// slowBuild is an entry of the slow build log.
+type slowBuild struct {
+	Image   string             `json:"image"`
+	Tag     string             `json:"tag"`
+	Seconds float64            `json:"seconds"`
+	Failed  bool               `json:"failed,omitempty"`
+	Stages  map[string]float64 `json:"stages"`
+}
+
+// SlowBuilds retains the slowest builds since it was last reported.
+//
+// A nil *SlowBuilds is valid and records nothing.
+type SlowBuilds struct {
+	top int
+
+	mu     sync.Mutex
+	builds []slowBuild
+	count  int
+}
+
+// NewSlowBuilds creates a log of the given number of slowest builds,
+// or returns nil if the number is 0.
+func NewSlowBuilds(top int) *SlowBuilds {
+	if top == 0 {
+		return nil
+	}
+
+	return &SlowBuilds{top: top}
+}
+
+// record adds a finished build, which is retained if it is among the
+// slowest builds of the interval.
+func (l *SlowBuilds) record(image *Image, duration time.Duration, failed bool, stages map[string]float64) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.count++
+	l.builds = append(l.builds, slowBuild{
+		Image:   image.Name,
+		Tag:     image.Tag,
+		Seconds: duration.Seconds(),
+		Failed:  failed,
+		Stages:  stages,
+	})
+
+	sort.Slice(l.builds, func(i, j int) bool {
+		return l.builds[i].Seconds > l.builds[j].Seconds
+	})
+	if len(l.builds) > l.top {
+		l.builds = l.builds[:l.top]
+	}
+}
+
+// Report logs the slowest builds since the last report, if there were
+// any builds.
+func (l *SlowBuilds) Report() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	builds, count := l.builds, l.count
+	l.builds, l.count = nil, 0
+	l.mu.Unlock()
+
+	if count == 0 {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"builds":  count,
+		"slowest": builds,
+	}).Info("slowest builds of interval")
+}
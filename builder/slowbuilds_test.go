@@ -0,0 +1,33 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlowBuildsKeepsSlowest(t *testing.T) {
+	l := NewSlowBuilds(2)
+	for i, tag := range []string{"a", "b", "c", "d"} {
+		image := Image{Name: "shell", Tag: tag}
+		l.record(&image, time.Duration(i%3+1)*time.Second, false, nil)
+	}
+
+	if l.count != 4 {
+		t.Errorf("expected 4 recorded builds, got %d", l.count)
+	}
+
+	if len(l.builds) != 2 || l.builds[0].Tag != "c" || l.builds[1].Tag != "b" {
+		t.Errorf("unexpected slowest builds: %+v", l.builds)
+	}
+
+	l.Report()
+	if l.count != 0 || len(l.builds) != 0 {
+		t.Error("report did not reset the interval")
+	}
+
+	if NewSlowBuilds(0) != nil {
+		t.Error("slow build log was created although it is disabled")
+	}
+}
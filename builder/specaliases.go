@@ -0,0 +1,90 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements spec aliases, which are short, content-addressed
+// image names (e.g. `spec-0123456789abcdef`) standing for an image spec.
+// They make images with long package lists pullable, whose names would
+// otherwise exceed the length accepted by registry clients.
+//
+// Aliases are stored at `spec-aliases/<hash>` in the storage backend.
+// As they are content-addressed, they never change and are kept in
+// memory once they have been read.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sync"
+
+	"github.com/google/nixery/api"
+)
+
+// MaxNameLength is the maximum length of repository names accepted by
+// registry clients, as specified by the distribution reference grammar.
+const MaxNameLength = 255
+
+var specAliasRegex = regexp.MustCompile(`^spec-([a-f0-9]{16})$`)
+
+// specAliases caches the specs of aliases that have been read.
+var specAliases sync.Map
+
+func specAliasPath(hash string) string {
+	return "spec-aliases/" + hash
+}
+
+// SaveSpecAlias stores an image spec and returns the alias name under
+// which it can be pulled.
+func SaveSpecAlias(ctx context.Context, s *State, spec *api.ImageSpec) (string, error) {
+	j, _ := json.Marshal(spec)
+	hash := fmt.Sprintf("%x", sha256.Sum256(j))[:16]
+
+	_, _, err := s.Storage.Persist(ctx, specAliasPath(hash), "application/json", func(w io.Writer) (string, int64, error) {
+		n, err := io.Copy(w, bytes.NewReader(j))
+		return "", n, err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store spec alias: %w", err)
+	}
+
+	specAliases.Store(hash, *spec)
+	return "spec-" + hash, nil
+}
+
+// LookupSpecAlias returns the spec an image name stands for, if it is a
+// spec alias. Unknown aliases are reported as errors.
+func LookupSpecAlias(ctx context.Context, s *State, name string) (*api.ImageSpec, bool, error) {
+	m := specAliasRegex.FindStringSubmatch(name)
+	if m == nil {
+		return nil, false, nil
+	}
+
+	if spec, ok := specAliases.Load(m[1]); ok {
+		cached := spec.(api.ImageSpec)
+		return &cached, true, nil
+	}
+
+	r, err := s.Storage.Fetch(ctx, specAliasPath(m[1]))
+	if err != nil {
+		return nil, true, fmt.Errorf("unknown spec alias %q", name)
+	}
+	defer r.Close()
+
+	j, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, true, err
+	}
+
+	var spec api.ImageSpec
+	if err := json.Unmarshal(j, &spec); err != nil {
+		return nil, true, fmt.Errorf("invalid spec alias %q: %w", name, err)
+	}
+
+	specAliases.Store(m[1], spec)
+	return &spec, true, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/storage"
+)
+
+func TestSpecAliases(t *testing.T) {
+	ctx := context.Background()
+	s := &State{Storage: storage.NewMemoryBackend()}
+	spec := api.ImageSpec{Packages: []string{"shell", "git"}, Pin: "a1b2c3"}
+
+	alias, err := SaveSpecAlias(ctx, s, &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Aliases are read from the storage backend by other replicas.
+	specAliases.Delete(alias[len("spec-"):])
+
+	found, ok, err := LookupSpecAlias(ctx, s, alias)
+	if !ok || err != nil {
+		t.Fatalf("alias %q was not found: %v", alias, err)
+	}
+
+	if !reflect.DeepEqual(*found, spec) {
+		t.Errorf("alias resolved to %+v, expected %+v", *found, spec)
+	}
+
+	if _, ok, _ := LookupSpecAlias(ctx, s, "shell/git"); ok {
+		t.Error("package list was treated as an alias")
+	}
+
+	if _, ok, err := LookupSpecAlias(ctx, s, "spec-0000000000000000"); !ok || err == nil {
+		t.Error("unknown alias was not reported")
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the timeouts of the individual stages of an
+// image build, which make slow uploads distinguishable from hung
+// evaluations:
+//
+// * evaluation and realisation are limited by the wrapper script, which runs them as separate Nix processes
+// * packing and uploading of layers are limited by deadlines on the writes of the layer
+//
+// Without a scratch directory, layers are packed while they are
+// uploaded, in which case both deadlines apply to the combined stage.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/nixery/config"
+)
+
+// ErrStageTimeout is returned if a stage of a build exceeded its
+// timeout.
+var ErrStageTimeout = errors.New("stage timed out")
+
+// ErrEvaluationFailed is returned if Nix failed to evaluate the
+// packages of an image, e.g. because a package is broken or has an
+// unfree license.
+var ErrEvaluationFailed = errors.New("evaluation failed")
+
+// ErrRealisationFailed is returned if Nix failed to build or download
+// the store paths of an image.
+var ErrRealisationFailed = errors.New("realisation failed")
+
+const (
+	// Wrapper script running the evaluation and realisation stages
+	prepareProgram = "nixery-prepare-image"
+
+	// Marker printed by the wrapper script between the evaluation
+	// and realisation stages.
+	evaluatedMarker = "nixery-stage: evaluated"
+
+	// Exit code of coreutils' `timeout` for timed out commands.
+	timeoutExitCode = 124
+)
+
+// ConfigureStageTimeouts passes the timeouts of the Nix stages to the
+// wrapper scripts.
+func ConfigureStageTimeouts(t config.StageTimeouts) {
+	os.Setenv("NIXERY_EVAL_TIMEOUT_SECS", strconv.Itoa(int(t.Eval.Seconds())))
+	os.Setenv("NIXERY_REALISE_TIMEOUT_SECS", strconv.Itoa(int(t.Realise.Seconds())))
+}
+
+// recordStage updates the stage timings of a command with a line of
+// its output.
+func recordStage(record *CommandRecord, line string) {
+	if strings.HasPrefix(line, evaluatedMarker) {
+		record.Stages = map[string]float64{
+			"evaluation": time.Since(record.Started).Seconds(),
+		}
+	}
+}
+
+// finishStages completes the stage timings of a finished command, and
+// identifies the stage that timed out if the command was terminated by
+// a stage timeout, or the stage in which the wrapper script failed.
+func finishStages(record *CommandRecord, err error) error {
+	eval, evaluated := record.Stages["evaluation"]
+	if evaluated {
+		record.Stages["realisation"] = record.Duration - eval
+	}
+
+	if err != nil && record.ExitCode > 0 && record.ExitCode != timeoutExitCode && record.Program == prepareProgram {
+		failure := ErrEvaluationFailed
+		if evaluated {
+			failure = ErrRealisationFailed
+		}
+
+		if msg := nixError(record.Output); msg != "" {
+			return fmt.Errorf("%w: %s", failure, msg)
+		}
+		return fmt.Errorf("%w: %s", failure, err)
+	}
+
+	if record.ExitCode != timeoutExitCode {
+		return err
+	}
+
+	stage := "evaluation"
+	if evaluated {
+		stage = "realisation"
+	}
+
+	return fmt.Errorf("%s %w", stage, ErrStageTimeout)
+}
+
+// ansiEscape matches the colour codes with which Nix highlights its
+// messages.
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// nixError returns the last error message in the output of a Nix
+// command, without its `error:` prefix. Nix prints the stack of an
+// evaluation error first, so its last error is the most specific one.
+func nixError(output []string) string {
+	for i := len(output) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(ansiEscape.ReplaceAllString(output[i], ""))
+		if !strings.HasPrefix(line, "error:") {
+			continue
+		}
+
+		if msg := strings.TrimSpace(strings.TrimPrefix(line, "error:")); msg != "" {
+			return msg
+		}
+	}
+
+	return ""
+}
+
+// deadlineWriter fails all writes after its deadline.
+type deadlineWriter struct {
+	w        io.Writer
+	stage    string
+	deadline time.Time
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	if time.Now().After(d.deadline) {
+		return 0, fmt.Errorf("%s %w", d.stage, ErrStageTimeout)
+	}
+
+	return d.w.Write(p)
+}
+
+// withTimeout limits the duration of a layer writer, starting from the
+// moment it is invoked. A timeout of zero is not enforced.
+func withTimeout(lw layerWriter, stage string, timeout time.Duration) layerWriter {
+	if timeout == 0 {
+		return lw
+	}
+
+	return func(w io.Writer) error {
+		return lw(&deadlineWriter{
+			w:        w,
+			stage:    stage,
+			deadline: time.Now().Add(timeout),
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestFinishStages(t *testing.T) {
+	record := CommandRecord{ExitCode: timeoutExitCode, Duration: 10}
+	if err := finishStages(&record, errors.New("exit status 124")); err == nil || err.Error() != "evaluation stage timed out" {
+		t.Errorf("expected evaluation timeout, got %v", err)
+	}
+
+	record = CommandRecord{Started: time.Now()}
+	recordStage(&record, evaluatedMarker+" /nix/store/foo.drv")
+	record.Duration = 10
+	record.ExitCode = timeoutExitCode
+
+	err := finishStages(&record, errors.New("exit status 124"))
+	if !errors.Is(err, ErrStageTimeout) || err.Error() != "realisation stage timed out" {
+		t.Errorf("expected realisation timeout, got %v", err)
+	}
+
+	if _, ok := record.Stages["realisation"]; !ok {
+		t.Errorf("expected realisation stage to be recorded, got %v", record.Stages)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	slow := func(w io.Writer) error {
+		if _, err := w.Write([]byte("first")); err != nil {
+			return err
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		_, err := w.Write([]byte("second"))
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := withTimeout(slow, "packing", time.Second)(&buf); err != nil {
+		t.Fatalf("unexpected error within timeout: %s", err)
+	}
+
+	err := withTimeout(slow, "packing", 10*time.Millisecond)(&buf)
+	if !errors.Is(err, ErrStageTimeout) {
+		t.Fatalf("expected packing timeout, got %v", err)
+	}
+}
+
+func TestFinishStagesFailure(t *testing.T) {
+	record := CommandRecord{
+		Program:  prepareProgram,
+		ExitCode: 1,
+		Output: []string{
+			"error:",
+			"       … while evaluating the attribute 'drvPath'",
+			"\x1b[31;1merror:\x1b[0m Package ‘foo-1.0’ has an unfree license (‘unfree’), refusing to evaluate.",
+		},
+	}
+
+	err := finishStages(&record, errors.New("exit status 1"))
+	if !errors.Is(err, ErrEvaluationFailed) || err.Error() != "evaluation failed: Package ‘foo-1.0’ has an unfree license (‘unfree’), refusing to evaluate." {
+		t.Errorf("expected evaluation failure, got %v", err)
+	}
+
+	record = CommandRecord{Program: prepareProgram, Started: time.Now()}
+	recordStage(&record, evaluatedMarker+" /nix/store/foo.drv")
+	record.ExitCode = 1
+
+	if err := finishStages(&record, errors.New("exit status 1")); !errors.Is(err, ErrRealisationFailed) {
+		t.Errorf("expected realisation failure, got %v", err)
+	}
+
+	// Other commands have no stages.
+	record = CommandRecord{Program: "nixery-prefetch", ExitCode: 1}
+	if err := finishStages(&record, errors.New("exit status 1")); errors.Is(err, ErrEvaluationFailed) {
+		t.Errorf("unexpected evaluation failure of other command: %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the garbage collection of the local Nix store,
+// which otherwise grows with every build until the disk is full.
+//
+// The disk usage of the store is checked periodically, and garbage is
+// collected once it exceeds the configured threshold. Only as much as
+// necessary to get back to the target usage is deleted, and the store
+// paths of recent builds are protected by GC roots, as related images
+// are likely to be requested again soon.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/nixery/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Location of the Nix store, whose disk usage is monitored.
+const nixStore = "/nix/store"
+
+// StoreCheckInterval is the interval at which the disk usage of the
+// store is checked.
+const StoreCheckInterval = 5 * time.Minute
+
+// StoreCollector collects garbage in the local Nix store when its disk
+// fills up.
+//
+// A nil *StoreCollector is valid and neither protects nor collects
+// anything.
+type StoreCollector struct {
+	threshold float64
+	target    float64
+	protect   time.Duration
+	roots     string
+
+	mu        sync.Mutex
+	recent    map[string]time.Time
+	lastRun   *time.Time
+	lastFreed uint64
+}
+
+// NewStoreCollector creates a collector that deletes garbage once the
+// disk usage exceeds threshold, down to target (both fractions of the
+// disk size). The store paths of builds within the protection window
+// are registered as GC roots in the roots directory.
+func NewStoreCollector(threshold, target float64, protect time.Duration, roots string) *StoreCollector {
+	return &StoreCollector{
+		threshold: threshold,
+		target:    target,
+		protect:   protect,
+		roots:     roots,
+		recent:    make(map[string]time.Time),
+	}
+}
+
+// built records the store paths of a build, which are protected from
+// collection for the protection window. Their GC roots are registered
+// right away, as a collection could otherwise delete them before the
+// next check.
+func (c *StoreCollector) built(paths []string) {
+	if c == nil {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, p := range paths {
+		c.recent[p] = now
+	}
+
+	if err := c.addRoots(paths); err != nil {
+		log.WithError(err).Warn("failed to register GC roots of build")
+	}
+}
+
+// addRoots registers a GC root for each of the given store paths. The
+// caller must hold c.mu.
+func (c *StoreCollector) addRoots(paths []string) error {
+	if err := os.MkdirAll(c.roots, 0755); err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		name := filepath.Base(p)
+		err := os.Symlink(filepath.Join(nixStore, name), filepath.Join(c.roots, name))
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// diskUsage returns the size of the disk holding the Nix store and the
+// number of bytes available on it.
+func diskUsage() (total, free uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(nixStore, &st); err != nil {
+		return 0, 0, err
+	}
+
+	return st.Blocks * uint64(st.Bsize), st.Bavail * uint64(st.Bsize), nil
+}
+
+// Usage reports the disk usage of the store. It is available even if
+// collection is disabled.
+func (c *StoreCollector) Usage() (api.StoreUsage, error) {
+	total, free, err := diskUsage()
+	if err != nil {
+		return api.StoreUsage{}, err
+	}
+
+	usage := api.StoreUsage{
+		Path:       nixStore,
+		TotalBytes: total,
+		UsedBytes:  total - free,
+		FreeBytes:  free,
+	}
+
+	if c != nil {
+		c.mu.Lock()
+		usage.Threshold = c.threshold
+		usage.Target = c.target
+		usage.Protected = len(c.recent)
+		usage.LastCollection = c.lastRun
+		usage.LastFreed = c.lastFreed
+		c.mu.Unlock()
+	}
+
+	return usage, nil
+}
+
+// Check removes the GC roots of builds outside the protection window,
+// checks the disk usage and collects garbage if it exceeds the
+// threshold.
+func (c *StoreCollector) Check(s *State) error {
+	if err := c.pruneRoots(); err != nil {
+		return fmt.Errorf("failed to update GC roots: %w", err)
+	}
+
+	total, free, err := diskUsage()
+	if err != nil {
+		return fmt.Errorf("failed to check Nix store disk usage: %w", err)
+	}
+
+	if float64(total-free) < c.threshold*float64(total) {
+		return nil
+	}
+
+	if err := c.Collect(s); err != nil {
+		return fmt.Errorf("Nix store garbage collection failed: %w", err)
+	}
+
+	return nil
+}
+
+// Collect deletes garbage from the store until its disk usage is back
+// at the target, sparing the store paths of recent builds.
+func (c *StoreCollector) Collect(s *State) error {
+	total, free, err := diskUsage()
+	if err != nil {
+		return err
+	}
+
+	used := total - free
+	target := uint64(c.target * float64(total))
+	if used <= target {
+		return nil
+	}
+
+	if err := c.pruneRoots(); err != nil {
+		return fmt.Errorf("failed to update GC roots: %w", err)
+	}
+
+	log.WithFields(log.Fields{
+		"used":   used,
+		"target": target,
+	}).Info("collecting garbage in Nix store")
+
+	args := []string{"--max-freed", strconv.FormatUint(used-target, 10)}
+	if _, _, err := runNix(s, "nixery-collect-garbage", &Image{}, args); err != nil {
+		return err
+	}
+
+	_, after, err := diskUsage()
+	if err != nil {
+		return err
+	}
+
+	var freed uint64
+	if after > free {
+		freed = after - free
+	}
+
+	now := time.Now().UTC()
+	c.mu.Lock()
+	c.lastRun = &now
+	c.lastFreed = freed
+	c.mu.Unlock()
+
+	log.WithField("freed", freed).Info("collected garbage in Nix store")
+	return nil
+}
+
+// pruneRoots forgets the store paths of builds outside the protection
+// window, and makes the roots directory contain exactly one GC root for
+// each remaining store path.
+//
+// The lock is held throughout, so that the roots of builds finishing
+// meanwhile are not removed.
+func (c *StoreCollector) pruneRoots() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.MkdirAll(c.roots, 0755); err != nil {
+		return err
+	}
+
+	protected := make(map[string]bool)
+	for p, built := range c.recent {
+		if time.Since(built) > c.protect {
+			delete(c.recent, p)
+			continue
+		}
+		protected[filepath.Base(p)] = true
+	}
+
+	existing, err := ioutil.ReadDir(c.roots)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range existing {
+		if protected[e.Name()] {
+			delete(protected, e.Name())
+		} else if err := os.Remove(filepath.Join(c.roots, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	for name := range protected {
+		if err := os.Symlink(filepath.Join(nixStore, name), filepath.Join(c.roots, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreCollectorRoots(t *testing.T) {
+	roots := filepath.Join(t.TempDir(), "roots")
+	c := NewStoreCollector(1, 0.5, time.Hour, roots)
+
+	old := "/nix/store/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa-old-1.0"
+	fresh := "/nix/store/bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb-fresh-1.0"
+
+	// Roots are registered as soon as a build finishes.
+	c.built([]string{old, fresh})
+	for _, p := range []string{old, fresh} {
+		target, err := os.Readlink(filepath.Join(roots, filepath.Base(p)))
+		if err != nil || target != p {
+			t.Errorf("GC root of %s was not registered: %q (%v)", p, target, err)
+		}
+	}
+
+	// Building the same paths again keeps their roots.
+	c.built([]string{fresh})
+
+	c.mu.Lock()
+	c.recent[old] = time.Now().Add(-2 * time.Hour)
+	c.mu.Unlock()
+
+	// Expired paths are pruned on every check, even if the disk
+	// usage is below the threshold.
+	c.Check(nil)
+
+	if _, err := os.Lstat(filepath.Join(roots, filepath.Base(old))); !os.IsNotExist(err) {
+		t.Errorf("GC root of expired path was not removed: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(roots, filepath.Base(fresh))); err != nil {
+		t.Errorf("GC root of protected path was removed: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.recent[old]; ok || len(c.recent) != 1 {
+		t.Errorf("expired path was not forgotten: %v", c.recent)
+	}
+}
+
+func TestStoreCollectorRemovesStaleRoots(t *testing.T) {
+	roots := t.TempDir()
+	stale := filepath.Join(roots, "cccccccccccccccccccccccccccccccc-stale-1.0")
+	if err := os.Symlink("/nix/store/cccccccccccccccccccccccccccccccc-stale-1.0", stale); err != nil {
+		t.Fatal(err)
+	}
+
+	// Roots left behind by a previous process are not protected.
+	c := NewStoreCollector(1, 0.5, time.Hour, roots)
+	if err := c.pruneRoots(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale GC root was not removed: %v", err)
+	}
+}
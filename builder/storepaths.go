@@ -0,0 +1,80 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements images built from raw store paths, for users
+// who realised the contents of an image with their own Nix invocation
+// and only want them wrapped in an image.
+//
+// The store paths must already be present in the Nix store used by
+// Nixery (e.g. copied there with `nix copy`), as there is no derivation
+// from which Nixery could build them. Their closures are layered like
+// those of packages.
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// ErrInvalidStorePath is returned for malformed store paths.
+var ErrInvalidStorePath = errors.New("invalid store path")
+
+// Name of images built from raw store paths. Such images are only
+// pullable by digest, as pulling the name by tag would attempt to
+// build it from packages.
+const StorePathsName = "store-paths"
+
+// Top-level store paths, which must not refer to files within a path.
+var storePathRegex = regexp.MustCompile(`^/nix/store/[0-9a-df-np-sv-z]{32}-[a-zA-Z0-9+\-._?=]+$`)
+
+// ImageFromStorePaths creates an image containing the given store paths
+// and their closures, for the given architecture (`amd64` or `arm64`).
+func ImageFromStorePaths(paths []string, arch string) (Image, error) {
+	if len(paths) == 0 {
+		return Image{}, fmt.Errorf("%w: at least one store path must be specified", ErrInvalidStorePath)
+	}
+
+	image := Image{
+		Name: StorePathsName,
+		Tag:  "latest",
+		Arch: &amd64,
+	}
+
+	switch arch {
+	case "", "amd64":
+	case "arm64":
+		image.Arch = &arm64
+	default:
+		return Image{}, fmt.Errorf("unsupported architecture: %q", arch)
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		if !storePathRegex.MatchString(p) {
+			return Image{}, fmt.Errorf("%w: %q", ErrInvalidStorePath, p)
+		}
+
+		if !seen[p] {
+			seen[p] = true
+			image.StorePaths = append(image.StorePaths, p)
+		}
+	}
+	sort.Strings(image.StorePaths)
+
+	return image, nil
+}
+
+// storePathsCacheKey returns the cache key of an image built from raw
+// store paths. Store paths identify their contents, so the key does
+// not depend on the package set.
+func storePathsCacheKey(image *Image) string {
+	fields, _ := json.Marshal([]interface{}{
+		"store-paths", image.StorePaths, image.Arch.imageArch, image.Cmd, image.Env, image.Annotations,
+	})
+
+	return fmt.Sprintf("%x", sha1.Sum(fields))
+}
@@ -0,0 +1,55 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const (
+	helloPath = "/nix/store/jb1qmg2xvqcwqhh4p0r1f6q9k6k3n0cz-hello-2.12.1"
+	bashPath  = "/nix/store/9dlsxl7gm6ryl8k6ib1fz5xqf3ms5z1v-bash-5.2-p15"
+)
+
+func TestImageFromStorePaths(t *testing.T) {
+	image, err := ImageFromStorePaths([]string{helloPath, bashPath, helloPath}, "arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(image.StorePaths, []string{bashPath, helloPath}) {
+		t.Errorf("store paths were not deduplicated and sorted: %v", image.StorePaths)
+	}
+	if image.Arch.imageArch != "arm64" || len(image.Packages) != 0 {
+		t.Errorf("unexpected image: %+v", image)
+	}
+
+	for _, paths := range [][]string{
+		nil,
+		{"/nix/store/jb1qmg2xvqcwqhh4p0r1f6q9k6k3n0cz-hello-2.12.1/bin/hello"},
+		{"/etc/passwd"},
+		{"hello"},
+	} {
+		if _, err := ImageFromStorePaths(paths, ""); !errors.Is(err, ErrInvalidStorePath) {
+			t.Errorf("store paths %v were accepted", paths)
+		}
+	}
+}
+
+func TestStorePathsCacheKey(t *testing.T) {
+	s := &State{}
+	a, _ := ImageFromStorePaths([]string{helloPath}, "")
+	b, _ := ImageFromStorePaths([]string{helloPath}, "")
+	b.Tag = "nixos-unstable"
+
+	if imageCacheKey(s, &a) == "" || imageCacheKey(s, &a) != imageCacheKey(s, &b) {
+		t.Error("cache key of store paths depends on the tag")
+	}
+
+	b.Cmd = []string{"hello"}
+	if imageCacheKey(s, &a) == imageCacheKey(s, &b) {
+		t.Error("cache key of store paths does not depend on the command")
+	}
+}
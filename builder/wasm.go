@@ -0,0 +1,131 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package builder
+
+// This file implements the experimental packaging of WebAssembly
+// modules and components built by Nix as OCI artifacts, which can be
+// pulled by WebAssembly runtimes such as wasmtime or Spin.
+//
+// Instead of layers containing the closure of the requested packages,
+// WebAssembly artifacts contain one layer per `.wasm` file found in
+// the outputs of the requested packages.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/nixery/manifest"
+	log "github.com/sirupsen/logrus"
+)
+
+// Version (and layer) fields of the WebAssembly binary header, which
+// distinguish components from core modules.
+var wasmComponentVersion = []byte{0x0d, 0x00, 0x01, 0x00}
+
+// findWasm returns all `.wasm` files in the outputs of the requested
+// packages of an image.
+func findWasm(result *ImageResult) ([]string, error) {
+	var files []string
+
+	for _, root := range result.Graph.References.Graph {
+		err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !info.IsDir() && strings.HasSuffix(p, ".wasm") {
+				files = append(files, p)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// isComponent checks whether a WebAssembly file is a component (as
+// opposed to a core module).
+func isComponent(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+
+	return bytes.Equal(header[4:], wasmComponentVersion)
+}
+
+// wasmLayerKey returns the staging key of a WebAssembly file, which is
+// derived from its full path (including the hash of its store path), as
+// files of different packages often share their name.
+func wasmLayerKey(file string) string {
+	return fmt.Sprintf("wasm-%x", sha256.Sum256([]byte(file)))
+}
+
+// prepareWasmLayers uploads the WebAssembly files of an image as
+// individual layers and returns their entries, as well as the target
+// OS of the artifact.
+func prepareWasmLayers(ctx context.Context, s *State, image *Image, result *ImageResult) ([]manifest.Entry, string, error) {
+	files, err := findWasm(result)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(files) == 0 {
+		return nil, "", fmt.Errorf("no WebAssembly files found in packages of image %s", image.Name)
+	}
+
+	wasmOS := "wasip1"
+	var entries []manifest.Entry
+	for _, file := range files {
+		if isComponent(file) {
+			wasmOS = "wasip2"
+		}
+
+		entry, err := uploadImageLayer(ctx, s, wasmLayerKey(file), func(w io.Writer) error {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			_, err = io.Copy(w, f)
+			return err
+		})
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		log.WithFields(log.Fields{
+			"image":  image.Name,
+			"file":   file,
+			"digest": entry.Digest,
+		}).Info("created WebAssembly layer")
+
+		entry.Annotations = map[string]string{
+			"org.opencontainers.image.title": filepath.Base(file),
+		}
+		entries = append(entries, *entry)
+	}
+
+	return entries, wasmOS, nil
+}
@@ -0,0 +1,521 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Package client implements a Go client for Nixery's extended API
+// (served under `/v1/`) and admin API (served under `/admin/`).
+//
+// Requests that fail with transient errors (network errors, or
+// responses indicating that the server is overloaded or restarting)
+// are retried with exponential backoff.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/nixery/api"
+)
+
+const (
+	// Number of times a failed request is retried by default
+	defaultRetries = 3
+
+	// Delay before the first retry, doubled for each further retry
+	defaultBackoff = 500 * time.Millisecond
+
+	// Upper bound on delays requested by the server via Retry-After
+	maxRetryAfter = 30 * time.Second
+)
+
+// Client is a client for a single Nixery instance.
+type Client struct {
+	// Base URL of the Nixery instance, e.g. `https://nixery.dev`
+	URL string
+
+	// Token for the admin API (`NIXERY_ADMIN_TOKEN`), only required
+	// for admin requests
+	AdminToken string
+
+	// HTTP client used for all requests. Note that image builds can
+	// take a long time, which should be reflected in its timeout.
+	HTTPClient *http.Client
+
+	// Number of times failed requests are retried, and the delay
+	// before the first retry
+	Retries int
+	Backoff time.Duration
+}
+
+// New creates a client for the Nixery instance at the given base URL.
+func New(baseURL string) *Client {
+	return &Client{
+		URL:        strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+		Retries:    defaultRetries,
+		Backoff:    defaultBackoff,
+	}
+}
+
+// Error is returned for requests that Nixery responded to with an
+// error. The code corresponds to the registry error codes, for example
+// `MANIFEST_UNKNOWN` if packages could not be found.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Detail  json.RawMessage
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("nixery returned %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// BuildSpec builds the image described by a spec and returns a
+// pullable reference to it.
+func (c *Client) BuildSpec(ctx context.Context, spec api.ImageSpec) (*api.SpecResponse, error) {
+	var resp api.SpecResponse
+	err := c.do(ctx, "POST", "/v1/spec", nil, spec, &resp, false)
+	return &resp, err
+}
+
+// BuildSpecAlias builds the image described by a spec, and creates a
+// short alias under which it can be pulled.
+func (c *Client) BuildSpecAlias(ctx context.Context, spec api.ImageSpec) (*api.SpecResponse, error) {
+	var resp api.SpecResponse
+	err := c.do(ctx, "POST", "/v1/spec", url.Values{"alias": {"true"}}, spec, &resp, false)
+	return &resp, err
+}
+
+// BuildFromPaths builds an image from raw store paths and returns a
+// pullable reference to it.
+func (c *Client) BuildFromPaths(ctx context.Context, req api.StorePathsRequest) (*api.SpecResponse, error) {
+	var resp api.SpecResponse
+	err := c.do(ctx, "POST", "/v1/from-paths", nil, req, &resp, false)
+	return &resp, err
+}
+
+// Status returns the build of Nixery serving the instance and the time
+// it was started.
+func (c *Client) Status(ctx context.Context) (*api.Status, error) {
+	var status api.Status
+	err := c.do(ctx, "GET", "/v1/status", nil, nil, &status, false)
+	return &status, err
+}
+
+// Spec returns the spec from which the image with the given manifest
+// digest (`sha256:<hex>`) was built.
+func (c *Client) Spec(ctx context.Context, digest string) (*api.ImageSpec, error) {
+	var spec api.ImageSpec
+	err := c.do(ctx, "GET", "/v1/spec/"+digest, nil, nil, &spec, false)
+	return &spec, err
+}
+
+// Contents returns the store paths included in the image with the
+// given manifest digest (`sha256:<hex>`).
+func (c *Client) Contents(ctx context.Context, digest string) (*api.ImageContents, error) {
+	var contents api.ImageContents
+	err := c.do(ctx, "GET", "/v1/contents/"+digest, nil, nil, &contents, false)
+	return &contents, err
+}
+
+// Invalidate announces that a branch of the package repository changed
+// (or all of them, if ref is empty), so that new packages can be pulled
+// immediately. The admin token or `NIXERY_INVALIDATE_TOKEN` must be set
+// as the client's admin token.
+func (c *Client) Invalidate(ctx context.Context, ref string) (*api.InvalidateReport, error) {
+	var report api.InvalidateReport
+	err := c.do(ctx, "POST", "/v1/invalidate", nil, api.InvalidateRequest{Ref: ref}, &report, true)
+	return &report, err
+}
+
+// NamedPins returns all named pins.
+func (c *Client) NamedPins(ctx context.Context) ([]api.NamedPin, error) {
+	var pins []api.NamedPin
+	err := c.do(ctx, "GET", "/v1/pin", nil, nil, &pins, false)
+	return pins, err
+}
+
+// SaveNamedPin saves the given revision under a name that can be used
+// as an image tag, or the current pin of `latest` if it is empty.
+// Existing pins of the name are advanced.
+func (c *Client) SaveNamedPin(ctx context.Context, name, revision string) (*api.NamedPin, error) {
+	var pin api.NamedPin
+	err := c.do(ctx, "POST", "/v1/pin", nil, api.NamedPinRequest{Name: name, Revision: revision}, &pin, true)
+	return &pin, err
+}
+
+// DeleteNamedPin deletes a named pin.
+func (c *Client) DeleteNamedPin(ctx context.Context, name string) error {
+	resp, err := c.send(ctx, "DELETE", "/v1/pin", url.Values{"name": {name}}, nil, true)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// CuratedImages returns the curated images and the state of their
+// last sync.
+func (c *Client) CuratedImages(ctx context.Context) (*api.CuratedImages, error) {
+	var curated api.CuratedImages
+	err := c.do(ctx, "GET", "/v1/curated", nil, nil, &curated, false)
+	return &curated, err
+}
+
+// SyncCuratedImages syncs the curated images from their repository. The
+// admin token or `NIXERY_INVALIDATE_TOKEN` must be set as the client's
+// admin token.
+func (c *Client) SyncCuratedImages(ctx context.Context) (*api.CuratedImages, error) {
+	var curated api.CuratedImages
+	err := c.do(ctx, "POST", "/v1/curated", nil, nil, &curated, true)
+	return &curated, err
+}
+
+// Capabilities returns the features supported by the instance.
+func (c *Client) Capabilities(ctx context.Context) (*api.Capabilities, error) {
+	var capabilities api.Capabilities
+	err := c.do(ctx, "GET", "/.well-known/nixery.json", nil, nil, &capabilities, false)
+	return &capabilities, err
+}
+
+// Size returns the transfer size of an image, building it if
+// necessary. An empty tag defaults to `latest`.
+func (c *Client) Size(ctx context.Context, image, tag string) (*api.SizeResponse, error) {
+	query := url.Values{"image": {image}}
+	if tag != "" {
+		query.Set("tag", tag)
+	}
+
+	var size api.SizeResponse
+	err := c.do(ctx, "GET", "/v1/size", query, nil, &size, false)
+	return &size, err
+}
+
+// ExplainCacheKey describes how the cache key of an image is derived,
+// without building it. An empty tag defaults to `latest`.
+func (c *Client) ExplainCacheKey(ctx context.Context, image, tag string) (*api.CacheKeyExplanation, error) {
+	var query url.Values
+	if tag != "" {
+		query = url.Values{"tag": {tag}}
+	}
+
+	var explanation api.CacheKeyExplanation
+	err := c.do(ctx, "GET", "/v1/explain/"+image, query, nil, &explanation, false)
+	return &explanation, err
+}
+
+// CollectGarbage runs a garbage collection on the storage backend.
+// With dryRun, the report only describes what would be deleted.
+func (c *Client) CollectGarbage(ctx context.Context, dryRun bool) (*api.GCReport, error) {
+	query := url.Values{"dry_run": {strconv.FormatBool(dryRun)}}
+
+	var report api.GCReport
+	err := c.do(ctx, "POST", "/admin/gc", query, nil, &report, true)
+	return &report, err
+}
+
+// Commands returns the most recent Nix invocations, optionally
+// filtered to a single image.
+func (c *Client) Commands(ctx context.Context, image string) ([]api.CommandRecord, error) {
+	var query url.Values
+	if image != "" {
+		query = url.Values{"image": {image}}
+	}
+
+	var records []api.CommandRecord
+	err := c.do(ctx, "GET", "/admin/commands", query, nil, &records, true)
+	return records, err
+}
+
+// Logging returns the current logging settings.
+func (c *Client) Logging(ctx context.Context) (*api.LoggingSettings, error) {
+	var settings api.LoggingSettings
+	err := c.do(ctx, "GET", "/admin/logging", nil, nil, &settings, true)
+	return &settings, err
+}
+
+// SetLogging changes the logging settings and returns the resulting
+// settings. Fields that are not set are left unchanged.
+func (c *Client) SetLogging(ctx context.Context, settings api.LoggingSettings) (*api.LoggingSettings, error) {
+	var updated api.LoggingSettings
+	err := c.do(ctx, "PUT", "/admin/logging", nil, settings, &updated, true)
+	return &updated, err
+}
+
+// Usage returns the storage usage of each tenant.
+func (c *Client) Usage(ctx context.Context) (map[string]api.Usage, error) {
+	var usage map[string]api.Usage
+	err := c.do(ctx, "GET", "/admin/usage", nil, nil, &usage, true)
+	return usage, err
+}
+
+// StorageOperations returns the number of calls made to the storage
+// backend, by operation and object class.
+func (c *Client) StorageOperations(ctx context.Context) (*api.StorageOperations, error) {
+	var ops api.StorageOperations
+	err := c.do(ctx, "GET", "/admin/storage-operations", nil, nil, &ops, true)
+	return &ops, err
+}
+
+// Tasks returns the status of the periodic background tasks.
+func (c *Client) Tasks(ctx context.Context) (*api.SchedulerStatus, error) {
+	var status api.SchedulerStatus
+	err := c.do(ctx, "GET", "/admin/tasks", nil, nil, &status, true)
+	return &status, err
+}
+
+// Cache returns the contents and disk usage of the local cache.
+func (c *Client) Cache(ctx context.Context) (*api.CacheStats, error) {
+	var stats api.CacheStats
+	err := c.do(ctx, "GET", "/admin/cache", nil, nil, &stats, true)
+	return &stats, err
+}
+
+// Store returns the disk usage of the Nix store.
+func (c *Client) Store(ctx context.Context) (*api.StoreUsage, error) {
+	var usage api.StoreUsage
+	err := c.do(ctx, "GET", "/admin/store", nil, nil, &usage, true)
+	return &usage, err
+}
+
+// CollectStoreGarbage collects garbage in the Nix store down to the
+// configured target usage.
+func (c *Client) CollectStoreGarbage(ctx context.Context) (*api.StoreUsage, error) {
+	var usage api.StoreUsage
+	err := c.do(ctx, "POST", "/admin/store", nil, nil, &usage, true)
+	return &usage, err
+}
+
+// Pin returns the pin of the `latest` tag and its rollout progress.
+func (c *Client) Pin(ctx context.Context) (*api.PinStatus, error) {
+	var status api.PinStatus
+	err := c.do(ctx, "GET", "/admin/pin", nil, nil, &status, true)
+	return &status, err
+}
+
+// AdvancePin starts the rollout of a new pin for the `latest` tag.
+func (c *Client) AdvancePin(ctx context.Context, revision string) (*api.PinStatus, error) {
+	var status api.PinStatus
+	err := c.do(ctx, "PUT", "/admin/pin", nil, api.PinRequest{Revision: revision}, &status, true)
+	return &status, err
+}
+
+// Promote copies cached images from the storage prefix of another
+// environment. All cached images are promoted if no keys are given.
+func (c *Client) Promote(ctx context.Context, from string, keys ...string) (*api.PromoteReport, error) {
+	var report api.PromoteReport
+	err := c.do(ctx, "POST", "/admin/promote", nil, api.PromoteRequest{From: from, Keys: keys}, &report, true)
+	return &report, err
+}
+
+// Profiles returns the imported profiles.
+func (c *Client) Profiles(ctx context.Context) ([]api.Profile, error) {
+	var profiles []api.Profile
+	err := c.do(ctx, "GET", "/admin/profiles", nil, nil, &profiles, true)
+	return profiles, err
+}
+
+// ImportProfile imports an image from another registry, to be served
+// as name:tag. An empty arch defaults to `amd64`.
+func (c *Client) ImportProfile(ctx context.Context, name, tag, from, arch string) (*api.Profile, error) {
+	query := url.Values{"name": {name}, "tag": {tag}, "from": {from}}
+	if arch != "" {
+		query.Set("arch", arch)
+	}
+
+	var profile api.Profile
+	err := c.do(ctx, "POST", "/admin/profiles", query, nil, &profile, true)
+	return &profile, err
+}
+
+// DeleteProfile deletes an imported profile.
+func (c *Client) DeleteProfile(ctx context.Context, name, tag string) error {
+	resp, err := c.send(ctx, "DELETE", "/admin/profiles", url.Values{"name": {name}, "tag": {tag}}, nil, true)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Popularity reports the package popularity derived from access logs.
+func (c *Client) Popularity(ctx context.Context) (*api.PopularityStatus, error) {
+	var status api.PopularityStatus
+	err := c.do(ctx, "GET", "/admin/popularity", nil, nil, &status, true)
+	return &status, err
+}
+
+// IngestAccessLog counts the image pulls in a registry access log, and
+// adds them to the package popularity or replaces it with them.
+func (c *Client) IngestAccessLog(ctx context.Context, accessLog []byte, replace bool) (*api.PopularityReport, error) {
+	var query url.Values
+	if replace {
+		query = url.Values{"replace": {"true"}}
+	}
+
+	resp, err := c.send(ctx, "POST", "/admin/popularity", query, accessLog, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var report api.PopularityReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return nil, fmt.Errorf("failed to decode access log report: %s", err)
+	}
+
+	return &report, nil
+}
+
+// PullToken mints a token granting access to an image for the given
+// lifetime (e.g. `30m`). An empty ttl uses the server's default.
+func (c *Client) PullToken(ctx context.Context, image, ttl string) (*api.PullToken, error) {
+	var token api.PullToken
+	err := c.do(ctx, "POST", "/admin/pull-tokens", nil, api.PullTokenRequest{Image: image, TTL: ttl}, &token, true)
+	return &token, err
+}
+
+// SupportBundle returns a gzipped tarball with debugging information,
+// optionally restricting failed builds to a single image. The caller
+// must close the returned reader.
+func (c *Client) SupportBundle(ctx context.Context, image string) (io.ReadCloser, error) {
+	var query url.Values
+	if image != "" {
+		query = url.Values{"image": {image}}
+	}
+
+	resp, err := c.send(ctx, "GET", "/admin/support-bundle", query, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// do performs a request with an optional JSON body and decodes the
+// JSON response into out.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out interface{}, admin bool) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	resp, err := c.send(ctx, method, path, query, body, admin)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response to %s %s: %s", method, path, err)
+	}
+
+	return nil
+}
+
+// send performs a request, retrying it on transient failures, and
+// returns the response if it was successful.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, body []byte, admin bool) (*http.Response, error) {
+	target := c.URL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		if admin {
+			req.Header.Set("Authorization", "Bearer "+c.AdminToken)
+		}
+
+		resp, err := c.HTTPClient.Do(req)
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		delay := backoff
+		if err == nil {
+			err = readError(resp)
+			if !retryable(resp.StatusCode) {
+				return nil, err
+			}
+
+			if after, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil {
+				delay = time.Duration(after) * time.Second
+				if delay > maxRetryAfter {
+					delay = maxRetryAfter
+				}
+			}
+		}
+
+		if attempt >= c.Retries {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		backoff *= 2
+	}
+}
+
+// retryable reports whether a response status indicates a transient
+// failure.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// readError converts an error response into an *Error and closes its
+// body.
+func readError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	e := &Error{
+		Status:  resp.StatusCode,
+		Code:    "UNKNOWN",
+		Message: strings.TrimSpace(string(body)),
+	}
+
+	var parsed struct {
+		Errors []struct {
+			Code    string          `json:"code"`
+			Message string          `json:"message"`
+			Detail  json.RawMessage `json:"detail"`
+		} `json:"errors"`
+	}
+
+	if json.Unmarshal(body, &parsed) == nil && len(parsed.Errors) > 0 {
+		e.Code = parsed.Errors[0].Code
+		e.Message = parsed.Errors[0].Message
+		e.Detail = parsed.Errors[0].Detail
+	}
+
+	return e
+}
@@ -0,0 +1,57 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/nixery/api"
+)
+
+func TestRetryAndErrors(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(503)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(401)
+			w.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"invalid admin token"}]}`))
+			return
+		}
+
+		w.Write([]byte(`{"current":"abc","migrated":1,"pending":2}`))
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	c.Backoff = 0
+
+	_, err := c.Pin(context.Background())
+	var e *Error
+	if !errors.As(err, &e) || e.Status != 401 || e.Code != "UNAUTHORIZED" {
+		t.Fatalf("expected UNAUTHORIZED error, got %v", err)
+	}
+
+	if attempts != 2 {
+		t.Errorf("expected request to be retried once, got %d attempts", attempts)
+	}
+
+	c.AdminToken = "secret"
+	status, err := c.Pin(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := api.PinStatus{Current: "abc", Migrated: 1, Pending: 2}
+	if *status != expected {
+		t.Errorf("unexpected pin status: %+v", status)
+	}
+}
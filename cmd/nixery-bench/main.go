@@ -0,0 +1,301 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// The nixery-bench command generates pull workloads against a Nixery
+// instance and reports the latency percentiles of each stage of the
+// pulls, which helps operators to plan the capacity of an instance
+// before moving traffic (e.g. from CI) onto it.
+//
+// Workloads are either replayed from a trace of pulls (`-trace`), or
+// generated as a mix of pulls of warm images, which are cached before
+// the run, and cold images, which are random combinations of packages
+// that have to be built. Pulls are classified by their kind and by the
+// size of the image, as the latencies of small and big images differ
+// by orders of magnitude.
+//
+// Images are pulled like registry clients do: the manifest is requested
+// by tag, followed by the configuration and all layers.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mf "github.com/google/nixery/manifest"
+	log "github.com/sirupsen/logrus"
+)
+
+// Number of layers downloaded concurrently per pull, as by Docker.
+const layerConcurrency = 3
+
+type bench struct {
+	url    string
+	token  string
+	bigMB  float64
+	client *http.Client
+	report *Report
+}
+
+func (b *bench) get(ctx context.Context, path string, accept ...string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", b.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range accept {
+		req.Header.Add("Accept", a)
+	}
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("GET %s returned %d: %s", path, resp.StatusCode, body)
+	}
+
+	return resp, nil
+}
+
+// download fetches a blob and returns its size.
+func (b *bench) download(ctx context.Context, image, digest string) (int64, error) {
+	resp, err := b.get(ctx, "/v2/"+image+"/blobs/"+digest)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	return io.Copy(ioutil.Discard, resp.Body)
+}
+
+// pull pulls an image and records the latencies of its stages. The
+// class of the pull is only known once the manifest (and thereby the
+// size of the image) was retrieved.
+func (b *bench) pull(ctx context.Context, p pull) (string, int64, error) {
+	start := time.Now()
+	class := p.Kind
+
+	resp, err := b.get(ctx, "/v2/"+p.Image+"/manifests/"+p.Tag, mf.ManifestType, mf.OCIManifestType)
+	if err != nil {
+		return class, 0, err
+	}
+	manifest, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return class, 0, err
+	}
+
+	size, err := mf.TransferSize(manifest)
+	if err != nil {
+		return class, 0, fmt.Errorf("invalid manifest of %s: %w", p.Image, err)
+	}
+	if float64(size) >= b.bigMB*1e6 {
+		class += "/big"
+	} else {
+		class += "/small"
+	}
+	b.report.record(class, stageManifest, time.Since(start))
+
+	refs, err := mf.References(manifest)
+	if err != nil || len(refs) == 0 {
+		return class, 0, fmt.Errorf("invalid manifest of %s: %v", p.Image, err)
+	}
+
+	// The configuration is the first reference.
+	configStart := time.Now()
+	bytes, err := b.download(ctx, p.Image, refs[0])
+	if err != nil {
+		return class, bytes, err
+	}
+	b.report.record(class, stageConfig, time.Since(configStart))
+
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, layerConcurrency)
+
+	layersStart := time.Now()
+	for _, ref := range refs[1:] {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(ref string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			layerStart := time.Now()
+			n, err := b.download(ctx, p.Image, ref)
+
+			mu.Lock()
+			defer mu.Unlock()
+			bytes += n
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			b.report.record(class, stageLayer, time.Since(layerStart))
+		}(ref)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return class, bytes, firstErr
+	}
+
+	b.report.record(class, stageLayers, time.Since(layersStart))
+	b.report.record(class, stageTotal, time.Since(start))
+	return class, bytes, nil
+}
+
+// run replays the pulls of a workload, starting each at its offset
+// with at most the given number of pulls in flight (0 = unlimited).
+func (b *bench) run(ctx context.Context, pulls []pull, concurrency int) {
+	var sem chan struct{}
+	if concurrency > 0 {
+		sem = make(chan struct{}, concurrency)
+	}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, p := range pulls {
+		if wait := p.At - time.Since(start); wait > 0 {
+			time.Sleep(wait)
+		}
+		if sem != nil {
+			sem <- struct{}{}
+		}
+
+		wg.Add(1)
+		go func(p pull) {
+			defer wg.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+
+			class, bytes, err := b.pull(ctx, p)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"image": p.Image,
+					"tag":   p.Tag,
+				}).Warn("pull failed")
+			}
+			b.report.pulled(class, bytes, err)
+		}(p)
+	}
+	wg.Wait()
+
+	b.report.finish(time.Since(start))
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.Trim(strings.TrimSpace(item), "/"); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func main() {
+	url := flag.String("url", "http://localhost:8080", "base URL of the Nixery instance")
+	token := flag.String("token", "", "bearer token sent with all requests (e.g. a pull token)")
+	trace := flag.String("trace", "", "file with a trace of pulls to replay, one `<offset in seconds> <image>[:<tag>]` per line")
+	speed := flag.Float64("speed", 1, "factor by which the trace is replayed faster")
+	pulls := flag.Int("pulls", 100, "number of pulls of a generated workload")
+	rate := flag.Float64("rate", 0, "pulls started per second in a generated workload (0 = as fast as the concurrency allows)")
+	cold := flag.Float64("cold", 0.1, "fraction of pulls of cold images in a generated workload")
+	warm := flag.String("images", "shell,shell/git", "comma-separated warm images of a generated workload")
+	packages := flag.String("packages", "", "comma-separated packages combined into cold images of a generated workload")
+	coldSize := flag.Int("cold-size", 3, "number of packages in each cold image")
+	prewarm := flag.Bool("prewarm", true, "pull the warm images once before the run")
+	concurrency := flag.Int("concurrency", 8, "maximum number of pulls in flight (0 = unlimited)")
+	bigMB := flag.Float64("big-mb", 100, "transfer size (in MB) from which images are classified as big")
+	timeout := flag.Duration("timeout", 15*time.Minute, "timeout of each request, including image builds")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seed of the generated workload")
+	jsonOutput := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+
+	b := &bench{
+		url:    strings.TrimSuffix(*url, "/"),
+		token:  *token,
+		bigMB:  *bigMB,
+		client: &http.Client{Timeout: *timeout},
+		report: newReport(),
+	}
+
+	var workload []pull
+	var err error
+	if *trace != "" {
+		f, err := os.Open(*trace)
+		if err != nil {
+			log.WithError(err).Fatal("failed to open trace")
+		}
+		workload, err = parseTrace(f)
+		f.Close()
+		if err != nil {
+			log.WithError(err).Fatal("failed to parse trace")
+		}
+
+		if *speed <= 0 {
+			log.Fatal("-speed must be positive")
+		}
+		for i := range workload {
+			workload[i].At = time.Duration(float64(workload[i].At) / *speed)
+		}
+	} else {
+		g := generator{
+			Pulls:    *pulls,
+			Rate:     *rate,
+			Cold:     *cold,
+			Warm:     splitList(*warm),
+			Packages: splitList(*packages),
+			ColdSize: *coldSize,
+		}
+
+		workload, err = g.generate(rand.New(rand.NewSource(*seed)))
+		if err != nil {
+			log.WithError(err).Fatal("failed to generate workload")
+		}
+
+		if *prewarm {
+			for _, image := range g.Warm {
+				log.WithField("image", image).Info("pre-warming image")
+				if _, _, err := b.pull(context.Background(), pull{Image: image, Tag: "latest", Kind: kindWarm}); err != nil {
+					log.WithError(err).WithField("image", image).Fatal("failed to pre-warm image")
+				}
+			}
+			b.report = newReport()
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"pulls": len(workload),
+		"url":   b.url,
+	}).Info("starting benchmark")
+
+	b.run(context.Background(), workload, *concurrency)
+
+	if *jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(b.report)
+	} else {
+		b.report.write(os.Stdout)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements the aggregation of measured latencies into
+// percentiles per stage of a pull and class of image.
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Stages of a pull. Builds of images that are not cached happen while
+// the manifest is requested.
+const (
+	stageManifest = "manifest" // Request of the manifest by tag
+	stageConfig   = "config"   // Download of the image configuration
+	stageLayer    = "layer"    // Download of a single layer
+	stageLayers   = "layers"   // Download of all layers of an image
+	stageTotal    = "total"    // Complete pull
+)
+
+var stages = []string{stageManifest, stageConfig, stageLayer, stageLayers, stageTotal}
+
+// Stats summarises the latencies of one stage for one class of pulls.
+type Stats struct {
+	Class string  `json:"class"`
+	Stage string  `json:"stage"`
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"` // Latencies in seconds
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// Report is the result of a benchmark run.
+type Report struct {
+	Duration float64        `json:"duration"` // Wall-clock time of the run in seconds
+	Pulls    int            `json:"pulls"`
+	Errors   map[string]int `json:"errors"` // Failed pulls per class
+	Bytes    int64          `json:"bytes"`  // Bytes downloaded
+	Stats    []Stats        `json:"stats"`
+
+	mu      sync.Mutex
+	samples map[sampleKey][]float64
+}
+
+type sampleKey struct {
+	class string
+	stage string
+}
+
+func newReport() *Report {
+	return &Report{
+		Errors:  make(map[string]int),
+		samples: make(map[sampleKey][]float64),
+	}
+}
+
+func (r *Report) record(class, stage string, d time.Duration) {
+	r.mu.Lock()
+	key := sampleKey{class, stage}
+	r.samples[key] = append(r.samples[key], d.Seconds())
+	r.mu.Unlock()
+}
+
+func (r *Report) pulled(class string, bytes int64, err error) {
+	r.mu.Lock()
+	r.Pulls++
+	r.Bytes += bytes
+	if err != nil {
+		r.Errors[class]++
+	}
+	r.mu.Unlock()
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// finish computes the statistics of all recorded samples.
+func (r *Report) finish(duration time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Duration = duration.Seconds()
+	r.Stats = nil
+
+	classes := make(map[string]bool)
+	var sorted []string
+	for key := range r.samples {
+		if !classes[key.class] {
+			classes[key.class] = true
+			sorted = append(sorted, key.class)
+		}
+	}
+	sort.Strings(sorted)
+
+	for _, class := range sorted {
+		for _, stage := range stages {
+			values := r.samples[sampleKey{class, stage}]
+			if len(values) == 0 {
+				continue
+			}
+			sort.Float64s(values)
+
+			r.Stats = append(r.Stats, Stats{
+				Class: class,
+				Stage: stage,
+				Count: len(values),
+				P50:   percentile(values, 50),
+				P90:   percentile(values, 90),
+				P99:   percentile(values, 99),
+				Max:   values[len(values)-1],
+			})
+		}
+	}
+}
+
+// write prints the report as a table.
+func (r *Report) write(w io.Writer) {
+	fmt.Fprintf(w, "%d pulls in %.1fs, %.1f MB downloaded\n", r.Pulls, r.Duration, float64(r.Bytes)/1e6)
+	for class, n := range r.Errors {
+		fmt.Fprintf(w, "%d failed pulls of %s images\n", n, class)
+	}
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "class\tstage\tcount\tp50\tp90\tp99\tmax\t")
+	for _, s := range r.Stats {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%.3fs\t%.3fs\t%.3fs\t%.3fs\t\n", s.Class, s.Stage, s.Count, s.P50, s.P90, s.P99, s.Max)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,160 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements the workloads replayed against an instance:
+// either a recorded trace of pulls, or a generated mix of pulls of
+// warm (already cached) and cold (never built) images.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pull is a single image pull of a workload.
+type pull struct {
+	At    time.Duration // Offset from the start of the workload
+	Image string
+	Tag   string
+	Kind  string // Class of the pull, e.g. `cold` or `warm`
+}
+
+// Kinds of pulls. Pulls of traces are classified by whether the image
+// was pulled before during the same run.
+const (
+	kindCold   = "cold"
+	kindWarm   = "warm"
+	kindFirst  = "first"
+	kindRepeat = "repeat"
+)
+
+// splitRef splits an image reference into its name and tag.
+func splitRef(ref string) (string, string) {
+	if i := strings.LastIndexByte(ref, ':'); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, "latest"
+}
+
+// parseTrace reads a trace of pulls, with one pull per line in the form
+// `<offset in seconds> <image>[:<tag>]`, e.g. `12.5 shell/git:latest`.
+// Empty lines and lines starting with `#` are ignored.
+func parseTrace(r io.Reader) ([]pull, error) {
+	var pulls []pull
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected `<offset> <image>`", line)
+		}
+
+		offset, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("line %d: invalid offset %q", line, fields[0])
+		}
+
+		name, tag := splitRef(strings.Trim(fields[1], "/"))
+		p := pull{
+			At:    time.Duration(offset * float64(time.Second)),
+			Image: name,
+			Tag:   tag,
+		}
+
+		pulls = append(pulls, p)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(pulls, func(i, j int) bool { return pulls[i].At < pulls[j].At })
+
+	seen := make(map[string]bool)
+	for i, p := range pulls {
+		ref := p.Image + ":" + p.Tag
+		pulls[i].Kind = kindRepeat
+		if !seen[ref] {
+			seen[ref] = true
+			pulls[i].Kind = kindFirst
+		}
+	}
+
+	return pulls, nil
+}
+
+// generator describes a generated workload.
+type generator struct {
+	Pulls int     // Number of pulls
+	Rate  float64 // Pulls started per second (0 = as fast as possible)
+	Cold  float64 // Fraction of pulls of images that were never built
+
+	Warm     []string // Images pulled as warm images, which are cached before the run
+	Packages []string // Packages combined into cold images
+	ColdSize int      // Number of packages in each cold image
+}
+
+// generate creates the pulls of a generated workload. Cold images are
+// random combinations of packages, which are unlikely to have been
+// built before and are never pulled twice.
+func (g *generator) generate(rng *rand.Rand) ([]pull, error) {
+	if g.Cold > 0 && len(g.Packages) < g.ColdSize {
+		return nil, fmt.Errorf("cold images require at least %d packages", g.ColdSize)
+	}
+	if g.Cold < 1 && len(g.Warm) == 0 {
+		return nil, fmt.Errorf("warm pulls require at least one image")
+	}
+
+	var pulls []pull
+	used := make(map[string]bool)
+	for i := 0; i < g.Pulls; i++ {
+		p := pull{Tag: "latest"}
+		if g.Rate > 0 {
+			p.At = time.Duration(float64(i) * float64(time.Second) / g.Rate)
+		}
+
+		if rng.Float64() < g.Cold {
+			name, err := g.coldImage(rng, used)
+			if err != nil {
+				return nil, err
+			}
+			p.Image, p.Kind = name, kindCold
+		} else {
+			p.Image, p.Kind = g.Warm[rng.Intn(len(g.Warm))], kindWarm
+		}
+
+		pulls = append(pulls, p)
+	}
+
+	return pulls, nil
+}
+
+// coldImage picks a combination of packages that was not used yet.
+func (g *generator) coldImage(rng *rand.Rand, used map[string]bool) (string, error) {
+	for attempt := 0; attempt < 100; attempt++ {
+		perm := rng.Perm(len(g.Packages))[:g.ColdSize]
+		pkgs := make([]string, len(perm))
+		for i, idx := range perm {
+			pkgs[i] = g.Packages[idx]
+		}
+		sort.Strings(pkgs)
+
+		name := strings.Join(pkgs, "/")
+		if !used[name] {
+			used[name] = true
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("ran out of package combinations for cold images, specify more packages")
+}
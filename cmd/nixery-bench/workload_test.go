@@ -0,0 +1,113 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTrace(t *testing.T) {
+	trace := `
+# recorded on 2022-10-01
+2.5 shell/git
+0 shell:v1
+1 shell/git:latest
+`
+
+	pulls, err := parseTrace(strings.NewReader(trace))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []pull{
+		{At: 0, Image: "shell", Tag: "v1", Kind: kindFirst},
+		{At: time.Second, Image: "shell/git", Tag: "latest", Kind: kindFirst},
+		{At: 2500 * time.Millisecond, Image: "shell/git", Tag: "latest", Kind: kindRepeat},
+	}
+
+	if len(pulls) != len(expected) {
+		t.Fatalf("expected %d pulls, got %v", len(expected), pulls)
+	}
+	for i := range expected {
+		if pulls[i] != expected[i] {
+			t.Errorf("pull %d: expected %v, got %v", i, expected[i], pulls[i])
+		}
+	}
+}
+
+func TestParseTraceInvalid(t *testing.T) {
+	for _, trace := range []string{"shell", "-1 shell", "x shell", "1 shell extra"} {
+		if _, err := parseTrace(strings.NewReader(trace)); err == nil {
+			t.Errorf("trace %q was accepted", trace)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	g := generator{
+		Pulls:    50,
+		Rate:     10,
+		Cold:     0.5,
+		Warm:     []string{"shell"},
+		Packages: []string{"a", "b", "c", "d", "e", "f", "g", "h"},
+		ColdSize: 3,
+	}
+
+	pulls, err := g.generate(rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pulls) != g.Pulls {
+		t.Fatalf("expected %d pulls, got %d", g.Pulls, len(pulls))
+	}
+
+	cold := make(map[string]bool)
+	for i, p := range pulls {
+		if expected := time.Duration(i) * 100 * time.Millisecond; p.At != expected {
+			t.Errorf("pull %d: expected offset %s, got %s", i, expected, p.At)
+		}
+
+		switch p.Kind {
+		case kindWarm:
+			if p.Image != "shell" {
+				t.Errorf("unexpected warm image %q", p.Image)
+			}
+		case kindCold:
+			if cold[p.Image] {
+				t.Errorf("cold image %q was pulled twice", p.Image)
+			}
+			cold[p.Image] = true
+			if n := len(strings.Split(p.Image, "/")); n != g.ColdSize {
+				t.Errorf("cold image %q has %d packages", p.Image, n)
+			}
+		}
+	}
+
+	if len(cold) == 0 {
+		t.Error("no cold images were generated")
+	}
+}
+
+func TestGenerateExhausted(t *testing.T) {
+	g := generator{Pulls: 10, Cold: 1, Packages: []string{"a", "b"}, ColdSize: 2}
+	if _, err := g.generate(rand.New(rand.NewSource(1))); err == nil {
+		t.Error("more cold images than package combinations were generated")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	values := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	for p, expected := range map[float64]float64{0: 1, 50: 5, 90: 9, 99: 10, 100: 10} {
+		if v := percentile(values, p); v != expected {
+			t.Errorf("p%v: expected %v, got %v", p, expected, v)
+		}
+	}
+
+	if v := percentile(nil, 50); v != 0 {
+		t.Errorf("percentile of no values was %v", v)
+	}
+}
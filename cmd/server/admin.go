@@ -0,0 +1,527 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements the admin API, which exposes operations on the
+// Nixery instance to operators. All admin requests must be
+// authenticated with the configured admin token.
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/builder"
+	"github.com/google/nixery/gc"
+	"github.com/google/nixery/logs"
+	"github.com/google/nixery/scheduler"
+	"github.com/google/nixery/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+type adminHandler struct {
+	state *builder.State
+}
+
+// authorized reports whether a request may use the admin API.
+func (h *adminHandler) authorized(r *http.Request) bool {
+	return hasBearer(r, h.state.Cfg.AdminToken)
+}
+
+// newAdminHandler assembles the handler for the separate admin
+// listener, which serves the admin API and Go's profiling endpoints.
+func newAdminHandler(state *builder.State) http.Handler {
+	admin := &adminHandler{state: state}
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", admin)
+	mux.HandleFunc("/ready", serveReady)
+
+	profiling := http.NewServeMux()
+	profiling.HandleFunc("/debug/pprof/", pprof.Index)
+	profiling.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	profiling.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	profiling.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	profiling.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.Handle("/debug/pprof/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !admin.authorized(r) {
+			writeError(w, 401, "UNAUTHORIZED", "invalid admin token")
+			return
+		}
+
+		profiling.ServeHTTP(w, r)
+	}))
+
+	return realIP(state.Cfg.TrustedProxies, mux)
+}
+
+// newScheduler creates the scheduler for the periodic tasks enabled
+// in the configuration.
+func newScheduler(state *builder.State) *scheduler.Scheduler {
+	var leader scheduler.Leader
+	if state.Cfg.LeaderLease > 0 {
+		lease := scheduler.NewLease(state.Storage, state.Cfg.LeaderLease)
+		go lease.Run()
+		leader = lease
+	}
+
+	s := scheduler.New(leader)
+	add := func(t scheduler.Task) {
+		if err := s.Add(t); err != nil {
+			log.WithError(err).Fatal("failed to schedule periodic task")
+		}
+	}
+
+	if state.Cfg.GCInterval > 0 {
+		add(scheduler.Task{
+			Name:        "gc",
+			Interval:    state.Cfg.GCInterval,
+			ClusterWide: true,
+			Run: func(ctx context.Context) error {
+				_, err := gc.Collect(ctx, state.Storage, gc.Options{
+					Grace:  state.Cfg.GCGrace,
+					Events: state.Events,
+				})
+				return err
+			},
+		})
+	}
+
+	// Every replica enforces quotas, so each of them needs to know
+	// the current usage.
+	if state.Quotas != nil {
+		add(scheduler.Task{
+			Name:      "quota-refresh",
+			Interval:  state.Cfg.QuotaRefresh,
+			Immediate: true,
+			Run: func(ctx context.Context) error {
+				return state.Quotas.Refresh(ctx, state.Storage)
+			},
+		})
+	}
+
+	// Profiles imported on other replicas are picked up
+	// periodically.
+	add(scheduler.Task{
+		Name:      "profile-refresh",
+		Interval:  builder.ProfileRefreshInterval,
+		Immediate: true,
+		Run: func(ctx context.Context) error {
+			return state.Profiles.Refresh(ctx, state.Storage)
+		},
+	})
+
+	// Pins set on other replicas (or before a restart) are picked
+	// up periodically.
+	if state.Pins != nil {
+		add(scheduler.Task{
+			Name:      "pin-refresh",
+			Interval:  builder.PinRefreshInterval,
+			Immediate: true,
+			Run: func(ctx context.Context) error {
+				return state.Pins.RefreshPin(ctx, state.Storage)
+			},
+		})
+
+		add(scheduler.Task{
+			Name:      "named-pin-refresh",
+			Interval:  builder.NamedPinRefreshInterval,
+			Immediate: true,
+			Run: func(ctx context.Context) error {
+				return state.Pins.RefreshNamed(ctx, state.Storage)
+			},
+		})
+	}
+
+	// Popularity derived from access logs ingested on other
+	// replicas is picked up periodically.
+	add(scheduler.Task{
+		Name:      "popularity-refresh",
+		Interval:  builder.PopularityRefreshInterval,
+		Immediate: true,
+		Run: func(ctx context.Context) error {
+			return state.Popularity.Refresh(ctx, state.Storage)
+		},
+	})
+
+	// Every replica serves curated images from its own checkout.
+	if state.Curated != nil {
+		add(scheduler.Task{
+			Name:      "curated-sync",
+			Interval:  state.Cfg.Curated.Interval,
+			Immediate: true,
+			Run: func(ctx context.Context) error {
+				return state.Curated.Sync(ctx)
+			},
+		})
+	}
+
+	// Every replica routes builds to healthy builders of its own
+	// pools.
+	if state.Pools != nil {
+		add(scheduler.Task{
+			Name:      "builder-health",
+			Interval:  builder.BuilderHealthInterval,
+			Immediate: true,
+			Run: func(ctx context.Context) error {
+				return state.Pools.CheckHealth(ctx)
+			},
+		})
+	}
+
+	if state.StoreGC != nil {
+		add(scheduler.Task{
+			Name:     "store-gc",
+			Interval: builder.StoreCheckInterval,
+			Run: func(ctx context.Context) error {
+				return state.StoreGC.Check(state)
+			},
+		})
+	}
+
+	// Summaries are logged by every replica for its own builds and
+	// requests.
+	add(scheduler.Task{
+		Name:     "log-summary",
+		Interval: state.Cfg.LogSummaryInterval,
+		Run: func(ctx context.Context) error {
+			state.SlowBuilds.Report()
+			logs.ReportDuplicates()
+			return nil
+		},
+	})
+
+	return s
+}
+
+// serveGC runs a garbage collection and returns its report. Passing
+// `?dry_run=true` reports what would be deleted without deleting it.
+func (h *adminHandler) serveGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, 405, "UNSUPPORTED", "garbage collection must be triggered with POST")
+		return
+	}
+
+	report, err := gc.Collect(r.Context(), h.state.Storage, gc.Options{
+		Grace:  h.state.Cfg.GCGrace,
+		DryRun: r.URL.Query().Get("dry_run") == "true",
+		Events: h.state.Events,
+	})
+
+	if err != nil {
+		log.WithError(err).Error("garbage collection failed")
+		writeError(w, 500, "GC_FAILED", err.Error())
+		return
+	}
+
+	writeJSON(w, 200, report)
+}
+
+// serveCommands returns the recorded Nix invocations, optionally
+// filtered to a single image with `?image=<name>`.
+func (h *adminHandler) serveCommands(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, h.state.Audit.Records(r.URL.Query().Get("image")))
+}
+
+// serveLogging returns (GET) or changes (PUT) the runtime logging
+// settings.
+func (h *adminHandler) serveLogging(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var settings api.LoggingSettings
+		if !readJSON(w, r, &settings) {
+			return
+		}
+
+		if settings.Level != "" {
+			if err := logs.SetLevel(settings.Level); err != nil {
+				writeError(w, 400, "INVALID_REQUEST", err.Error())
+				return
+			}
+		}
+
+		if settings.VerboseNix != nil {
+			logs.SetVerboseNix(*settings.VerboseNix)
+		}
+
+		log.WithFields(log.Fields{
+			"level":      logs.Level(),
+			"verboseNix": logs.VerboseNix(),
+			"client":     clientIP(r),
+		}).Info("changed logging settings")
+	default:
+		writeError(w, 405, "UNSUPPORTED", "unsupported method")
+		return
+	}
+
+	verbose := logs.VerboseNix()
+	writeJSON(w, 200, api.LoggingSettings{
+		Level:      logs.Level(),
+		VerboseNix: &verbose,
+	})
+}
+
+// serveUsage reports the storage usage of each tenant, based on the
+// metadata labels of the stored objects.
+func (h *adminHandler) serveUsage(w http.ResponseWriter, r *http.Request) {
+	usage, err := storage.UsageByTenant(r.Context(), h.state.Storage)
+	if err != nil {
+		log.WithError(err).Error("failed to compute storage usage")
+		writeError(w, 500, "UNKNOWN", "could not list storage objects")
+		return
+	}
+
+	writeJSON(w, 200, usage)
+}
+
+// serveStorageOperations reports the number of calls made to the
+// storage backend since startup.
+func (h *adminHandler) serveStorageOperations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, storage.Operations())
+}
+
+// serveCache reports the contents and disk usage of the local cache.
+func (h *adminHandler) serveCache(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, h.state.Cache.Stats())
+}
+
+// serveTasks reports the status of the periodic background tasks.
+func (h *adminHandler) serveTasks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, h.state.Scheduler.Status())
+}
+
+// serveBuilderPools reports the health and usage of the remote builder
+// pools.
+func (h *adminHandler) serveBuilderPools(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, h.state.Pools.Status())
+}
+
+// serveStore reports the disk usage of the local Nix store (GET), or
+// collects garbage in it right away (POST).
+func (h *adminHandler) serveStore(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if h.state.StoreGC == nil {
+			writeError(w, 400, "INVALID_REQUEST", "Nix store garbage collection is not enabled")
+			return
+		}
+
+		if err := h.state.StoreGC.Collect(h.state); err != nil {
+			log.WithError(err).Error("Nix store garbage collection failed")
+			writeError(w, 500, "GC_FAILED", err.Error())
+			return
+		}
+	default:
+		writeError(w, 405, "UNSUPPORTED", "unsupported method")
+		return
+	}
+
+	usage, err := h.state.StoreGC.Usage()
+	if err != nil {
+		log.WithError(err).Error("failed to check Nix store disk usage")
+		writeError(w, 500, "UNKNOWN", "could not determine Nix store disk usage")
+		return
+	}
+
+	writeJSON(w, 200, usage)
+}
+
+// servePin returns (GET) or advances (PUT) the pin of the `latest` tag.
+func (h *adminHandler) servePin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var req api.PinRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+
+		if err := h.state.Pins.Advance(r.Context(), h.state, req.Revision); err != nil {
+			writeError(w, 400, "INVALID_REQUEST", err.Error())
+			return
+		}
+	default:
+		writeError(w, 405, "UNSUPPORTED", "unsupported method")
+		return
+	}
+
+	writeJSON(w, 200, h.state.Pins.Status())
+}
+
+// servePromote copies cached images from the storage prefix of another
+// environment into that of this instance.
+func (h *adminHandler) servePromote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, 405, "UNSUPPORTED", "promotion must be triggered with POST")
+		return
+	}
+
+	var req api.PromoteRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if req.From == h.state.Cfg.StoragePrefix {
+		writeError(w, 400, "INVALID_REQUEST", "images can not be promoted within an environment")
+		return
+	}
+
+	from, err := storage.Sibling(h.state.Storage, req.From)
+	if err != nil {
+		writeError(w, 400, "INVALID_REQUEST", err.Error())
+		return
+	}
+
+	report, err := builder.Promote(r.Context(), h.state, from, req.Keys)
+	if err != nil {
+		log.WithError(err).WithField("from", req.From).Error("promotion failed")
+		writeError(w, 500, "PROMOTION_FAILED", err.Error())
+		return
+	}
+
+	writeJSON(w, 200, report)
+}
+
+// serveProfiles lists the imported profiles (GET), imports a profile
+// (POST) or deletes one (DELETE). Profiles are imported from the
+// registry reference in `?from=` if it is set, and otherwise from an
+// OCI archive in the request body.
+func (h *adminHandler) serveProfiles(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name, tag := query.Get("name"), query.Get("tag")
+	if tag == "" {
+		tag = "latest"
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, 200, h.state.Profiles.List())
+
+	case "POST":
+		arch := query.Get("arch")
+		if arch == "" {
+			arch = "amd64"
+		}
+
+		var profile *builder.Profile
+		var err error
+		if from := query.Get("from"); from != "" {
+			profile, err = builder.ImportRegistry(r.Context(), h.state, name, tag, arch, from)
+		} else {
+			profile, err = builder.ImportArchive(r.Context(), h.state, name, tag, arch, r.Body)
+		}
+
+		if errors.Is(err, builder.ErrInvalidImport) {
+			writeError(w, 400, "INVALID_REQUEST", err.Error())
+			return
+		}
+
+		if err != nil {
+			log.WithError(err).WithField("profile", name).Error("failed to import profile")
+			writeError(w, 500, "IMPORT_FAILED", err.Error())
+			return
+		}
+
+		writeJSON(w, 200, profile)
+
+	case "DELETE":
+		if _, _, ok := h.state.Profiles.Lookup(name, tag); !ok {
+			writeError(w, 404, "MANIFEST_UNKNOWN", "unknown profile")
+			return
+		}
+
+		if err := builder.DeleteProfile(r.Context(), h.state, name, tag); err != nil {
+			log.WithError(err).WithField("profile", name).Error("failed to delete profile")
+			writeError(w, 500, "UNKNOWN", err.Error())
+			return
+		}
+
+		w.WriteHeader(204)
+
+	default:
+		writeError(w, 405, "UNSUPPORTED", "unsupported method")
+	}
+}
+
+// servePopularity returns (GET), extends (POST) or discards (DELETE)
+// the package popularity derived from access logs. POSTed logs replace
+// the previous counts with `?replace=true`.
+func (h *adminHandler) servePopularity(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, 200, h.state.Popularity.Status())
+
+	case "POST":
+		replace := r.URL.Query().Get("replace") == "true"
+		report, err := builder.IngestAccessLog(r.Context(), h.state, r.Body, replace)
+		if err != nil {
+			log.WithError(err).Error("failed to ingest access log")
+			writeError(w, 500, "UNKNOWN", err.Error())
+			return
+		}
+
+		writeJSON(w, 200, report)
+
+	case "DELETE":
+		if err := builder.ResetPopularity(r.Context(), h.state); err != nil {
+			log.WithError(err).Error("failed to discard popularity")
+			writeError(w, 500, "UNKNOWN", err.Error())
+			return
+		}
+
+		w.WriteHeader(204)
+
+	default:
+		writeError(w, 405, "UNSUPPORTED", "unsupported method")
+	}
+}
+
+// ServeHTTP authenticates admin requests and dispatches them to the
+// matching handlers.
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		log.WithField("client", clientIP(r)).Warn("rejected unauthenticated admin request")
+		writeError(w, 401, "UNAUTHORIZED", "invalid admin token")
+		return
+	}
+
+	switch r.URL.Path {
+	case "/admin/gc":
+		h.serveGC(w, r)
+	case "/admin/commands":
+		h.serveCommands(w, r)
+	case "/admin/logging":
+		h.serveLogging(w, r)
+	case "/admin/usage":
+		h.serveUsage(w, r)
+	case "/admin/storage-operations":
+		h.serveStorageOperations(w, r)
+	case "/admin/tasks":
+		h.serveTasks(w, r)
+	case "/admin/cache":
+		h.serveCache(w, r)
+	case "/admin/store":
+		h.serveStore(w, r)
+	case "/admin/builder-pools":
+		h.serveBuilderPools(w, r)
+	case "/admin/pin":
+		h.servePin(w, r)
+	case "/admin/promote":
+		h.servePromote(w, r)
+	case "/admin/profiles":
+		h.serveProfiles(w, r)
+	case "/admin/pull-tokens":
+		h.servePullTokens(w, r)
+	case "/admin/popularity":
+		h.servePopularity(w, r)
+	case "/admin/support-bundle":
+		h.serveSupportBundle(w, r)
+	default:
+		writeError(w, 404, "UNSUPPORTED", "unsupported admin route")
+	}
+}
@@ -0,0 +1,668 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements Nixery's extended HTTP API, which provides
+// functionality beyond what the registry protocol offers. All types
+// used in requests and responses are defined in the api package.
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/builder"
+	mf "github.com/google/nixery/manifest"
+	log "github.com/sirupsen/logrus"
+)
+
+var specDigestRegex = regexp.MustCompile(`^/v1/spec/sha256:([a-f0-9]{64})$`)
+var contentsDigestRegex = regexp.MustCompile(`^/v1/contents/(sha256:[a-f0-9]{64})$`)
+var driftDigestRegex = regexp.MustCompile(`^/v1/drift/(sha256:[a-f0-9]{64})$`)
+
+// Maximum size of request bodies accepted by the API.
+const maxRequestBody = 1 << 20
+
+type apiHandler struct {
+	state *builder.State
+
+	// Background builds of the registry handler, which are dropped
+	// when their package source is invalidated
+	async *asyncBuilds
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	j, _ := json.Marshal(v)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+}
+
+// readJSON decodes a JSON request body into the supplied value and
+// writes an error response if that fails.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	if err == nil {
+		err = json.Unmarshal(body, v)
+	}
+
+	if err != nil {
+		writeError(w, 400, "INVALID_REQUEST", fmt.Sprintf("could not parse request: %s", err))
+		return false
+	}
+
+	return true
+}
+
+func hasPackage(pkgs []string, pkg string) bool {
+	for _, p := range pkgs {
+		if p == pkg {
+			return true
+		}
+	}
+	return false
+}
+
+// imageFromSpec converts an image spec into the image structure used
+// by the builder.
+//
+// The returned name is the repository name under which the image can
+// be pulled, which (unlike the image's internal name) retains the
+// meta-packages at the front.
+func imageFromSpec(spec *api.ImageSpec) (builder.Image, string, error) {
+	if len(spec.Packages) == 0 {
+		return builder.Image{}, "", fmt.Errorf("at least one package must be specified")
+	}
+
+	pkgs := spec.Packages
+	for _, p := range pkgs {
+		if p == "" || strings.Contains(p, "/") {
+			return builder.Image{}, "", fmt.Errorf("invalid package name: %q", p)
+		}
+	}
+
+	if spec.Activation != "" && !hasPackage(pkgs, "profile") {
+		pkgs = append([]string{"profile"}, pkgs...)
+	}
+
+	switch spec.Arch {
+	case "", "amd64":
+	case "arm64":
+		pkgs = append([]string{"arm64"}, pkgs...)
+	default:
+		return builder.Image{}, "", fmt.Errorf("unsupported architecture: %q", spec.Arch)
+	}
+
+	tag := spec.Pin
+	if tag == "" {
+		tag = "latest"
+	}
+
+	name := strings.Join(pkgs, "/")
+	image := builder.ImageFromName(name, tag)
+	image.Cmd = spec.Cmd
+	image.Env = spec.Env
+	image.Activation = spec.Activation
+
+	// The spec is recorded in the image itself, which makes it
+	// possible to retrieve it later from nothing but the digest.
+	j, _ := json.Marshal(spec)
+	image.Annotations = map[string]string{
+		api.SpecAnnotation: string(j),
+	}
+
+	if spec.TTL != "" {
+		ttl, err := builder.ParseTTL(spec.TTL)
+		if err != nil {
+			return builder.Image{}, "", err
+		}
+		builder.SetTTL(&image, ttl)
+	}
+
+	// Flags can only be spelled with `__` in pullable names.
+	return image, strings.ReplaceAll(name, "!", "__"), nil
+}
+
+// buildSpec builds an image from a POSTed spec and returns a
+// reference to the resulting manifest.
+func (h *apiHandler) buildSpec(w http.ResponseWriter, r *http.Request) {
+	var spec api.ImageSpec
+	if !readJSON(w, r, &spec) {
+		return
+	}
+
+	image, name, err := imageFromSpec(&spec)
+	if err != nil {
+		writeError(w, 400, "INVALID_SPEC", err.Error())
+		return
+	}
+
+	// Registry clients reject long names before sending any
+	// request, so such images can only be pulled through an alias.
+	alias := r.URL.Query().Get("alias") == "true"
+	if len(name) > builder.MaxNameLength && !alias {
+		writeError(w, 400, "INVALID_SPEC", fmt.Sprintf(
+			"the image name is %d characters long, but registry clients only accept %d: request a short alias with ?alias=true, or ask the operators to import the image as a profile",
+			len(name), builder.MaxNameLength))
+		return
+	}
+
+	image.Tenant = requestTenant(&h.state.Cfg, r)
+	h.state.Pins.WithPin(&image)
+
+	result, err := builder.BuildImage(r.Context(), h.state, &image)
+	if invalidPackages(err) {
+		writeError(w, 400, "INVALID_SPEC", err.Error())
+		return
+	}
+
+	if writeBuildError(w, &image, result, err) {
+		return
+	}
+
+	digest := result.Digest
+	log.WithFields(log.Fields{
+		"image":  image.Name,
+		"tag":    image.Tag,
+		"digest": digest,
+	}).Info("built image from spec")
+
+	response := api.SpecResponse{
+		Name:      name,
+		Tag:       image.Tag,
+		Digest:    digest,
+		Reference: imageReference(&h.state.Cfg, name, digest),
+	}
+
+	if alias {
+		response.Alias, err = builder.SaveSpecAlias(r.Context(), h.state, &spec)
+		if err != nil {
+			log.WithError(err).WithField("image", image.Name).Error("failed to create spec alias")
+			writeError(w, 500, "UNKNOWN", "could not create alias")
+			return
+		}
+		response.Reference = imageReference(&h.state.Cfg, response.Alias, digest)
+	}
+
+	writeJSON(w, 200, response)
+}
+
+// buildFromPaths builds an image from POSTed raw store paths and
+// returns a reference to the resulting manifest.
+func (h *apiHandler) buildFromPaths(w http.ResponseWriter, r *http.Request) {
+	if !h.state.Cfg.FromPaths {
+		writeError(w, 400, "INVALID_REQUEST", "building images from store paths is not enabled")
+		return
+	}
+
+	var req api.StorePathsRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	image, err := builder.ImageFromStorePaths(req.StorePaths, req.Arch)
+	if err != nil {
+		writeError(w, 400, "INVALID_REQUEST", err.Error())
+		return
+	}
+	image.Cmd = req.Cmd
+	image.Env = req.Env
+	image.Tenant = requestTenant(&h.state.Cfg, r)
+	h.state.Pins.WithPin(&image)
+
+	result, err := builder.BuildImage(r.Context(), h.state, &image)
+	if err == nil && result.Error == "not_found" {
+		writeError(w, 404, "MANIFEST_UNKNOWN", fmt.Sprintf("Store paths are not present in the Nix store: %v", result.Pkgs))
+		return
+	}
+
+	if writeBuildError(w, &image, result, err) {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"paths":  len(image.StorePaths),
+		"digest": result.Digest,
+	}).Info("built image from store paths")
+
+	// The image is only pullable by digest, so no tag is returned.
+	writeJSON(w, 200, api.SpecResponse{
+		Name:      image.Name,
+		Digest:    result.Digest,
+		Reference: imageReference(&h.state.Cfg, image.Name, result.Digest),
+	})
+}
+
+// fetchSpec returns the spec from which the image with the given
+// manifest digest was built.
+func (h *apiHandler) fetchSpec(w http.ResponseWriter, r *http.Request, digest string) {
+	reader, err := h.state.Storage.Fetch(r.Context(), "layers/"+digest)
+	if err != nil {
+		writeError(w, 404, "MANIFEST_UNKNOWN", "no manifest with this digest is known")
+		return
+	}
+	defer reader.Close()
+
+	manifest, err := ioutil.ReadAll(reader)
+	if err != nil {
+		log.WithError(err).WithField("digest", digest).Error("failed to read manifest")
+		writeError(w, 500, "UNKNOWN", "could not read manifest")
+		return
+	}
+
+	spec, ok := mf.Annotations(manifest)[api.SpecAnnotation]
+	if !ok {
+		writeError(w, 404, "SPEC_UNKNOWN", "image was not built from a spec")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(spec))
+}
+
+// fetchContents returns the store paths included in the image with the
+// given manifest digest.
+func (h *apiHandler) fetchContents(w http.ResponseWriter, r *http.Request, digest string) {
+	contents, err := builder.ImageContents(r.Context(), h.state, digest)
+	if err != nil {
+		writeError(w, 404, "MANIFEST_UNKNOWN", "no contents are known for this digest")
+		return
+	}
+
+	writeJSON(w, 200, contents)
+}
+
+// serveDrift builds the spec of the image with the given manifest
+// digest from the current package set (or the revision given in the
+// `pin` query parameter), and reports how its closure changed.
+func (h *apiHandler) serveDrift(w http.ResponseWriter, r *http.Request, digest string) {
+	m, err := builder.ManifestByDigest(r.Context(), h.state, digest)
+	if errors.Is(err, builder.ErrManifestUnknown) {
+		writeError(w, 404, "MANIFEST_UNKNOWN", "no manifest with this digest is known")
+		return
+	}
+	if err != nil {
+		log.WithError(err).WithField("digest", digest).Error("failed to read manifest")
+		writeError(w, 500, "UNKNOWN", "could not read manifest")
+		return
+	}
+
+	var spec api.ImageSpec
+	j, ok := mf.Annotations(m)[api.SpecAnnotation]
+	if !ok || json.Unmarshal([]byte(j), &spec) != nil {
+		writeError(w, 404, "SPEC_UNKNOWN", "image was not built from a spec")
+		return
+	}
+
+	// Images built from a pinned revision are compared to the
+	// current revision unless another one is requested.
+	spec.Pin = r.URL.Query().Get("pin")
+
+	image, name, err := imageFromSpec(&spec)
+	if err != nil {
+		writeError(w, 400, "INVALID_SPEC", err.Error())
+		return
+	}
+
+	image.Tenant = requestTenant(&h.state.Cfg, r)
+	h.state.Pins.WithPin(&image)
+
+	result, err := builder.BuildImage(r.Context(), h.state, &image)
+	if invalidPackages(err) {
+		writeError(w, 400, "INVALID_SPEC", err.Error())
+		return
+	}
+
+	if writeBuildError(w, &image, result, err) {
+		return
+	}
+
+	report, err := builder.ClosureDrift(r.Context(), h.state, digest, result.Digest)
+	if errors.Is(err, builder.ErrContentsUnknown) {
+		writeError(w, 404, "MANIFEST_UNKNOWN", err.Error())
+		return
+	}
+	if err != nil {
+		log.WithError(err).WithField("digest", digest).Error("failed to compare image contents")
+		writeError(w, 500, "UNKNOWN", "could not compare image contents")
+		return
+	}
+
+	report.Tag = image.Tag
+	report.Reference = imageReference(&h.state.Cfg, name, result.Digest)
+
+	log.WithFields(log.Fields{
+		"digest":  digest,
+		"current": result.Digest,
+		"drifted": report.Drifted,
+	}).Info("compared image to current build of its spec")
+
+	writeJSON(w, 200, report)
+}
+
+// serveSize reports the expected transfer size of an image, which is
+// specified with the `image` and `tag` query parameters. The image is
+// built if it is not yet cached.
+func (h *apiHandler) serveSize(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("image")
+	tag := r.URL.Query().Get("tag")
+	if tag == "" {
+		tag = "latest"
+	}
+
+	if !manifestRegex.MatchString("/v2/" + name + "/manifests/" + tag) {
+		writeError(w, 400, "NAME_INVALID", "invalid image name or tag")
+		return
+	}
+
+	name, ns := builder.ResolveNamespace(h.state.Cfg.Namespaces, resolveAlias(&h.state.Cfg, name))
+	image := builder.ImageFromName(name, tag)
+	image.Tenant = requestTenant(&h.state.Cfg, r)
+	if err := builder.ApplyNamespace(ns, &image); err != nil {
+		writeError(w, 403, "DENIED", err.Error())
+		return
+	}
+	if !selectPlatform(w, r, &image) {
+		return
+	}
+	h.state.Pins.WithPin(&image)
+
+	result, err := builder.BuildImage(r.Context(), h.state, &image)
+	if writeBuildError(w, &image, result, err) {
+		return
+	}
+
+	manifest := []byte(result.Manifest)
+	size, err := mf.TransferSize(manifest)
+	if err != nil {
+		log.WithError(err).WithField("image", name).Error("manifest has invalid sizes")
+		writeError(w, 500, "UNKNOWN", "could not determine image size")
+		return
+	}
+
+	refs, _ := mf.References(manifest)
+	annotations := mf.Annotations(manifest)
+	unpacked, _ := strconv.ParseUint(annotations[builder.TotalSizeAnnotation], 10, 64)
+
+	writeJSON(w, 200, api.SizeResponse{
+		Name:         name,
+		Tag:          tag,
+		Digest:       result.Digest,
+		Layers:       len(refs) - 1,
+		TransferSize: size + int64(len(manifest)),
+		UnpackedSize: unpacked,
+	})
+}
+
+// explainCacheKey reports how the cache key of the image named in the
+// path is derived, without building it. The tag is specified with the
+// `tag` query parameter.
+func (h *apiHandler) explainCacheKey(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/explain/")
+	tag := r.URL.Query().Get("tag")
+	if tag == "" {
+		tag = "latest"
+	}
+
+	if !manifestRegex.MatchString("/v2/" + name + "/manifests/" + tag) {
+		writeError(w, 400, "NAME_INVALID", "invalid image name or tag")
+		return
+	}
+
+	name, ns := builder.ResolveNamespace(h.state.Cfg.Namespaces, resolveAlias(&h.state.Cfg, name))
+	image := builder.ImageFromName(name, tag)
+	image.Tenant = requestTenant(&h.state.Cfg, r)
+	if err := builder.ApplyNamespace(ns, &image); err != nil {
+		writeError(w, 403, "DENIED", err.Error())
+		return
+	}
+	if !selectPlatform(w, r, &image) {
+		return
+	}
+
+	writeJSON(w, 200, builder.ExplainCacheKey(h.state, &image))
+}
+
+// hasBearer checks whether the request is authenticated with the
+// given bearer token. An empty token never matches.
+func hasBearer(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	supplied := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(supplied), []byte(token)) == 1
+}
+
+// replicate receives local cache entries from the active instance
+// (POST), or returns a snapshot of the local cache to a starting
+// replica (GET).
+func (h *apiHandler) replicate(w http.ResponseWriter, r *http.Request) {
+	if !hasBearer(r, h.state.Cfg.ReplicationToken) {
+		writeError(w, 401, "UNAUTHORIZED", "invalid replication token")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, 200, h.state.Cache.Snapshot())
+	case "POST":
+		var records []api.ReplicationRecord
+		if !readJSON(w, r, &records) {
+			return
+		}
+
+		h.state.Cache.Apply(records)
+		log.WithField("records", len(records)).Debug("applied replicated cache entries")
+		w.WriteHeader(200)
+	default:
+		writeError(w, 405, "UNSUPPORTED", "unsupported method")
+	}
+}
+
+// invalidate marks a branch of the package source (or all of them) as
+// changed, so that new packages can be pulled immediately. It is meant
+// to be called by CI of the package repository and accepts either the
+// invalidation token or the admin token.
+func (h *apiHandler) invalidate(w http.ResponseWriter, r *http.Request) {
+	if !hasBearer(r, h.state.Cfg.InvalidateToken) && !hasBearer(r, h.state.Cfg.AdminToken) {
+		writeError(w, 401, "UNAUTHORIZED", "invalid invalidation token")
+		return
+	}
+
+	var req api.InvalidateRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	var scope string
+	if req.Ref != "" {
+		scope = builder.SourceScope(h.state, req.Ref)
+	}
+
+	h.state.Invalidations.Invalidate(scope)
+	report := api.InvalidateReport{
+		Ref:    req.Ref,
+		Builds: h.async.invalidate(scope),
+	}
+
+	log.WithFields(log.Fields{
+		"ref":    req.Ref,
+		"builds": report.Builds,
+		"client": clientIP(r),
+	}).Info("invalidated package source")
+
+	writeJSON(w, 200, report)
+}
+
+// serveCurated lists (GET) or syncs (POST) the curated images. Syncs
+// are meant to be triggered by CI of the repository defining them, and
+// accept the invalidation token or the admin token.
+func (h *apiHandler) serveCurated(w http.ResponseWriter, r *http.Request) {
+	if h.state.Curated == nil {
+		writeError(w, 400, "INVALID_REQUEST", "curated images are not enabled")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, 200, h.state.Curated.Status())
+	case "POST":
+		if !hasBearer(r, h.state.Cfg.InvalidateToken) && !hasBearer(r, h.state.Cfg.AdminToken) {
+			writeError(w, 401, "UNAUTHORIZED", "invalid invalidation token")
+			return
+		}
+
+		if err := h.state.Curated.Sync(r.Context()); err != nil {
+			log.WithError(err).Error("failed to sync curated images")
+			writeError(w, 500, "SYNC_FAILED", err.Error())
+			return
+		}
+
+		writeJSON(w, 200, h.state.Curated.Status())
+	default:
+		writeError(w, 405, "UNSUPPORTED", "unsupported method")
+	}
+}
+
+// serveNamedPins lists (GET), saves (POST) or deletes (DELETE) named
+// pins. Changes require the admin token or a tenant, and pins created
+// by a tenant can only be changed by it.
+func (h *apiHandler) serveNamedPins(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		writeJSON(w, 200, h.state.Pins.NamedPins())
+		return
+	}
+
+	admin := hasBearer(r, h.state.Cfg.AdminToken)
+	tenant := requestTenant(&h.state.Cfg, r)
+	if !admin && tenant == "" {
+		writeError(w, 401, "UNAUTHORIZED", "named pins can only be changed by tenants or with the admin token")
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case "POST":
+		var req api.NamedPinRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+
+		var pin *builder.NamedPin
+		pin, err = h.state.Pins.SaveNamedPin(r.Context(), h.state, req.Name, req.Revision, tenant, admin)
+		if err == nil {
+			writeJSON(w, 200, pin)
+			return
+		}
+
+	case "DELETE":
+		err = h.state.Pins.DeleteNamedPin(r.Context(), h.state, r.URL.Query().Get("name"), tenant, admin)
+		if err == nil {
+			w.WriteHeader(204)
+			return
+		}
+
+	default:
+		writeError(w, 405, "UNSUPPORTED", "unsupported method")
+		return
+	}
+
+	switch {
+	case errors.Is(err, builder.ErrInvalidPin):
+		writeError(w, 400, "INVALID_REQUEST", err.Error())
+	case errors.Is(err, builder.ErrPinOwner):
+		writeError(w, 403, "DENIED", err.Error())
+	case errors.Is(err, builder.ErrUnknownPin):
+		writeError(w, 404, "PIN_UNKNOWN", err.Error())
+	default:
+		log.WithError(err).Error("failed to change named pin")
+		writeError(w, 500, "UNKNOWN", err.Error())
+	}
+}
+
+// ServeHTTP dispatches API requests to the matching handlers.
+func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/replicate" {
+		h.replicate(w, r)
+		return
+	}
+
+	if r.URL.Path == "/v1/invalidate" && r.Method == "POST" {
+		h.invalidate(w, r)
+		return
+	}
+
+	if r.URL.Path == "/v1/pin" {
+		h.serveNamedPins(w, r)
+		return
+	}
+
+	if r.URL.Path == "/v1/curated" {
+		h.serveCurated(w, r)
+		return
+	}
+
+	if r.URL.Path == "/v1/spec" && r.Method == "POST" {
+		h.buildSpec(w, r)
+		return
+	}
+
+	if r.URL.Path == "/v1/from-paths" && r.Method == "POST" {
+		h.buildFromPaths(w, r)
+		return
+	}
+
+	if r.URL.Path == "/v1/token" && r.Method == "GET" {
+		h.serveToken(w, r)
+		return
+	}
+
+	if r.URL.Path == "/v1/status" && r.Method == "GET" {
+		writeJSON(w, 200, api.Status{
+			Build:   builder.ServerBuildInfo(),
+			Started: started,
+		})
+		return
+	}
+
+	if r.URL.Path == "/v1/openapi.json" && r.Method == "GET" {
+		serveOpenAPI(w, r)
+		return
+	}
+
+	if r.URL.Path == "/v1/size" && r.Method == "GET" {
+		h.serveSize(w, r)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/v1/explain/") && r.Method == "GET" {
+		h.explainCacheKey(w, r)
+		return
+	}
+
+	if m := specDigestRegex.FindStringSubmatch(r.URL.Path); m != nil && r.Method == "GET" {
+		h.fetchSpec(w, r, m[1])
+		return
+	}
+
+	if m := contentsDigestRegex.FindStringSubmatch(r.URL.Path); m != nil && r.Method == "GET" {
+		h.fetchContents(w, r, m[1])
+		return
+	}
+
+	if m := driftDigestRegex.FindStringSubmatch(r.URL.Path); m != nil && r.Method == "GET" {
+		h.serveDrift(w, r, m[1])
+		return
+	}
+
+	writeError(w, 404, "UNSUPPORTED", "unsupported API route")
+}
@@ -0,0 +1,176 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements asynchronous builds for manifest requests.
+// Clients that opt in with the `Prefer: respond-async` header (RFC
+// 7240) receive `202 Accepted` with a `Retry-After` header if their
+// image is not built in time, while the build continues in the
+// background. Retried requests are served the result of the build
+// once it has finished.
+//
+// This keeps idle timeouts of load balancers from killing very long
+// cold builds, which would otherwise be started again on every retry.
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nixery/builder"
+	log "github.com/sirupsen/logrus"
+)
+
+// Time for which the result of a background build is kept for
+// clients that retry.
+const asyncRetention = 10 * time.Minute
+
+// Bounds of the retry hints sent to clients.
+const (
+	minRetryAfter = 5 * time.Second
+	maxRetryAfter = time.Minute
+)
+
+type asyncBuild struct {
+	scope   string
+	started time.Time
+	done    chan struct{}
+	result  *builder.BuildResult
+	err     error
+}
+
+// asyncBuilds tracks the builds running in the background on behalf
+// of clients that were told to retry.
+//
+// A nil *asyncBuilds is valid and disables asynchronous builds.
+type asyncBuilds struct {
+	// Time to wait for a build before responding with 202
+	wait time.Duration
+
+	mu     sync.Mutex
+	builds map[string]*asyncBuild
+}
+
+// newAsyncBuilds returns the tracker for asynchronous builds, or nil
+// if they are disabled.
+func newAsyncBuilds(wait time.Duration) *asyncBuilds {
+	if wait <= 0 {
+		return nil
+	}
+
+	return &asyncBuilds{
+		wait:   wait,
+		builds: make(map[string]*asyncBuild),
+	}
+}
+
+// accepts reports whether asynchronous builds are enabled and the
+// client opted in to them.
+func (a *asyncBuilds) accepts(r *http.Request) bool {
+	if a == nil {
+		return false
+	}
+
+	for _, v := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(v, ",") {
+			if strings.TrimSpace(strings.SplitN(pref, ";", 2)[0]) == "respond-async" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// retryHint returns the time after which a client should retry, which
+// grows with the duration of the build so far.
+func retryHint(elapsed time.Duration) time.Duration {
+	hint := elapsed / 4
+	if hint < minRetryAfter {
+		return minRetryAfter
+	}
+	if hint > maxRetryAfter {
+		return maxRetryAfter
+	}
+
+	return hint
+}
+
+// build waits for the build of an image identified by key, starting it
+// in the background if it is not running yet. If the build does not
+// finish in time, the time after which the client should retry is
+// returned instead of a result.
+func (a *asyncBuilds) build(s *builder.State, key string, image *builder.Image) (*builder.BuildResult, time.Duration, error) {
+	a.mu.Lock()
+	b, ok := a.builds[key]
+	if !ok {
+		b = &asyncBuild{
+			scope:   builder.SourceScope(s, image.Tag),
+			started: time.Now(),
+			done:    make(chan struct{}),
+		}
+		a.builds[key] = b
+		go a.run(s, key, b, image)
+	}
+	a.mu.Unlock()
+
+	select {
+	case <-b.done:
+		return b.result, 0, b.err
+	case <-time.After(a.wait):
+		return nil, retryHint(time.Since(b.started)), nil
+	}
+}
+
+// run performs a background build, which is not bound to the request
+// that started it.
+func (a *asyncBuilds) run(s *builder.State, key string, b *asyncBuild, image *builder.Image) {
+	b.result, b.err = builder.BuildImage(context.Background(), s, image)
+	close(b.done)
+
+	log.WithFields(log.Fields{
+		"image":    image.Name,
+		"tag":      image.Tag,
+		"duration": time.Since(b.started),
+	}).Debug("finished background build")
+
+	time.AfterFunc(asyncRetention, func() {
+		a.mu.Lock()
+		if a.builds[key] == b {
+			delete(a.builds, key)
+		}
+		a.mu.Unlock()
+	})
+}
+
+// invalidate drops the builds of images built from the package source
+// of the given scope (or from any source if it is empty), so that
+// retried requests build them again. It returns the number of dropped
+// builds.
+func (a *asyncBuilds) invalidate(scope string) int {
+	if a == nil {
+		return 0
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	dropped := 0
+	for key, b := range a.builds {
+		if scope == "" || b.scope == scope {
+			delete(a.builds, key)
+			dropped++
+		}
+	}
+
+	return dropped
+}
+
+// formatRetryAfter formats a duration as the value of a Retry-After
+// header.
+func formatRetryAfter(d time.Duration) string {
+	return strconv.Itoa(int(d.Seconds()))
+}
@@ -0,0 +1,41 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAsyncOptIn(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v2/shell/manifests/latest", nil)
+	r.Header.Set("Prefer", "return=minimal, respond-async; wait=10")
+
+	var disabled *asyncBuilds
+	if disabled.accepts(r) {
+		t.Errorf("disabled asynchronous builds must not accept requests")
+	}
+
+	a := newAsyncBuilds(time.Second)
+	if !a.accepts(r) {
+		t.Errorf("expected respond-async preference to be accepted")
+	}
+
+	r.Header.Set("Prefer", "return=minimal")
+	if a.accepts(r) {
+		t.Errorf("expected requests without preference to be synchronous")
+	}
+}
+
+func TestRetryHint(t *testing.T) {
+	for elapsed, expected := range map[time.Duration]time.Duration{
+		time.Second:     minRetryAfter,
+		2 * time.Minute: 30 * time.Second,
+		time.Hour:       maxRetryAfter,
+	} {
+		if hint := retryHint(elapsed); hint != expected {
+			t.Errorf("expected retry hint %s after %s, got %s", expected, elapsed, hint)
+		}
+	}
+}
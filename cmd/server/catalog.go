@@ -0,0 +1,104 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements the discovery endpoints of the registry API,
+// which list the images that were pulled from the instance. Tools such
+// as crane, skopeo and registry UIs use them to browse registries.
+//
+// Any image name can be built on demand, so the catalog only lists the
+// names and tags that clients requested before (see builder.Catalog).
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/google/nixery/builder"
+	log "github.com/sirupsen/logrus"
+)
+
+type catalogResponse struct {
+	Repositories []string `json:"repositories"`
+}
+
+type tagsResponse struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// paginate returns the page of a sorted list selected by the `n` and
+// `last` query parameters of the distribution spec, and sets the Link
+// header pointing to the next page if there is one.
+func paginate(w http.ResponseWriter, r *http.Request, items []string) ([]string, bool) {
+	q := r.URL.Query()
+
+	if last := q.Get("last"); last != "" {
+		items = items[sort.Search(len(items), func(i int) bool { return items[i] > last }):]
+	}
+
+	if q.Get("n") == "" {
+		return items, true
+	}
+
+	n, err := strconv.Atoi(q.Get("n"))
+	if err != nil || n < 0 {
+		writeError(w, 400, "PAGINATION_NUMBER_INVALID", "invalid number of results requested")
+		return nil, false
+	}
+
+	if len(items) > n {
+		items = items[:n]
+		if n > 0 {
+			next := url.Values{"n": {strconv.Itoa(n)}, "last": {items[n-1]}}
+			w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, next.Encode()))
+		}
+	}
+
+	return items, true
+}
+
+// serveCatalog lists the names of the images in the catalog.
+func (h *registryHandler) serveCatalog(w http.ResponseWriter, r *http.Request) {
+	names, err := builder.CatalogNames(r.Context(), h.state.Storage)
+	if err != nil {
+		log.WithError(err).WithField("backend", h.state.Storage.Name()).Error("failed to list catalog")
+		writeError(w, 500, "UNKNOWN", "failed to list catalog")
+		return
+	}
+
+	page, ok := paginate(w, r, names)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, 200, catalogResponse{Repositories: page})
+}
+
+// serveTags lists the tags of an image in the catalog.
+func (h *registryHandler) serveTags(w http.ResponseWriter, r *http.Request, name string) {
+	tags, err := builder.CatalogTags(r.Context(), h.state.Storage, name)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"image":   name,
+			"backend": h.state.Storage.Name(),
+		}).Error("failed to list image tags")
+
+		writeError(w, 500, "UNKNOWN", "failed to list image tags")
+		return
+	}
+
+	if len(tags) == 0 {
+		writeError(w, 404, "NAME_UNKNOWN", "repository name not known to registry")
+		return
+	}
+
+	page, ok := paginate(w, r, tags)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, 200, tagsResponse{Name: name, Tags: page})
+}
@@ -0,0 +1,126 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements the resolution of the real client address for
+// requests that pass through trusted reverse proxies (load balancers,
+// ingress controllers and such).
+//
+// Without this, all requests would appear to come from the address of
+// the proxy in logs and other per-client bookkeeping.
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// clientIP returns the address of the client that originated the
+// request, as determined by the realIP middleware. If the middleware
+// was not used, the address of the direct peer is returned.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+
+	return hostOnly(r.RemoteAddr)
+}
+
+// realIP wraps a handler and resolves the client address of each
+// request before passing it on. Forwarding headers are only
+// considered if the direct peer is a trusted proxy.
+func realIP(trusted []*net.IPNet, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := resolveClientIP(trusted, r)
+		ctx := context.WithValue(r.Context(), clientIPKey{}, ip)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func resolveClientIP(trusted []*net.IPNet, r *http.Request) string {
+	peer := hostOnly(r.RemoteAddr)
+	if !isTrusted(trusted, peer) {
+		return peer
+	}
+
+	// The standardised header takes precedence over the de-facto
+	// standard one if both are present.
+	var chain []string
+	if fwd := r.Header.Values("Forwarded"); len(fwd) > 0 {
+		chain = parseForwarded(fwd)
+	} else {
+		for _, xff := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(xff, ",") {
+				chain = append(chain, hostOnly(strings.TrimSpace(hop)))
+			}
+		}
+	}
+
+	// Walk the chain from the closest hop outwards. The first
+	// address that is not a trusted proxy is the client, as any
+	// entries before it could have been forged by the client.
+	for i := len(chain) - 1; i >= 0; i-- {
+		if chain[i] == "" {
+			continue
+		}
+
+		if !isTrusted(trusted, chain[i]) {
+			return chain[i]
+		}
+	}
+
+	if len(chain) > 0 && chain[0] != "" {
+		return chain[0]
+	}
+
+	return peer
+}
+
+// parseForwarded extracts the `for` parameters of all elements in the
+// supplied RFC 7239 Forwarded headers, in order.
+func parseForwarded(headers []string) []string {
+	var hops []string
+
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hop = hostOnly(strings.Trim(kv[1], `"`))
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+
+	return hops
+}
+
+// hostOnly strips the port and IPv6 brackets from an address, if
+// present.
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+func isTrusted(trusted []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/nixery/config"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestClientIPUntrustedPeer(t *testing.T) {
+	trusted := []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}
+	r := httptest.NewRequest("GET", "/v2/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+
+	if ip := resolveClientIP(trusted, r); ip != "192.0.2.1" {
+		t.Fatalf("expected headers of untrusted peer to be ignored, got %q", ip)
+	}
+}
+
+func TestClientIPForwardedFor(t *testing.T) {
+	trusted := []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}
+	r := httptest.NewRequest("GET", "/v2/", nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.9, 203.0.113.7, 10.0.0.5")
+
+	if ip := resolveClientIP(trusted, r); ip != "203.0.113.7" {
+		t.Fatalf("expected closest untrusted hop, got %q", ip)
+	}
+}
+
+func TestClientIPForwardedHeader(t *testing.T) {
+	trusted := []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}
+	r := httptest.NewRequest("GET", "/v2/", nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	r.Header.Set("Forwarded", `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`)
+
+	if ip := resolveClientIP(trusted, r); ip != "2001:db8:cafe::17" {
+		t.Fatalf("expected IPv6 client from Forwarded header, got %q", ip)
+	}
+}
+
+func TestRequestTenantFromTrustedProxy(t *testing.T) {
+	cfg := config.Config{
+		TenantHeader:   "X-Tenant",
+		TrustedProxies: []*net.IPNet{mustCIDR(t, "10.0.0.0/8")},
+	}
+
+	r := httptest.NewRequest("GET", "/v2/", nil)
+	r.Header.Set("X-Tenant", "team-a")
+
+	r.RemoteAddr = "192.0.2.1:1234"
+	if tenant := requestTenant(&cfg, r); tenant != "" {
+		t.Errorf("tenant header of untrusted peer was honoured: %q", tenant)
+	}
+
+	r.RemoteAddr = "10.0.0.2:1234"
+	if tenant := requestTenant(&cfg, r); tenant != "team-a" {
+		t.Errorf("expected tenant of trusted proxy, got %q", tenant)
+	}
+}
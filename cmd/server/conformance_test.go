@@ -0,0 +1,223 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file runs Nixery against the pull category of the OCI
+// distribution-spec conformance suite, using the in-memory storage
+// backend seeded with a single image. Nix is not invoked, as only
+// cached images are served.
+//
+// The checks below cover the parts of the suite that are specific to
+// how Nixery resolves tags. The official suite is additionally run if
+// OCI_CONFORMANCE_SUITE points to its compiled test binary (see
+// scripts/conformance-test.sh).
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/google/nixery/builder"
+	"github.com/google/nixery/config"
+	mf "github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+)
+
+const (
+	conformanceNamespace = "conformance/hello"
+	conformanceTag       = "0123456789abcdef0123456789abcdef01234567"
+)
+
+// conformanceSource is a package source for which only the
+// conformance tag is cacheable.
+type conformanceSource struct{}
+
+func (conformanceSource) Render(tag string) (string, string) {
+	return "path", "/var/empty"
+}
+
+func (conformanceSource) CacheKey(pkgs []string, tag string) string {
+	if tag != conformanceTag {
+		return ""
+	}
+
+	return "conformance"
+}
+
+func persistBlob(t *testing.T, s storage.Backend, contentType string, data []byte) string {
+	sum := fmt.Sprintf("%x", sha256.Sum256(data))
+	_, _, err := s.Persist(context.Background(), "layers/"+sum, contentType, func(w io.Writer) (string, int64, error) {
+		n, err := w.Write(data)
+		return sum, int64(n), err
+	})
+
+	if err != nil {
+		t.Fatalf("failed to seed blob: %s", err)
+	}
+
+	return "sha256:" + sum
+}
+
+// conformanceState returns builder state serving a single cached
+// image, and the digest of one of its layers.
+func conformanceState(t *testing.T) (*builder.State, string) {
+	t.Setenv("TMPDIR", t.TempDir())
+	cache, err := builder.NewCache()
+	if err != nil {
+		t.Fatalf("failed to create local cache: %s", err)
+	}
+
+	backend := storage.NewMemoryBackend()
+	layer := []byte("conformance layer")
+	layerDigest := persistBlob(t, backend, mf.LayerType, layer)
+
+	m, c := mf.Manifest("amd64", []mf.Entry{{Digest: layerDigest, Size: int64(len(layer))}}, mf.RuntimeConfig{}, nil)
+	persistBlob(t, backend, mf.LayerType, c.Config)
+
+	_, _, err = backend.Persist(context.Background(), "manifests/conformance", mf.ManifestType, func(w io.Writer) (string, int64, error) {
+		n, err := w.Write(m)
+		return "", int64(n), err
+	})
+	if err != nil {
+		t.Fatalf("failed to seed manifest: %s", err)
+	}
+
+	return &builder.State{
+		Storage:   backend,
+		Cache:     &cache,
+		Cfg:       config.Config{Pkgs: conformanceSource{}},
+		CacheOnly: true,
+		Catalog:   builder.NewCatalog(),
+	}, layerDigest
+}
+
+func TestConformance(t *testing.T) {
+	state, layerDigest := conformanceState(t)
+	srv := httptest.NewServer(newHandler(state))
+	defer srv.Close()
+
+	get := func(method, path string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %s", method, path, err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	base := "/v2/" + conformanceNamespace
+
+	// Manifests resolved by tag must be served under the digest
+	// reported for them.
+	resp, manifest := get("GET", base+"/manifests/"+conformanceTag)
+	if resp.StatusCode != 200 {
+		t.Fatalf("GET manifest by tag returned %d: %s", resp.StatusCode, manifest)
+	}
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+	if d := resp.Header.Get("Docker-Content-Digest"); d != digest {
+		t.Errorf("manifest digest header %q does not match content digest %q", d, digest)
+	}
+
+	resp, _ = get("HEAD", base+"/manifests/"+conformanceTag)
+	if resp.StatusCode != 200 || resp.Header.Get("Docker-Content-Digest") != digest {
+		t.Errorf("HEAD manifest by tag returned %d with digest %q", resp.StatusCode, resp.Header.Get("Docker-Content-Digest"))
+	}
+
+	if resp.ContentLength != int64(len(manifest)) {
+		t.Errorf("HEAD manifest by tag returned length %d, expected %d", resp.ContentLength, len(manifest))
+	}
+
+	resp, byDigest := get("GET", base+"/manifests/"+digest)
+	if resp.StatusCode != 200 || !bytes.Equal(byDigest, manifest) {
+		t.Errorf("GET manifest by digest returned %d with different content", resp.StatusCode)
+	}
+	if resp.Header.Get("Cache-Control") != storage.ImmutableCacheControl {
+		t.Errorf("manifest by digest is not cacheable: %q", resp.Header.Get("Cache-Control"))
+	}
+
+	resp, _ = get("HEAD", base+"/manifests/"+digest)
+	if resp.StatusCode != 200 || resp.Header.Get("Docker-Content-Digest") != digest || resp.Header.Get("Content-Type") != mf.ManifestType {
+		t.Errorf("HEAD manifest by digest returned %d with digest %q", resp.StatusCode, resp.Header.Get("Docker-Content-Digest"))
+	}
+
+	// Layers are stored next to manifests, but are not manifests.
+	resp, _ = get("GET", base+"/manifests/"+layerDigest)
+	if resp.StatusCode != 404 {
+		t.Errorf("GET layer as manifest returned %d", resp.StatusCode)
+	}
+
+	resp, _ = get("GET", base+"/blobs/"+layerDigest)
+	if resp.StatusCode != 200 {
+		t.Errorf("GET layer returned %d", resp.StatusCode)
+	}
+
+	// Unknown tags must not trigger builds in conformance mode.
+	resp, body := get("GET", base+"/manifests/nonexistent")
+	var errs registryErrors
+	json.Unmarshal(body, &errs)
+	if resp.StatusCode != 404 || len(errs.Errors) == 0 || errs.Errors[0].Code != "MANIFEST_UNKNOWN" {
+		t.Errorf("GET unknown tag returned %d: %s", resp.StatusCode, body)
+	}
+
+	// Pulled images are listed by the discovery endpoints once they
+	// are recorded in the background.
+	var catalog catalogResponse
+	for i := 0; i < 100 && len(catalog.Repositories) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		_, body = get("GET", "/v2/_catalog")
+		json.Unmarshal(body, &catalog)
+	}
+	if len(catalog.Repositories) != 1 || catalog.Repositories[0] != conformanceNamespace {
+		t.Errorf("unexpected catalog: %s", body)
+	}
+
+	resp, body = get("GET", base+"/tags/list?n=1")
+	var tags tagsResponse
+	json.Unmarshal(body, &tags)
+	if resp.StatusCode != 200 || tags.Name != conformanceNamespace || len(tags.Tags) != 1 || tags.Tags[0] != conformanceTag {
+		t.Errorf("GET tags returned %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = get("GET", "/v2/unknown/tags/list")
+	if resp.StatusCode != 404 {
+		t.Errorf("GET tags of unknown image returned %d: %s", resp.StatusCode, body)
+	}
+
+	suite := os.Getenv("OCI_CONFORMANCE_SUITE")
+	if suite == "" {
+		t.Log("OCI_CONFORMANCE_SUITE is not set, skipping official conformance suite")
+		return
+	}
+
+	cmd := exec.Command(suite)
+	cmd.Env = append(os.Environ(),
+		"OCI_ROOT_URL="+srv.URL,
+		"OCI_NAMESPACE="+conformanceNamespace,
+		"OCI_TEST_PULL=1",
+		"OCI_TAG_NAME="+conformanceTag,
+		"OCI_MANIFEST_DIGEST="+digest,
+		"OCI_BLOB_DIGEST="+layerDigest,
+		"OCI_HIDE_SKIPPED_WORKFLOWS=1",
+		"OCI_REPORT_DIR="+t.TempDir(),
+	)
+
+	out, err := cmd.CombinedOutput()
+	t.Log(string(out))
+	if err != nil {
+		t.Fatalf("conformance suite failed: %s", err)
+	}
+}
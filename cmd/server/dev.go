@@ -0,0 +1,81 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements the development mode (`--dev`), which runs
+// Nixery without any cloud dependencies or package set downloads:
+//
+// * objects are kept in memory and lost on exit
+// * packages come from a small package set bundled below, which uses the nixpkgs on the NIX_PATH
+// * logging is verbose, including the output of Nix
+//
+// Nixery's wrapper scripts must be on the PATH, for example by running
+// it inside of `nix-shell`.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// devPackageSet is the package set used in development mode. It only
+// exposes the packages required by Nixery itself, the packages of the
+// `shell` meta-package and a few others for testing.
+const devPackageSet = `# Package set used by Nixery's development mode, generated on startup.
+args:
+let pkgs = import <nixpkgs> args;
+in {
+  # Required for building images
+  inherit (pkgs) lib coreutils jq openssl runCommand writeText symlinkJoin;
+  inherit (pkgs) cacert iana-etc;
+
+  # Contents of the shell meta-package
+  inherit (pkgs) bashInteractive moreutils nano;
+
+  # Packages for testing
+  inherit (pkgs) hello curl git htop;
+}
+`
+
+// devDefaults are the configuration values used in development mode,
+// unless they are set explicitly.
+var devDefaults = map[string]string{
+	"PORT":                   "8080",
+	"NIXERY_STORAGE_BACKEND": "memory",
+	"NIXERY_LOG_LEVEL":       "debug",
+}
+
+// configureDev prepares the environment for development mode before
+// the configuration is loaded.
+func configureDev() error {
+	dir := filepath.Join(os.TempDir(), "nixery-dev")
+	if err := os.MkdirAll(filepath.Join(dir, "pkgs"), 0755); err != nil {
+		return err
+	}
+
+	pkgs := filepath.Join(dir, "pkgs", "default.nix")
+	if err := ioutil.WriteFile(pkgs, []byte(devPackageSet), 0644); err != nil {
+		return err
+	}
+
+	// Only one package source may be configured, so the bundled
+	// one is not used if another was chosen explicitly.
+	if os.Getenv("NIXERY_CHANNEL") == "" && os.Getenv("NIXERY_PKGS_REPO") == "" {
+		devDefaults["NIXERY_PKGS_PATH"] = filepath.Dir(pkgs)
+	}
+
+	// The static web files are not needed for development, but
+	// must be configured.
+	devDefaults["WEB_DIR"] = dir
+
+	for k, v := range devDefaults {
+		if os.Getenv(k) == "" {
+			os.Setenv(k, v)
+		}
+	}
+
+	log.WithField("port", os.Getenv("PORT")).Warn("running in development mode, images are not persisted")
+	return nil
+}
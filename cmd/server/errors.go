@@ -0,0 +1,135 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements the error responses of Nixery, which use the
+// format of the distribution spec on all routes, e.g.:
+//
+//	{"errors": [{"code": "NAME_UNKNOWN", "message": "...", "detail": {...}}]}
+//
+// Clients such as `docker pull` print the message of the first error,
+// so failed builds are reported with the most specific message that is
+// known, e.g. the error printed by Nix for packages that do not
+// evaluate.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/nixery/builder"
+	log "github.com/sirupsen/logrus"
+)
+
+// Error format corresponding to the registry protocol V2 specification. This
+// allows feeding back errors to clients in a way that can be presented to
+// users.
+type registryError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Detail  interface{} `json:"detail,omitempty"`
+}
+
+type registryErrors struct {
+	Errors []registryError `json:"errors"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorDetail(w, status, code, message, nil)
+}
+
+// writeErrorDetail writes a registry error with additional structured
+// information for clients.
+func writeErrorDetail(w http.ResponseWriter, status int, code, message string, detail interface{}) {
+	err := registryErrors{
+		Errors: []registryError{
+			{code, message, detail},
+		},
+	}
+	json, _ := json.Marshal(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(json)
+}
+
+// buildDenied reports whether a build was refused due to the policy of
+// the instance, which is reported to clients as DENIED.
+func buildDenied(err error) bool {
+	return errors.Is(err, builder.ErrQuotaExceeded) ||
+		errors.Is(err, builder.ErrHookRejected) ||
+		errors.Is(err, builder.ErrEmulationDisabled)
+}
+
+// invalidPackages reports whether a build was refused because of the
+// combination of requested packages.
+func invalidPackages(err error) bool {
+	return errors.Is(err, builder.ErrConflictingPackages) ||
+		errors.Is(err, builder.ErrUnknownFlag) ||
+		errors.Is(err, builder.ErrEvalOutOfMemory)
+}
+
+// buildFailure is the error response for a failed build.
+type buildFailure struct {
+	status  int
+	code    string
+	message string
+	detail  interface{}
+}
+
+// classifyBuild returns the error response for the result of a build,
+// or nil if the build succeeded.
+func classifyBuild(result *builder.BuildResult, err error) *buildFailure {
+	switch {
+	case err == nil && result.Error == "not_found":
+		return &buildFailure{404, "NAME_UNKNOWN", fmt.Sprintf("Could not find Nix packages: %v", result.Pkgs), map[string]interface{}{
+			"packages": result.Pkgs,
+		}}
+	case err == nil:
+		return nil
+	case buildDenied(err):
+		return &buildFailure{403, "DENIED", err.Error(), nil}
+	case errors.Is(err, builder.ErrPoolUnavailable):
+		return &buildFailure{503, "UNAVAILABLE", err.Error(), nil}
+	case invalidPackages(err):
+		return &buildFailure{400, "NAME_INVALID", err.Error(), nil}
+	case errors.Is(err, builder.ErrNotCached):
+		return &buildFailure{404, "MANIFEST_UNKNOWN", "manifest unknown to registry", nil}
+	case errors.Is(err, builder.ErrEvaluationFailed):
+		return &buildFailure{404, "MANIFEST_UNKNOWN", err.Error(), map[string]string{"stage": "evaluation"}}
+	case errors.Is(err, builder.ErrRealisationFailed):
+		return &buildFailure{500, "UNKNOWN", err.Error(), map[string]string{"stage": "realisation"}}
+	case errors.Is(err, builder.ErrStageTimeout):
+		return &buildFailure{500, "UNKNOWN", err.Error(), nil}
+	case errors.Is(err, builder.ErrManifestUpload):
+		return &buildFailure{500, "MANIFEST_UPLOAD", err.Error(), nil}
+	default:
+		return &buildFailure{500, "UNKNOWN", "image build failure", nil}
+	}
+}
+
+// writeBuildError writes the error response for a failed build of an
+// image, and reports whether the build failed. Failures that are not
+// caused by the request are logged.
+func writeBuildError(w http.ResponseWriter, image *builder.Image, result *builder.BuildResult, err error) bool {
+	failure := classifyBuild(result, err)
+	if failure == nil {
+		return false
+	}
+
+	entry := log.WithFields(log.Fields{
+		"image": image.Name,
+		"tag":   image.Tag,
+	})
+	if failure.status >= 500 {
+		entry.WithError(err).Error("failed to build image manifest")
+	} else if failure.code == "NAME_UNKNOWN" {
+		entry.WithField("packages", result.Pkgs).Warn("could not find Nix packages")
+	} else if errors.Is(err, builder.ErrEvaluationFailed) {
+		entry.WithError(err).Warn("failed to evaluate image")
+	}
+
+	writeErrorDetail(w, failure.status, failure.code, failure.message, failure.detail)
+	return true
+}
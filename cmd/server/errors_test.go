@@ -0,0 +1,70 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/nixery/builder"
+)
+
+func TestClassifyBuild(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{fmt.Errorf("%w: tenant over quota", builder.ErrQuotaExceeded), 403, "DENIED"},
+		{builder.ErrPoolUnavailable, 503, "UNAVAILABLE"},
+		{builder.ErrConflictingPackages, 400, "NAME_INVALID"},
+		{builder.ErrNotCached, 404, "MANIFEST_UNKNOWN"},
+		{fmt.Errorf("%w: Package ‘foo’ is marked as broken", builder.ErrEvaluationFailed), 404, "MANIFEST_UNKNOWN"},
+		{fmt.Errorf("%w: builder for 'foo.drv' failed", builder.ErrRealisationFailed), 500, "UNKNOWN"},
+		{errors.New("disk full"), 500, "UNKNOWN"},
+	}
+
+	for _, c := range cases {
+		failure := classifyBuild(nil, c.err)
+		if failure == nil || failure.status != c.status || failure.code != c.code {
+			t.Errorf("expected %d %s for %v, got %+v", c.status, c.code, c.err, failure)
+		}
+	}
+
+	if failure := classifyBuild(&builder.BuildResult{}, nil); failure != nil {
+		t.Errorf("successful build was classified as failure: %+v", failure)
+	}
+}
+
+func TestWriteBuildError(t *testing.T) {
+	image := builder.ImageFromName("shell/nonexistent", "latest")
+	result := &builder.BuildResult{Error: "not_found", Pkgs: []string{"nonexistent"}}
+
+	w := httptest.NewRecorder()
+	if !writeBuildError(w, &image, result, nil) {
+		t.Fatal("build with unknown packages was not reported as failed")
+	}
+
+	var errs registryErrors
+	if err := json.NewDecoder(w.Body).Decode(&errs); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != 404 || len(errs.Errors) != 1 || errs.Errors[0].Code != "NAME_UNKNOWN" {
+		t.Errorf("unexpected response %d: %+v", w.Code, errs)
+	}
+
+	if detail, _ := errs.Errors[0].Detail.(map[string]interface{}); detail == nil || fmt.Sprint(detail["packages"]) != "[nonexistent]" {
+		t.Errorf("unknown packages are not listed: %+v", errs.Errors[0].Detail)
+	}
+
+	// Internal errors are not exposed to clients.
+	w = httptest.NewRecorder()
+	writeBuildError(w, &image, nil, errors.New("open /var/lib/nixery/secret: permission denied"))
+	if errs := w.Body.String(); w.Code != 500 || errs != `{"errors":[{"code":"UNKNOWN","message":"image build failure"}]}` {
+		t.Errorf("unexpected response %d: %s", w.Code, errs)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements the `-export-mirror` mode, in which Nixery
+// exports its cache into a static registry mirror (see
+// builder/export.go) and exits instead of serving requests.
+//
+// Images named as arguments (e.g. `shell/git:latest`) are additionally
+// exported under their name. They are resolved like registry requests,
+// but only images that are already cached are exported.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/nixery/builder"
+	log "github.com/sirupsen/logrus"
+)
+
+func exportMirror(state *builder.State, dir string, refs []string) error {
+	ctx := context.Background()
+	state.CacheOnly = true
+
+	if err := state.Profiles.Refresh(ctx, state.Storage); err != nil {
+		return err
+	}
+
+	if state.Curated != nil {
+		if err := state.Curated.Sync(ctx); err != nil {
+			return fmt.Errorf("failed to sync curated images: %w", err)
+		}
+	}
+
+	var tags []builder.MirrorTag
+	for _, ref := range refs {
+		name, tag := ref, "latest"
+		if i := strings.LastIndexByte(ref, ':'); i >= 0 {
+			name, tag = ref[:i], ref[i+1:]
+		}
+
+		m, err := cachedManifest(ctx, state, name, tag)
+		if errors.Is(err, builder.ErrNotCached) {
+			log.WithFields(log.Fields{
+				"image": name,
+				"tag":   tag,
+			}).Warn("image is not cached, skipping export")
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", ref, err)
+		}
+
+		tags = append(tags, builder.MirrorTag{
+			Name:     name,
+			Tag:      tag,
+			Manifest: m,
+		})
+	}
+
+	_, err := builder.ExportMirror(ctx, state, dir, tags)
+
+	// Resolving the images may have started cache writes.
+	shutdown, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+	state.Background.Shutdown(shutdown)
+
+	return err
+}
+
+// cachedManifest returns the cached manifest that a registry request
+// for the given image would be served.
+func cachedManifest(ctx context.Context, state *builder.State, name, tag string) ([]byte, error) {
+	name, ns := builder.ResolveNamespace(state.Cfg.Namespaces, resolveAlias(&state.Cfg, name))
+	if m, _, ok := state.Profiles.Lookup(name, tag); ok {
+		return m, nil
+	}
+
+	image, err := resolveImage(ctx, state, name, tag)
+	if err != nil {
+		return nil, err
+	}
+	if err := builder.ApplyNamespace(ns, &image); err != nil {
+		return nil, err
+	}
+	state.Pins.WithPin(&image)
+
+	result, err := builder.BuildImage(ctx, state, &image)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Manifest, nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements the awareness of the URL under which clients
+// reach Nixery (NIXERY_EXTERNAL_URL), which may differ from the address
+// it listens on, for example behind an ingress that serves it on a
+// nonstandard port or below a path prefix.
+//
+// The external URL is used wherever Nixery tells clients where to go:
+// in authentication challenges and in the references of built images.
+// Without it, these are derived from the request, which is only correct
+// if the Host header reaches Nixery unchanged.
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/nixery/config"
+)
+
+// externalURL returns the base URL under which the client of a request
+// reaches Nixery, without a trailing slash.
+func externalURL(cfg *config.Config, r *http.Request) string {
+	if cfg.ExternalUrl != "" {
+		return cfg.ExternalUrl
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	return scheme + "://" + r.Host
+}
+
+// imageReference returns the reference under which an image can be
+// pulled. It is qualified with the registry host (including its port)
+// if the external URL is configured.
+//
+// Image references can not express path prefixes, which are left out.
+// Clients that reach Nixery below a prefix (e.g. containerd mirrors
+// with `override_path`) add it themselves.
+func imageReference(cfg *config.Config, name, digest string) string {
+	ref := name + "@" + digest
+	if cfg.ExternalUrl == "" {
+		return ref
+	}
+
+	u, _ := url.Parse(cfg.ExternalUrl)
+	return u.Host + "/" + ref
+}
+
+// stripExternalPrefix removes the path prefix of the external URL from
+// requests, for ingresses forwarding requests without rewriting them.
+// Requests that were already rewritten are served unchanged.
+func stripExternalPrefix(cfg *config.Config, h http.Handler) http.Handler {
+	if cfg.ExternalUrl == "" {
+		return h
+	}
+
+	u, _ := url.Parse(cfg.ExternalUrl)
+	prefix := strings.TrimSuffix(u.Path, "/")
+	if prefix == "" {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := strings.TrimPrefix(r.URL.Path, prefix); p != r.URL.Path && (p == "" || p[0] == '/') {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = p
+			r2.URL.RawPath = ""
+			if p == "" {
+				r2.URL.Path = "/"
+			}
+			r = r2
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
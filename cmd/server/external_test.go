@@ -0,0 +1,46 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/nixery/config"
+)
+
+func TestExternalURL(t *testing.T) {
+	cfg := &config.Config{ExternalUrl: "https://[fd00::1]:8443/nixery"}
+
+	if ref := imageReference(cfg, "shell/git", "sha256:ab"); ref != "[fd00::1]:8443/shell/git@sha256:ab" {
+		t.Errorf("unexpected image reference %s", ref)
+	}
+
+	if ref := imageReference(&config.Config{}, "shell/git", "sha256:ab"); ref != "shell/git@sha256:ab" {
+		t.Errorf("unexpected image reference without external URL %s", ref)
+	}
+
+	var served string
+	handler := stripExternalPrefix(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = r.URL.Path
+	}))
+
+	for path, expected := range map[string]string{
+		"/nixery/v2/shell/manifests/latest": "/v2/shell/manifests/latest",
+		"/v2/shell/manifests/latest":        "/v2/shell/manifests/latest",
+		"/nixery":                           "/",
+		"/nixeryfoo/v2/":                    "/nixeryfoo/v2/",
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		if served != expected {
+			t.Errorf("%s was served as %s, expected %s", path, served, expected)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	challenge(w, httptest.NewRequest("GET", "/v2/", nil), cfg, "")
+	if h := w.Header().Get("WWW-Authenticate"); h != `Bearer realm="https://[fd00::1]:8443/nixery/v1/token",service="nixery"` {
+		t.Errorf("unexpected challenge %s", h)
+	}
+}
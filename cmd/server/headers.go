@@ -0,0 +1,97 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements a middleware guaranteeing the response headers
+// required by the registry protocol on all responses under `/v2/`,
+// regardless of which handler (or storage backend) produced them:
+//
+// * `Docker-Distribution-API-Version` on every response
+// * `Docker-Content-Digest` on successful responses for content addressed by digest
+// * a JSON content type on error responses
+//
+// Content addressed by digest is also marked as immutable, with its
+// digest as the ETag, so that CDNs in front of Nixery can cache it
+// indefinitely. Storage backends redirecting to URLs that expire set
+// their own Cache-Control header.
+
+import (
+	"net/http"
+
+	"github.com/google/nixery/storage"
+)
+
+// registryHeaders wraps the registry handler with the required
+// response headers.
+func registryHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hw := &headerWriter{
+			ResponseWriter: w,
+			digest:         requestDigest(r),
+		}
+
+		// The ETag must be known before the response is
+		// written, so that conditional requests are answered
+		// by the storage backends.
+		if hw.digest != "" {
+			w.Header().Set("ETag", `"`+hw.digest+`"`)
+		}
+
+		h.ServeHTTP(hw, r)
+	})
+}
+
+// requestDigest returns the digest requested by a blob or manifest
+// request, if the content is addressed by digest.
+func requestDigest(r *http.Request) string {
+	if m := blobRegex.FindStringSubmatch(r.URL.Path); len(m) == 4 {
+		return "sha256:" + m[3]
+	}
+
+	return ""
+}
+
+// headerWriter adds missing headers right before the response status
+// is written, as headers can not be changed afterwards.
+type headerWriter struct {
+	http.ResponseWriter
+	digest  string
+	written bool
+}
+
+func (w *headerWriter) WriteHeader(status int) {
+	if !w.written {
+		w.written = true
+
+		h := w.Header()
+		if h.Get("Docker-Distribution-API-Version") == "" {
+			h.Set("Docker-Distribution-API-Version", "registry/2.0")
+		}
+
+		if w.digest != "" && status < 400 && h.Get("Docker-Content-Digest") == "" {
+			h.Set("Docker-Content-Digest", w.digest)
+		}
+
+		if w.digest != "" && (status == http.StatusOK || status == http.StatusPartialContent) && h.Get("Cache-Control") == "" {
+			h.Set("Cache-Control", storage.ImmutableCacheControl)
+		}
+
+		if status >= 300 && status != http.StatusNotModified {
+			h.Del("ETag")
+		}
+
+		if status >= 400 && h.Get("Content-Type") == "" {
+			h.Set("Content-Type", "application/json")
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(p)
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/nixery/builder"
+	mf "github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+)
+
+// TestRegistryHeaders checks the headers required by the registry
+// protocol on the responses of all routes that do not require Nix.
+func TestRegistryHeaders(t *testing.T) {
+	ctx := context.Background()
+	state := &builder.State{Storage: storage.NewMemoryBackend()}
+
+	layer := []byte("layer contents")
+	layerDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+	state.Storage.Persist(ctx, "layers/"+layerDigest[7:], mf.LayerType, func(w io.Writer) (string, int64, error) {
+		n, err := w.Write(layer)
+		return layerDigest[7:], int64(n), err
+	})
+
+	m, _ := mf.Manifest("amd64", []mf.Entry{{Digest: layerDigest, Size: int64(len(layer))}}, mf.RuntimeConfig{}, nil)
+	manifest, _ := json.Marshal(m)
+	manifestDigest, err := builder.PersistManifest(ctx, state, manifest)
+	if err != nil {
+		t.Fatalf("failed to persist manifest: %s", err)
+	}
+
+	unknown := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("unknown")))
+	handler := registryHeaders(&registryHandler{state: state})
+
+	cases := []struct {
+		method      string
+		path        string
+		status      int
+		contentType string
+		digest      string
+		code        string
+	}{
+		{"GET", "/v2/", 200, "application/json", "", ""},
+		{"GET", "/v2/shell/blobs/" + layerDigest, 200, mf.LayerType, layerDigest, ""},
+		{"HEAD", "/v2/shell/blobs/" + layerDigest, 200, mf.LayerType, layerDigest, ""},
+		{"GET", "/v2/shell/manifests/" + manifestDigest, 200, mf.ManifestType, manifestDigest, ""},
+		{"HEAD", "/v2/shell/manifests/" + manifestDigest, 200, mf.ManifestType, manifestDigest, ""},
+		{"GET", "/v2/shell/blobs/" + unknown, 404, "application/json", "", "BLOB_UNKNOWN"},
+		{"GET", "/v2/shell/manifests/" + unknown, 404, "application/json", "", "MANIFEST_UNKNOWN"},
+		{"GET", "/v2/_catalog", 200, "application/json", "", ""},
+		{"GET", "/v2/shell/tags/list", 404, "application/json", "", "NAME_UNKNOWN"},
+		{"GET", "/v2/shell/uploads/", 404, "application/json", "", "UNSUPPORTED"},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		resp := w.Result()
+
+		name := c.method + " " + c.path
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: expected status %d, got %d", name, c.status, resp.StatusCode)
+		}
+
+		if v := resp.Header.Get("Docker-Distribution-API-Version"); v != "registry/2.0" {
+			t.Errorf("%s: unexpected API version header %q", name, v)
+		}
+
+		if v := resp.Header.Get("Content-Type"); v != c.contentType {
+			t.Errorf("%s: expected content type %q, got %q", name, c.contentType, v)
+		}
+
+		if v := resp.Header.Get("Docker-Content-Digest"); v != c.digest {
+			t.Errorf("%s: expected digest %q, got %q", name, c.digest, v)
+		}
+
+		if c.code != "" {
+			var errs registryErrors
+			if err := json.NewDecoder(resp.Body).Decode(&errs); err != nil || len(errs.Errors) == 0 || errs.Errors[0].Code != c.code {
+				t.Errorf("%s: expected error code %s (%v)", name, c.code, err)
+			}
+		}
+	}
+}
+
+// TestCacheHeaders checks that content addressed by digest is cached
+// immutably, and that conditional requests are answered.
+func TestCacheHeaders(t *testing.T) {
+	ctx := context.Background()
+	state := &builder.State{Storage: storage.NewMemoryBackend()}
+
+	layer := []byte("layer contents")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+	state.Storage.Persist(ctx, "layers/"+digest[7:], mf.LayerType, func(w io.Writer) (string, int64, error) {
+		n, err := w.Write(layer)
+		return digest[7:], int64(n), err
+	})
+
+	handler := registryHeaders(&registryHandler{state: state})
+	path := "/v2/shell/blobs/" + digest
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if v := w.Header().Get("Cache-Control"); v != storage.ImmutableCacheControl {
+		t.Errorf("unexpected Cache-Control header %q", v)
+	}
+
+	etag := w.Header().Get("ETag")
+	if etag != `"`+digest+`"` {
+		t.Errorf("unexpected ETag header %q", etag)
+	}
+
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 304 {
+		t.Errorf("expected conditional request to return 304, got %d", w.Code)
+	}
+
+	unknown := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("unknown")))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v2/shell/blobs/"+unknown, nil))
+	if w.Header().Get("ETag") != "" || w.Header().Get("Cache-Control") != "" {
+		t.Errorf("expected no cache headers on errors")
+	}
+}
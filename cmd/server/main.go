@@ -16,39 +16,54 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
+	"crypto/rsa"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/nixery/builder"
 	"github.com/google/nixery/config"
+	"github.com/google/nixery/credentials"
+	"github.com/google/nixery/encryption"
+	"github.com/google/nixery/events"
 	"github.com/google/nixery/layers"
 	"github.com/google/nixery/logs"
 	mf "github.com/google/nixery/manifest"
+	"github.com/google/nixery/scan"
 	"github.com/google/nixery/storage"
 	log "github.com/sirupsen/logrus"
 )
 
-// ManifestMediaType is the Content-Type used for the manifest itself. This
-// corresponds to the "Image Manifest V2, Schema 2" described on this page:
-//
-// https://docs.docker.com/registry/spec/manifest-v2-2/
-const manifestMediaType string = "application/vnd.docker.distribution.manifest.v2+json"
-
 // This variable will be initialised during the build process and set
 // to the hash of the entire Nixery source tree.
 var version string = "devel"
 
+// Number of Nix invocations retained for the admin API.
+const auditLogSize = 256
+
 // Regexes matching the V2 Registry API routes. This only includes the
-// routes required for serving images, since pushing and other such
-// functionality is not available.
+// routes required for serving and discovering images, since pushing
+// and other such functionality is not available.
 var (
 	manifestRegex = regexp.MustCompile(`^/v2/([\w|\-|\.|\_|\/]+)/manifests/([\w|\-|\.|\_]+)$`)
 	blobRegex     = regexp.MustCompile(`^/v2/([\w|\-|\.|\_|\/]+)/(blobs|manifests)/sha256:(\w+)$`)
+
+	// Referrers of a manifest, and the tag under which clients
+	// without support for the referrers API look for them
+	referrersRegex    = regexp.MustCompile(`^/v2/([\w|\-|\.|\_|\/]+)/referrers/(sha256:[a-f0-9]{64})$`)
+	referrersTagRegex = regexp.MustCompile(`^sha256-([a-f0-9]{64})$`)
+
+	// Discovery of the images in the catalog
+	tagsRegex = regexp.MustCompile(`^/v2/([\w|\-|\.|\_|\/]+)/tags/list$`)
 )
 
 // Downloads the popularity information for the package set from the
@@ -77,175 +92,505 @@ func downloadPopularity(url string) (layers.Popularity, error) {
 	return pop, nil
 }
 
-// Error format corresponding to the registry protocol V2 specification. This
-// allows feeding back errors to clients in a way that can be presented to
-// users.
-type registryError struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
+// requestTenant returns the tenant on whose behalf a request is made,
+// as identified by the configured tenant header.
+//
+// The header is expected to be set (and overwritten, if sent by
+// clients) by an authenticating proxy in front of Nixery, and is
+// ignored on requests that do not come directly from a trusted proxy.
+func requestTenant(cfg *config.Config, r *http.Request) string {
+	if cfg.TenantHeader == "" || !isTrusted(cfg.TrustedProxies, hostOnly(r.RemoteAddr)) {
+		return ""
+	}
+
+	return r.Header.Get(cfg.TenantHeader)
+}
+
+// loadRecipients reads the encryption recipients for each tenant from
+// a JSON file mapping tenant names to lists of PEM key files.
+func loadRecipients(path string) (map[string][]*rsa.PublicKey, error) {
+	j, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files map[string][]string
+	if err := json.Unmarshal(j, &files); err != nil {
+		return nil, fmt.Errorf("invalid recipients file: %s", err)
+	}
+
+	recipients := make(map[string][]*rsa.PublicKey)
+	for tenant, keys := range files {
+		for _, file := range keys {
+			key, err := encryption.LoadRecipient(file)
+			if err != nil {
+				return nil, err
+			}
+			recipients[tenant] = append(recipients[tenant], key)
+		}
+	}
+
+	return recipients, nil
 }
 
-type registryErrors struct {
-	Errors []registryError `json:"errors"`
+// selectPlatform applies the platform requested by the client (via
+// the `platform` query parameter) to an image, and writes an error
+// naming the available platforms if it is not supported.
+func selectPlatform(w http.ResponseWriter, r *http.Request, image *builder.Image) bool {
+	platform := r.URL.Query().Get("platform")
+	if platform == "" {
+		return true
+	}
+
+	if err := image.SetPlatform(platform); err != nil {
+		writeErrorDetail(w, 404, "MANIFEST_UNKNOWN", err.Error(), map[string]interface{}{
+			"platform":  platform,
+			"platforms": builder.Platforms,
+		})
+		return false
+	}
+
+	return true
 }
 
-func writeError(w http.ResponseWriter, status int, code, message string) {
-	err := registryErrors{
-		Errors: []registryError{
-			{code, message},
-		},
+// selectTTL applies the lifetime requested by the client (via the `ttl`
+// query parameter) to an image, and writes an error if it is invalid.
+func selectTTL(w http.ResponseWriter, r *http.Request, image *builder.Image) bool {
+	ttl := r.URL.Query().Get("ttl")
+	if ttl == "" {
+		return true
+	}
+
+	d, err := builder.ParseTTL(ttl)
+	if err != nil {
+		writeError(w, 400, "INVALID_REQUEST", err.Error())
+		return false
 	}
-	json, _ := json.Marshal(err)
 
-	w.WriteHeader(status)
-	w.Header().Add("Content-Type", "application/json")
-	w.Write(json)
+	builder.SetTTL(image, d)
+	return true
 }
 
 type registryHandler struct {
 	state *builder.State
+	async *asyncBuilds
+}
+
+// resolveAlias returns the image name that a requested image name
+// stands for.
+func resolveAlias(cfg *config.Config, name string) string {
+	target, ok := builder.ResolveAlias(cfg.Aliases, name)
+	if ok {
+		log.WithFields(log.Fields{
+			"alias": name,
+			"image": target,
+		}).Debug("resolved image alias")
+	}
+
+	return target
+}
+
+// imageFromName returns the image requested by name, which is either
+// the name of a curated image, the name of a spec alias or a list of
+// packages. An error is written for unknown aliases.
+func (h *registryHandler) imageFromName(w http.ResponseWriter, r *http.Request, name, tag string) (builder.Image, bool) {
+	image, err := resolveImage(r.Context(), h.state, name, tag)
+	if err != nil {
+		writeError(w, 404, "MANIFEST_UNKNOWN", err.Error())
+		return image, false
+	}
+
+	return image, true
+}
+
+// resolveImage returns the image with the given name, see
+// imageFromName.
+func resolveImage(ctx context.Context, state *builder.State, name, tag string) (builder.Image, error) {
+	spec, isAlias := state.Curated.Lookup(name)
+	var err error
+	if isAlias {
+		log.WithField("image", name).Debug("serving curated image")
+	} else {
+		spec, isAlias, err = builder.LookupSpecAlias(ctx, state, name)
+	}
+
+	if !isAlias {
+		return builder.ImageFromName(name, tag), nil
+	}
+
+	var image builder.Image
+	if err == nil {
+		image, _, err = imageFromSpec(spec)
+	}
+	if err != nil {
+		return image, err
+	}
+
+	// Specs without a pin are built for the requested tag.
+	if spec.Pin == "" {
+		image.Tag = tag
+	}
+
+	return image, nil
 }
 
 // Serve a manifest by tag, building it via Nix and populating caches
 // if necessary.
 func (h *registryHandler) serveManifestTag(w http.ResponseWriter, r *http.Request, name string, tag string) {
 	log.WithFields(log.Fields{
-		"image": name,
-		"tag":   tag,
+		"image":     name,
+		"tag":       tag,
+		"client":    clientIP(r),
+		"namespace": mirrorNamespace(r),
 	}).Info("requesting image manifest")
 
-	image := builder.ImageFromName(name, tag)
-	buildResult, err := builder.BuildImage(r.Context(), h.state, &image)
+	requested := name
+	name, ns := builder.ResolveNamespace(h.state.Cfg.Namespaces, resolveAlias(&h.state.Cfg, name))
+	if m, digest, ok := h.state.Profiles.Lookup(name, tag); ok {
+		log.WithFields(log.Fields{
+			"profile": name,
+			"tag":     tag,
+		}).Debug("serving imported profile")
 
-	if err != nil {
-		writeError(w, 500, "UNKNOWN", "image build failure")
+		writeManifest(w, r, m, digest)
+		return
+	}
 
-		log.WithError(err).WithFields(log.Fields{
-			"image": name,
-			"tag":   tag,
-		}).Error("failed to build image manifest")
+	image, ok := h.imageFromName(w, r, name, tag)
+	if !ok {
+		return
+	}
+	image.Tenant = requestTenant(&h.state.Cfg, r)
+	if err := builder.ApplyNamespace(ns, &image); err != nil {
+		writeError(w, 403, "DENIED", err.Error())
+		return
+	}
 
+	if !selectPlatform(w, r, &image) || !selectTTL(w, r, &image) {
 		return
 	}
+	h.state.Pins.WithPin(&image)
 
-	// Some error types have special handling, which is applied
-	// here.
-	if buildResult.Error == "not_found" {
-		s := fmt.Sprintf("Could not find Nix packages: %v", buildResult.Pkgs)
-		writeError(w, 404, "MANIFEST_UNKNOWN", s)
+	// Clients that select a platform themselves receive an index of
+	// the images of all platforms.
+	if h.state.Cfg.MultiArch && r.URL.Query().Get("platform") == "" && acceptsIndex(r) {
+		image.MultiArch = true
+	}
 
-		log.WithFields(log.Fields{
-			"image":    name,
-			"tag":      tag,
-			"packages": buildResult.Pkgs,
-		}).Warn("could not find Nix packages")
+	if warning := h.state.Quotas.Warning(image.Tenant); warning != "" {
+		w.Header().Add("Warning", fmt.Sprintf("299 nixery %q", warning))
+	}
+
+	var buildResult *builder.BuildResult
+	var err error
+	if h.async.accepts(r) {
+		key := strings.Join([]string{image.Tenant, image.Name, image.Tag, r.URL.Query().Get("platform"), r.URL.Query().Get("ttl"), strconv.FormatBool(image.MultiArch)}, "|")
+
+		var retry time.Duration
+		buildResult, retry, err = h.async.build(h.state, key, &image)
+		if retry > 0 {
+			log.WithFields(log.Fields{
+				"image":       name,
+				"tag":         tag,
+				"retry-after": retry,
+			}).Info("image is still building, asking client to retry")
+
+			w.Header().Set("Retry-After", formatRetryAfter(retry))
+			w.WriteHeader(202)
+			return
+		}
+	} else {
+		buildResult, err = builder.BuildImage(r.Context(), h.state, &image)
+	}
 
+	if writeBuildError(w, &image, buildResult, err) {
 		return
 	}
 
-	// This marshaling error is ignored because we know that this
-	// field represents valid JSON data.
-	manifest, _ := json.Marshal(buildResult.Manifest)
-	w.Header().Add("Content-Type", manifestMediaType)
-
-	// The manifest needs to be persisted to the blob storage (to become
-	// available for clients that fetch manifests by their hash, e.g.
-	// containerd) and served to the client.
-	//
-	// Since we have no stable key to address this manifest (it may be
-	// uncacheable, yet still addressable by blob) we need to separate
-	// out the hashing, uploading and serving phases. The latter is
-	// especially important as clients may start to fetch it by digest
-	// as soon as they see a response.
-	sha256sum := fmt.Sprintf("%x", sha256.Sum256(manifest))
-	path := "layers/" + sha256sum
-	ctx := context.TODO()
-
-	_, _, err = h.state.Storage.Persist(ctx, path, mf.ManifestType, func(sw io.Writer) (string, int64, error) {
-		// We already know the hash, so no additional hash needs to be
-		// constructed here.
-		written, err := sw.Write(manifest)
-		return sha256sum, int64(written), err
-	})
+	// Manifests are always stored in their serialised form, which
+	// is served as-is to avoid copying them.
+	manifest := []byte(buildResult.Manifest)
+
+	// Let users see at a glance which packages take up most of the
+	// image, in particular if it exceeded the size budget.
+	annotations := mf.Annotations(buildResult.Manifest)
+	if top := builder.LargestContributors(annotations, 3); len(top) > 0 {
+		var contributors []string
+		for _, c := range top {
+			contributors = append(contributors, fmt.Sprintf("%s=%d", c.Package, c.Size))
+		}
+		w.Header().Set("X-Nixery-Largest-Contributors", strings.Join(contributors, ", "))
+	}
 
-	if err != nil {
-		writeError(w, 500, "MANIFEST_UPLOAD", "could not upload manifest to blob store")
+	if warning, ok := annotations[builder.SizeWarningAnnotation]; ok {
+		w.Header().Add("Warning", fmt.Sprintf("299 nixery %q", warning))
+	}
+
+	h.state.Catalog.Record(r.Context(), h.state, requested, tag, &image, buildResult.Digest)
+	writeManifest(w, r, manifest, buildResult.Digest)
+}
 
+// serveManifestDigest serves a manifest by digest. Manifests are
+// served directly instead of redirecting to the storage backend like
+// blobs, as clients expect the headers identifying manifests (and
+// signed URLs are not valid for HEAD requests).
+func (h *registryHandler) serveManifestDigest(w http.ResponseWriter, r *http.Request, digest string) {
+	m, err := builder.ManifestByDigest(r.Context(), h.state, digest)
+	if errors.Is(err, builder.ErrManifestUnknown) {
+		writeError(w, 404, "MANIFEST_UNKNOWN", err.Error())
+		return
+	}
+
+	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
-			"image": name,
-			"tag":   tag,
-		}).Error("could not upload manifest")
+			"digest":  digest,
+			"backend": h.state.Storage.Name(),
+			"client":  clientIP(r),
+		}).Error("failed to read manifest from storage backend")
 
+		writeError(w, 500, "UNKNOWN", "failed to read manifest")
 		return
 	}
 
-	w.Write(manifest)
+	writeManifest(w, r, m, digest)
 }
 
 // serveBlob serves a blob from storage by digest
 func (h *registryHandler) serveBlob(w http.ResponseWriter, r *http.Request, blobType, digest string) {
 	storage := h.state.Storage
 	err := storage.Serve(digest, r, w)
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, 404, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"type":    blobType,
 			"digest":  digest,
 			"backend": storage.Name(),
+			"client":  clientIP(r),
 		}).Error("failed to serve blob from storage backend")
+
+		writeError(w, 500, "UNKNOWN", "failed to serve blob")
 	}
 }
 
+// serveReferrers serves the index of the artifacts referring to a
+// manifest, either through the referrers API (which can be filtered
+// by `?artifactType=`) or as the fallback tag of the manifest.
+func (h *registryHandler) serveReferrers(w http.ResponseWriter, r *http.Request, digest string, api bool) {
+	var artifactType string
+	if api {
+		artifactType = r.URL.Query().Get("artifactType")
+	}
+
+	index, err := builder.Referrers(r.Context(), h.state, digest, artifactType)
+	if err != nil {
+		log.WithError(err).WithField("digest", digest).Error("failed to read referrers")
+		writeError(w, 500, "UNKNOWN", "failed to read referrers")
+		return
+	}
+
+	if artifactType != "" {
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+
+	writeManifest(w, r, index, mf.Descriptor(index).Digest)
+}
+
 // ServeHTTP dispatches HTTP requests to the matching handlers.
 func (h *registryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Acknowledge that we speak V2 with an empty response
-	if r.RequestURI == "/v2/" {
+	if r.URL.Path == "/v2/" {
+		servePing(w)
 		return
 	}
 
-	// Build & serve a manifest by tag
-	manifestMatches := manifestRegex.FindStringSubmatch(r.RequestURI)
+	// Routes are matched on the path only, as clients using Nixery
+	// as a mirror append the upstream registry as a query parameter.
+	manifestMatches := manifestRegex.FindStringSubmatch(r.URL.Path)
 	if len(manifestMatches) == 3 {
+		if m := referrersTagRegex.FindStringSubmatch(manifestMatches[2]); m != nil {
+			h.serveReferrers(w, r, "sha256:"+m[1], false)
+			return
+		}
+
 		h.serveManifestTag(w, r, manifestMatches[1], manifestMatches[2])
 		return
 	}
 
+	if m := referrersRegex.FindStringSubmatch(r.URL.Path); m != nil {
+		h.serveReferrers(w, r, m[2], true)
+		return
+	}
+
+	if r.URL.Path == "/v2/_catalog" {
+		h.serveCatalog(w, r)
+		return
+	}
+
+	if m := tagsRegex.FindStringSubmatch(r.URL.Path); m != nil {
+		h.serveTags(w, r, m[1])
+		return
+	}
+
 	// Serve a blob by digest
-	layerMatches := blobRegex.FindStringSubmatch(r.RequestURI)
+	layerMatches := blobRegex.FindStringSubmatch(r.URL.Path)
+	if len(layerMatches) == 4 && layerMatches[2] == "manifests" {
+		h.serveManifestDigest(w, r, "sha256:"+layerMatches[3])
+		return
+	}
+
 	if len(layerMatches) == 4 {
 		h.serveBlob(w, r, layerMatches[2], layerMatches[3])
 		return
 	}
 
-	log.WithField("uri", r.RequestURI).Info("unsupported registry route")
+	log.WithFields(log.Fields{
+		"uri":    r.RequestURI,
+		"client": clientIP(r),
+	}).Info("unsupported registry route")
+
+	writeError(w, 404, "UNSUPPORTED", "unsupported registry route")
+}
+
+// newHandler assembles the handler for all routes served by Nixery.
+func newHandler(state *builder.State) http.Handler {
+	mux := http.NewServeMux()
+
+	// All /v2/ requests belong to the registry handler. Required
+	// headers are added to all responses, including those of
+	// requests rejected due to load.
+	async := newAsyncBuilds(state.Cfg.AsyncBuildWait)
+	mux.Handle("/v2/", registryHeaders(requirePullTokens(&state.Cfg, shedLoad(state.Cfg.MaxInflight, &registryHandler{
+		state: state,
+		async: async,
+	}))))
+
+	// Nixery's own API is served under /v1/.
+	mux.Handle("/v1/", &apiHandler{
+		state: state,
+		async: async,
+	})
+
+	// The admin API is only available if a token is configured, and
+	// is not served publicly if it has its own listener.
+	if state.Cfg.AdminToken != "" && state.Cfg.AdminListen == "" {
+		mux.Handle("/admin/", &adminHandler{
+			state: state,
+		})
+	}
+
+	// Readiness is reported separately from the registry routes,
+	// as it depends on the startup self-test.
+	mux.HandleFunc("/ready", serveReady)
+
+	// Clients discover the capabilities of the instance through a
+	// well-known document.
+	mux.HandleFunc("/.well-known/nixery.json", serveCapabilities(state))
+
+	// All other roots are served by the static file server.
+	webDir := http.Dir(state.Cfg.WebDir)
+	mux.Handle("/", http.FileServer(webDir))
 
-	w.WriteHeader(404)
+	// Client addresses are resolved for all routes, so that any
+	// handler can rely on them regardless of reverse proxies.
+	return realIP(state.Cfg.TrustedProxies, stripExternalPrefix(&state.Cfg, mux))
 }
 
 func main() {
+	dev := flag.Bool("dev", false, "run in development mode, without persistent storage or package set downloads")
+	export := flag.String("export-mirror", "", "export the cache into a static registry mirror in the given directory, naming the images given as arguments, and exit")
+	layerWorker := flag.Bool(builder.LayerWorkerFlag, false, "pack a single layer as a worker process (used internally)")
+	flag.Parse()
+
+	// Layer workers write the layer to standard output, which must
+	// not be mixed with any other output.
+	if *layerWorker {
+		if err := builder.RunLayerWorker(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	logs.Init(version)
+	builder.ConfigureBuildInfo(version)
+	if *dev {
+		if err := configureDev(); err != nil {
+			log.WithError(err).Fatal("failed to configure development mode")
+		}
+	}
+
 	cfg, err := config.FromEnv()
 	if err != nil {
 		log.WithError(err).Fatal("failed to load configuration")
 	}
 
+	if err = builder.ValidateNamespaces(cfg.Namespaces); err != nil {
+		log.WithError(err).Fatal("failed to load configuration")
+	}
+
+	if err = logs.SetLevel(cfg.LogLevel); err != nil {
+		log.WithError(err).Fatal("failed to set log level")
+	}
+	logs.SetVerboseNix(*dev)
+
+	if err = configureOutbound(cfg.Outbound); err != nil {
+		log.WithError(err).Fatal("failed to configure outbound traffic")
+	}
+
+	if cfg.ScratchDir != "" {
+		if err = builder.CleanScratch(cfg.ScratchDir, cfg.SpillDir); err != nil {
+			log.WithError(err).Fatal("failed to prepare scratch directory")
+		}
+	}
+
+	if err = builder.ConfigureNix(); err != nil {
+		log.WithError(err).Fatal("failed to configure Nix")
+	}
+	builder.ConfigureStageTimeouts(cfg.Timeouts)
+	builder.ConfigureParallelEval(cfg.EvalWorkers, cfg.EvalWorkerMemory)
+	builder.LogEmulation(cfg.DisableEmulation)
+
 	var s storage.Backend
 
+	storage.SetUploadLimits(cfg.UploadChunkSize, cfg.UploadMemory)
 	switch cfg.Backend {
 	case config.GCS:
 		s, err = storage.NewGCSBackend()
 	case config.FileSystem:
 		s, err = storage.NewFSBackend()
+	case config.Memory:
+		s = storage.NewMemoryBackend()
+	case config.S3:
+		s, err = storage.NewS3Backend()
 	}
 	if err != nil {
 		log.WithError(err).Fatal("failed to initialise storage backend")
 	}
 
+	if cfg.StoragePrefix != "" {
+		s, err = storage.WithPrefix(s, cfg.StoragePrefix)
+		if err != nil {
+			log.WithError(err).Fatal("failed to configure storage prefix")
+		}
+	}
+
+	if cfg.ChunkedLayers {
+		s = storage.WithChunking(s)
+	}
+
 	log.WithField("backend", s.Name()).Info("initialised storage backend")
 
 	cache, err := builder.NewCache()
 	if err != nil {
 		log.WithError(err).Fatal("failed to instantiate build cache")
 	}
+	cache.SetManifestLimit(cfg.ManifestCacheLimit)
+	cache.SetLayerTTL(cfg.LayerCacheTTL)
+	cache.SetNegativeTTL(cfg.NegativeCacheTTL)
 
 	var pop layers.Popularity
 	if cfg.PopUrl != "" {
@@ -256,26 +601,165 @@ func main() {
 		}
 	}
 
+	var bus *events.Bus
+	if cfg.EventsUrl != "" {
+		bus, err = events.New(cfg.EventsUrl)
+		if err != nil {
+			log.WithError(err).Fatal("failed to configure event bus")
+		}
+	}
+	cache.SetEvents(bus)
+
+	var recipients map[string][]*rsa.PublicKey
+	if cfg.RecipientsFile != "" {
+		recipients, err = loadRecipients(cfg.RecipientsFile)
+		if err != nil {
+			log.WithError(err).Fatal("failed to load encryption recipients")
+		}
+	}
+
+	var scanner scan.Scanner
+	if cfg.ScannerUrl != "" {
+		scanner, err = scan.New(cfg.ScannerUrl)
+		if err != nil {
+			log.WithError(err).Fatal("failed to configure malware scanner")
+		}
+		log.WithField("scanner", scanner.Name()).Info("scanning layers before publication")
+	}
+
+	var creds credentials.Provider
+	if cfg.CredentialsUrl != "" {
+		creds, err = credentials.New(cfg.CredentialsUrl)
+		if err != nil {
+			log.WithError(err).Fatal("failed to configure credentials provider")
+		}
+		log.WithField("provider", creds.Name()).Info("passing tenant credentials to Nix")
+	}
+
+	if cfg.Hooks.PreBuild != "" || cfg.Hooks.PostPublish != "" {
+		log.WithFields(log.Fields{
+			"pre-build":    cfg.Hooks.PreBuild,
+			"post-publish": cfg.Hooks.PostPublish,
+			"policy":       cfg.Hooks.Policy,
+		}).Info("invoking build hooks")
+	}
+
+	var replicator *builder.Replicator
+	if len(cfg.ReplicaPeers) > 0 {
+		replicator = builder.NewReplicator(cfg.ReplicaPeers, cfg.ReplicationToken)
+		replicator.Warm(&cache)
+	}
+
 	state := builder.State{
-		Cache:   &cache,
-		Cfg:     cfg,
-		Pop:     pop,
-		Storage: s,
+		Cache:       &cache,
+		Cfg:         cfg,
+		Pop:         pop,
+		Storage:     s,
+		Events:      bus,
+		Recipients:  recipients,
+		Replicator:  replicator,
+		Audit:       builder.NewAuditLog(auditLogSize),
+		Scanner:     scanner,
+		Credentials: creds,
+	}
+
+	// Pinning is only possible for git sources, as the other
+	// sources do not support selecting revisions by tag.
+	if _, ok := cfg.Pkgs.(*config.GitSource); ok {
+		state.Pins = builder.NewPinTracker(cfg.Pin, cfg.PinRolloutWindow)
+	}
+
+	if len(cfg.Quotas) > 0 {
+		state.Quotas = builder.NewQuotaTracker(cfg.Quotas)
+	}
+
+	if cfg.Prefetch {
+		state.Prefetch = builder.NewPrefetcher(&state)
+	}
+
+	if cfg.StoreGCThreshold > 0 {
+		state.StoreGC = builder.NewStoreCollector(cfg.StoreGCThreshold, cfg.StoreGCTarget, cfg.StoreGCProtect, cfg.StoreGCRoots)
+	}
+
+	state.SlowBuilds = builder.NewSlowBuilds(cfg.SlowBuilds)
+	state.Background = builder.NewBackground(cfg.BackgroundWrites)
+
+	state.LayerWorkers, err = builder.NewLayerWorkers(cfg.LayerWorkers, cfg.LayerWorkerMemory)
+	if err != nil {
+		log.WithError(err).Fatal("failed to configure layer workers")
+	}
+
+	state.EvalCgroups, err = builder.NewEvalCgroups(cfg.EvalCgroup, cfg.EvalMemory)
+	if err != nil {
+		log.WithError(err).Fatal("failed to configure memory ceiling of evaluations")
+	}
+
+	if len(cfg.BuilderPools) > 0 {
+		state.Pools, err = builder.NewBuilderPools(cfg.BuilderPools)
+		if err != nil {
+			log.WithError(err).Fatal("failed to configure builder pools")
+		}
 	}
 
+	state.Profiles = builder.NewProfileStore()
+	state.Catalog = builder.NewCatalog()
+	state.Curated, err = builder.NewCuratedImages(cfg.Curated)
+	if err != nil {
+		log.WithError(err).Fatal("failed to configure curated images")
+	}
+
+	state.Invalidations = builder.NewInvalidations()
+	state.Popularity = builder.NewPullPopularity()
+
+	if *export != "" {
+		if err := exportMirror(&state, *export, flag.Args()); err != nil {
+			log.WithError(err).Fatal("failed to export registry mirror")
+		}
+		return
+	}
+
+	if cfg.JournalDir != "" {
+		state.Journal, err = builder.NewBuildJournal(cfg.JournalDir)
+		if err != nil {
+			log.WithError(err).Fatal("failed to open build journal")
+		}
+
+		if err = state.Journal.Recover(context.Background(), &state); err != nil {
+			log.WithError(err).Error("failed to recover interrupted builds")
+		}
+	}
+	state.Scheduler = newScheduler(&state)
+
+	build := builder.ServerBuildInfo()
 	log.WithFields(log.Fields{
-		"version": version,
-		"port":    cfg.Port,
+		"version":  version,
+		"revision": build.Revision,
+		"modified": build.Modified,
+		"go":       build.GoVersion,
+		"port":     cfg.Port,
 	}).Info("starting Nixery")
 
-	// All /v2/ requests belong to the registry handler.
-	http.Handle("/v2/", &registryHandler{
-		state: &state,
-	})
+	state.Scheduler.Start()
 
-	// All other roots are served by the static file server.
-	webDir := http.Dir(cfg.WebDir)
-	http.Handle("/", http.FileServer(webDir))
+	// The listener is opened before serving, so that the self-test
+	// can connect to it right away.
+	listener, err := net.Listen("tcp", ":"+cfg.Port)
+	if err != nil {
+		log.WithError(err).Fatal("failed to listen")
+	}
+
+	if cfg.AdminListen != "" {
+		go func() {
+			log.WithField("address", cfg.AdminListen).Info("serving admin API on separate listener")
+			log.Fatal(http.ListenAndServe(cfg.AdminListen, newAdminHandler(&state)))
+		}()
+	}
 
-	log.Fatal(http.ListenAndServe(":"+cfg.Port, nil))
+	if cfg.SelfTest != "" {
+		runSelfTest(cfg.Port, cfg.SelfTest)
+	}
+
+	if err := serve(listener, newHandler(&state), &state); err != nil {
+		log.WithError(err).Fatal("failed to serve")
+	}
 }
@@ -0,0 +1,118 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements the registry behaviour expected by containerd
+// when Nixery is configured as a mirror host in a hosts.toml file:
+//
+// * requests carry the upstream registry in an `ns` query parameter
+// * the `/v2/` ping must identify the API version and must not ask for credentials
+// * manifests are resolved via HEAD requests and the Docker-Content-Digest header
+// * responses may be gzip-encoded if the client asks for it
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	mf "github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+)
+
+// servePing answers the registry API version check.
+//
+// Unless pull tokens are required, Nixery does not require
+// authentication, so no WWW-Authenticate challenge is sent, which
+// tells clients not to attempt a token exchange.
+func servePing(w http.ResponseWriter) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
+
+// mirrorNamespace returns the upstream registry on whose behalf a
+// request was sent to Nixery as a mirror, if any.
+func mirrorNamespace(r *http.Request) string {
+	return r.URL.Query().Get("ns")
+}
+
+// acceptsIndex reports whether the client accepts OCI image indexes
+// in response to manifest requests.
+func acceptsIndex(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept") {
+		for _, t := range strings.Split(header, ",") {
+			if strings.TrimSpace(strings.Split(t, ";")[0]) == mf.OCIIndexType {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// acceptsGzip reports whether the client accepts gzip-encoded
+// responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(header, ",") {
+			params := strings.Split(coding, ";")
+			if strings.TrimSpace(params[0]) != "gzip" {
+				continue
+			}
+
+			// A quality value of zero explicitly refuses the
+			// encoding.
+			for _, p := range params[1:] {
+				if q := strings.TrimSpace(p); strings.HasPrefix(q, "q=") {
+					if v, err := strconv.ParseFloat(q[2:], 64); err == nil && v == 0 {
+						return false
+					}
+				}
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeManifest writes a manifest response, including the headers
+// clients use to resolve manifests without downloading them.
+//
+// HEAD responses are never encoded, as clients use their
+// Content-Length as the size of the manifest.
+func writeManifest(w http.ResponseWriter, r *http.Request, manifest []byte, digest string) {
+	w.Header().Set("Content-Type", mf.MediaType(manifest))
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	// Tags may point to other manifests over time, so caches must
+	// revalidate them, which is cheap with the digest as the ETag.
+	// Manifests requested by digest never change.
+	etag := `"` + digest + `"`
+	w.Header().Set("ETag", etag)
+	if strings.HasSuffix(r.URL.Path, "/manifests/"+digest) {
+		w.Header().Set("Cache-Control", storage.ImmutableCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if r.Method == "HEAD" || !acceptsGzip(r) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+		w.Write(manifest)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	gz.Write(manifest)
+	gz.Close()
+}
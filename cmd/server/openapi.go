@@ -0,0 +1,188 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file generates the OpenAPI document describing Nixery's own
+// HTTP endpoints (everything except the registry protocol), which is
+// served at `/v1/openapi.json`.
+//
+// The schemas are derived from the Go types in the api package, so the
+// document only has to be updated by hand when routes change.
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/google/nixery/api"
+)
+
+type apiParam struct {
+	name        string
+	in          string // "query" or "path"
+	description string
+}
+
+type apiOperation struct {
+	method      string
+	path        string
+	summary     string
+	params      []apiParam
+	request     interface{} // Value of the request body type, if any
+	response    interface{} // Value of the response body type, if JSON
+	contentType string      // Content type of non-JSON responses
+	auth        string      // Security scheme protecting the operation, if any
+}
+
+var imageParam = apiParam{"image", "query", "Image name, e.g. `shell/git`"}
+var tagParam = apiParam{"tag", "query", "Image tag, defaults to `latest`"}
+var profileNameParam = apiParam{"name", "query", "Name under which the profile is served"}
+var profileTagParam = apiParam{"tag", "query", "Tag under which the profile is served, defaults to `latest`"}
+
+// apiOperations lists all operations served outside of the registry
+// protocol.
+var apiOperations = []apiOperation{
+	{method: "POST", path: "/v1/spec", summary: "Build an image from a spec", params: []apiParam{{"alias", "query", "Create a short alias for the image if `true`, which is required for names longer than 255 characters"}}, request: api.ImageSpec{}, response: api.SpecResponse{}},
+	{method: "POST", path: "/v1/from-paths", summary: "Build an image from raw store paths present in the Nix store", request: api.StorePathsRequest{}, response: api.SpecResponse{}},
+	{method: "GET", path: "/v1/spec/{digest}", summary: "Fetch the spec an image was built from", params: []apiParam{{"digest", "path", "Manifest digest (`sha256:<hex>`)"}}, response: api.ImageSpec{}},
+	{method: "GET", path: "/v1/contents/{digest}", summary: "List the store paths included in an image", params: []apiParam{{"digest", "path", "Manifest digest (`sha256:<hex>`)"}}, response: api.ImageContents{}},
+	{method: "GET", path: "/v1/drift/{digest}", summary: "Compare an image to the current build of its spec", params: []apiParam{{"digest", "path", "Manifest digest (`sha256:<hex>`)"}, {"pin", "query", "Revision of the package set to compare to, defaults to `latest`"}}, response: api.DriftReport{}},
+	{method: "GET", path: "/v1/size", summary: "Report the transfer size of an image, building it if necessary", params: []apiParam{imageParam, tagParam}, response: api.SizeResponse{}},
+	{method: "GET", path: "/v1/explain/{image}", summary: "Explain how the cache key of an image is derived", params: []apiParam{{"image", "path", "Image name, e.g. `shell/git`"}, tagParam}, response: api.CacheKeyExplanation{}},
+	{method: "GET", path: "/v1/replicate", summary: "Snapshot the local cache for a starting replica", response: []api.ReplicationRecord{}, auth: "replication"},
+	{method: "POST", path: "/v1/replicate", summary: "Apply local cache entries of the active instance", request: []api.ReplicationRecord{}, auth: "replication"},
+	{method: "POST", path: "/v1/invalidate", summary: "Invalidate cached resolutions of the package source after it changed", request: api.InvalidateRequest{}, response: api.InvalidateReport{}, auth: "invalidate"},
+	{method: "GET", path: "/v1/pin", summary: "List named pins", response: []api.NamedPin{}},
+	{method: "POST", path: "/v1/pin", summary: "Save the current pin of `latest` (or a revision) under a name usable as a tag, or advance a named pin; requires the admin token or a tenant", request: api.NamedPinRequest{}, response: api.NamedPin{}, auth: "admin"},
+	{method: "DELETE", path: "/v1/pin", summary: "Delete a named pin; requires the admin token or the tenant that created it", params: []apiParam{{"name", "query", "Name of the pin"}}, auth: "admin"},
+	{method: "GET", path: "/v1/curated", summary: "List the curated images synced from the Git repository", response: api.CuratedImages{}},
+	{method: "POST", path: "/v1/curated", summary: "Sync the curated images from the Git repository after it changed", response: api.CuratedImages{}, auth: "invalidate"},
+	{method: "GET", path: "/v1/token", summary: "Exchange a pull token for a bearer token (Docker token authentication)", response: api.TokenResponse{}, auth: "pull"},
+	{method: "GET", path: "/v1/status", summary: "Identify the build of Nixery serving the instance", response: api.Status{}},
+	{method: "GET", path: "/.well-known/nixery.json", summary: "Describe the capabilities of the instance", response: api.Capabilities{}},
+	{method: "GET", path: "/v1/openapi.json", summary: "This document", contentType: "application/json"},
+	{method: "GET", path: "/ready", summary: "Report whether the instance is ready to serve traffic"},
+	{method: "POST", path: "/admin/gc", summary: "Garbage-collect the storage backend", params: []apiParam{{"dry_run", "query", "Only report what would be deleted if `true`"}}, response: api.GCReport{}, auth: "admin"},
+	{method: "GET", path: "/admin/commands", summary: "List recent Nix invocations", params: []apiParam{{"image", "query", "Only list invocations for this image"}}, response: []api.CommandRecord{}, auth: "admin"},
+	{method: "GET", path: "/admin/logging", summary: "Return the logging settings", response: api.LoggingSettings{}, auth: "admin"},
+	{method: "PUT", path: "/admin/logging", summary: "Change the logging settings", request: api.LoggingSettings{}, response: api.LoggingSettings{}, auth: "admin"},
+	{method: "GET", path: "/admin/usage", summary: "Report the storage usage of each tenant", response: map[string]api.Usage{}, auth: "admin"},
+	{method: "GET", path: "/admin/storage-operations", summary: "Count storage backend calls by operation and object class", response: api.StorageOperations{}, auth: "admin"},
+	{method: "GET", path: "/admin/tasks", summary: "Report the status of periodic background tasks", response: api.SchedulerStatus{}, auth: "admin"},
+	{method: "GET", path: "/admin/cache", summary: "Report the contents and disk usage of the local cache", response: api.CacheStats{}, auth: "admin"},
+	{method: "GET", path: "/admin/store", summary: "Report the disk usage of the Nix store", response: api.StoreUsage{}, auth: "admin"},
+	{method: "POST", path: "/admin/store", summary: "Collect garbage in the Nix store", response: api.StoreUsage{}, auth: "admin"},
+	{method: "GET", path: "/admin/builder-pools", summary: "Report the health and usage of remote builder pools", response: []api.BuilderPoolStatus{}, auth: "admin"},
+	{method: "GET", path: "/admin/pin", summary: "Return the pin of the `latest` tag", response: api.PinStatus{}, auth: "admin"},
+	{method: "PUT", path: "/admin/pin", summary: "Advance the pin of the `latest` tag", request: api.PinRequest{}, response: api.PinStatus{}, auth: "admin"},
+	{method: "POST", path: "/admin/promote", summary: "Promote cached images from another environment", request: api.PromoteRequest{}, response: api.PromoteReport{}, auth: "admin"},
+	{method: "GET", path: "/admin/profiles", summary: "List imported profiles", response: []api.Profile{}, auth: "admin"},
+	{method: "POST", path: "/admin/profiles", summary: "Import an image from another registry, or from an OCI archive in the request body", params: []apiParam{profileNameParam, profileTagParam, {"from", "query", "Registry reference to import, e.g. `docker.io/library/alpine:3.19`"}, {"arch", "query", "Architecture imported from multi-platform images, defaults to `amd64`"}}, response: api.Profile{}, auth: "admin"},
+	{method: "DELETE", path: "/admin/profiles", summary: "Delete an imported profile", params: []apiParam{profileNameParam, profileTagParam}, auth: "admin"},
+	{method: "GET", path: "/admin/popularity", summary: "Report the package popularity derived from access logs", response: api.PopularityStatus{}, auth: "admin"},
+	{method: "POST", path: "/admin/popularity", summary: "Count the image pulls in the access log in the request body", params: []apiParam{{"replace", "query", "Replace the previous counts instead of adding to them"}}, response: api.PopularityReport{}, auth: "admin"},
+	{method: "DELETE", path: "/admin/popularity", summary: "Discard the package popularity derived from access logs", auth: "admin"},
+	{method: "POST", path: "/admin/pull-tokens", summary: "Mint a short-lived token for pulling an image", request: api.PullTokenRequest{}, response: api.PullToken{}, auth: "admin"},
+	{method: "GET", path: "/admin/support-bundle", summary: "Download a support bundle", params: []apiParam{{"image", "query", "Include failed builds of this image"}}, contentType: "application/gzip", auth: "admin"},
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  map[string]interface{}
+)
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+// openAPIDocument generates the OpenAPI document from the operations
+// listed above.
+func openAPIDocument() map[string]interface{} {
+	schemas := make(map[string]interface{})
+
+	// Errors use the format of the registry protocol.
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content":     jsonContent(api.Schema(reflect.TypeOf(registryErrors{}), schemas)),
+	}
+
+	paths := make(map[string]interface{})
+	for _, op := range apiOperations {
+		ok := map[string]interface{}{"description": "Success"}
+		if op.response != nil {
+			ok["content"] = jsonContent(api.Schema(reflect.TypeOf(op.response), schemas))
+		} else if op.contentType != "" {
+			ok["content"] = map[string]interface{}{op.contentType: map[string]interface{}{}}
+		}
+
+		operation := map[string]interface{}{
+			"summary":     op.summary,
+			"operationId": strings.ToLower(op.method) + strings.NewReplacer("/", "_", "{", "", "}", "", ".", "_").Replace(op.path),
+			"responses": map[string]interface{}{
+				"200":     ok,
+				"default": errorResponse,
+			},
+		}
+
+		var params []interface{}
+		for _, p := range op.params {
+			params = append(params, map[string]interface{}{
+				"name":        p.name,
+				"in":          p.in,
+				"required":    p.in == "path",
+				"description": p.description,
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+
+		if op.request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(api.Schema(reflect.TypeOf(op.request), schemas)),
+			}
+		}
+
+		if op.auth != "" {
+			operation["security"] = []interface{}{map[string]interface{}{op.auth: []string{}}}
+		}
+
+		if _, ok := paths[op.path]; !ok {
+			paths[op.path] = make(map[string]interface{})
+		}
+		paths[op.path].(map[string]interface{})[strings.ToLower(op.method)] = operation
+	}
+
+	bearer := map[string]interface{}{"type": "http", "scheme": "bearer"}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Nixery extended API",
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"admin":       bearer,
+				"replication": bearer,
+				"invalidate":  bearer,
+				"pull":        map[string]interface{}{"type": "http", "scheme": "basic"},
+			},
+		},
+	}
+}
+
+// serveOpenAPI serves the OpenAPI document, which is generated once.
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIDoc = openAPIDocument()
+	})
+
+	writeJSON(w, 200, openAPIDoc)
+}
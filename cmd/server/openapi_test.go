@@ -0,0 +1,44 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestOpenAPIRoutes checks that every operation in the OpenAPI
+// document is routed to a handler, and that all referenced schemas are
+// defined.
+func TestOpenAPIRoutes(t *testing.T) {
+	state, _ := conformanceState(t)
+	state.Cfg.AdminToken = "token"
+	state.Cfg.WebDir = t.TempDir()
+	handler := newHandler(state)
+
+	for _, op := range apiOperations {
+		path := strings.NewReplacer("{digest}", "sha256:"+strings.Repeat("0", 64), "{image}", "hello").Replace(op.path)
+		req := httptest.NewRequest(op.method, path, strings.NewReader(""))
+		req.Header.Set("Authorization", "Bearer token")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		var errs registryErrors
+		json.Unmarshal(w.Body.Bytes(), &errs)
+		if len(errs.Errors) > 0 && errs.Errors[0].Code == "UNSUPPORTED" {
+			t.Errorf("%s %s is documented but not routed: %s", op.method, op.path, w.Body)
+		}
+	}
+
+	doc, _ := json.Marshal(openAPIDocument())
+	schemas := openAPIDocument()["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	for _, ref := range regexp.MustCompile(`#/components/schemas/(\w+)`).FindAllStringSubmatch(string(doc), -1) {
+		if _, ok := schemas[ref[1]]; !ok {
+			t.Errorf("schema %s is referenced but not defined", ref[1])
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/google/nixery/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// Locations of the system CA bundle that are checked (in order) when
+// combining it with a custom bundle for Nix.
+var systemBundles = []string{
+	os.Getenv("NIX_SSL_CERT_FILE"),
+	os.Getenv("SSL_CERT_FILE"),
+	"/etc/ssl/certs/ca-bundle.crt",
+	"/etc/ssl/certs/ca-certificates.crt",
+}
+
+// configureOutbound applies the outbound traffic configuration to the
+// default HTTP transport, which is used by all HTTP clients in Nixery
+// (including the ones constructed by the storage SDKs), and to the
+// environment inherited by Nix and git.
+//
+// This must be called before any storage backends or other HTTP
+// clients are constructed.
+func configureOutbound(o config.Outbound) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if o.CABundle != "" {
+		pem, err := ioutil.ReadFile(o.CABundle)
+		if err != nil {
+			return err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in CA bundle %s", o.CABundle)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+
+		if err := configureNixCAs(pem); err != nil {
+			return err
+		}
+
+		log.WithField("bundle", o.CABundle).Info("trusting additional CA certificates")
+	}
+
+	if len(o.ProxyRules) > 0 {
+		rules := o.ProxyRules
+		transport.Proxy = func(r *http.Request) (*url.URL, error) {
+			host := r.URL.Hostname()
+			for _, rule := range rules {
+				if rule.Matches(host) {
+					return rule.Proxy, nil
+				}
+			}
+
+			return http.ProxyFromEnvironment(r)
+		}
+
+		log.WithField("rules", len(rules)).Info("configured outbound proxy rules")
+	}
+
+	http.DefaultTransport = transport
+	return nil
+}
+
+// configureNixCAs writes a CA bundle combining the system CAs with the
+// custom ones and points Nix and git at it.
+//
+// Both of these only support a single bundle file, so simply pointing
+// them at the custom bundle would lose the system CAs.
+func configureNixCAs(custom []byte) error {
+	var combined []byte
+	for _, path := range systemBundles {
+		if path == "" {
+			continue
+		}
+
+		if system, err := ioutil.ReadFile(path); err == nil {
+			combined = append(system, '\n')
+			break
+		}
+	}
+	combined = append(combined, custom...)
+
+	// The bundle is written to a new file with an unpredictable
+	// name, as other users could otherwise plant their own CAs in
+	// a shared temporary directory.
+	f, err := ioutil.TempFile("", "nixery-ca-bundle-*.crt")
+	if err != nil {
+		return fmt.Errorf("failed to create combined CA bundle: %s", err)
+	}
+
+	_, err = f.Write(combined)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write combined CA bundle: %s", err)
+	}
+
+	os.Setenv("NIX_SSL_CERT_FILE", f.Name())
+	os.Setenv("GIT_SSL_CAINFO", f.Name())
+
+	return nil
+}
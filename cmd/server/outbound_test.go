@@ -0,0 +1,50 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigureNixCAs(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	t.Setenv("NIX_SSL_CERT_FILE", "")
+	t.Setenv("GIT_SSL_CAINFO", "")
+
+	// A file planted under a predictable name must not be used.
+	planted := filepath.Join(dir, "nixery-ca-bundle.crt")
+	if err := ioutil.WriteFile(planted, []byte("planted"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	custom := []byte("-----BEGIN CERTIFICATE-----\ncustom\n-----END CERTIFICATE-----\n")
+	if err := configureNixCAs(custom); err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("NIX_SSL_CERT_FILE")
+	if path == "" || path == planted || os.Getenv("GIT_SSL_CAINFO") != path {
+		t.Fatalf("unexpected CA bundle paths %q and %q", path, os.Getenv("GIT_SSL_CAINFO"))
+	}
+
+	bundle, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(bundle, custom) {
+		t.Error("custom CAs are missing from the combined bundle")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		t.Errorf("combined bundle is writable by other users: %s", info.Mode())
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements short-lived pull tokens, which grant access to
+// a single image repository until they expire. They are minted through
+// the admin API and can be handed to ephemeral jobs (e.g. in CI) in
+// place of long-lived registry credentials.
+//
+// Tokens are signed with the key configured in NIXERY_PULL_TOKEN_KEY
+// and are not stored anywhere, which means that all replicas sharing
+// the key accept them. Once a key is configured, all registry requests
+// require a token, unless the registry is in hybrid mode.
+//
+// Clients supply tokens as bearer tokens, or as the password of basic
+// authentication (e.g. after `docker login`). For the latter, the
+// registry challenges clients to fetch a bearer token from
+// `/v1/token`, as the Docker token authentication flow expects.
+//
+// In hybrid mode, requests without a token are served anonymously.
+// Only the ping at `/v2/` challenges them, which makes `docker login`
+// verify the supplied credentials, while anonymous clients following
+// the challenge receive a token granting access to all images.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// Lifetimes of pull tokens.
+const (
+	defaultPullTokenTTL = 15 * time.Minute
+	maxPullTokenTTL     = 24 * time.Hour
+)
+
+var errInvalidPullToken = errors.New("invalid pull token")
+
+// pullTokenClaims is the signed payload of a pull token. Tokens
+// without an image grant access to all images.
+type pullTokenClaims struct {
+	Image   string `json:"image"`
+	Expires int64  `json:"exp"`
+}
+
+// canonicalRepository normalises the order of the components of a
+// repository name, which does not affect the image it refers to.
+func canonicalRepository(name string) string {
+	components := strings.Split(name, "/")
+	sort.Strings(components)
+	return strings.Join(components, "/")
+}
+
+func signPullToken(key, payload []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// mintPullToken creates a token granting access to an image until it
+// expires.
+func mintPullToken(key []byte, image string, expires time.Time) string {
+	payload, _ := json.Marshal(pullTokenClaims{
+		Image:   canonicalRepository(image),
+		Expires: expires.Unix(),
+	})
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + signPullToken(key, payload)
+}
+
+// verifyPullToken checks the signature and expiry of a token and
+// returns its claims.
+func verifyPullToken(key []byte, token string) (*pullTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errInvalidPullToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || !hmac.Equal([]byte(signPullToken(key, payload)), []byte(parts[1])) {
+		return nil, errInvalidPullToken
+	}
+
+	var claims pullTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidPullToken
+	}
+
+	if time.Now().Unix() >= claims.Expires {
+		return nil, fmt.Errorf("%w: token expired", errInvalidPullToken)
+	}
+
+	return &claims, nil
+}
+
+// suppliedToken returns the token supplied with a request, either as a
+// bearer token or as the password of basic authentication.
+func suppliedToken(r *http.Request) string {
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// challenge asks clients to authenticate, pointing them at the token
+// endpoint.
+func challenge(w http.ResponseWriter, r *http.Request, cfg *config.Config, scope string) {
+	value := fmt.Sprintf(`Bearer realm="%s/v1/token",service="nixery"`, externalURL(cfg, r))
+	if scope != "" {
+		value += fmt.Sprintf(`,scope="repository:%s:pull"`, scope)
+	}
+
+	w.Header().Set("WWW-Authenticate", value)
+	writeError(w, 401, "UNAUTHORIZED", "a valid pull token is required")
+}
+
+// requirePullTokens wraps the registry handler with the verification
+// of pull tokens. It is not applied to anonymous registries.
+func requirePullTokens(cfg *config.Config, h http.Handler) http.Handler {
+	mode, key := cfg.RegistryAuth, []byte(cfg.PullTokenKey)
+	if mode != config.AuthPullToken && mode != config.AuthHybrid {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var repository string
+		if m := manifestRegex.FindStringSubmatch(r.URL.Path); len(m) == 3 {
+			repository = m[1]
+		} else if m := blobRegex.FindStringSubmatch(r.URL.Path); len(m) == 4 {
+			repository = m[1]
+		} else if m := tagsRegex.FindStringSubmatch(r.URL.Path); m != nil {
+			repository = m[1]
+		}
+
+		token := suppliedToken(r)
+		if token == "" {
+			if mode == config.AuthHybrid && r.URL.Path != "/v2/" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			challenge(w, r, cfg, repository)
+			return
+		}
+
+		claims, err := verifyPullToken(key, token)
+		if err == nil && repository != "" && claims.Image != "" && claims.Image != canonicalRepository(repository) {
+			err = fmt.Errorf("%w: token does not grant access to %s", errInvalidPullToken, repository)
+		}
+
+		// Tokens for a single image do not reveal the other images.
+		if err == nil && r.URL.Path == "/v2/_catalog" && claims.Image != "" {
+			err = fmt.Errorf("%w: token does not grant access to the catalog", errInvalidPullToken)
+		}
+
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"client": clientIP(r),
+				"uri":    r.RequestURI,
+			}).Warn("rejected registry request with invalid pull token")
+
+			challenge(w, r, cfg, repository)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveToken implements the token endpoint of the Docker token
+// authentication flow. The pull token supplied by the client is
+// returned as the bearer token after it has been verified, as it
+// already carries its scope.
+//
+// Clients logging in with the admin token, and anonymous clients of a
+// hybrid registry, receive a token granting access to all images.
+func (h *apiHandler) serveToken(w http.ResponseWriter, r *http.Request) {
+	key := []byte(h.state.Cfg.PullTokenKey)
+	if len(key) == 0 {
+		writeError(w, 400, "INVALID_REQUEST", "pull tokens are not enabled")
+		return
+	}
+
+	token := suppliedToken(r)
+	admin := h.state.Cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.state.Cfg.AdminToken)) == 1
+	if admin || (token == "" && h.state.Cfg.RegistryAuth == config.AuthHybrid) {
+		token = mintPullToken(key, "", time.Now().Add(defaultPullTokenTTL))
+	}
+
+	claims, err := verifyPullToken(key, token)
+	if err != nil {
+		writeError(w, 401, "UNAUTHORIZED", err.Error())
+		return
+	}
+
+	expires := time.Unix(claims.Expires, 0)
+	writeJSON(w, 200, api.TokenResponse{
+		Token:       token,
+		AccessToken: token,
+		ExpiresIn:   int(time.Until(expires).Seconds()),
+	})
+}
+
+// servePullTokens mints a pull token for the image in the request.
+func (h *adminHandler) servePullTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, 405, "UNSUPPORTED", "pull tokens must be minted with POST")
+		return
+	}
+
+	key := []byte(h.state.Cfg.PullTokenKey)
+	if len(key) == 0 {
+		writeError(w, 400, "INVALID_REQUEST", "pull tokens are not enabled")
+		return
+	}
+
+	var req api.PullTokenRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if !manifestRegex.MatchString("/v2/" + req.Image + "/manifests/latest") {
+		writeError(w, 400, "INVALID_REQUEST", "invalid image name")
+		return
+	}
+
+	ttl := defaultPullTokenTTL
+	if req.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 || ttl > maxPullTokenTTL {
+			writeError(w, 400, "INVALID_REQUEST", fmt.Sprintf("ttl must be a duration of at most %s", maxPullTokenTTL))
+			return
+		}
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	log.WithFields(log.Fields{
+		"image":   req.Image,
+		"expires": expires,
+		"client":  clientIP(r),
+	}).Info("minted pull token")
+
+	writeJSON(w, 200, api.PullToken{
+		Token:   mintPullToken(key, req.Image, expires),
+		Image:   canonicalRepository(req.Image),
+		Expires: expires,
+	})
+}
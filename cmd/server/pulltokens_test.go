@@ -0,0 +1,97 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/nixery/config"
+)
+
+func TestPullTokens(t *testing.T) {
+	key := []byte("secret")
+	token := mintPullToken(key, "shell/git", time.Now().Add(time.Minute))
+
+	claims, err := verifyPullToken(key, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Image != "git/shell" {
+		t.Errorf("expected canonical repository name, got %s", claims.Image)
+	}
+
+	if _, err := verifyPullToken([]byte("other"), token); !errors.Is(err, errInvalidPullToken) {
+		t.Errorf("expected token signed with another key to be rejected, got %v", err)
+	}
+
+	expired := mintPullToken(key, "shell/git", time.Now().Add(-time.Second))
+	if _, err := verifyPullToken(key, expired); !errors.Is(err, errInvalidPullToken) {
+		t.Errorf("expected expired token to be rejected, got %v", err)
+	}
+
+	handler := requirePullTokens(&config.Config{RegistryAuth: config.AuthPullToken, PullTokenKey: string(key)}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	for path, expected := range map[string]int{
+		"/v2/git/shell/manifests/latest":  200,
+		"/v2/shell/htop/manifests/latest": 401,
+		"/v2/shell/git/tags/list":         200,
+		"/v2/shell/htop/tags/list":        401,
+		"/v2/_catalog":                    401,
+	} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.SetBasicAuth("token", token)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("expected status %d for %s, got %d", expected, path, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v2/", nil))
+	if w.Code != 401 || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("expected unauthenticated ping to be challenged, got %d", w.Code)
+	}
+}
+
+func TestHybridRegistryAuth(t *testing.T) {
+	key := []byte("secret")
+	handler := requirePullTokens(&config.Config{RegistryAuth: config.AuthHybrid, PullTokenKey: string(key)}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	serve := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.SetBasicAuth("token", token)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve("/v2/shell/htop/manifests/latest", ""); w.Code != 200 {
+		t.Errorf("expected anonymous pull to be served, got %d", w.Code)
+	}
+
+	if w := serve("/v2/", ""); w.Code != 401 || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("expected unauthenticated ping to be challenged, got %d", w.Code)
+	}
+
+	if w := serve("/v2/", "invalid"); w.Code != 401 {
+		t.Errorf("expected ping with invalid credentials to be rejected, got %d", w.Code)
+	}
+
+	anonymous := mintPullToken(key, "", time.Now().Add(time.Minute))
+	if w := serve("/v2/shell/htop/manifests/latest", anonymous); w.Code != 200 {
+		t.Errorf("expected token without image to grant access to all images, got %d", w.Code)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements the optional startup self-test, which pulls an
+// image through Nixery's own HTTP listener before the instance reports
+// itself as ready. This catches misconfigurations (e.g. of the package
+// source, Nix or the storage backend) before real traffic is served.
+//
+// Readiness is reported on `/ready`, which load balancers and
+// orchestrators should use instead of probing the registry routes.
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mf "github.com/google/nixery/manifest"
+	log "github.com/sirupsen/logrus"
+)
+
+// Time allowed for the self-test, including the image build.
+const selfTestTimeout = 10 * time.Minute
+
+// ready is set once the instance can serve traffic. It is only unset
+// while a startup self-test is pending.
+var ready int32 = 1
+
+func serveReady(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&ready) == 0 {
+		writeError(w, 503, "UNAVAILABLE", "self-test has not completed")
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+// selfTest pulls an image from the registry at the given base URL, and
+// verifies the digests of its manifest and all referenced blobs.
+func selfTest(base, image string) error {
+	client := &http.Client{Timeout: selfTestTimeout}
+
+	fetch := func(path string, accept ...string) ([]byte, *http.Response, error) {
+		req, err := http.NewRequest("GET", base+path, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+			return nil, nil, fmt.Errorf("GET %s returned %d: %s", path, resp.StatusCode, body)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		return body, resp, err
+	}
+
+	manifest, resp, err := fetch("/v2/"+image+"/manifests/latest", mf.ManifestType, mf.OCIManifestType)
+	if err != nil {
+		return err
+	}
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+	if header := resp.Header.Get("Docker-Content-Digest"); header != digest {
+		return fmt.Errorf("manifest digest %q does not match its content (%s)", header, digest)
+	}
+
+	refs, err := mf.References(manifest)
+	if err != nil {
+		return fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	for _, ref := range refs {
+		blob, _, err := fetch("/v2/" + image + "/blobs/" + ref)
+		if err != nil {
+			return err
+		}
+
+		if sum := fmt.Sprintf("sha256:%x", sha256.Sum256(blob)); sum != ref {
+			return fmt.Errorf("blob %s has unexpected digest %s", ref, sum)
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"image":  image,
+		"digest": digest,
+		"blobs":  len(refs),
+	}).Info("startup self-test succeeded")
+
+	return nil
+}
+
+// runSelfTest runs the self-test against the local listener once it is
+// up, and marks the instance as ready if it succeeds. A failing
+// self-test terminates the process.
+func runSelfTest(port, image string) {
+	atomic.StoreInt32(&ready, 0)
+	image = strings.Trim(image, "/")
+
+	go func() {
+		log.WithField("image", image).Info("running startup self-test")
+
+		if err := selfTest("http://localhost:"+port, image); err != nil {
+			log.WithError(err).WithField("image", image).Fatal("startup self-test failed")
+		}
+
+		atomic.StoreInt32(&ready, 1)
+	}()
+}
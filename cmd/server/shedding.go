@@ -0,0 +1,83 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements load shedding for registry requests. Once the
+// configured number of requests is in flight, further requests are
+// rejected immediately instead of queueing up behind slow builds.
+//
+// Requests that may trigger a build (manifests by tag) can only use
+// part of the capacity, which keeps the remainder available for blob
+// and manifest-by-digest requests. These are cheap to serve and are
+// what clients pulling already-built images need.
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Number of seconds clients are asked to wait before retrying a shed
+// request.
+const retryAfter = "5"
+
+type loadShedder struct {
+	inflight int64
+
+	// Maximum number of requests in flight
+	limit int64
+
+	// Maximum number of requests in flight at which new builds are
+	// still accepted
+	buildLimit int64
+}
+
+// shedLoad wraps a handler with an in-flight request limit. A limit
+// of zero disables load shedding.
+func shedLoad(limit int, h http.Handler) http.Handler {
+	if limit <= 0 {
+		return h
+	}
+
+	// A quarter of the capacity is reserved for requests that do not
+	// build, but at least one slot must remain for builds.
+	reserved := limit / 4
+	if reserved == 0 && limit > 1 {
+		reserved = 1
+	}
+
+	s := &loadShedder{
+		limit:      int64(limit),
+		buildLimit: int64(limit - reserved),
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := s.limit
+		if isBuildRequest(r) {
+			limit = s.buildLimit
+		}
+
+		if atomic.AddInt64(&s.inflight, 1) > limit {
+			atomic.AddInt64(&s.inflight, -1)
+
+			log.WithFields(log.Fields{
+				"uri":    r.RequestURI,
+				"client": clientIP(r),
+			}).Warn("server overloaded, shedding request")
+
+			w.Header().Set("Retry-After", retryAfter)
+			writeError(w, 503, "UNAVAILABLE", "server is overloaded, retry later")
+			return
+		}
+		defer atomic.AddInt64(&s.inflight, -1)
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isBuildRequest reports whether a registry request may trigger an
+// image build.
+func isBuildRequest(r *http.Request) bool {
+	return manifestRegex.MatchString(r.URL.Path)
+}
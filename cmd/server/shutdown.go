@@ -0,0 +1,59 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements the graceful shutdown of the server. When the
+// process is asked to terminate, requests that are in flight and the
+// background tasks they started (such as cache writes) are given time
+// to finish, so that no cache entries are lost on deployments.
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/google/nixery/builder"
+	log "github.com/sirupsen/logrus"
+)
+
+// Time allowed for requests and background tasks to finish on
+// shutdown, which is below the default grace period of Kubernetes.
+const shutdownTimeout = 25 * time.Second
+
+// serve serves requests on the listener until the process receives
+// SIGTERM or SIGINT, and then shuts down gracefully.
+func serve(listener net.Listener, handler http.Handler, state *builder.State) error {
+	server := &http.Server{Handler: handler}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		log.WithField("signal", sig.String()).Info("shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("requests did not finish before shutdown")
+	}
+
+	if err := state.Background.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("background tasks did not finish before shutdown")
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements the generation of support bundles, which
+// collect the information typically needed to debug a problem with a
+// Nixery instance into a single tarball that can be attached to bug
+// reports.
+//
+// Secrets are redacted from all contents of the bundle.
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/google/nixery/builder"
+	"github.com/google/nixery/config"
+	"github.com/google/nixery/logs"
+	"github.com/google/nixery/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+var started = time.Now()
+
+type storageCheck struct {
+	Backend  string  `json:"backend"`
+	Step     string  `json:"step"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"durationSeconds"`
+}
+
+// checkStorage writes, reads and deletes a probe object in the storage
+// backend and reports the first step that failed, if any.
+func checkStorage(ctx context.Context, state *builder.State) storageCheck {
+	start := time.Now()
+	check := storageCheck{Backend: state.Storage.Name()}
+	path := fmt.Sprintf("support/probe-%d", start.UnixNano())
+	probe := []byte("nixery support bundle probe")
+
+	check.Step = "persist"
+	_, _, err := state.Storage.Persist(ctx, path, "text/plain", func(w io.Writer) (string, int64, error) {
+		n, err := w.Write(probe)
+		return "", int64(n), err
+	})
+
+	if err == nil {
+		check.Step = "fetch"
+		var r io.ReadCloser
+		if r, err = state.Storage.Fetch(ctx, path); err == nil {
+			var content []byte
+			content, err = ioutil.ReadAll(r)
+			r.Close()
+
+			if err == nil && !bytes.Equal(content, probe) {
+				err = fmt.Errorf("probe object content does not match")
+			}
+		}
+	}
+
+	if err == nil {
+		check.Step = "delete"
+		err = state.Storage.Delete(ctx, path)
+	}
+
+	if err != nil {
+		check.Error = err.Error()
+	} else {
+		check.Step = "complete"
+	}
+
+	check.Duration = time.Since(start).Seconds()
+	return check
+}
+
+// redactConfig returns the configuration with all secrets removed.
+func redactConfig(cfg config.Config) []byte {
+	if cfg.AdminToken != "" {
+		cfg.AdminToken = "<redacted>"
+	}
+
+	if cfg.ReplicationToken != "" {
+		cfg.ReplicationToken = "<redacted>"
+	}
+
+	if cfg.InvalidateToken != "" {
+		cfg.InvalidateToken = "<redacted>"
+	}
+	if cfg.PullTokenKey != "" {
+		cfg.PullTokenKey = "<redacted>"
+	}
+
+	j, _ := json.MarshalIndent(cfg, "", "  ")
+	return []byte(builder.RedactCredentials(string(j)))
+}
+
+// failedCommands returns the recorded Nix invocations that failed,
+// optionally restricted to a single image.
+func failedCommands(state *builder.State, image string) []builder.CommandRecord {
+	failed := []builder.CommandRecord{}
+	for _, r := range state.Audit.Records(image) {
+		if r.ExitCode != 0 {
+			failed = append(failed, r)
+		}
+	}
+
+	return failed
+}
+
+func addFile(tw *tar.Writer, name string, content []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    "nixery-support/" + name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tw.Write(content)
+	return err
+}
+
+func asJSON(v interface{}) []byte {
+	j, _ := json.MarshalIndent(v, "", "  ")
+	return j
+}
+
+// serveSupportBundle streams a support bundle as a gzipped tarball.
+// The failed Nix invocations included in it can be restricted to a
+// single image with `?image=<name>`.
+func (h *adminHandler) serveSupportBundle(w http.ResponseWriter, r *http.Request) {
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{"version.json", asJSON(map[string]interface{}{
+			"version":       version,
+			"go":            runtime.Version(),
+			"build":         builder.ServerBuildInfo(),
+			"uptimeSeconds": time.Since(started).Seconds(),
+		})},
+		{"config.json", redactConfig(h.state.Cfg)},
+		{"cache.json", asJSON(h.state.Cache.Stats())},
+		{"storage.json", asJSON(checkStorage(r.Context(), h.state))},
+		{"storage-operations.json", asJSON(storage.Operations())},
+		{"failed-builds.json", asJSON(failedCommands(h.state, r.URL.Query().Get("image")))},
+		{"logs.json", []byte(builder.RedactCredentials(string(logs.Recent())))},
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=nixery-support-%d.tar.gz", time.Now().Unix()))
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, f := range files {
+		if err := addFile(tw, f.name, f.content); err != nil {
+			log.WithError(err).WithField("file", f.name).Error("failed to write support bundle")
+			return
+		}
+	}
+
+	tw.Close()
+	gz.Close()
+
+	log.WithField("client", clientIP(r)).Info("generated support bundle")
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// This file implements the well-known document describing the
+// capabilities of the instance (`/.well-known/nixery.json`), which lets
+// CLI tooling and CI plugins adapt to it without configuration.
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/builder"
+	"github.com/google/nixery/config"
+)
+
+// capabilities describes the features enabled by the configuration of
+// an instance.
+func capabilities(state *builder.State) api.Capabilities {
+	cfg := &state.Cfg
+
+	c := api.Capabilities{
+		Version:        version,
+		GrammarVersion: builder.NameGrammarVersion,
+		Platforms:      builder.Platforms,
+		MetaPackages:   builder.MetaPackages,
+		MaxLayers:      builder.LayerBudget + 1, // including the symlink layer
+		Auth:           []string{"anonymous"},
+		TenantHeader:   cfg.TenantHeader,
+		Features:       []string{"image-specs", "image-contents", "image-ttl"},
+	}
+
+	switch cfg.RegistryAuth {
+	case config.AuthPullToken:
+		c.Auth = []string{"pull-token"}
+	case config.AuthHybrid:
+		c.Auth = []string{"anonymous", "pull-token"}
+	}
+
+	optional := map[string]bool{
+		"async-builds":   cfg.AsyncBuildWait > 0,
+		"package-flags":  len(cfg.Overrides) > 0,
+		"package-groups": len(cfg.Groups) > 0,
+		"aliases":        len(cfg.Aliases) > 0,
+		"encryption":     len(state.Recipients) > 0,
+		"pinning":        state.Pins != nil,
+		"quotas":         state.Quotas != nil,
+		"emulation":      !cfg.DisableEmulation,
+		"invalidation":   cfg.InvalidateToken != "",
+		"sbom":           cfg.SBOM,
+		"curated-images": state.Curated != nil,
+		"namespaces":     len(cfg.Namespaces) > 0,
+		"from-paths":     cfg.FromPaths,
+		"multi-arch":     cfg.MultiArch,
+		"builder-pools":  state.Pools != nil,
+	}
+	for feature, enabled := range optional {
+		if enabled {
+			c.Features = append(c.Features, feature)
+		}
+	}
+	sort.Strings(c.Features)
+
+	return c
+}
+
+func serveCapabilities(state *builder.State) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeError(w, 405, "UNSUPPORTED", "unsupported method")
+			return
+		}
+
+		writeJSON(w, 200, capabilities(state))
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// aliasesFromEnv reads the image aliases from the JSON file configured
+// in NIXERY_ALIASES, which maps alias names to the image names they
+// stand for, for example:
+//
+//	{ "golang": "shell/go_1_22/git" }
+func aliasesFromEnv() (map[string]string, error) {
+	path := os.Getenv("NIXERY_ALIASES")
+	if path == "" {
+		return nil, nil
+	}
+
+	j, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NIXERY_ALIASES: %s", err)
+	}
+
+	var aliases map[string]string
+	if err := json.Unmarshal(j, &aliases); err != nil {
+		return nil, fmt.Errorf("invalid NIXERY_ALIASES: %s", err)
+	}
+
+	for alias, target := range aliases {
+		if alias == "" || strings.Trim(target, "/") == "" {
+			return nil, fmt.Errorf("invalid alias %q for %q", alias, target)
+		}
+
+		// Aliases are resolved once, chains would silently
+		// resolve to another alias.
+		if _, ok := aliases[strings.SplitN(target, "/", 2)[0]]; ok {
+			return nil, fmt.Errorf("alias %q refers to another alias (%q)", alias, target)
+		}
+	}
+
+	return aliases, nil
+}
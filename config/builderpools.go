@@ -0,0 +1,72 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// BuilderPool is a pool of remote Nix builders to which the builds of
+// images for one platform are delegated, instead of building them on
+// the instance itself.
+type BuilderPool struct {
+	Platform    string   `json:"-"`           // Platform whose images are built by the pool, e.g. `linux/arm64`
+	Builders    []string `json:"builders"`    // Store URIs of the builders, e.g. `ssh-ng://nix@arm64-1.internal`
+	SSHKey      string   `json:"sshKey"`      // SSH identity used to connect to the builders
+	MaxJobs     int      `json:"maxJobs"`     // Derivations built at once by each builder (default 1)
+	Concurrency int      `json:"concurrency"` // Image builds running on the pool at once (default: builders × maxJobs)
+	MaxQueue    int      `json:"maxQueue"`    // Image builds waiting for the pool above which builds are rejected (0 = unlimited)
+}
+
+// builderPoolsFromEnv reads the remote builder pools from the JSON file
+// configured in NIXERY_BUILDER_POOLS, which maps platforms to their
+// pools, for example:
+//
+//	{ "linux/arm64": { "builders": ["ssh-ng://nix@arm64-1"], "sshKey": "/secrets/builder-key", "maxJobs": 4 } }
+//
+// Platforms are validated by the builder, which knows the supported
+// platforms.
+func builderPoolsFromEnv() (map[string]BuilderPool, error) {
+	path := os.Getenv("NIXERY_BUILDER_POOLS")
+	if path == "" {
+		return nil, nil
+	}
+
+	j, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NIXERY_BUILDER_POOLS: %s", err)
+	}
+
+	var pools map[string]BuilderPool
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&pools); err != nil {
+		return nil, fmt.Errorf("invalid NIXERY_BUILDER_POOLS: %s", err)
+	}
+
+	for platform, pool := range pools {
+		if len(pool.Builders) == 0 {
+			return nil, fmt.Errorf("invalid NIXERY_BUILDER_POOLS: pool of %s has no builders", platform)
+		}
+
+		if pool.MaxJobs < 0 || pool.Concurrency < 0 || pool.MaxQueue < 0 {
+			return nil, fmt.Errorf("invalid NIXERY_BUILDER_POOLS: limits of %s must not be negative", platform)
+		}
+
+		if pool.MaxJobs == 0 {
+			pool.MaxJobs = 1
+		}
+		if pool.Concurrency == 0 {
+			pool.Concurrency = len(pool.Builders) * pool.MaxJobs
+		}
+
+		pool.Platform = platform
+		pools[platform] = pool
+	}
+
+	return pools, nil
+}
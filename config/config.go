@@ -7,8 +7,16 @@
 package config
 
 import (
+	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/google/nixery/manifest"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -32,6 +40,8 @@ type Backend int
 const (
 	GCS = iota
 	FileSystem
+	Memory
+	S3
 )
 
 // Config holds the Nixery configuration options.
@@ -42,6 +52,189 @@ type Config struct {
 	WebDir  string    // Directory with static web assets
 	PopUrl  string    // URL to the Nix package popularity count
 	Backend Backend   // Storage backend to use for Nixery
+
+	StoragePrefix string // Prefix of the environment's objects in the storage backend
+	ChunkedLayers bool   // Whether layers are stored in content-defined chunks (experimental)
+
+	Timeouts StageTimeouts // Timeouts of the individual build stages
+
+	EvalWorkers      int // Processes evaluating requested packages in parallel (0 = disabled)
+	EvalWorkerMemory int // Memory (in MiB) after which evaluation workers are restarted
+
+	EvalMemory int    // Memory ceiling (in MiB) of each evaluation (0 = disabled)
+	EvalCgroup string // Delegated cgroup (v2) below which evaluations are limited
+
+	LayerWorkers      int // Processes packing layers outside of the server process (0 = disabled)
+	LayerWorkerMemory int // Memory limit (in MiB) of each layer worker
+
+	LayerOrder string // Strategy ordering the layers of manifests ("merge-rating" or "size")
+
+	BinaryCache   string // Nix store URL to which built paths are copied
+	PostBuildHook string // Nix post-build-hook to run after each derivation build
+
+	TrustedProxies []*net.IPNet // Reverse proxies whose forwarding headers are honoured
+	ExternalUrl    string       // URL under which clients reach Nixery, including any path prefix of an ingress
+	EventsUrl      string       // Message bus to which build events are published
+	Outbound       Outbound     // Proxy and CA settings for outbound traffic
+	SizeBudget     uint64       // Image size (in bytes) above which warnings are emitted
+	TenantHeader   string       // Request header identifying the tenant of a request
+	RecipientsFile string       // JSON file mapping tenants to encryption key files
+
+	ReplicaPeers     []string // Base URLs of standby replicas
+	ReplicationToken string   // Shared secret authenticating replication requests
+	InvalidateToken  string   // Bearer token authenticating package source invalidations (disabled if empty)
+
+	MaxInflight    int           // Maximum number of concurrent registry requests (0 = unlimited)
+	AsyncBuildWait time.Duration // Time after which opted-in manifest requests are answered with 202 (0 = disabled)
+
+	AdminToken   string        // Bearer token protecting the admin API (disabled if empty)
+	PullTokenKey string        // Key signing pull tokens
+	RegistryAuth RegistryAuth  // Authentication of registry requests
+	AdminListen  string        // Separate address serving the admin API and profiling endpoints
+	GCGrace      time.Duration // Minimum age of unreferenced blobs before deletion
+	GCInterval   time.Duration // Interval between garbage collection runs (0 = disabled)
+
+	LeaderLease time.Duration // Duration of the lease elected replicas hold to run cluster-wide tasks (0 = disabled)
+
+	LogLevel           string        // Initial log level, can be changed via the admin API
+	LogSummaryInterval time.Duration // Interval of the summaries of slow builds and suppressed log lines
+	SlowBuilds         int           // Number of slowest builds logged per interval (0 = disabled)
+
+	ScannerUrl string // Malware scanner checking layers before publication
+
+	CredentialsUrl string // Provider of per-tenant credentials for the Nix fetchers
+
+	Hooks BuildHooks // Operator scripts invoked before and after builds
+
+	Pin              string        // Revision of the package set that `latest` is pinned to
+	PinRolloutWindow time.Duration // Time over which images are migrated to a new pin
+
+	Quotas       map[string]Quota // Storage quotas per tenant
+	QuotaRefresh time.Duration    // Interval at which storage usage is recomputed
+
+	Prefetch         bool // Whether store paths of cached images are fetched in the background
+	ContentAddressed bool // Whether packages are built as content-addressed derivations
+	DisableEmulation bool // Whether builds for architectures other than the host's are rejected
+	SBOM             bool // Whether SBOMs are attached to built images as referrers
+	FromPaths        bool // Whether images can be built from raw store paths
+	MultiArch        bool // Whether image indexes of all platforms are served to clients that accept them
+
+	BuilderPools map[string]BuilderPool // Remote builders to which builds are delegated, keyed by platform
+
+	Groups  map[string][]string // Curated package groups, keyed by group name
+	Aliases map[string]string   // Image names standing for other image names
+	Curated CuratedImages       // Image definitions synced from a Git repository
+
+	Namespaces map[string]Namespace // Repository namespaces, keyed by their name
+
+	Overrides map[string]map[string]Override // Curated package flags, keyed by package and flag name
+
+	Duplicates DuplicatePolicy // Handling of images requesting several versions of a package
+
+	ForeignLayersUrl    string // CDN serving layers as foreign layers (experimental)
+	NondistributableUrl string // Approved source serving layers of packages that may not be redistributed
+
+	SelfTest string // Image pulled through the local listener on startup
+
+	StoreGCThreshold float64       // Fraction of disk usage at which the Nix store is collected (0 = disabled)
+	StoreGCTarget    float64       // Fraction of disk usage down to which the Nix store is collected
+	StoreGCProtect   time.Duration // Time for which the store paths of builds are protected
+	StoreGCRoots     string        // Directory in which GC roots for protected store paths are created
+
+	ScratchDir     string // Directory (usually a tmpfs) in which layers are assembled
+	SpillDir       string // Directory to which layers exceeding the threshold are moved
+	SpillThreshold int64  // Size (in bytes) above which layers are moved to disk
+
+	UploadChunkSize int64 // Size (in bytes) of the chunks in which objects are uploaded to GCS and S3
+	UploadMemory    int64 // Memory (in bytes) that the buffers of concurrent uploads may use (0 = unlimited)
+
+	JournalDir string // Directory in which in-progress builds are recorded for crash recovery
+
+	ManifestCacheLimit int64         // Size (in bytes) of the local manifest cache above which old manifests are evicted (0 = unlimited)
+	LayerCacheTTL      time.Duration // Time after which locally cached layers are validated against the storage backend (0 = never)
+	NegativeCacheTTL   time.Duration // Time for which cache entries missing from the storage backend are remembered (0 = disabled)
+	BackgroundWrites   int           // Maximum number of concurrent background cache writes
+}
+
+// externalURLFromEnv validates the URL under which clients reach
+// Nixery, if it is configured. The host may include a port and be an
+// IPv6 literal, and the path is the prefix under which an ingress
+// serves Nixery.
+func externalURLFromEnv() (string, error) {
+	external := os.Getenv("NIXERY_EXTERNAL_URL")
+	if external == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(external)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("invalid NIXERY_EXTERNAL_URL: must be an absolute http(s) URL without credentials or query")
+	}
+
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// trustedProxiesFromEnv parses the comma-separated list of trusted
+// proxy addresses. Entries may be either CIDR ranges or single IP
+// addresses.
+func trustedProxiesFromEnv() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, entry := range strings.Split(os.Getenv("NIXERY_TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address: %q", entry)
+			}
+
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %q: %s", entry, err)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// postBuildHookFromEnv determines which executable, if any, should be
+// passed to Nix as its post-build-hook.
+//
+// An explicitly configured hook always takes precedence. Otherwise,
+// if a binary cache is configured, the bundled nixery-push-to-cache
+// hook is used to populate it.
+func postBuildHookFromEnv(cache string) (string, error) {
+	if hook := os.Getenv("NIXERY_NIX_POST_BUILD_HOOK"); hook != "" {
+		return hook, nil
+	}
+
+	if cache == "" {
+		return "", nil
+	}
+
+	// Nix requires the hook to be an absolute path, as it does
+	// not perform a lookup on its own.
+	hook, err := exec.LookPath("nixery-push-to-cache")
+	if err != nil {
+		return "", fmt.Errorf("NIXERY_BINARY_CACHE is set, but the cache upload hook could not be found: %s", err)
+	}
+
+	return hook, nil
 }
 
 func FromEnv() (Config, error) {
@@ -56,18 +249,459 @@ func FromEnv() (Config, error) {
 		b = GCS
 	case "filesystem":
 		b = FileSystem
+	case "memory":
+		b = Memory
+	case "s3":
+		b = S3
 	default:
 		log.WithField("values", []string{
 			"gcs",
-		}).Fatal("NIXERY_STORAGE_BACKEND must be set to a supported value (gcs or filesystem)")
+		}).Fatal("NIXERY_STORAGE_BACKEND must be set to a supported value (gcs, s3, filesystem or memory)")
+	}
+
+	cache := os.Getenv("NIXERY_BINARY_CACHE")
+	hook, err := postBuildHookFromEnv(cache)
+	if err != nil {
+		return Config{}, err
+	}
+
+	proxies, err := trustedProxiesFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	external, err := externalURLFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	outbound, err := outboundFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	var budget uint64
+	if mb := os.Getenv("NIXERY_SIZE_BUDGET_MB"); mb != "" {
+		budget, err = strconv.ParseUint(mb, 10, 64)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid NIXERY_SIZE_BUDGET_MB: %s", err)
+		}
+		budget *= 1000000
+	}
+
+	var peers []string
+	for _, peer := range strings.Split(os.Getenv("NIXERY_REPLICA_PEERS"), ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers = append(peers, strings.TrimSuffix(peer, "/"))
+		}
+	}
+
+	token := os.Getenv("NIXERY_REPLICATION_TOKEN")
+	if len(peers) > 0 && token == "" {
+		return Config{}, fmt.Errorf("NIXERY_REPLICATION_TOKEN must be set if replica peers are configured")
+	}
+
+	var inflight int
+	if max := os.Getenv("NIXERY_MAX_INFLIGHT"); max != "" {
+		inflight, err = strconv.Atoi(max)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid NIXERY_MAX_INFLIGHT: %s", err)
+		}
+	}
+
+	var asyncWait time.Duration
+	if w := os.Getenv("NIXERY_ASYNC_BUILD_WAIT"); w != "" {
+		asyncWait, err = time.ParseDuration(w)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid NIXERY_ASYNC_BUILD_WAIT: %s", err)
+		}
+	}
+
+	grace := 24 * time.Hour
+	if g := os.Getenv("NIXERY_GC_GRACE"); g != "" {
+		grace, err = time.ParseDuration(g)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid NIXERY_GC_GRACE: %s", err)
+		}
+	}
+
+	var gcInterval time.Duration
+	if i := os.Getenv("NIXERY_GC_INTERVAL"); i != "" {
+		gcInterval, err = time.ParseDuration(i)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid NIXERY_GC_INTERVAL: %s", err)
+		}
+	}
+
+	var lease time.Duration
+	if l := os.Getenv("NIXERY_LEADER_LEASE"); l != "" {
+		lease, err = time.ParseDuration(l)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid NIXERY_LEADER_LEASE: %s", err)
+		}
+	}
+
+	registryAuth, err := registryAuthFromEnv(os.Getenv("NIXERY_PULL_TOKEN_KEY"))
+	if err != nil {
+		return Config{}, err
+	}
+
+	level := os.Getenv("NIXERY_LOG_LEVEL")
+	if level == "" {
+		level = "info"
+	} else if _, err := log.ParseLevel(level); err != nil {
+		return Config{}, fmt.Errorf("invalid NIXERY_LOG_LEVEL: %s", err)
+	}
+
+	logSummary := 10 * time.Minute
+	if i := os.Getenv("NIXERY_LOG_SUMMARY_INTERVAL"); i != "" {
+		logSummary, err = time.ParseDuration(i)
+		if err != nil || logSummary <= 0 {
+			return Config{}, fmt.Errorf("invalid NIXERY_LOG_SUMMARY_INTERVAL: must be a positive duration")
+		}
+	}
+
+	slowBuilds := 10
+	if n := os.Getenv("NIXERY_SLOW_BUILDS"); n != "" {
+		slowBuilds, err = strconv.Atoi(n)
+		if err != nil || slowBuilds < 0 {
+			return Config{}, fmt.Errorf("invalid NIXERY_SLOW_BUILDS: must be a non-negative integer")
+		}
+	}
+
+	if os.Getenv("NIXERY_CREDENTIALS") != "" && os.Getenv("NIXERY_TENANT_HEADER") == "" {
+		return Config{}, fmt.Errorf("NIXERY_CREDENTIALS requires NIXERY_TENANT_HEADER to identify tenants")
+	}
+
+	// The tenant header is only honoured on requests from trusted
+	// proxies, as clients could otherwise impersonate any tenant.
+	if os.Getenv("NIXERY_TENANT_HEADER") != "" && len(proxies) == 0 {
+		return Config{}, fmt.Errorf("NIXERY_TENANT_HEADER requires NIXERY_TRUSTED_PROXIES to identify the proxy setting it")
+	}
+
+	// The admin listener exposes operations such as garbage
+	// collection and profiling, which always require the token.
+	if os.Getenv("NIXERY_ADMIN_LISTEN") != "" && os.Getenv("NIXERY_ADMIN_TOKEN") == "" {
+		return Config{}, fmt.Errorf("NIXERY_ADMIN_LISTEN requires NIXERY_ADMIN_TOKEN to authenticate admin requests")
+	}
+
+	// Chunked layers only exist as recipes in the backend, and can
+	// not be served from a CDN.
+	if os.Getenv("NIXERY_CHUNKED_LAYERS") == "true" && os.Getenv("NIXERY_FOREIGN_LAYERS_URL") != "" {
+		return Config{}, fmt.Errorf("NIXERY_CHUNKED_LAYERS can not be used with NIXERY_FOREIGN_LAYERS_URL")
+	}
+	if os.Getenv("NIXERY_CHUNKED_LAYERS") == "true" && os.Getenv("NIXERY_NONDISTRIBUTABLE_URL") != "" {
+		return Config{}, fmt.Errorf("NIXERY_CHUNKED_LAYERS can not be used with NIXERY_NONDISTRIBUTABLE_URL")
+	}
+
+	pin := os.Getenv("NIXERY_PIN")
+	if _, ok := pkgs.(*GitSource); pin != "" && !ok {
+		return Config{}, fmt.Errorf("NIXERY_PIN is only supported with NIXERY_PKGS_REPO")
+	}
+
+	window := time.Hour
+	if w := os.Getenv("NIXERY_PIN_ROLLOUT_WINDOW"); w != "" {
+		window, err = time.ParseDuration(w)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid NIXERY_PIN_ROLLOUT_WINDOW: %s", err)
+		}
+	}
+
+	quotas, err := quotasFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	quotaRefresh, err := quotaRefreshFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	groups, err := groupsFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	namespaces, err := namespacesFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	pools, err := builderPoolsFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	aliases, err := aliasesFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	curated, err := curatedFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	duplicates, err := duplicatePolicyFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	overrides, err := overridesFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	timeouts, err := timeoutsFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	hooks, err := hooksFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	var manifestCacheMB int64
+	if mb := os.Getenv("NIXERY_MANIFEST_CACHE_MB"); mb != "" {
+		manifestCacheMB, err = strconv.ParseInt(mb, 10, 64)
+		if err != nil || manifestCacheMB < 0 {
+			return Config{}, fmt.Errorf("invalid NIXERY_MANIFEST_CACHE_MB: must be a non-negative integer")
+		}
+	}
+
+	layerTTL := time.Hour
+	if ttl := os.Getenv("NIXERY_LAYER_CACHE_TTL"); ttl != "" {
+		layerTTL, err = time.ParseDuration(ttl)
+		if err != nil || layerTTL < 0 {
+			return Config{}, fmt.Errorf("invalid NIXERY_LAYER_CACHE_TTL: must be a non-negative duration")
+		}
+	}
+
+	negativeTTL := 10 * time.Second
+	if ttl := os.Getenv("NIXERY_NEGATIVE_CACHE_TTL"); ttl != "" {
+		negativeTTL, err = time.ParseDuration(ttl)
+		if err != nil || negativeTTL < 0 {
+			return Config{}, fmt.Errorf("invalid NIXERY_NEGATIVE_CACHE_TTL: must be a non-negative duration")
+		}
+	}
+
+	backgroundWrites := 32
+	if n := os.Getenv("NIXERY_BACKGROUND_WRITES"); n != "" {
+		backgroundWrites, err = strconv.Atoi(n)
+		if err != nil || backgroundWrites <= 0 {
+			return Config{}, fmt.Errorf("invalid NIXERY_BACKGROUND_WRITES: must be a positive integer")
+		}
+	}
+
+	var evalWorkers int
+	if w := os.Getenv("NIXERY_EVAL_WORKERS"); w != "" {
+		evalWorkers, err = strconv.Atoi(w)
+		if err != nil || evalWorkers < 0 {
+			return Config{}, fmt.Errorf("invalid NIXERY_EVAL_WORKERS: must be a non-negative integer")
+		}
+	}
+
+	evalMemory := 4096
+	if mb := os.Getenv("NIXERY_EVAL_WORKER_MEMORY"); mb != "" {
+		evalMemory, err = strconv.Atoi(mb)
+		if err != nil || evalMemory <= 0 {
+			return Config{}, fmt.Errorf("invalid NIXERY_EVAL_WORKER_MEMORY: must be a positive number of MiB")
+		}
+	}
+
+	var evalCeiling int
+	if mb := os.Getenv("NIXERY_EVAL_MEMORY"); mb != "" {
+		evalCeiling, err = strconv.Atoi(mb)
+		if err != nil || evalCeiling < 0 {
+			return Config{}, fmt.Errorf("invalid NIXERY_EVAL_MEMORY: must be a non-negative number of MiB")
+		}
+	}
+
+	evalCgroup := os.Getenv("NIXERY_EVAL_CGROUP")
+	if evalCeiling > 0 && evalCgroup == "" {
+		return Config{}, fmt.Errorf("NIXERY_EVAL_MEMORY requires NIXERY_EVAL_CGROUP")
+	}
+
+	layerOrder := getConfig("NIXERY_LAYER_ORDER", "layer order", manifest.OrderMergeRating)
+	if layerOrder != manifest.OrderMergeRating && layerOrder != manifest.OrderSize {
+		return Config{}, fmt.Errorf("invalid NIXERY_LAYER_ORDER: must be %q or %q", manifest.OrderMergeRating, manifest.OrderSize)
+	}
+
+	var layerWorkers int
+	if w := os.Getenv("NIXERY_LAYER_WORKERS"); w != "" {
+		layerWorkers, err = strconv.Atoi(w)
+		if err != nil || layerWorkers < 0 {
+			return Config{}, fmt.Errorf("invalid NIXERY_LAYER_WORKERS: must be a non-negative integer")
+		}
+	}
+
+	layerMemory := 1024
+	if mb := os.Getenv("NIXERY_LAYER_WORKER_MEMORY"); mb != "" {
+		layerMemory, err = strconv.Atoi(mb)
+		if err != nil || layerMemory < 256 {
+			return Config{}, fmt.Errorf("invalid NIXERY_LAYER_WORKER_MEMORY: must be at least 256 MiB")
+		}
+	}
+
+	spill := int64(64)
+	if mb := os.Getenv("NIXERY_SCRATCH_SPILL_MB"); mb != "" {
+		spill, err = strconv.ParseInt(mb, 10, 64)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid NIXERY_SCRATCH_SPILL_MB: %s", err)
+		}
+	}
+
+	uploadChunk := 16
+	if mb := os.Getenv("NIXERY_UPLOAD_CHUNK_SIZE"); mb != "" {
+		uploadChunk, err = strconv.Atoi(mb)
+		if err != nil || uploadChunk < 5 {
+			return Config{}, fmt.Errorf("invalid NIXERY_UPLOAD_CHUNK_SIZE: must be at least 5 MiB")
+		}
+	}
+
+	uploadMemory := 512
+	if mb := os.Getenv("NIXERY_UPLOAD_MEMORY"); mb != "" {
+		uploadMemory, err = strconv.Atoi(mb)
+		if err != nil || uploadMemory < 0 {
+			return Config{}, fmt.Errorf("invalid NIXERY_UPLOAD_MEMORY: must be a non-negative number of MiB")
+		}
+	}
+
+	var storeThreshold, storeTarget int
+	if pct := os.Getenv("NIXERY_STORE_GC_THRESHOLD"); pct != "" {
+		storeThreshold, err = strconv.Atoi(pct)
+		if err != nil || storeThreshold <= 0 || storeThreshold > 100 {
+			return Config{}, fmt.Errorf("invalid NIXERY_STORE_GC_THRESHOLD: must be a percentage")
+		}
+
+		storeTarget = storeThreshold - 10
+		if pct := os.Getenv("NIXERY_STORE_GC_TARGET"); pct != "" {
+			storeTarget, err = strconv.Atoi(pct)
+			if err != nil || storeTarget < 0 || storeTarget >= storeThreshold {
+				return Config{}, fmt.Errorf("invalid NIXERY_STORE_GC_TARGET: must be a percentage below the threshold")
+			}
+		}
+
+		if storeTarget < 0 {
+			storeTarget = 0
+		}
+	}
+
+	storeProtect := time.Hour
+	if d := os.Getenv("NIXERY_STORE_GC_PROTECT"); d != "" {
+		storeProtect, err = time.ParseDuration(d)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid NIXERY_STORE_GC_PROTECT: %s", err)
+		}
 	}
 
 	return Config{
-		Port:    getConfig("PORT", "HTTP port", ""),
-		Pkgs:    pkgs,
-		Timeout: getConfig("NIX_TIMEOUT", "Nix builder timeout", "60"),
-		WebDir:  getConfig("WEB_DIR", "Static web file dir", ""),
-		PopUrl:  os.Getenv("NIX_POPULARITY_URL"),
-		Backend: b,
+		Port:     getConfig("PORT", "HTTP port", ""),
+		Pkgs:     pkgs,
+		Timeout:  getConfig("NIX_TIMEOUT", "Nix builder timeout", "60"),
+		Timeouts: timeouts,
+
+		EvalWorkers:      evalWorkers,
+		EvalWorkerMemory: evalMemory,
+
+		EvalMemory: evalCeiling,
+		EvalCgroup: evalCgroup,
+
+		LayerWorkers:      layerWorkers,
+		LayerWorkerMemory: layerMemory,
+
+		LayerOrder: layerOrder,
+
+		StoragePrefix: os.Getenv("NIXERY_STORAGE_PREFIX"),
+		ChunkedLayers: os.Getenv("NIXERY_CHUNKED_LAYERS") == "true",
+		WebDir:        getConfig("WEB_DIR", "Static web file dir", ""),
+		PopUrl:        os.Getenv("NIX_POPULARITY_URL"),
+		Backend:       b,
+		BinaryCache:   cache,
+		PostBuildHook: hook,
+
+		TrustedProxies: proxies,
+		ExternalUrl:    external,
+		EventsUrl:      os.Getenv("NIXERY_EVENTS_URL"),
+		Outbound:       outbound,
+		SizeBudget:     budget,
+		TenantHeader:   os.Getenv("NIXERY_TENANT_HEADER"),
+		RecipientsFile: os.Getenv("NIXERY_ENCRYPTION_RECIPIENTS"),
+
+		ReplicaPeers:     peers,
+		ReplicationToken: token,
+		InvalidateToken:  os.Getenv("NIXERY_INVALIDATE_TOKEN"),
+
+		MaxInflight:    inflight,
+		AsyncBuildWait: asyncWait,
+
+		AdminToken:   os.Getenv("NIXERY_ADMIN_TOKEN"),
+		PullTokenKey: os.Getenv("NIXERY_PULL_TOKEN_KEY"),
+		RegistryAuth: registryAuth,
+		AdminListen:  os.Getenv("NIXERY_ADMIN_LISTEN"),
+		GCGrace:      grace,
+		GCInterval:   gcInterval,
+
+		LeaderLease: lease,
+
+		LogLevel:           level,
+		LogSummaryInterval: logSummary,
+		SlowBuilds:         slowBuilds,
+
+		ScannerUrl: os.Getenv("NIXERY_SCANNER"),
+
+		CredentialsUrl: os.Getenv("NIXERY_CREDENTIALS"),
+
+		Hooks: hooks,
+
+		Pin:              pin,
+		PinRolloutWindow: window,
+
+		Quotas:       quotas,
+		QuotaRefresh: quotaRefresh,
+
+		Prefetch:         os.Getenv("NIXERY_PREFETCH") == "true",
+		ContentAddressed: os.Getenv("NIXERY_CONTENT_ADDRESSED") == "true",
+		DisableEmulation: os.Getenv("NIXERY_DISABLE_EMULATION") == "true",
+		SBOM:             os.Getenv("NIXERY_SBOM") == "true",
+		FromPaths:        os.Getenv("NIXERY_FROM_PATHS") == "true",
+		MultiArch:        os.Getenv("NIXERY_MULTI_ARCH") == "true",
+
+		BuilderPools: pools,
+
+		Groups:  groups,
+		Aliases: aliases,
+		Curated: curated,
+
+		Namespaces: namespaces,
+
+		Overrides: overrides,
+
+		Duplicates: duplicates,
+
+		ForeignLayersUrl:    os.Getenv("NIXERY_FOREIGN_LAYERS_URL"),
+		NondistributableUrl: os.Getenv("NIXERY_NONDISTRIBUTABLE_URL"),
+
+		SelfTest: os.Getenv("NIXERY_SELF_TEST"),
+
+		StoreGCThreshold: float64(storeThreshold) / 100,
+		StoreGCTarget:    float64(storeTarget) / 100,
+		StoreGCProtect:   storeProtect,
+		StoreGCRoots:     getConfig("NIXERY_STORE_GC_ROOTS", "Nix store GC roots directory", "/nix/var/nix/gcroots/nixery"),
+
+		ScratchDir:     os.Getenv("NIXERY_SCRATCH_DIR"),
+		SpillDir:       os.TempDir(),
+		SpillThreshold: spill * 1000000,
+
+		UploadChunkSize: int64(uploadChunk) << 20,
+		UploadMemory:    int64(uploadMemory) << 20,
+
+		JournalDir: os.Getenv("NIXERY_BUILD_JOURNAL"),
+
+		ManifestCacheLimit: manifestCacheMB * 1000000,
+		LayerCacheTTL:      layerTTL,
+		NegativeCacheTTL:   negativeTTL,
+		BackgroundWrites:   backgroundWrites,
 	}, nil
 }
@@ -0,0 +1,45 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// CuratedImages configures the Git repository from which curated image
+// definitions are synced.
+type CuratedImages struct {
+	Repo     string        // URL of the repository (disabled if empty)
+	Ref      string        // Branch or tag to sync, defaults to the repository's HEAD
+	Interval time.Duration // Interval at which the repository is synced
+}
+
+// curatedFromEnv reads the repository of curated image definitions
+// from NIXERY_CURATED_REPO, NIXERY_CURATED_REF and
+// NIXERY_CURATED_INTERVAL.
+func curatedFromEnv() (CuratedImages, error) {
+	c := CuratedImages{
+		Repo:     os.Getenv("NIXERY_CURATED_REPO"),
+		Ref:      os.Getenv("NIXERY_CURATED_REF"),
+		Interval: 5 * time.Minute,
+	}
+
+	if c.Repo == "" {
+		if c.Ref != "" || os.Getenv("NIXERY_CURATED_INTERVAL") != "" {
+			return CuratedImages{}, fmt.Errorf("NIXERY_CURATED_REF and NIXERY_CURATED_INTERVAL require NIXERY_CURATED_REPO")
+		}
+		return c, nil
+	}
+
+	if i := os.Getenv("NIXERY_CURATED_INTERVAL"); i != "" {
+		interval, err := time.ParseDuration(i)
+		if err != nil || interval <= 0 {
+			return CuratedImages{}, fmt.Errorf("invalid NIXERY_CURATED_INTERVAL: must be a positive duration")
+		}
+		c.Interval = interval
+	}
+
+	return c, nil
+}
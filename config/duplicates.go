@@ -0,0 +1,34 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"fmt"
+	"os"
+)
+
+// DuplicatePolicy determines how images requesting several versions of
+// the same package are handled.
+type DuplicatePolicy string
+
+const (
+	// DuplicatesKeepBoth includes all versions and logs a warning
+	DuplicatesKeepBoth DuplicatePolicy = "keep-both"
+
+	// DuplicatesPreferLatest only includes the latest version
+	DuplicatesPreferLatest DuplicatePolicy = "prefer-latest"
+
+	// DuplicatesError rejects the image
+	DuplicatesError DuplicatePolicy = "error"
+)
+
+func duplicatePolicyFromEnv() (DuplicatePolicy, error) {
+	switch p := DuplicatePolicy(os.Getenv("NIXERY_DUPLICATE_PACKAGES")); p {
+	case "":
+		return DuplicatesKeepBoth, nil
+	case DuplicatesKeepBoth, DuplicatesPreferLatest, DuplicatesError:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid NIXERY_DUPLICATE_PACKAGES: must be %q, %q or %q", DuplicatesKeepBoth, DuplicatesPreferLatest, DuplicatesError)
+	}
+}
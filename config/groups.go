@@ -0,0 +1,40 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// groupsFromEnv reads the curated package groups from the JSON file
+// configured in NIXERY_PACKAGE_GROUPS, which maps group names to the
+// packages they contain, for example:
+//
+//	{ "devtools.go": ["go", "gopls", "delve"] }
+func groupsFromEnv() (map[string][]string, error) {
+	path := os.Getenv("NIXERY_PACKAGE_GROUPS")
+	if path == "" {
+		return nil, nil
+	}
+
+	j, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NIXERY_PACKAGE_GROUPS: %s", err)
+	}
+
+	var groups map[string][]string
+	if err := json.Unmarshal(j, &groups); err != nil {
+		return nil, fmt.Errorf("invalid NIXERY_PACKAGE_GROUPS: %s", err)
+	}
+
+	for name, pkgs := range groups {
+		if len(pkgs) == 0 {
+			return nil, fmt.Errorf("package group %q is empty", name)
+		}
+	}
+
+	return groups, nil
+}
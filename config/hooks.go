@@ -0,0 +1,58 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// HookPolicy determines how failures of build hooks are handled.
+type HookPolicy string
+
+const (
+	// HookAbort fails the build if a hook fails
+	HookAbort HookPolicy = "abort"
+
+	// HookWarn logs failing hooks, but continues the build
+	HookWarn HookPolicy = "warn"
+)
+
+// BuildHooks are operator-supplied executables which are invoked with
+// the context of each image build. Hooks that are not configured are
+// not invoked.
+type BuildHooks struct {
+	PreBuild    string        // Executable run before the image's packages are evaluated
+	PostPublish string        // Executable run after the image has been published
+	Policy      HookPolicy    // Handling of failing hooks
+	Timeout     time.Duration // Maximum runtime of a single hook invocation
+}
+
+// hooksFromEnv reads the build hook configuration.
+func hooksFromEnv() (BuildHooks, error) {
+	hooks := BuildHooks{
+		PreBuild:    os.Getenv("NIXERY_HOOK_PRE_BUILD"),
+		PostPublish: os.Getenv("NIXERY_HOOK_POST_PUBLISH"),
+		Policy:      HookAbort,
+		Timeout:     time.Minute,
+	}
+
+	switch p := HookPolicy(os.Getenv("NIXERY_HOOK_FAILURE")); p {
+	case "":
+	case HookAbort, HookWarn:
+		hooks.Policy = p
+	default:
+		return hooks, fmt.Errorf("invalid NIXERY_HOOK_FAILURE: must be %q or %q", HookAbort, HookWarn)
+	}
+
+	if t := os.Getenv("NIXERY_HOOK_TIMEOUT"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			return hooks, fmt.Errorf("invalid NIXERY_HOOK_TIMEOUT: %s", err)
+		}
+		hooks.Timeout = d
+	}
+
+	return hooks, nil
+}
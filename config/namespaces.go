@@ -0,0 +1,67 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+)
+
+// Namespace is a repository namespace, which is selected by the first
+// component of image names (e.g. `team-a` in `team-a/shell/git`)
+// instead of that component being treated as a package.
+type Namespace struct {
+	Name     string   `json:"-"`        // Name of the namespace
+	Tenant   string   `json:"tenant"`   // Tenant whose quota and credentials apply to images of the namespace
+	Pin      string   `json:"pin"`      // Named pin or revision from which `latest` is built in the namespace
+	Packages []string `json:"packages"` // Packages that images in the namespace may contain (all if empty)
+}
+
+// Names of namespaces, which are single components of image names.
+var namespaceRegex = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*$`)
+
+// namespacesFromEnv reads the repository namespaces from the JSON file
+// configured in NIXERY_NAMESPACES, which maps namespace names to their
+// configuration, for example:
+//
+//	{ "team-a": { "tenant": "team-a", "pin": "stable", "packages": ["git", "curl"] } }
+//
+// The tenant defaults to the name of the namespace.
+func namespacesFromEnv() (map[string]Namespace, error) {
+	path := os.Getenv("NIXERY_NAMESPACES")
+	if path == "" {
+		return nil, nil
+	}
+
+	j, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NIXERY_NAMESPACES: %s", err)
+	}
+
+	// Unknown fields are rejected, as a misspelled policy would
+	// otherwise silently allow everything.
+	var namespaces map[string]Namespace
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&namespaces); err != nil {
+		return nil, fmt.Errorf("invalid NIXERY_NAMESPACES: %s", err)
+	}
+
+	for name, ns := range namespaces {
+		if !namespaceRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid namespace name %q", name)
+		}
+
+		ns.Name = name
+		if ns.Tenant == "" {
+			ns.Tenant = name
+		}
+		namespaces[name] = ns
+	}
+
+	return namespaces, nil
+}
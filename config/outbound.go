@@ -0,0 +1,88 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ProxyRule routes outbound requests for matching hosts through a
+// specific proxy.
+type ProxyRule struct {
+	// Host pattern, either an exact hostname, a suffix pattern of
+	// the form `*.example.com` or `*` for all hosts.
+	Pattern string
+
+	// Proxy to use for matching hosts. A nil value means that
+	// requests are sent directly.
+	Proxy *url.URL
+}
+
+// Matches reports whether the rule applies to the given hostname.
+func (r *ProxyRule) Matches(host string) bool {
+	switch {
+	case r.Pattern == "*":
+		return true
+	case strings.HasPrefix(r.Pattern, "*."):
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(r.Pattern[1:]))
+	default:
+		return strings.EqualFold(host, r.Pattern)
+	}
+}
+
+// Outbound holds the configuration for Nixery's outbound network
+// traffic, such as channel resolution and storage backend calls.
+type Outbound struct {
+	CABundle   string      // PEM file with additional trusted CAs
+	ProxyRules []ProxyRule // Per-destination proxies, in order of precedence
+}
+
+// outboundFromEnv reads the outbound traffic configuration.
+//
+// Proxy rules are configured as a comma-separated list of
+// `pattern=proxy` pairs, where the proxy can be set to `direct` to
+// bypass proxies for the matching hosts, for example:
+//
+//	storage.googleapis.com=http://egress:3128,*.corp.example=direct
+//
+// Hosts not matched by any rule use the standard proxy environment
+// variables (HTTPS_PROXY, NO_PROXY etc.).
+func outboundFromEnv() (Outbound, error) {
+	o := Outbound{
+		CABundle: os.Getenv("NIXERY_CA_BUNDLE"),
+	}
+
+	if o.CABundle != "" {
+		if _, err := os.Stat(o.CABundle); err != nil {
+			return o, fmt.Errorf("could not read NIXERY_CA_BUNDLE: %s", err)
+		}
+	}
+
+	for _, entry := range strings.Split(os.Getenv("NIXERY_PROXY_RULES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return o, fmt.Errorf("invalid proxy rule %q, expected pattern=proxy", entry)
+		}
+
+		rule := ProxyRule{Pattern: parts[0]}
+		if parts[1] != "direct" {
+			proxy, err := url.Parse(parts[1])
+			if err != nil || proxy.Host == "" {
+				return o, fmt.Errorf("invalid proxy URL in rule %q", entry)
+			}
+			rule.Proxy = proxy
+		}
+
+		o.ProxyRules = append(o.ProxyRules, rule)
+	}
+
+	return o, nil
+}
@@ -0,0 +1,30 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import "testing"
+
+func TestProxyRuleMatches(t *testing.T) {
+	cases := []struct {
+		pattern string
+		host    string
+		matches bool
+	}{
+		{"*", "storage.googleapis.com", true},
+		{"storage.googleapis.com", "storage.googleapis.com", true},
+		{"storage.googleapis.com", "Storage.GoogleAPIs.com", true},
+		{"storage.googleapis.com", "googleapis.com", false},
+		{"*.corp.example", "cache.corp.example", true},
+		{"*.corp.example", "Cache.CORP.example", true},
+		{"*.CORP.Example", "cache.corp.example", true},
+		{"*.corp.example", "corp.example", false},
+		{"*.corp.example", "cache.othercorp.example", false},
+	}
+
+	for _, c := range cases {
+		r := ProxyRule{Pattern: c.pattern}
+		if m := r.Matches(c.host); m != c.matches {
+			t.Errorf("rule %q matching %q: got %v, expected %v", c.pattern, c.host, m, c.matches)
+		}
+	}
+}
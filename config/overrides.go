@@ -0,0 +1,62 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+)
+
+// Override holds the arguments passed to the `override` function of a
+// package for a flag.
+type Override map[string]interface{}
+
+var flagName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// overridesFromEnv reads the package flags from the JSON file
+// configured in NIXERY_OVERRIDES, which maps package names and flag
+// names to override arguments, for example:
+//
+//	{ "ffmpeg": { "vaapi": { "withVaapi": true } } }
+//
+// Only literal values (booleans, numbers and strings) can be passed as
+// arguments, so that requests can not evaluate arbitrary expressions.
+func overridesFromEnv() (map[string]map[string]Override, error) {
+	path := os.Getenv("NIXERY_OVERRIDES")
+	if path == "" {
+		return nil, nil
+	}
+
+	j, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NIXERY_OVERRIDES: %s", err)
+	}
+
+	var overrides map[string]map[string]Override
+	if err := json.Unmarshal(j, &overrides); err != nil {
+		return nil, fmt.Errorf("invalid NIXERY_OVERRIDES: %s", err)
+	}
+
+	for pkg, flags := range overrides {
+		for flag, args := range flags {
+			// Image names can only contain lowercase
+			// characters, which applies to flags as well.
+			if !flagName.MatchString(flag) {
+				return nil, fmt.Errorf("invalid flag %q for package %q", flag, pkg)
+			}
+
+			for arg, v := range args {
+				switch v.(type) {
+				case bool, float64, string:
+				default:
+					return nil, fmt.Errorf("argument %q of flag %s!%s must be a boolean, number or string", arg, pkg, flag)
+				}
+			}
+		}
+	}
+
+	return overrides, nil
+}
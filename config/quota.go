@@ -0,0 +1,80 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quota limits the storage used by a tenant, in bytes. Exceeding the
+// soft limit produces warnings, exceeding the hard limit rejects new
+// builds. Limits of zero are not enforced.
+type Quota struct {
+	Soft uint64
+	Hard uint64
+}
+
+// quotasFromEnv reads the per-tenant storage quotas.
+//
+// Quotas are configured as a comma-separated list of
+// `tenant=soft:hard` entries with sizes in megabytes. The tenant `*`
+// applies to all tenants without a quota of their own, for example:
+//
+//	ml-team=500000:1000000,*=50000:100000
+func quotasFromEnv() (map[string]Quota, error) {
+	quotas := make(map[string]Quota)
+
+	for _, entry := range strings.Split(os.Getenv("NIXERY_TENANT_QUOTAS_MB"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid quota %q, expected tenant=soft:hard", entry)
+		}
+
+		limits := strings.SplitN(parts[1], ":", 2)
+		if len(limits) != 2 {
+			return nil, fmt.Errorf("invalid quota %q, expected tenant=soft:hard", entry)
+		}
+
+		soft, err := strconv.ParseUint(limits[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid soft quota in %q: %s", entry, err)
+		}
+
+		hard, err := strconv.ParseUint(limits[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hard quota in %q: %s", entry, err)
+		}
+
+		quotas[parts[0]] = Quota{
+			Soft: soft * 1000000,
+			Hard: hard * 1000000,
+		}
+	}
+
+	return quotas, nil
+}
+
+// quotaRefreshFromEnv reads the interval at which storage usage is
+// recomputed, which defaults to ten minutes.
+func quotaRefreshFromEnv() (time.Duration, error) {
+	r := os.Getenv("NIXERY_QUOTA_REFRESH")
+	if r == "" {
+		return 10 * time.Minute, nil
+	}
+
+	refresh, err := time.ParseDuration(r)
+	if err != nil || refresh <= 0 {
+		return 0, fmt.Errorf("invalid NIXERY_QUOTA_REFRESH: must be a positive duration")
+	}
+
+	return refresh, nil
+}
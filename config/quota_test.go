@@ -0,0 +1,51 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotasFromEnv(t *testing.T) {
+	t.Setenv("NIXERY_TENANT_QUOTAS_MB", "ml-team=500:1000, *=50:100")
+
+	quotas, err := quotasFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q := quotas["ml-team"]; q.Soft != 500000000 || q.Hard != 1000000000 {
+		t.Errorf("unexpected quota of ml-team: %+v", q)
+	}
+	if q := quotas["*"]; q.Soft != 50000000 || q.Hard != 100000000 {
+		t.Errorf("unexpected default quota: %+v", q)
+	}
+}
+
+func TestQuotasFromEnvInvalid(t *testing.T) {
+	for _, v := range []string{"ml-team", "=1:2", "ml-team=1", "ml-team=x:2", "ml-team=1:-2"} {
+		t.Setenv("NIXERY_TENANT_QUOTAS_MB", v)
+		if _, err := quotasFromEnv(); err == nil {
+			t.Errorf("invalid quota %q was accepted", v)
+		}
+	}
+}
+
+func TestQuotaRefreshFromEnv(t *testing.T) {
+	if r, err := quotaRefreshFromEnv(); err != nil || r != 10*time.Minute {
+		t.Errorf("expected default refresh interval, got %v (%v)", r, err)
+	}
+
+	t.Setenv("NIXERY_QUOTA_REFRESH", "30s")
+	if r, err := quotaRefreshFromEnv(); err != nil || r != 30*time.Second {
+		t.Errorf("expected refresh interval of 30s, got %v (%v)", r, err)
+	}
+
+	for _, v := range []string{"0", "-1m", "soon"} {
+		t.Setenv("NIXERY_QUOTA_REFRESH", v)
+		if _, err := quotaRefreshFromEnv(); err == nil {
+			t.Errorf("invalid refresh interval %q was accepted", v)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"fmt"
+	"os"
+)
+
+// RegistryAuth determines how requests to the registry under `/v2/`
+// are authenticated.
+type RegistryAuth string
+
+const (
+	// AuthAnonymous serves all registry requests without
+	// authentication
+	AuthAnonymous RegistryAuth = "anonymous"
+
+	// AuthPullToken requires a pull token for all registry requests
+	AuthPullToken RegistryAuth = "pull-token"
+
+	// AuthHybrid serves anonymous requests, but verifies the
+	// credentials of clients that log in
+	AuthHybrid RegistryAuth = "hybrid"
+)
+
+// registryAuthFromEnv determines the authentication mode of the
+// registry, which defaults to requiring pull tokens if a key for them
+// is configured.
+func registryAuthFromEnv(pullTokenKey string) (RegistryAuth, error) {
+	switch a := RegistryAuth(os.Getenv("NIXERY_REGISTRY_AUTH")); a {
+	case "":
+		if pullTokenKey != "" {
+			return AuthPullToken, nil
+		}
+		return AuthAnonymous, nil
+	case AuthAnonymous:
+		if pullTokenKey != "" {
+			return "", fmt.Errorf("NIXERY_PULL_TOKEN_KEY requires NIXERY_REGISTRY_AUTH to be %q or %q", AuthPullToken, AuthHybrid)
+		}
+		return a, nil
+	case AuthPullToken, AuthHybrid:
+		if pullTokenKey == "" {
+			return "", fmt.Errorf("NIXERY_REGISTRY_AUTH=%s requires NIXERY_PULL_TOKEN_KEY", a)
+		}
+		return a, nil
+	default:
+		return "", fmt.Errorf("invalid NIXERY_REGISTRY_AUTH: must be %q, %q or %q", AuthAnonymous, AuthPullToken, AuthHybrid)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// StageTimeouts limit the duration of the individual stages of an
+// image build. Timeouts of zero are not enforced.
+type StageTimeouts struct {
+	Eval    time.Duration // Evaluation of the image's packages
+	Realise time.Duration // Building or downloading the store paths
+	Pack    time.Duration // Packing a single layer
+	Upload  time.Duration // Uploading a single layer
+}
+
+// timeoutsFromEnv reads the per-stage timeouts, which are configured
+// as durations (e.g. `5m`).
+func timeoutsFromEnv() (StageTimeouts, error) {
+	var t StageTimeouts
+	stages := []struct {
+		env string
+		d   *time.Duration
+	}{
+		{"NIXERY_TIMEOUT_EVAL", &t.Eval},
+		{"NIXERY_TIMEOUT_REALISE", &t.Realise},
+		{"NIXERY_TIMEOUT_PACK", &t.Pack},
+		{"NIXERY_TIMEOUT_UPLOAD", &t.Upload},
+	}
+
+	for _, s := range stages {
+		v := os.Getenv(s.env)
+		if v == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return t, fmt.Errorf("invalid %s: %s", s.env, err)
+		}
+		*s.d = d
+	}
+
+	return t, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Package credentials implements providers of per-tenant credentials,
+// which are passed to the Nix fetchers when building images for an
+// authenticated tenant. This makes it possible to build images from
+// private sources (e.g. private flake inputs or `fetchGit` calls)
+// that only some tenants have access to.
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Credentials are the credentials of a single tenant.
+type Credentials struct {
+	// Access tokens keyed by host (e.g. `github.com`), which are used
+	// by Nix's fetchers for that host and by `fetchGit` for HTTPS
+	// repositories on it.
+	AccessTokens map[string]string `json:"accessTokens,omitempty"`
+}
+
+// Provider is implemented by the supported credential sources.
+type Provider interface {
+	// Name returns the name of the provider, for use in log
+	// messages.
+	Name() string
+
+	// Credentials returns the credentials of a tenant, or nil if
+	// the tenant has none.
+	Credentials(ctx context.Context, tenant string) (*Credentials, error)
+}
+
+// New creates a provider for the specified URL. The URL scheme selects
+// the source:
+//
+// * `file:///path/to/credentials.json` reads a JSON object mapping tenants to their credentials
+// * `http(s)://...` requests the credentials of each tenant from a webhook
+func New(target string) (Provider, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials URL: %s", err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return newFileProvider(u.Path)
+	case "http", "https":
+		return &webhookProvider{url: target}, nil
+	default:
+		return nil, fmt.Errorf("unsupported credentials scheme %q", u.Scheme)
+	}
+}
+
+// Env returns the environment variables that pass the credentials to
+// a Nix process, which otherwise inherits the given environment.
+//
+// Tokens are passed through the `access-tokens` setting of Nix and as
+// URL rewrites in the git configuration, which are appended to any
+// configuration already present in the environment.
+func (c *Credentials) Env(environ []string) []string {
+	if c == nil || len(c.AccessTokens) == 0 {
+		return nil
+	}
+
+	var hosts []string
+	for host := range c.AccessTokens {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var tokens []string
+	for _, host := range hosts {
+		tokens = append(tokens, host+"="+c.AccessTokens[host])
+	}
+
+	nixConfig := "access-tokens = " + strings.Join(tokens, " ")
+	gitCount := 0
+	for _, kv := range environ {
+		if v := strings.TrimPrefix(kv, "NIX_CONFIG="); v != kv && v != "" {
+			nixConfig = v + "\n" + nixConfig
+		}
+
+		if v := strings.TrimPrefix(kv, "GIT_CONFIG_COUNT="); v != kv {
+			gitCount, _ = strconv.Atoi(v)
+		}
+	}
+
+	env := []string{"NIX_CONFIG=" + nixConfig}
+	for i, host := range hosts {
+		n := strconv.Itoa(gitCount + i)
+		rewritten := fmt.Sprintf("https://oauth2:%s@%s/", url.PathEscape(c.AccessTokens[host]), host)
+		env = append(env,
+			"GIT_CONFIG_KEY_"+n+"=url."+rewritten+".insteadOf",
+			"GIT_CONFIG_VALUE_"+n+"=https://"+host+"/",
+		)
+	}
+
+	return append(env, "GIT_CONFIG_COUNT="+strconv.Itoa(gitCount+len(hosts)))
+}
+
+// fileProvider serves credentials from a JSON file, which is read once
+// on startup.
+type fileProvider struct {
+	tenants map[string]Credentials
+}
+
+func newFileProvider(path string) (*fileProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &fileProvider{}
+	if err := json.NewDecoder(f).Decode(&p.tenants); err != nil {
+		return nil, fmt.Errorf("invalid credentials file: %s", err)
+	}
+
+	return p, nil
+}
+
+func (p *fileProvider) Name() string {
+	return "file"
+}
+
+func (p *fileProvider) Credentials(ctx context.Context, tenant string) (*Credentials, error) {
+	c, ok := p.tenants[tenant]
+	if !ok {
+		return nil, nil
+	}
+
+	return &c, nil
+}
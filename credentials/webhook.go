@@ -0,0 +1,53 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookProvider requests the credentials of a tenant with a GET
+// request carrying the `X-Nixery-Tenant` header. The endpoint responds
+// with the JSON-encoded credentials, or 404 if the tenant has none.
+type webhookProvider struct {
+	url string
+}
+
+func (w *webhookProvider) Name() string {
+	return "webhook"
+}
+
+func (w *webhookProvider) Credentials(ctx context.Context, tenant string) (*Credentials, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", w.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Nixery-Tenant", tenant)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, nil
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("credentials provider returned status: %s", resp.Status)
+	}
+
+	var c Credentials
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return nil, fmt.Errorf("invalid credentials response: %s", err)
+	}
+
+	return &c, nil
+}
@@ -0,0 +1,240 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Package encryption implements the creation of encrypted image layers
+// as specified by the OCI image-spec encryption extension (as used by
+// containerd's imgcrypt and ocicrypt).
+//
+// Each layer is encrypted with a random symmetric key using
+// AES-256-CTR and authenticated with HMAC-SHA256. The symmetric key is
+// then wrapped for each recipient in a JWE (RSA-OAEP key encryption,
+// A256GCM content encryption) and stored in the layer annotations.
+//
+// Only RSA recipient keys are currently supported.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// MediaType of encrypted gzip-compressed layers
+	LayerType = "application/vnd.oci.image.layer.v1.tar+gzip+encrypted"
+
+	// Annotations carrying the wrapped keys and public options
+	jweAnnotation     = "org.opencontainers.image.enc.keys.jwe"
+	pubOptsAnnotation = "org.opencontainers.image.enc.pubopts"
+
+	cipherName = "AES_256_CTR_HMAC_SHA256"
+)
+
+// privateOptions are the layer options that are only available to
+// recipients, as they are transported inside of the JWE.
+type privateOptions struct {
+	SymmetricKey  []byte            `json:"symkey"`
+	Digest        string            `json:"digest"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// publicOptions are stored in the clear in the layer annotations.
+type publicOptions struct {
+	Cipher        string            `json:"cipher"`
+	Hmac          []byte            `json:"hmac"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// LoadRecipient reads an RSA public key from a PEM file, which may
+// contain either a PKIX or a PKCS#1 public key.
+func LoadRecipient(path string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse public key in %s: %s", path, err)
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key in %s is not an RSA key", path)
+	}
+
+	return rsaKey, nil
+}
+
+// Writer encrypts a layer written to it and forwards the ciphertext
+// to an underlying writer. The layer annotations can be retrieved
+// after all data has been written.
+type Writer struct {
+	w      io.Writer
+	stream cipher.Stream
+	mac    hash.Hash
+	opts   privateOptions
+}
+
+// NewWriter creates a writer that encrypts data with a new random key.
+func NewWriter(w io.Writer) (*Writer, error) {
+	key := make([]byte, 32)
+	nonce := make([]byte, aes.BlockSize)
+
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:      w,
+		stream: cipher.NewCTR(block, nonce),
+		mac:    hmac.New(sha256.New, key),
+		opts: privateOptions{
+			SymmetricKey: key,
+			CipherOptions: map[string][]byte{
+				"nonce": nonce,
+			},
+		},
+	}, nil
+}
+
+func (e *Writer) Write(p []byte) (int, error) {
+	out := make([]byte, len(p))
+	e.stream.XORKeyStream(out, p)
+	e.mac.Write(out)
+
+	return e.w.Write(out)
+}
+
+// Annotations finalises the encryption and returns the annotations
+// that must be set on the layer descriptor. The digest of the
+// unencrypted layer is recorded in the private options, which lets
+// recipients verify the decrypted content.
+func (e *Writer) Annotations(plainDigest string, recipients []*rsa.PublicKey) (map[string]string, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients configured for encrypted layer")
+	}
+
+	e.opts.Digest = plainDigest
+	private, err := json.Marshal(e.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	jwe, err := seal(private, recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := json.Marshal(publicOptions{
+		Cipher:        cipherName,
+		Hmac:          e.mac.Sum(nil),
+		CipherOptions: map[string][]byte{},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		jweAnnotation:     base64.StdEncoding.EncodeToString(jwe),
+		pubOptsAnnotation: base64.StdEncoding.EncodeToString(public),
+	}, nil
+}
+
+// JWE in general JSON serialisation, with one entry per recipient.
+type jweRecipient struct {
+	Header       map[string]string `json:"header"`
+	EncryptedKey string            `json:"encrypted_key"`
+}
+
+type jweMessage struct {
+	Protected  string         `json:"protected"`
+	Recipients []jweRecipient `json:"recipients"`
+	IV         string         `json:"iv"`
+	Ciphertext string         `json:"ciphertext"`
+	Tag        string         `json:"tag"`
+}
+
+// seal encrypts the payload into a JWE that can be opened by any of
+// the recipients.
+func seal(payload []byte, recipients []*rsa.PublicKey) ([]byte, error) {
+	b64 := base64.RawURLEncoding
+
+	cek := make([]byte, 32)
+	if _, err := rand.Read(cek); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	protected := b64.EncodeToString([]byte(`{"enc":"A256GCM"}`))
+
+	// The protected header is authenticated as additional data, and
+	// GCM appends the authentication tag to the ciphertext.
+	sealed := gcm.Seal(nil, iv, payload, []byte(protected))
+	ciphertext := sealed[:len(sealed)-gcm.Overhead()]
+	tag := sealed[len(sealed)-gcm.Overhead():]
+
+	msg := jweMessage{
+		Protected:  protected,
+		IV:         b64.EncodeToString(iv),
+		Ciphertext: b64.EncodeToString(ciphertext),
+		Tag:        b64.EncodeToString(tag),
+	}
+
+	for _, r := range recipients {
+		wrapped, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, r, cek, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Recipients = append(msg.Recipients, jweRecipient{
+			Header:       map[string]string{"alg": "RSA-OAEP"},
+			EncryptedKey: b64.EncodeToString(wrapped),
+		})
+	}
+
+	return json.Marshal(msg)
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+// open decrypts the private layer options from the JWE annotation,
+// as a recipient would.
+func open(t *testing.T, annotation string, key *rsa.PrivateKey, idx int) privateOptions {
+	b64 := base64.RawURLEncoding
+
+	raw, err := base64.StdEncoding.DecodeString(annotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg jweMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, _ := b64.DecodeString(msg.Recipients[idx].EncryptedKey)
+	cek, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, key, wrapped, nil)
+	if err != nil {
+		t.Fatalf("failed to unwrap content key: %s", err)
+	}
+
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	iv, _ := b64.DecodeString(msg.IV)
+	ciphertext, _ := b64.DecodeString(msg.Ciphertext)
+	tag, _ := b64.DecodeString(msg.Tag)
+
+	plain, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(msg.Protected))
+	if err != nil {
+		t.Fatalf("failed to decrypt JWE payload: %s", err)
+	}
+
+	var opts privateOptions
+	if err := json.Unmarshal(plain, &opts); err != nil {
+		t.Fatal(err)
+	}
+
+	return opts
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	alice, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bob, _ := rsa.GenerateKey(rand.Reader, 2048)
+	layer := bytes.Repeat([]byte("nixery layer content "), 1000)
+
+	var out bytes.Buffer
+	w, err := NewWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(layer)
+
+	annotations, err := w.Annotations("sha256:abc", []*rsa.PublicKey{&alice.PublicKey, &bob.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(out.Bytes(), layer) {
+		t.Fatal("layer was not encrypted")
+	}
+
+	for idx, key := range []*rsa.PrivateKey{alice, bob} {
+		opts := open(t, annotations[jweAnnotation], key, idx)
+		if opts.Digest != "sha256:abc" {
+			t.Fatalf("unexpected digest in private options: %q", opts.Digest)
+		}
+
+		block, _ := aes.NewCipher(opts.SymmetricKey)
+		plain := make([]byte, out.Len())
+		cipher.NewCTR(block, opts.CipherOptions["nonce"]).XORKeyStream(plain, out.Bytes())
+
+		if !bytes.Equal(plain, layer) {
+			t.Fatalf("recipient %d could not decrypt the layer", idx)
+		}
+
+		var public publicOptions
+		raw, _ := base64.StdEncoding.DecodeString(annotations[pubOptsAnnotation])
+		json.Unmarshal(raw, &public)
+
+		mac := hmac.New(sha256.New, opts.SymmetricKey)
+		mac.Write(out.Bytes())
+		if !hmac.Equal(mac.Sum(nil), public.Hmac) {
+			t.Fatal("layer HMAC does not match")
+		}
+	}
+}
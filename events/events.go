@@ -0,0 +1,141 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Package events publishes notifications about the lifecycle of image
+// builds (and related happenings, such as cache evictions) to an
+// external message bus.
+//
+// This lets external systems, such as cost accounting or security
+// scanning pipelines, react to builds without polling Nixery.
+//
+// Publishing is strictly best-effort: events are queued in memory and
+// delivered in the background, and are dropped if the bus can not keep
+// up. Nixery itself never blocks on event delivery.
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Type identifies the kind of an event.
+type Type string
+
+const (
+	BuildStarted   Type = "build.started"
+	BuildSucceeded Type = "build.succeeded"
+	BuildFailed    Type = "build.failed"
+	CacheEvicted   Type = "cache.evicted"
+)
+
+// queueSize is the number of events that can be waiting for delivery
+// before new events are dropped.
+const queueSize = 256
+
+// Event is the payload published for each event, serialised as JSON.
+type Event struct {
+	Type Type      `json:"type"`
+	Time time.Time `json:"time"`
+
+	Image string `json:"image,omitempty"`
+	Tag   string `json:"tag,omitempty"`
+	Arch  string `json:"arch,omitempty"`
+
+	// Set for finished builds
+	Digest   string  `json:"digest,omitempty"`
+	Duration float64 `json:"durationSeconds,omitempty"`
+	Error    string  `json:"error,omitempty"`
+
+	// Set for evicted cache entries. Blobs deleted by garbage
+	// collection only carry their digest.
+	Key string `json:"key,omitempty"`
+}
+
+// sink is implemented by the supported message bus transports.
+type sink interface {
+	name() string
+	send(payload []byte) error
+}
+
+// Bus queues events and delivers them to the configured sink.
+//
+// A nil *Bus is valid and discards all events, so callers do not need
+// to check whether publishing is configured.
+type Bus struct {
+	sink  sink
+	queue chan Event
+}
+
+// New creates a bus publishing to the specified URL and starts its
+// delivery loop. The URL scheme selects the transport:
+//
+// * `nats://[user:pass@]host:port/subject` publishes to a NATS subject
+// * `http(s)://...` POSTs each event to a webhook (e.g. a Kafka REST proxy)
+func New(target string) (*Bus, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event bus URL: %s", err)
+	}
+
+	var s sink
+	switch u.Scheme {
+	case "nats":
+		s, err = newNATSSink(u)
+	case "http", "https":
+		s = &webhookSink{url: target}
+	default:
+		err = fmt.Errorf("unsupported event bus scheme %q", u.Scheme)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bus{
+		sink:  s,
+		queue: make(chan Event, queueSize),
+	}
+	go b.deliver()
+
+	log.WithField("sink", s.name()).Info("publishing build events")
+	return b, nil
+}
+
+// Publish queues an event for delivery. The event time is set if it is
+// not already populated.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	select {
+	case b.queue <- e:
+	default:
+		log.WithField("event", e.Type).Warn("event queue is full, dropping event")
+	}
+}
+
+func (b *Bus) deliver() {
+	for e := range b.queue {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			log.WithError(err).WithField("event", e.Type).Error("failed to serialise event")
+			continue
+		}
+
+		if err := b.sink.send(payload); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"event": e.Type,
+				"sink":  b.sink.name(),
+			}).Warn("failed to publish event")
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package events
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	received := make(chan Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		if r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&e) != nil {
+			w.WriteHeader(400)
+			return
+		}
+		received <- e
+	}))
+	defer srv.Close()
+
+	b, err := New(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.Publish(Event{Type: BuildSucceeded, Image: "shell", Tag: "latest", Digest: "sha256:abc"})
+
+	select {
+	case e := <-received:
+		if e.Type != BuildSucceeded || e.Image != "shell" || e.Digest != "sha256:abc" {
+			t.Errorf("unexpected event %+v", e)
+		}
+		if e.Time.IsZero() {
+			t.Error("event time was not set")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+}
+
+func TestFullQueueDropsEvents(t *testing.T) {
+	// Without a delivery loop, the queue is never drained.
+	b := &Bus{
+		sink:  &webhookSink{},
+		queue: make(chan Event, 1),
+	}
+
+	b.Publish(Event{Type: BuildStarted, Image: "first"})
+	b.Publish(Event{Type: BuildStarted, Image: "second"})
+
+	if len(b.queue) != 1 {
+		t.Fatalf("expected one queued event, got %d", len(b.queue))
+	}
+	if e := <-b.queue; e.Image != "first" {
+		t.Errorf("expected the newest event to be dropped, got %+v", e)
+	}
+}
+
+func TestNilBus(t *testing.T) {
+	var b *Bus
+	b.Publish(Event{Type: BuildFailed})
+}
+
+func TestUnsupportedScheme(t *testing.T) {
+	if _, err := New("kafka://broker:9092/topic"); err == nil {
+		t.Error("unsupported event bus was accepted")
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webhookSink POSTs each event to an HTTP endpoint.
+type webhookSink struct {
+	url string
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (w *webhookSink) name() string {
+	return "webhook"
+}
+
+func (w *webhookSink) send(payload []byte) error {
+	resp, err := webhookClient.Post(w.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// natsSink publishes events to a NATS subject.
+//
+// Only the small subset of the (text-based) NATS client protocol that
+// is required for publishing is implemented, which avoids pulling in a
+// full client library for a fire-and-forget use-case.
+type natsSink struct {
+	addr    string
+	subject string
+	connect []byte
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+type natsConnect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+	Token    string `json:"auth_token,omitempty"`
+}
+
+func newNATSSink(u *url.URL) (*natsSink, error) {
+	subject := strings.Trim(u.Path, "/")
+	if subject == "" {
+		subject = "nixery.events"
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	c := natsConnect{Name: "nixery"}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			c.User = u.User.Username()
+			c.Pass = pass
+		} else {
+			c.Token = u.User.Username()
+		}
+	}
+	connect, _ := json.Marshal(c)
+
+	return &natsSink{
+		addr:    host,
+		subject: subject,
+		connect: connect,
+	}, nil
+}
+
+func (n *natsSink) name() string {
+	return "nats://" + n.addr + "/" + n.subject
+}
+
+// dial establishes a new connection and performs the protocol
+// handshake. The server's INFO line is read and discarded.
+func (n *natsSink) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", n.addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	info, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected NATS handshake: %q (%v)", info, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", n.connect); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The server regularly pings its clients and disconnects them
+	// if they do not respond.
+	go func() {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			if strings.HasPrefix(line, "PING") {
+				n.mu.Lock()
+				conn.Write([]byte("PONG\r\n"))
+				n.mu.Unlock()
+			}
+		}
+	}()
+
+	return conn, nil
+}
+
+func (n *natsSink) send(payload []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conn == nil {
+		conn, err := n.dial()
+		if err != nil {
+			return err
+		}
+		n.conn = conn
+	}
+
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\n", n.subject, len(payload), payload)
+	if _, err := n.conn.Write([]byte(msg)); err != nil {
+		// Reconnect on the next event
+		n.conn.Close()
+		n.conn = nil
+		return err
+	}
+
+	return nil
+}
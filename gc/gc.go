@@ -0,0 +1,331 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Package gc implements garbage collection of blobs in the storage
+// backend.
+//
+// Every manifest served by Nixery is recorded in a reference record
+// (stored at `refs/<digest>`) listing the blobs it references. Along
+// with the manifests in the build cache (`manifests/`), these records
+// form the roots of the reference graph.
+//
+// Blobs are only ever deleted if no root references them, and if they
+// have not been written within a grace period. The grace period
+// protects the layers of builds that are still in progress, which are
+// uploaded before their manifest exists.
+package gc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/google/nixery/api"
+	"github.com/google/nixery/events"
+	mf "github.com/google/nixery/manifest"
+	"github.com/google/nixery/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// Record is the reference record persisted for each served manifest.
+type Record struct {
+	Manifest string   `json:"manifest"`
+	Blobs    []string `json:"blobs"`
+
+	// Time after which the record no longer references its blobs,
+	// set for manifests with a lifetime annotation
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Options configure a garbage collection run.
+type Options struct {
+	// Minimum age of unreferenced blobs before they are deleted
+	Grace time.Duration
+
+	// Only report what would be deleted, without deleting anything
+	DryRun bool
+
+	// Bus on which deleted blobs and layer cache entries are
+	// announced
+	Events *events.Bus
+}
+
+// Report summarises the outcome of a garbage collection run.
+type Report = api.GCReport
+
+// RecordReferences persists the reference record for a manifest with
+// the given digest (`sha256:<hex>`). Records of manifests with a
+// lifetime (see api.TTLAnnotation) expire once it has passed, which
+// restarts whenever the record is written again.
+func RecordReferences(ctx context.Context, s storage.Backend, digest string, m json.RawMessage) error {
+	blobs, err := mf.References(m)
+	if err != nil {
+		return fmt.Errorf("failed to parse manifest references: %s", err)
+	}
+
+	record := Record{
+		Manifest: digest,
+		Blobs:    append(blobs, digest),
+	}
+
+	if ttl, ok := mf.Annotations(m)[api.TTLAnnotation]; ok {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return fmt.Errorf("invalid lifetime annotation: %s", err)
+		}
+
+		expires := time.Now().Add(d)
+		record.Expires = &expires
+	}
+
+	j, _ := json.Marshal(record)
+
+	path := "refs/" + strings.TrimPrefix(digest, "sha256:")
+	_, _, err = s.Persist(ctx, path, "application/json", func(w io.Writer) (string, int64, error) {
+		size, err := io.Copy(w, bytes.NewReader(j))
+		return "", size, err
+	})
+
+	return err
+}
+
+func fetch(ctx context.Context, s storage.Backend, path string) ([]byte, error) {
+	r, err := s.Fetch(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// references counts the references to each blob from all roots. The
+// paths of expired reference records, which are not roots, are
+// returned separately.
+func references(ctx context.Context, s storage.Backend) (map[string]int, int, []string, error) {
+	counts := make(map[string]int)
+	roots := 0
+	var expired []string
+
+	refs, err := s.List(ctx, "refs/")
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to list reference records: %s", err)
+	}
+
+	now := time.Now()
+	for _, obj := range refs {
+		j, err := fetch(ctx, s, obj.Path)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("failed to read reference record %s: %s", obj.Path, err)
+		}
+
+		var record Record
+		if err := json.Unmarshal(j, &record); err != nil {
+			return nil, 0, nil, fmt.Errorf("invalid reference record %s: %s", obj.Path, err)
+		}
+
+		if record.Expires != nil && record.Expires.Before(now) {
+			expired = append(expired, obj.Path)
+			continue
+		}
+
+		for _, blob := range record.Blobs {
+			counts[blob]++
+		}
+		roots++
+	}
+
+	cached, err := s.List(ctx, "manifests/")
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to list cached manifests: %s", err)
+	}
+
+	for _, obj := range cached {
+		m, err := fetch(ctx, s, obj.Path)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("failed to read cached manifest %s: %s", obj.Path, err)
+		}
+
+		// Any failure to account for a root must abort the
+		// collection, as its blobs would otherwise be deleted.
+		blobs, err := mf.References(m)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("invalid cached manifest %s: %s", obj.Path, err)
+		}
+
+		for _, blob := range blobs {
+			counts[blob]++
+		}
+
+		// Cached manifests are served in their compacted form, which
+		// is also how they are addressed by digest.
+		compact, _ := json.Marshal(json.RawMessage(m))
+		counts[fmt.Sprintf("sha256:%x", sha256.Sum256(compact))]++
+		roots++
+	}
+
+	return counts, roots, expired, nil
+}
+
+// Collect deletes all blobs that are not referenced by any root and
+// are older than the grace period, as well as layer cache entries
+// (`builds/`) pointing to blobs that no longer exist and abandoned
+// uploads in the staging area.
+func Collect(ctx context.Context, s storage.Backend, opts Options) (*Report, error) {
+	counts, roots, expired, err := references(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	report := Report{
+		Roots:   roots,
+		Expired: len(expired),
+		DryRun:  opts.DryRun,
+	}
+
+	// Expired records are deleted before their blobs, so that a
+	// failed run does not leave records of deleted blobs behind.
+	for _, path := range expired {
+		log.WithFields(log.Fields{
+			"record": path,
+			"dryRun": opts.DryRun,
+		}).Info("deleting expired reference record")
+
+		if !opts.DryRun {
+			if err := s.Delete(ctx, path); err != nil {
+				return &report, fmt.Errorf("failed to delete expired record %s: %s", path, err)
+			}
+		}
+	}
+	cutoff := time.Now().Add(-opts.Grace)
+
+	blobs, err := s.List(ctx, "layers/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blobs: %s", err)
+	}
+
+	live := make(map[string]bool)
+	for _, obj := range blobs {
+		digest := "sha256:" + strings.TrimPrefix(obj.Path, "layers/")
+
+		if counts[digest] > 0 {
+			report.Referenced++
+			live[digest] = true
+			continue
+		}
+
+		if obj.Updated.After(cutoff) {
+			report.Grace++
+			live[digest] = true
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"digest": digest,
+			"size":   obj.Size,
+			"dryRun": opts.DryRun,
+		}).Info("deleting unreferenced blob")
+
+		if !opts.DryRun {
+			if err := s.Delete(ctx, obj.Path); err != nil {
+				return &report, fmt.Errorf("failed to delete blob %s: %s", digest, err)
+			}
+
+			opts.Events.Publish(events.Event{
+				Type:   events.CacheEvicted,
+				Digest: digest,
+			})
+		}
+
+		report.Deleted++
+		report.Freed += obj.Size
+	}
+
+	// Layer cache entries for deleted blobs would otherwise cause
+	// future builds to reference them.
+	builds, err := s.List(ctx, "builds/")
+	if err != nil {
+		return &report, fmt.Errorf("failed to list layer cache: %s", err)
+	}
+
+	for _, obj := range builds {
+		j, err := fetch(ctx, s, obj.Path)
+		if err != nil {
+			log.WithError(err).WithField("path", obj.Path).Warn("failed to read cached layer")
+			continue
+		}
+
+		var entry mf.Entry
+		if err := json.Unmarshal(j, &entry); err != nil || live[entry.Digest] {
+			continue
+		}
+
+		if !opts.DryRun {
+			if err := s.Delete(ctx, obj.Path); err != nil {
+				return &report, fmt.Errorf("failed to delete cached layer %s: %s", obj.Path, err)
+			}
+
+			opts.Events.Publish(events.Event{
+				Type:   events.CacheEvicted,
+				Key:    strings.TrimPrefix(obj.Path, "builds/"),
+				Digest: entry.Digest,
+			})
+		}
+		report.Builds++
+	}
+
+	// Uploads are moved out of the staging area once they are
+	// complete, so anything older than the grace period belongs to a
+	// failed build.
+	staging, err := s.List(ctx, "staging/")
+	if err != nil {
+		return &report, fmt.Errorf("failed to list staging area: %s", err)
+	}
+
+	for _, obj := range staging {
+		if obj.Updated.After(cutoff) {
+			continue
+		}
+
+		if !opts.DryRun {
+			if err := s.Delete(ctx, obj.Path); err != nil {
+				return &report, fmt.Errorf("failed to delete staged upload %s: %s", obj.Path, err)
+			}
+		}
+		report.Staging++
+		report.Freed += obj.Size
+	}
+
+	// Chunks are only unreferenced once the recipes of the blobs
+	// deleted above are gone.
+	if chunked, ok := s.(*storage.ChunkedBackend); ok {
+		deleted, freed, err := chunked.CollectChunks(ctx, cutoff, opts.DryRun)
+		if err != nil {
+			return &report, err
+		}
+
+		report.Chunks = deleted
+		report.Freed += freed
+	}
+
+	log.WithFields(log.Fields{
+		"roots":      report.Roots,
+		"referenced": report.Referenced,
+		"grace":      report.Grace,
+		"deleted":    report.Deleted,
+		"freedBytes": report.Freed,
+		"builds":     report.Builds,
+		"staging":    report.Staging,
+		"chunks":     report.Chunks,
+		"expired":    report.Expired,
+		"dryRun":     report.DryRun,
+	}).Info("completed garbage collection")
+
+	return &report, nil
+}
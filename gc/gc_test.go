@@ -0,0 +1,80 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package gc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/nixery/events"
+	"github.com/google/nixery/storage"
+)
+
+func TestCollectAnnouncesEvictions(t *testing.T) {
+	received := make(chan events.Event, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e events.Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err == nil {
+			received <- e
+		}
+	}))
+	defer srv.Close()
+
+	bus, err := events.New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	s := storage.NewMemoryBackend()
+	put := func(path string, data []byte) {
+		s.Persist(ctx, path, "", func(w io.Writer) (string, int64, error) {
+			n, err := io.Copy(w, bytes.NewReader(data))
+			return "", n, err
+		})
+	}
+	put("layers/abc", []byte("layer"))
+	put("builds/key", []byte(`{"digest":"sha256:abc","size":5}`))
+
+	report, err := Collect(ctx, s, Options{Events: bus})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 1 || report.Builds != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	expected := map[string]bool{"sha256:abc": true, "key": true}
+	for len(expected) > 0 {
+		select {
+		case e := <-received:
+			if e.Type != events.CacheEvicted || e.Digest != "sha256:abc" {
+				t.Errorf("unexpected event %+v", e)
+			}
+			if e.Key != "" {
+				delete(expected, e.Key)
+			} else {
+				delete(expected, e.Digest)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("evictions were not announced: %v", expected)
+		}
+	}
+
+	// Dry runs do not evict anything.
+	put("layers/def", []byte("other layer"))
+	if _, err := Collect(ctx, s, Options{DryRun: true, Events: bus}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-received:
+		t.Errorf("dry run announced an eviction: %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
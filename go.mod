@@ -9,5 +9,7 @@ require (
 	github.com/pkg/xattr v0.4.7
 	github.com/sirupsen/logrus v1.8.1
 	golang.org/x/oauth2 v0.0.0-20220524215830-622c5d57e401
+	golang.org/x/sys v0.0.0-20220408201424-a24fb2fb8a0f
 	gonum.org/v1/gonum v0.11.0
+	google.golang.org/api v0.74.0
 )
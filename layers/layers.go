@@ -127,12 +127,46 @@ type RuntimeGraph struct {
 	} `json:"exportReferencesGraph"`
 
 	Graph []struct {
-		Size uint64   `json:"closureSize"`
-		Path string   `json:"path"`
-		Refs []string `json:"references"`
+		Size    uint64   `json:"closureSize"`
+		NarSize uint64   `json:"narSize"`
+		Path    string   `json:"path"`
+		Refs    []string `json:"references"`
 	} `json:"graph"`
 }
 
+// ClosureSizes returns the closure size of each top-level package in
+// the graph (i.e. the packages that were requested for the image),
+// keyed by package name.
+//
+// Closures of different packages may overlap, so these sizes do not
+// add up to the total size of the image.
+func (g *RuntimeGraph) ClosureSizes() map[string]uint64 {
+	top := make(map[string]bool)
+	for _, p := range g.References.Graph {
+		top[p] = true
+	}
+
+	sizes := make(map[string]uint64)
+	for _, c := range g.Graph {
+		if top[c.Path] {
+			sizes[PackageFromPath(c.Path)] = c.Size
+		}
+	}
+
+	return sizes
+}
+
+// TotalSize returns the total (uncompressed) size of all store paths
+// in the graph.
+func (g *RuntimeGraph) TotalSize() uint64 {
+	var total uint64
+	for _, c := range g.Graph {
+		total += c.NarSize
+	}
+
+	return total
+}
+
 // Popularity data for each Nix package that was calculated in advance.
 //
 // Popularity is a number from 1-100 that represents the
@@ -0,0 +1,34 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package layers
+
+import "sort"
+
+// PathLayers places each store path of the graph into its own layer,
+// without grouping the graph (which requires the popularity data).
+// This is only possible if the store paths fit into the layer budget,
+// otherwise false is returned.
+//
+// Layers of a single store path are shared with every other image
+// containing the same path, including the layers that grouping would
+// have split off for popular or large packages.
+func PathLayers(refs *RuntimeGraph, budget int) ([]Layer, bool) {
+	if len(refs.Graph) > budget {
+		return nil, false
+	}
+
+	layers := make([]Layer, 0, len(refs.Graph))
+	for _, c := range refs.Graph {
+		layers = append(layers, Layer{
+			Contents:    []string{c.Path},
+			MergeRating: c.Size,
+		})
+	}
+
+	// Layers are ordered like grouped layers, see dominate.
+	sort.Slice(layers, func(i, j int) bool {
+		return layers[i].MergeRating < layers[j].MergeRating
+	})
+
+	return layers, true
+}
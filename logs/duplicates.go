@@ -0,0 +1,68 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package logs
+
+// This file implements the suppression of duplicate log lines. Some
+// lines are logged for every request to an object, e.g. for each blob
+// of an image that is pulled by hundreds of CI jobs. Such lines are
+// only logged the first time in each interval, and the number of
+// suppressed lines is logged when the interval ends.
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Suppressed repetitions of each line logged in the current interval
+var duplicates = struct {
+	sync.Mutex
+	seen map[string]uint64
+}{seen: make(map[string]uint64)}
+
+// Duplicate reports whether a line with the given key (usually the
+// message and the object it refers to) was already logged in the
+// current interval, in which case it should not be logged again.
+// Nothing is suppressed at the debug level.
+func Duplicate(key string) bool {
+	if log.IsLevelEnabled(log.DebugLevel) {
+		return false
+	}
+
+	duplicates.Lock()
+	defer duplicates.Unlock()
+
+	n, seen := duplicates.seen[key]
+	if seen {
+		n++
+	}
+	duplicates.seen[key] = n
+
+	return seen
+}
+
+// ReportDuplicates logs the number of duplicate lines suppressed in the
+// current interval, and starts a new interval.
+func ReportDuplicates() {
+	duplicates.Lock()
+	seen := duplicates.seen
+	duplicates.seen = make(map[string]uint64)
+	duplicates.Unlock()
+
+	var lines, suppressed uint64
+	for _, n := range seen {
+		if n > 0 {
+			lines++
+			suppressed += n
+		}
+	}
+
+	if suppressed == 0 {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"lines":      lines,
+		"suppressed": suppressed,
+	}).Info("suppressed duplicate log lines")
+}
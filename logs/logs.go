@@ -11,6 +11,9 @@ package logs
 import (
 	"bytes"
 	"encoding/json"
+	"sync"
+	"sync/atomic"
+
 	log "github.com/sirupsen/logrus"
 )
 
@@ -101,8 +104,93 @@ func (f stackdriverFormatter) Format(e *log.Entry) ([]byte, error) {
 	return b.Bytes(), err
 }
 
+// Number of log entries retained in memory for support bundles.
+const recentSize = 1000
+
+// recentHook retains the most recent log entries in memory.
+type recentHook struct {
+	mu      sync.Mutex
+	entries [][]byte
+}
+
+var recent = &recentHook{}
+
+func (h *recentHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *recentHook) Fire(e *log.Entry) error {
+	// The formatter modifies the fields of the entry, so a copy is
+	// formatted to leave the entry intact for the actual output.
+	c := *e
+	c.Data = make(log.Fields, len(e.Data))
+	for k, v := range e.Data {
+		c.Data[k] = v
+	}
+
+	b, err := stackdriverFormatter{}.Format(&c)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries = append(h.entries, b)
+	if len(h.entries) > recentSize {
+		h.entries = h.entries[len(h.entries)-recentSize:]
+	}
+
+	return nil
+}
+
+// Recent returns the most recent log entries in their formatted form,
+// oldest first.
+func Recent() []byte {
+	recent.mu.Lock()
+	defer recent.mu.Unlock()
+
+	return bytes.Join(recent.entries, nil)
+}
+
 func Init(version string) {
 	nixeryContext.Version = version
 	log.SetReportCaller(true)
 	log.SetFormatter(stackdriverFormatter{})
+	log.AddHook(recent)
+}
+
+// verboseNix is set (to 1) if Nix should be invoked with verbose
+// output. It is accessed atomically, as it can be toggled at runtime.
+var verboseNix int32
+
+// SetLevel changes the log level at runtime.
+func SetLevel(level string) error {
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	log.SetLevel(l)
+	return nil
+}
+
+// Level returns the name of the current log level.
+func Level() string {
+	return log.GetLevel().String()
+}
+
+// SetVerboseNix toggles verbose output of spawned Nix processes.
+func SetVerboseNix(verbose bool) {
+	var v int32
+	if verbose {
+		v = 1
+	}
+
+	atomic.StoreInt32(&verboseNix, v)
+}
+
+// VerboseNix reports whether Nix should be invoked with verbose output.
+func VerboseNix() bool {
+	return atomic.LoadInt32(&verboseNix) == 1
 }
@@ -1,8 +1,15 @@
 // Copyright 2022 The TVL Contributors
 // SPDX-License-Identifier: Apache-2.0
 
-// Package image implements logic for creating the image metadata
-// (such as the image manifest and configuration).
+// Package manifest implements the image metadata served by Nixery
+// (image manifests, configurations and indexes).
+//
+// The documents are represented by typed structs (see ImageManifest,
+// ImageConfig and ImageIndex), which can be parsed and validated from
+// their serialised form with Parse, ParseConfig and ParseIndex. The
+// functions Manifest, WasmManifest, ArtifactManifest and Index build
+// serialised documents in the form Nixery serves them, so that other
+// tools can construct manifests compatible with Nixery.
 package manifest
 
 import (
@@ -13,8 +20,8 @@ import (
 )
 
 const (
-	// manifest constants
-	schemaVersion = 2
+	// Schema version of all manifests and indexes
+	SchemaVersion = 2
 
 	// media types
 	ManifestType = "application/vnd.docker.distribution.manifest.v2+json"
@@ -24,39 +31,135 @@ const (
 	// image config constants
 	os     = "linux"
 	fsType = "layers"
+
+	// WebAssembly artifact media types, as specified by the CNCF
+	// TAG Runtime WASM OCI artifact layout
+	OCIManifestType = "application/vnd.oci.image.manifest.v1+json"
+	WasmLayerType   = "application/wasm"
+	wasmConfigType  = "application/vnd.wasm.config.v0+json"
+
+	// Layers that clients fetch from the URLs in their descriptor
+	// instead of the registry
+	ForeignLayerType = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+
+	// Artifacts attached to images, which are listed in the index
+	// returned by the referrers API
+	OCIIndexType    = "application/vnd.oci.image.index.v1+json"
+	emptyConfigType = "application/vnd.oci.empty.v1+json"
 )
 
+// EmptyConfig is the configuration blob of artifacts, which have no
+// configuration.
+var EmptyConfig = ConfigLayer{
+	Config: []byte("{}"),
+	SHA256: "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a",
+}
+
+// Entry is a descriptor, which refers to a blob (such as a layer) or
+// to another manifest by its digest.
 type Entry struct {
-	MediaType string `json:"mediaType,omitempty"`
-	Size      int64  `json:"size"`
-	Digest    string `json:"digest"`
+	MediaType    string            `json:"mediaType,omitempty"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Size         int64             `json:"size"`
+	Digest       string            `json:"digest"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	URLs         []string          `json:"urls,omitempty"`
+	Platform     *Platform         `json:"platform,omitempty"`
 
 	// These fields are internal to Nixery and not part of the
 	// serialised entry.
 	MergeRating uint64 `json:"-"`
 	TarHash     string `json:",omitempty"`
+
+	// Packages in the layer whose licenses forbid redistribution
+	Nondistributable []string `json:"-"`
+}
+
+// Annotations reads the annotations of a serialised manifest. Invalid
+// manifests are treated as having no annotations.
+func Annotations(m json.RawMessage) map[string]string {
+	var parsed struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	json.Unmarshal(m, &parsed)
+
+	return parsed.Annotations
 }
 
-type manifest struct {
-	SchemaVersion int     `json:"schemaVersion"`
-	MediaType     string  `json:"mediaType"`
-	Config        Entry   `json:"config"`
-	Layers        []Entry `json:"layers"`
+// References returns the digests of all blobs (configuration and
+// layers) referenced by a serialised manifest, or of all manifests
+// referenced by an image index.
+func References(m json.RawMessage) ([]string, error) {
+	if MediaType(m) == OCIIndexType {
+		var index ImageIndex
+		if err := json.Unmarshal(m, &index); err != nil {
+			return nil, err
+		}
+
+		var refs []string
+		for _, d := range index.Manifests {
+			refs = append(refs, d.Digest)
+		}
+
+		return refs, nil
+	}
+
+	var parsed ImageManifest
+	if err := json.Unmarshal(m, &parsed); err != nil {
+		return nil, err
+	}
+
+	refs := []string{parsed.Config.Digest}
+	for _, l := range parsed.Layers {
+		refs = append(refs, l.Digest)
+	}
+
+	return refs, nil
 }
 
-type imageConfig struct {
-	Architecture string `json:"architecture"`
-	OS           string `json:"os"`
+// TransferSize returns the number of bytes clients have to download
+// to pull an image from scratch, i.e. the sum of the sizes of its
+// configuration and layers.
+func TransferSize(m json.RawMessage) (int64, error) {
+	var parsed ImageManifest
+	if err := json.Unmarshal(m, &parsed); err != nil {
+		return 0, err
+	}
 
-	RootFS struct {
-		FSType  string   `json:"type"`
-		DiffIDs []string `json:"diff_ids"`
-	} `json:"rootfs"`
+	total := parsed.Config.Size
+	for _, l := range parsed.Layers {
+		if l.Size <= 0 {
+			return 0, fmt.Errorf("layer %s has no size", l.Digest)
+		}
+		total += l.Size
+	}
 
-	Config struct {
-		Cmd []string `json:"cmd,omitempty"`
-		Env []string `json:"env,omitempty"`
-	} `json:"config"`
+	return total, nil
+}
+
+// MediaType returns the media type of a serialised manifest, which
+// defaults to the Docker manifest type.
+func MediaType(m json.RawMessage) string {
+	var parsed struct {
+		MediaType string `json:"mediaType"`
+	}
+	json.Unmarshal(m, &parsed)
+
+	if parsed.MediaType == "" {
+		return ManifestType
+	}
+
+	return parsed.MediaType
+}
+
+// RuntimeConfig holds the settings that determine how containers are
+// run from the image.
+type RuntimeConfig struct {
+	// Command to run if none is specified by the user
+	Cmd []string
+
+	// Additional environment variables, in `KEY=value` form
+	Env []string
 }
 
 // ConfigLayer represents the configuration layer to be included in
@@ -67,24 +170,32 @@ type ConfigLayer struct {
 	SHA256 string
 }
 
-// imageConfig creates an image configuration with the values set to
-// the constant defaults.
+// NewImageConfig creates the configuration of an image with the given
+// layers (identified by the hashes of their uncompressed tarballs),
+// with the remaining values set to the constant defaults.
+func NewImageConfig(arch string, diffIDs []string, rc RuntimeConfig) ImageConfig {
+	return ImageConfig{
+		Architecture: arch,
+		OS:           os,
+		RootFS: RootFS{
+			Type:    fsType,
+			DiffIDs: diffIDs,
+		},
+		Config: ContainerConfig{
+			Cmd: rc.Cmd,
+			Env: append([]string{"SSL_CERT_FILE=/etc/ssl/certs/ca-bundle.crt"}, rc.Env...),
+		},
+	}
+}
+
+// ConfigBlob serialises a configuration (such as an ImageConfig) into
+// the configuration layer of a manifest.
 //
 // Outside of this module the image configuration is treated as an
 // opaque blob and it is thus returned as an already serialised byte
 // array and its SHA256-hash.
-func configLayer(arch string, hashes []string, cmd string) ConfigLayer {
-	c := imageConfig{}
-	c.Architecture = arch
-	c.OS = os
-	c.RootFS.FSType = fsType
-	c.RootFS.DiffIDs = hashes
-	if cmd != "" {
-		c.Config.Cmd = []string{cmd}
-	}
-	c.Config.Env = []string{"SSL_CERT_FILE=/etc/ssl/certs/ca-bundle.crt"}
-
-	j, _ := json.Marshal(c)
+func ConfigBlob(config interface{}) ConfigLayer {
+	j, _ := json.Marshal(config)
 
 	return ConfigLayer{
 		Config: j,
@@ -92,44 +203,171 @@ func configLayer(arch string, hashes []string, cmd string) ConfigLayer {
 	}
 }
 
-// Manifest creates an image manifest from the specified layer entries
-// and returns its JSON-serialised form as well as the configuration
-// layer.
-//
-// Callers do not need to set the media type for the layer entries.
-func Manifest(arch string, layers []Entry, cmd string) (json.RawMessage, ConfigLayer) {
-	// Sort layers by their merge rating, from highest to lowest.
-	// This makes it likely for a contiguous chain of shared image
-	// layers to appear at the beginning of a layer.
-	//
-	// Due to moby/moby#38446 Docker considers the order of layers
-	// when deciding which layers to download again.
+// Strategies for ordering the layers of a manifest.
+const (
+	// Layers with the highest merge rating first, which makes it
+	// likely for a contiguous chain of shared image layers to
+	// appear at the beginning of a manifest. Due to moby/moby#38446
+	// Docker considers the order of layers when deciding which
+	// layers to download again.
+	OrderMergeRating = "merge-rating"
+
+	// Largest layers first. Clients download layers in the order
+	// of the manifest with limited concurrency, and starting with
+	// the largest ones keeps the downloads parallel for longer.
+	OrderSize = "size"
+)
+
+// SortLayers sorts layer entries according to the given strategy, and
+// by merge rating for unknown strategies.
+func SortLayers(layers []Entry, order string) {
 	sort.Slice(layers, func(i, j int) bool {
 		return layers[i].MergeRating > layers[j].MergeRating
 	})
 
+	if order == OrderSize {
+		sort.SliceStable(layers, func(i, j int) bool {
+			return layers[i].Size > layers[j].Size
+		})
+	}
+}
+
+// Manifest creates an image manifest from the specified layer entries
+// and returns its JSON-serialised form as well as the configuration
+// layer. Layers appear in the manifest in the given order (see
+// SortLayers).
+//
+// Callers do not need to set the media type for the layer entries,
+// unless they differ from the default layer type.
+//
+// Annotations are optional and are serialised as part of the manifest.
+func Manifest(arch string, layers []Entry, rc RuntimeConfig, annotations map[string]string) (json.RawMessage, ConfigLayer) {
 	hashes := make([]string, len(layers))
 	for i, l := range layers {
 		hashes[i] = l.TarHash
-		l.MediaType = LayerType
+		if l.MediaType == "" {
+			l.MediaType = LayerType
+		}
 		l.TarHash = ""
 		layers[i] = l
 	}
 
-	c := configLayer(arch, hashes, cmd)
+	c := ConfigBlob(NewImageConfig(arch, hashes, rc))
 
-	m := manifest{
-		SchemaVersion: schemaVersion,
+	m := ImageManifest{
+		SchemaVersion: SchemaVersion,
 		MediaType:     ManifestType,
 		Config: Entry{
 			MediaType: configType,
 			Size:      int64(len(c.Config)),
 			Digest:    "sha256:" + c.SHA256,
 		},
-		Layers: layers,
+		Layers:      layers,
+		Annotations: annotations,
 	}
 
 	j, _ := json.Marshal(m)
 
 	return json.RawMessage(j), c
 }
+
+type wasmConfig struct {
+	Created      string   `json:"created"`
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	LayerDigests []string `json:"layerDigests"`
+}
+
+// WasmManifest creates the manifest of a WebAssembly artifact, in
+// which each layer is a single (uncompressed) WebAssembly module or
+// component, and returns it along with its configuration layer.
+//
+// The OS is `wasip1` for core modules and `wasip2` for components.
+func WasmManifest(wasmOS string, layers []Entry, annotations map[string]string) (json.RawMessage, ConfigLayer) {
+	digests := make([]string, len(layers))
+	for i, l := range layers {
+		digests[i] = l.Digest
+		layers[i].MediaType = WasmLayerType
+		layers[i].TarHash = ""
+	}
+
+	// The creation time is fixed, as the artifact would otherwise
+	// differ on every build.
+	config := ConfigBlob(wasmConfig{
+		Created:      "1970-01-01T00:00:00Z",
+		Architecture: "wasm",
+		OS:           wasmOS,
+		LayerDigests: digests,
+	})
+
+	m := ImageManifest{
+		SchemaVersion: SchemaVersion,
+		MediaType:     OCIManifestType,
+		Config: Entry{
+			MediaType: wasmConfigType,
+			Size:      int64(len(config.Config)),
+			Digest:    "sha256:" + config.SHA256,
+		},
+		Layers:      layers,
+		Annotations: annotations,
+	}
+
+	j, _ := json.Marshal(m)
+
+	return json.RawMessage(j), config
+}
+
+// Descriptor returns the descriptor of a serialised manifest, which
+// other manifests use to refer to it.
+func Descriptor(m json.RawMessage) Entry {
+	return Entry{
+		MediaType: MediaType(m),
+		Size:      int64(len(m)),
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(m)),
+	}
+}
+
+// ArtifactManifest creates the manifest of an artifact (such as an
+// SBOM) consisting of a single blob, which is attached to the manifest
+// described by subject. Its configuration is EmptyConfig.
+func ArtifactManifest(artifactType string, blob Entry, subject Entry, annotations map[string]string) json.RawMessage {
+	blob.TarHash = ""
+
+	m := ImageManifest{
+		SchemaVersion: SchemaVersion,
+		MediaType:     OCIManifestType,
+		ArtifactType:  artifactType,
+		Config: Entry{
+			MediaType: emptyConfigType,
+			Size:      int64(len(EmptyConfig.Config)),
+			Digest:    "sha256:" + EmptyConfig.SHA256,
+		},
+		Layers:      []Entry{blob},
+		Subject:     &subject,
+		Annotations: annotations,
+	}
+
+	j, _ := json.Marshal(m)
+	return json.RawMessage(j)
+}
+
+// ReferrersIndex creates the image index listing the artifacts that
+// refer to a manifest, as returned by the referrers API.
+func ReferrersIndex(referrers []Entry) json.RawMessage {
+	return Index(referrers)
+}
+
+// Index creates an image index listing the given manifests.
+func Index(manifests []Entry) json.RawMessage {
+	if manifests == nil {
+		manifests = []Entry{}
+	}
+
+	j, _ := json.Marshal(ImageIndex{
+		SchemaVersion: SchemaVersion,
+		MediaType:     OCIIndexType,
+		Manifests:     manifests,
+	})
+
+	return json.RawMessage(j)
+}
@@ -0,0 +1,95 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestManifestRoundTrip(t *testing.T) {
+	layers := []Entry{{Digest: testDigest, Size: 42, TarHash: testDigest}}
+	m, c := Manifest("arm64", layers, RuntimeConfig{Cmd: []string{"bash"}}, map[string]string{"a": "b"})
+
+	parsed, err := Parse(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.MediaType != ManifestType || parsed.Layers[0].MediaType != LayerType {
+		t.Errorf("unexpected media types in %s", m)
+	}
+	if parsed.Config.Digest != "sha256:"+c.SHA256 || parsed.Config.Size != int64(len(c.Config)) {
+		t.Errorf("configuration is not referenced by %s", m)
+	}
+	if parsed.Annotations["a"] != "b" {
+		t.Errorf("annotations are missing from %s", m)
+	}
+
+	// The typed form serialises back to the identical manifest, which
+	// keeps digests stable.
+	j, _ := json.Marshal(parsed)
+	if string(j) != string(m) {
+		t.Errorf("manifest changed on serialisation:\n%s\n%s", m, j)
+	}
+
+	config, err := ParseConfig(c.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Architecture != "arm64" || config.RootFS.DiffIDs[0] != testDigest || config.Config.Cmd[0] != "bash" {
+		t.Errorf("unexpected configuration %s", c.Config)
+	}
+}
+
+func TestIndexRoundTrip(t *testing.T) {
+	m, _ := Manifest("amd64", nil, RuntimeConfig{}, nil)
+
+	parsed, err := ParseIndex(Index([]Entry{Descriptor(m)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parsed.Manifests) != 1 || parsed.Manifests[0].MediaType != ManifestType {
+		t.Errorf("unexpected index %+v", parsed)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() ImageManifest {
+		return ImageManifest{
+			SchemaVersion: SchemaVersion,
+			MediaType:     OCIManifestType,
+			Config:        Entry{MediaType: configType, Digest: testDigest, Size: 2},
+			Layers:        []Entry{{MediaType: LayerType, Digest: testDigest, Size: 1}},
+		}
+	}
+
+	m := valid()
+	if err := m.Validate(); err != nil {
+		t.Fatalf("valid manifest was rejected: %s", err)
+	}
+
+	cases := map[string]func(m *ImageManifest){
+		"schema version":    func(m *ImageManifest) { m.SchemaVersion = 1 },
+		"manifest media":    func(m *ImageManifest) { m.MediaType = OCIIndexType },
+		"configuration":     func(m *ImageManifest) { m.Config.MediaType = "" },
+		"invalid digest":    func(m *ImageManifest) { m.Config.Digest = "sha256:abc" },
+		"layer size":        func(m *ImageManifest) { m.Layers[0].Size = 0 },
+		"negative size":     func(m *ImageManifest) { m.Layers[0].Size = -1 },
+		"layer media":       func(m *ImageManifest) { m.Layers[0].MediaType = "" },
+		"subject digest":    func(m *ImageManifest) { m.Subject = &Entry{Digest: "md5:abc"} },
+		"uppercase digests": func(m *ImageManifest) { m.Layers[0].Digest = strings.ToUpper(testDigest) },
+	}
+
+	for name, mutate := range cases {
+		m := valid()
+		mutate(&m)
+		if err := m.Validate(); err == nil {
+			t.Errorf("%s: invalid manifest was accepted", name)
+		}
+	}
+}
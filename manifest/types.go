@@ -0,0 +1,59 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+// This file contains the typed representations of the documents that
+// Nixery serves: image manifests, image configurations and indexes.
+//
+// The field order of these types determines the serialised form of
+// built manifests, and thereby their digests. Changing it changes the
+// digest of every image built afterwards.
+
+// ImageManifest is an image manifest in either the Docker schema2 or
+// the OCI format, which only differ in their media types.
+type ImageManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        Entry             `json:"config"`
+	Layers        []Entry           `json:"layers"`
+	Subject       *Entry            `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ImageIndex is an OCI image index, which lists other manifests.
+type ImageIndex struct {
+	SchemaVersion int     `json:"schemaVersion"`
+	MediaType     string  `json:"mediaType"`
+	Manifests     []Entry `json:"manifests"`
+}
+
+// Platform describes the platform of an image referenced by an image
+// index, from which clients select the image to run.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// ImageConfig is the configuration of a container image, of which
+// Nixery only sets the fields listed here.
+type ImageConfig struct {
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	RootFS       RootFS          `json:"rootfs"`
+	Config       ContainerConfig `json:"config"`
+}
+
+// RootFS lists the layers of an image configuration by the hashes of
+// their uncompressed tarballs.
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// ContainerConfig holds the runtime settings of an image
+// configuration.
+type ContainerConfig struct {
+	Cmd []string `json:"cmd,omitempty"`
+	Env []string `json:"env,omitempty"`
+}
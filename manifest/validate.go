@@ -0,0 +1,151 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+// This file implements parsing and validation of serialised image
+// manifests, configurations and indexes.
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+var digestRegex = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// ValidDigest reports whether a digest is a valid SHA256 digest, which
+// is the only algorithm used by Nixery.
+func ValidDigest(digest string) bool {
+	return digestRegex.MatchString(digest)
+}
+
+// Validate checks that a descriptor refers to content by a valid
+// digest and size.
+func (e *Entry) Validate() error {
+	if !ValidDigest(e.Digest) {
+		return fmt.Errorf("invalid digest %q", e.Digest)
+	}
+
+	if e.Size < 0 {
+		return fmt.Errorf("invalid size %d of %s", e.Size, e.Digest)
+	}
+
+	return nil
+}
+
+// Validate checks that a manifest is a Docker schema2 or OCI manifest
+// whose configuration and layers are valid descriptors.
+func (m *ImageManifest) Validate() error {
+	if m.SchemaVersion != SchemaVersion {
+		return fmt.Errorf("unsupported schema version %d", m.SchemaVersion)
+	}
+
+	if m.MediaType != ManifestType && m.MediaType != OCIManifestType {
+		return fmt.Errorf("unsupported manifest media type %q", m.MediaType)
+	}
+
+	if m.Config.MediaType == "" {
+		return fmt.Errorf("configuration has no media type")
+	}
+	if err := m.Config.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	for i, l := range m.Layers {
+		if l.MediaType == "" {
+			return fmt.Errorf("layer %d has no media type", i)
+		}
+		if err := l.Validate(); err != nil {
+			return fmt.Errorf("invalid layer %d: %w", i, err)
+		}
+		if l.Size == 0 {
+			return fmt.Errorf("layer %s has no size", l.Digest)
+		}
+	}
+
+	if m.Subject != nil {
+		if err := m.Subject.Validate(); err != nil {
+			return fmt.Errorf("invalid subject: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that an index is an OCI image index of valid
+// descriptors.
+func (i *ImageIndex) Validate() error {
+	if i.SchemaVersion != SchemaVersion {
+		return fmt.Errorf("unsupported schema version %d", i.SchemaVersion)
+	}
+
+	if i.MediaType != OCIIndexType {
+		return fmt.Errorf("unsupported index media type %q", i.MediaType)
+	}
+
+	for n, m := range i.Manifests {
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("invalid manifest %d: %w", n, err)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that an image configuration lists its layers by
+// valid hashes.
+func (c *ImageConfig) Validate() error {
+	if c.Architecture == "" || c.OS == "" {
+		return fmt.Errorf("configuration has no platform")
+	}
+
+	for _, id := range c.RootFS.DiffIDs {
+		if !ValidDigest(id) {
+			return fmt.Errorf("invalid layer hash %q", id)
+		}
+	}
+
+	return nil
+}
+
+// Parse parses and validates a serialised image manifest.
+func Parse(m json.RawMessage) (*ImageManifest, error) {
+	var parsed ImageManifest
+	if err := json.Unmarshal(m, &parsed); err != nil {
+		return nil, err
+	}
+
+	if err := parsed.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &parsed, nil
+}
+
+// ParseIndex parses and validates a serialised image index.
+func ParseIndex(i json.RawMessage) (*ImageIndex, error) {
+	var parsed ImageIndex
+	if err := json.Unmarshal(i, &parsed); err != nil {
+		return nil, err
+	}
+
+	if err := parsed.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &parsed, nil
+}
+
+// ParseConfig parses and validates a serialised image configuration.
+func ParseConfig(c []byte) (*ImageConfig, error) {
+	var parsed ImageConfig
+	if err := json.Unmarshal(c, &parsed); err != nil {
+		return nil, err
+	}
+
+	if err := parsed.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &parsed, nil
+}
@@ -9,10 +9,126 @@
 
 { pkgs ? import <nixpkgs> { } }:
 
-pkgs.writeShellScriptBin "nixery-prepare-image" ''
-  exec ${pkgs.nix}/bin/nix-build \
-    --show-trace \
-    --no-out-link "$@" \
-    --argstr loadPkgs ${./load-pkgs.nix} \
-    ${./prepare-image.nix}
-''
+let
+  # Nixery sets NIXERY_NIX_BIN to the Nix installation on the host (if
+  # any) and NIXERY_NIX_CLI to the matching invocation strategy.
+  #
+  # The image is evaluated and realised in separate stages, each limited
+  # by its own timeout in seconds (0 disables it). Arguments before `--`
+  # are passed to the evaluation, the others to the realisation. Nixery
+  # tracks the stages through the marker printed in between.
+  #
+  # If NIXERY_EVAL_WORKERS is set, the requested packages are first
+  # evaluated in parallel by nix-eval-jobs, whose worker processes are
+  # restarted once they exceed NIXERY_EVAL_WORKER_MEMORY (in MiB). The
+  # main evaluation then only refers to their derivations.
+  #
+  # If NIXERY_EVAL_CGROUP is set, the evaluation processes are moved
+  # into that cgroup, whose memory limit is set by Nixery. The
+  # realisation is not limited.
+  evalJobs = pkgs.nix-eval-jobs or null;
+  prepareImage = pkgs.writeShellScriptBin "nixery-prepare-image" ''
+    NIX_BIN="''${NIXERY_NIX_BIN:-${pkgs.nix}/bin}"
+    TIMEOUT="${pkgs.coreutils}/bin/timeout"
+    EVAL_JOBS="''${NIXERY_NIX_EVAL_JOBS:-${if evalJobs != null then "${evalJobs}/bin/nix-eval-jobs" else ""}}"
+
+    in_eval_cgroup() {
+      if [ -n "''${NIXERY_EVAL_CGROUP:-}" ]; then
+        echo "$BASHPID" > "$NIXERY_EVAL_CGROUP/cgroup.procs" || exit 1
+      fi
+      exec "$@"
+    }
+
+    EVAL_ARGS=()
+    while [ $# -gt 0 ] && [ "$1" != "--" ]; do
+      EVAL_ARGS+=("$1")
+      shift
+    done
+    shift
+
+    if [ -n "''${NIXERY_EVAL_WORKERS:-}" ] && [ -x "$EVAL_JOBS" ]; then
+      RESOLVED=$(set -o pipefail; in_eval_cgroup "$TIMEOUT" "''${NIXERY_EVAL_TIMEOUT_SECS:-0}" \
+        "$EVAL_JOBS" --meta \
+        --workers "$NIXERY_EVAL_WORKERS" \
+        --max-memory-size "''${NIXERY_EVAL_WORKER_MEMORY:-4096}" \
+        "''${EVAL_ARGS[@]}" \
+        --argstr loadPkgs ${./load-pkgs.nix} \
+        --arg evalPackages true \
+        ${./prepare-image.nix} | ${pkgs.jq}/bin/jq -s -c 'map({
+          key: (.attrPath[0]? // .attr),
+          value: (if .error then { error } else {
+            drvPath,
+            outputName: .meta.nixeryOutput,
+            outPath: .outputs[.meta.nixeryOutput],
+            nondistributable: .meta.nixeryNondistributable,
+            mainProgram: .meta.nixeryMainProgram
+          } end)
+        }) | from_entries') || exit $?
+
+      EVAL_ARGS+=(--argstr resolved "$RESOLVED")
+    fi
+
+    if [ "''${NIXERY_NIX_CLI:-legacy}" = "nix-command" ]; then
+      DRV=$(in_eval_cgroup "$TIMEOUT" "''${NIXERY_EVAL_TIMEOUT_SECS:-0}" \
+        "$NIX_BIN/nix" --extra-experimental-features nix-command eval --raw \
+        --show-trace "''${EVAL_ARGS[@]}" \
+        --argstr loadPkgs ${./load-pkgs.nix} \
+        -f ${./prepare-image.nix} drvPath) || exit $?
+    else
+      DRV=$(in_eval_cgroup "$TIMEOUT" "''${NIXERY_EVAL_TIMEOUT_SECS:-0}" \
+        "$NIX_BIN/nix-instantiate" \
+        --show-trace "''${EVAL_ARGS[@]}" \
+        --argstr loadPkgs ${./load-pkgs.nix} \
+        ${./prepare-image.nix}) || exit $?
+    fi
+
+    echo "nixery-stage: evaluated $DRV" >&2
+    exec "$TIMEOUT" "''${NIXERY_REALISE_TIMEOUT_SECS:-0}" \
+      "$NIX_BIN/nix-store" --realise "$@" "$DRV"
+  '';
+
+  # Nix post-build-hook which copies freshly built store paths to the
+  # binary cache configured in NIXERY_BINARY_CACHE. Nix invokes this
+  # with the built paths in $OUT_PATHS.
+  #
+  # This only covers paths that were actually built, substituted paths
+  # are already available in some other cache.
+  pushToCache = pkgs.writeShellScriptBin "nixery-push-to-cache" ''
+    set -euf
+    export IFS=' '
+
+    if [ -z "''${NIXERY_BINARY_CACHE:-}" ]; then
+      exit 0
+    fi
+
+    NIX_BIN="''${NIXERY_NIX_BIN:-${pkgs.nix}/bin}"
+
+    # Nix versions before 2.4 do not know about experimental features
+    # and enable the new CLI unconditionally.
+    FEATURES=""
+    if "$NIX_BIN/nix" --extra-experimental-features nix-command --version >/dev/null 2>&1; then
+      FEATURES="--extra-experimental-features nix-command"
+    fi
+
+    echo "Uploading paths to $NIXERY_BINARY_CACHE:" $OUT_PATHS
+    exec "$NIX_BIN/nix" $FEATURES copy --to "$NIXERY_BINARY_CACHE" $OUT_PATHS
+  '';
+
+  # Realises the closures of the store paths passed as arguments, which
+  # Nixery uses to pre-fetch the contents of cached images.
+  prefetch = pkgs.writeShellScriptBin "nixery-prefetch" ''
+    NIX_BIN="''${NIXERY_NIX_BIN:-${pkgs.nix}/bin}"
+    exec "$NIX_BIN/nix-store" --realise "$@"
+  '';
+
+  # Collects garbage in the local Nix store, which Nixery invokes when
+  # the disk holding the store fills up.
+  collectGarbage = pkgs.writeShellScriptBin "nixery-collect-garbage" ''
+    NIX_BIN="''${NIXERY_NIX_BIN:-${pkgs.nix}/bin}"
+    exec "$NIX_BIN/nix-collect-garbage" "$@"
+  '';
+in
+pkgs.symlinkJoin {
+  name = "nixery-prepare-image";
+  paths = [ prepareImage pushToCache prefetch collectGarbage ];
+}
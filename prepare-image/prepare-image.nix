@@ -21,29 +21,82 @@
 , # Packages to install by name (which must refer to top-level attributes of
   # nixpkgs). This is passed in as a JSON-array in string form.
   packages ? "[]"
+, # Arguments with which packages requested with flags (such as
+  # `ffmpeg!vaapi`) are overridden, keyed by the requested name. This is
+  # passed in as a JSON-object in string form.
+  overrides ? "{}"
+, # Layout of the image root, either a symlink forest of the contents
+  # ("symlinks"), a buildEnv profile with /etc/profile ("profile") or a
+  # conventional FHS structure with a dynamic loader ("fhs").
+  layout ? "symlinks"
+, # Shell snippet sourced by login shells in images with the profile
+  # layout.
+  activation ? ""
+, # Packages that were already evaluated by nix-eval-jobs, as a JSON-object
+  # mapping names to their derivation and default output (or the error
+  # encountered while evaluating them).
+  resolved ? "{}"
+, # Whether to return the set of requested packages for evaluation by
+  # nix-eval-jobs, instead of the build output.
+  evalPackages ? false
+, # Whether to build packages as content-addressed derivations, which
+  # requires the ca-derivations experimental feature.
+  contentAddressed ? false
+, # Packages of which only the main program is included, instead of their
+  # complete output. This is passed in as a JSON-array in string form.
+  binOnly ? "[]"
+, # Store paths to include in the image instead of packages, which must
+  # already be present in the Nix store. This is passed in as a
+  # JSON-array in string form.
+  storePaths ? "[]"
 }:
 
 let
   inherit (builtins)
+    any
+    appendContext
+    elem
+    filter
     foldl'
     fromJSON
     hasAttr
+    head
+    isAttrs
     length
+    listToAttrs
     match
+    pathExists
     readFile
+    storePath
+    throw
     toFile
     toJSON;
 
+  # With content-addressed derivations, the store paths of outputs that
+  # are identical across package set revisions do not change, which
+  # lets the corresponding layers be reused.
+  caImportArgs =
+    if contentAddressed
+    then importArgs // {
+      config = (importArgs.config or { }) // {
+        contentAddressedByDefault = true;
+      };
+    }
+    else importArgs;
+
   # Package set to use for sourcing utilities
-  nativePkgs = import loadPkgs { inherit srcType srcArgs importArgs; };
-  inherit (nativePkgs) coreutils jq openssl lib runCommand writeText symlinkJoin;
+  nativePkgs = import loadPkgs {
+    inherit srcType srcArgs;
+    importArgs = caImportArgs;
+  };
+  inherit (nativePkgs) buildEnv coreutils jq openssl lib runCommand writeText symlinkJoin;
 
   # Package set to use for packages to be included in the image. This
   # package set is imported with the system set to the target
   # architecture.
   pkgs = import loadPkgs {
     inherit srcType srcArgs;
-    importArgs = importArgs // {
+    importArgs = caImportArgs // {
       inherit system;
     };
   };
@@ -89,6 +142,106 @@ let
     in
     attrByPath path fetchLower s;
 
+  overrideArgs = fromJSON overrides;
+
+  # Packages with flags are fetched by their name without flags and
+  # overridden. Packages that can not be overridden are reported as not
+  # found.
+  fetchUnresolved = n:
+    if hasAttr n overrideArgs
+    then
+      let pkg = deepFetch pkgs (head (lib.splitString "!" n));
+      in
+      if !(pkg ? override)
+      then { error = "not_found"; pkg = n; }
+      else pkg.override overrideArgs."${n}"
+    else deepFetch pkgs n;
+
+  # Marker of packages that nix-eval-jobs could not find.
+  notFound = "nixery: package not found";
+
+  # Packages evaluated by nix-eval-jobs are referred to by their output
+  # path, with the context of their derivation, which skips evaluating
+  # them again. Evaluation errors other than missing packages are
+  # raised again.
+  resolvedPkgs = fromJSON resolved;
+  fromResolved = n: r:
+    if !(r ? error)
+    then appendContext r.outPath { "${r.drvPath}" = { outputs = [ r.outputName ]; }; }
+    else if lib.hasInfix notFound r.error
+    then { error = "not_found"; pkg = n; }
+    else throw r.error;
+
+  fetch = n:
+    if hasAttr n resolvedPkgs
+    then fromResolved n resolvedPkgs."${n}"
+    else fetchUnresolved n;
+
+  # Packages whose licenses forbid redistribution, which are served
+  # from a separate source if configured. Licenses may be lists, and
+  # are plain strings in some packages.
+  licenseForbids = pkg:
+    any (l: !(l.redistributable or true)) (lib.toList (pkg.meta.license or [ ]));
+  isNondistributable = n: pkg:
+    if hasAttr n resolvedPkgs
+    then resolvedPkgs."${n}".nondistributable or false
+    else isAttrs pkg && licenseForbids pkg;
+
+  # Set of the requested packages, which nix-eval-jobs evaluates in
+  # parallel. The default output of each package is recorded in its
+  # metadata, as nix-eval-jobs reports all outputs.
+  packageSet = listToAttrs (map
+    (n: {
+      name = n;
+      value =
+        let pkg = fetchUnresolved n;
+        in
+        if pkg ? error
+        then throw notFound
+        else pkg // {
+          meta = (pkg.meta or { }) // {
+            nixeryOutput = pkg.outputName or "out";
+            nixeryNondistributable = licenseForbids pkg;
+            nixeryMainProgram = pkg.meta.mainProgram or (lib.getName pkg);
+          };
+        };
+    })
+    (fromJSON packages));
+
+  # Raw store paths are referred to with their context, which makes
+  # them part of the runtime graph. Paths missing from the store are
+  # reported like missing packages.
+  fetchStorePath = p:
+    if pathExists p
+    then storePath p
+    else { error = "not_found"; pkg = p; };
+
+  # Main program of a package, which is looked up like `lib.getExe`
+  # does, without warning about packages that do not set it.
+  mainProgram = n: pkg:
+    if hasAttr n resolvedPkgs
+    then resolvedPkgs."${n}".mainProgram
+    else pkg.meta.mainProgram or (lib.getName pkg);
+
+  # Copies only the main program of a package, whose references then
+  # determine the runtime closure instead of the complete package.
+  # Symlinks (e.g. into libexec) are resolved while copying.
+  mainBinary = n: pkg:
+    let exe = mainProgram n pkg;
+    in runCommand "${exe}-bin" { } ''
+      mkdir -p $out/bin
+      cp -L ${pkg}/bin/${exe} $out/bin/${exe}
+    '';
+
+  binOnlyNames = fromJSON binOnly;
+  reduce = f:
+    if elem f.name binOnlyNames && !(isAttrs f.pkg && f.pkg ? error)
+    then f // { pkg = mainBinary f.name f.pkg; }
+    else f;
+
+  fetched = map (n: { name = n; pkg = fetch n; }) (fromJSON packages)
+    ++ map (p: { name = p; pkg = fetchStorePath p; }) (fromJSON storePaths);
+
   # allContents contains all packages successfully retrieved by name
   # from the package set, as well as any errors encountered while
   # attempting to fetch a package.
@@ -100,13 +253,51 @@ let
     # terminate early and return only the errors if any are encountered.
     let
       splitter = attrs: res:
-        if hasAttr "error" res
+        if isAttrs res && hasAttr "error" res
         then attrs // { errors = attrs.errors ++ [ res ]; }
         else attrs // { contents = attrs.contents ++ [ res ]; };
       init = { contents = [ ]; errors = [ ]; };
-      fetched = (map (deepFetch pkgs) (fromJSON packages));
     in
-    foldl' splitter init fetched;
+    foldl' splitter init (map (f: (reduce f).pkg) fetched);
+
+  # Files initialising login shells in images with the profile layout,
+  # which are included in the image as a separate store path.
+  profileFiles = runCommand "nixery-profile" { inherit activation; passAsFile = [ "activation" ]; } ''
+    mkdir -p $out/etc/profile.d
+
+    cat > $out/etc/profile <<'EOF'
+    # Generated by Nixery. Scripts in /etc/profile.d are sourced in order.
+    for f in /etc/profile.d/*.sh; do
+      [ -r "$f" ] && . "$f"
+    done
+    unset f
+    EOF
+
+    cat > $out/etc/profile.d/00-nixery.sh <<'EOF'
+    export PATH="/bin:/sbin:/usr/bin''${PATH:+:$PATH}"
+    export NIX_PROFILES="/"
+    export MANPATH="/share/man''${MANPATH:+:$MANPATH}"
+    export INFOPATH="/share/info''${INFOPATH:+:$INFOPATH}"
+    export XDG_DATA_DIRS="/share''${XDG_DATA_DIRS:+:$XDG_DATA_DIRS}"
+    export XDG_CONFIG_DIRS="/etc/xdg''${XDG_CONFIG_DIRS:+:$XDG_CONFIG_DIRS}"
+    export TERMINFO_DIRS="/share/terminfo''${TERMINFO_DIRS:+:$TERMINFO_DIRS}"
+    export SSL_CERT_FILE="/etc/ssl/certs/ca-bundle.crt"
+    EOF
+
+    if [ -s "$activationPath" ]; then
+      cp "$activationPath" $out/etc/profile.d/90-activation.sh
+    fi
+  '';
+
+  # Runtime added to images with the FHS layout, which lets binaries
+  # built outside of Nix find a dynamic loader and the C and C++
+  # standard libraries.
+  fhsPackages = [ pkgs.glibc pkgs.stdenv.cc.cc.lib ];
+
+  # Store paths whose contents are linked into the image root.
+  contents = allContents.contents
+    ++ lib.optional (layout == "profile") profileFiles
+    ++ lib.optionals (layout == "fhs") fhsPackages;
 
   # Contains the export references graph of all retrieved packages,
   # which has information about all runtime dependencies of the image.
@@ -115,7 +306,7 @@ let
   runtimeGraph = runCommand "runtime-graph.json"
     {
       __structuredAttrs = true;
-      exportReferencesGraph.graph = allContents.contents;
+      exportReferencesGraph.graph = contents;
       PATH = "${coreutils}/bin";
       builder = toFile "builder" ''
         . .attrs.sh
@@ -123,26 +314,61 @@ let
       '';
     } "";
 
+  # Provide a few essentials that many programs expect:
+  # - a /tmp directory,
+  # - a /usr/bin/env for shell scripts that require it.
+  #
+  # Note that in images that do not actually contain `coreutils`,
+  # /usr/bin/env will be a dangling symlink.
+  #
+  # TODO(tazjin): Don't link /usr/bin/env if coreutils is not included.
+  essentials = ''
+    mkdir -p $out/tmp
+    mkdir -p $out/usr/bin
+    ln -s ${coreutils}/bin/env $out/usr/bin/env
+  '';
+
   # Create a symlink forest into all top-level store paths of the
-  # image contents.
-  contentsEnv = symlinkJoin {
-    name = "bulk-layers";
-    paths = allContents.contents;
-
-    # Provide a few essentials that many programs expect:
-    # - a /tmp directory,
-    # - a /usr/bin/env for shell scripts that require it.
-    #
-    # Note that in images that do not actually contain `coreutils`,
-    # /usr/bin/env will be a dangling symlink.
-    #
-    # TODO(tazjin): Don't link /usr/bin/env if coreutils is not included.
-    postBuild = ''
-      mkdir -p $out/tmp
-      mkdir -p $out/usr/bin
-      ln -s ${coreutils}/bin/env $out/usr/bin/env
-    '';
-  };
+  # image contents. With the profile layout, the forest is built like
+  # a user profile, whose files in /etc take precedence over those of
+  # the packages.
+  contentsEnv =
+    if layout == "profile"
+    then buildEnv {
+      name = "nixery-profile-root";
+      paths = [ profileFiles ] ++ allContents.contents;
+      ignoreCollisions = true;
+      postBuild = essentials;
+    }
+    else if layout == "fhs"
+    then symlinkJoin {
+      name = "nixery-fhs-root";
+      paths = contents;
+
+      # The top-level directories are made available under /usr as
+      # well, and the loader is found in /lib64 on x86_64.
+      postBuild = ''
+        mkdir -p $out/bin $out/lib $out/tmp $out/usr
+        for dir in bin sbin lib libexec include share; do
+          if [ -e $out/$dir ]; then
+            ln -s ../$dir $out/usr/$dir
+          fi
+        done
+
+        if [ ! -e $out/lib64 ]; then
+          ln -s lib $out/lib64
+        fi
+
+        if [ ! -e $out/bin/env ]; then
+          ln -s ${coreutils}/bin/env $out/bin/env
+        fi
+      '';
+    }
+    else symlinkJoin {
+      name = "bulk-layers";
+      paths = contents;
+      postBuild = essentials;
+    };
 
   # Image layer that contains the symlink forest created above. This
   # must be included in the image to ensure that the filesystem has a
@@ -170,6 +396,9 @@ let
   buildOutput = {
     runtimeGraph = fromJSON (readFile runtimeGraph);
     symlinkLayer = symlinkLayerMeta;
+    fhsPaths = if layout == "fhs" then map toString fhsPackages else [ ];
+    nondistributable = map (f: { inherit (f) name; path = toString (reduce f).pkg; })
+      (filter (f: isNondistributable f.name f.pkg) fetched);
   };
 
   # Output structure returned if errors occured during the build. Currently the
@@ -179,7 +408,9 @@ let
     pkgs = map (err: err.pkg) allContents.errors;
   };
 in
-writeText "build-output.json" (if (length allContents.errors) == 0
-then toJSON buildOutput
-else toJSON errorOutput
-)
+if evalPackages then packageSet
+else
+  writeText "build-output.json" (if (length allContents.errors) == 0
+  then toJSON buildOutput
+  else toJSON errorOutput
+  )
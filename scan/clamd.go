@@ -0,0 +1,91 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package scan
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Size of the chunks in which layers are streamed to clamd.
+const clamdChunk = 64 * 1024
+
+// clamdScanner streams layers to a ClamAV daemon using the INSTREAM
+// command.
+//
+// Note that clamd rejects streams larger than its StreamMaxLength
+// setting, which must be raised above the size of the largest layer.
+type clamdScanner struct {
+	addr string
+}
+
+func (c *clamdScanner) Name() string {
+	return "clamd (" + c.addr + ")"
+}
+
+func (c *clamdScanner) Scan(ctx context.Context, digest string, layer io.Reader) (Result, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(10 * time.Minute))
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Result{}, err
+	}
+
+	// Each chunk is prefixed with its length, a zero-length chunk
+	// terminates the stream.
+	buf := make([]byte, 4+clamdChunk)
+	for {
+		n, err := io.ReadFull(layer, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return Result{}, werr
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return Result{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return Result{}, err
+	}
+	reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+
+	// Replies have the form `stream: OK`, `stream: <signature>
+	// FOUND` or `<message> ERROR`.
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return Result{Clean: true, Scanner: c.Name(), Time: time.Now().UTC()}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		reason := strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")
+		return Result{Clean: false, Reason: reason, Scanner: c.Name(), Time: time.Now().UTC()}, nil
+	default:
+		return Result{}, fmt.Errorf("clamd returned an error: %s", reply)
+	}
+}
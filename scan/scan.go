@@ -0,0 +1,55 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Package scan implements calls to external malware scanners, which
+// check image layers before they are published in a manifest.
+package scan
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+// Result is the outcome of scanning a single layer.
+type Result struct {
+	Clean   bool      `json:"clean"`
+	Reason  string    `json:"reason,omitempty"`
+	Scanner string    `json:"scanner"`
+	Time    time.Time `json:"time"`
+}
+
+// Scanner is implemented by the supported scanner integrations.
+type Scanner interface {
+	// Name returns the name of the scanner, for use in log
+	// messages and scan results.
+	Name() string
+
+	// Scan checks the contents of a (compressed) layer. Errors
+	// indicate that the scan could not be performed, infected
+	// layers are reported in the result.
+	Scan(ctx context.Context, digest string, layer io.Reader) (Result, error)
+}
+
+// New creates a scanner for the specified URL. The URL scheme selects
+// the integration:
+//
+// * `clamd://host:port` streams layers to a ClamAV daemon
+// * `http(s)://...` POSTs layers to a webhook returning a result
+func New(target string) (Scanner, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scanner URL: %s", err)
+	}
+
+	switch u.Scheme {
+	case "clamd":
+		return &clamdScanner{addr: u.Host}, nil
+	case "http", "https":
+		return &webhookScanner{url: target}, nil
+	default:
+		return nil, fmt.Errorf("unsupported scanner scheme %q", u.Scheme)
+	}
+}
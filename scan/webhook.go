@@ -0,0 +1,52 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Minute}
+
+// webhookScanner POSTs layers to an HTTP endpoint, which responds
+// with a JSON object of the form `{"clean": bool, "reason": "..."}`.
+type webhookScanner struct {
+	url string
+}
+
+func (w *webhookScanner) Name() string {
+	return "webhook"
+}
+
+func (w *webhookScanner) Scan(ctx context.Context, digest string, layer io.Reader) (Result, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, layer)
+	if err != nil {
+		return Result{}, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Nixery-Digest", digest)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return Result{}, fmt.Errorf("scanner returned status: %s", resp.Status)
+	}
+
+	var result Result
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return Result{}, fmt.Errorf("invalid scanner response: %s", err)
+	}
+
+	result.Scanner = w.Name()
+	result.Time = time.Now().UTC()
+	return result, nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package scheduler
+
+// This file implements leader election between replicas sharing a
+// storage backend, using a lease object that the leader renews
+// periodically.
+//
+// The storage backends do not support conditional writes, so the
+// election is best-effort: a replica that takes over an expired lease
+// reads it back after writing it, and if several replicas raced for the
+// lease, only the last writer considers itself the leader. In rare
+// cases, two replicas may both run cluster-wide tasks for up to one
+// renewal interval, which the tasks must tolerate.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/nixery/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// leasePath is the location of the lease object in the storage
+// backend.
+const leasePath = "leases/scheduler"
+
+// leaseRecord is the content of the lease object.
+type leaseRecord struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// Lease elects a leader among the replicas sharing a storage backend.
+type Lease struct {
+	backend storage.Backend
+	holder  string
+	ttl     time.Duration
+
+	mu     sync.Mutex
+	leader bool
+}
+
+// NewLease creates a lease that is held for ttl after each renewal.
+// Replicas are identified by their hostname.
+func NewLease(b storage.Backend, ttl time.Duration) *Lease {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+
+	return &Lease{
+		backend: b,
+		holder:  host + "-" + hex.EncodeToString(suffix),
+		ttl:     ttl,
+	}
+}
+
+// IsLeader reports whether this replica held the lease when it was
+// last checked.
+func (l *Lease) IsLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leader
+}
+
+// Run checks and renews the lease periodically, starting immediately.
+func (l *Lease) Run() {
+	for {
+		leader, err := l.acquire(context.Background())
+		if err != nil {
+			log.WithError(err).Warn("failed to renew leader lease")
+		}
+
+		l.mu.Lock()
+		if leader != l.leader {
+			log.WithFields(log.Fields{
+				"holder": l.holder,
+				"leader": leader,
+			}).Info("leadership changed")
+		}
+		l.leader = leader
+		l.mu.Unlock()
+
+		time.Sleep(l.ttl / 3)
+	}
+}
+
+func (l *Lease) read(ctx context.Context) (*leaseRecord, error) {
+	r, err := l.backend.Fetch(ctx, leasePath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var record leaseRecord
+	if err := json.NewDecoder(r).Decode(&record); err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// acquire takes or renews the lease unless another replica holds it,
+// and reports whether this replica is the leader.
+func (l *Lease) acquire(ctx context.Context) (bool, error) {
+	// A lease that can not be read is treated as absent.
+	current, err := l.read(ctx)
+	if err == nil && current.Holder != l.holder && time.Now().Before(current.Expires) {
+		return false, nil
+	}
+
+	j, _ := json.Marshal(leaseRecord{
+		Holder:  l.holder,
+		Expires: time.Now().Add(l.ttl),
+	})
+
+	_, _, err = l.backend.Persist(ctx, leasePath, "application/json", func(w io.Writer) (string, int64, error) {
+		n, err := io.Copy(w, bytes.NewReader(j))
+		return "", n, err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	written, err := l.read(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return written.Holder == l.holder, nil
+}
@@ -0,0 +1,39 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/nixery/storage"
+)
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	b := storage.NewMemoryBackend()
+
+	a := NewLease(b, time.Minute)
+	c := NewLease(b, time.Minute)
+
+	if leader, err := a.acquire(ctx); err != nil || !leader {
+		t.Fatalf("expected first replica to acquire lease (err: %v)", err)
+	}
+
+	if leader, _ := c.acquire(ctx); leader {
+		t.Errorf("expected second replica not to acquire held lease")
+	}
+
+	if leader, _ := a.acquire(ctx); !leader {
+		t.Errorf("expected leader to renew its lease")
+	}
+
+	// Expired leases are taken over.
+	a.ttl = -time.Second
+	a.acquire(ctx)
+
+	if leader, _ := c.acquire(ctx); !leader {
+		t.Errorf("expected second replica to take over expired lease")
+	}
+}
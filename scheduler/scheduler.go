@@ -0,0 +1,199 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Package scheduler runs Nixery's periodic background tasks, such as
+// garbage collection and the refreshing of storage usage.
+//
+// Runs of each task are spread out with random jitter, so that replicas
+// started at the same time do not hit the storage backend in lockstep.
+// Tasks that operate on state shared by all replicas (such as the
+// storage backend) can be marked as cluster-wide, in which case they
+// only run on the replica currently holding the leader lease.
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/nixery/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// jitter is the fraction of a task's interval by which its runs are
+// randomly shifted.
+const jitter = 0.1
+
+// Task is a function that is run periodically.
+type Task struct {
+	Name     string
+	Interval time.Duration
+
+	// Cluster-wide tasks only run on the leader replica.
+	ClusterWide bool
+
+	// Immediate tasks run once on startup, instead of after their
+	// first interval.
+	Immediate bool
+
+	Run func(ctx context.Context) error
+}
+
+// Leader reports whether this replica should run cluster-wide tasks.
+type Leader interface {
+	IsLeader() bool
+}
+
+type task struct {
+	Task
+	status api.TaskStatus
+}
+
+// Scheduler runs a set of periodic tasks.
+//
+// A nil *Scheduler is valid and has no tasks.
+type Scheduler struct {
+	leader Leader
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	tasks []*task
+}
+
+// New creates a scheduler that runs cluster-wide tasks only while the
+// given leader reports leadership. If leader is nil, this replica is
+// assumed to be the only one.
+func New(leader Leader) *Scheduler {
+	return &Scheduler{
+		leader: leader,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Add registers a task. Tasks must be added before the scheduler is
+// started.
+func (s *Scheduler) Add(t Task) error {
+	if t.Interval <= 0 {
+		return fmt.Errorf("invalid interval %s of task %s: must be positive", t.Interval, t.Name)
+	}
+
+	s.tasks = append(s.tasks, &task{
+		Task: t,
+		status: api.TaskStatus{
+			Name:        t.Name,
+			Interval:    t.Interval.Seconds(),
+			ClusterWide: t.ClusterWide,
+		},
+	})
+
+	return nil
+}
+
+// Start runs all registered tasks in the background.
+func (s *Scheduler) Start() {
+	for _, t := range s.tasks {
+		log.WithFields(log.Fields{
+			"task":         t.Name,
+			"interval":     t.Interval,
+			"cluster-wide": t.ClusterWide,
+		}).Info("scheduling periodic task")
+
+		go s.loop(t)
+	}
+}
+
+// isLeader reports whether this replica runs cluster-wide tasks.
+func (s *Scheduler) isLeader() bool {
+	return s.leader == nil || s.leader.IsLeader()
+}
+
+// delay returns the time until the next run of a task, including
+// jitter.
+func (s *Scheduler) delay(t *task) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	spread := float64(t.Interval) * jitter
+	d := t.Interval + time.Duration((s.rand.Float64()*2-1)*spread)
+
+	next := time.Now().Add(d)
+	t.status.NextRun = &next
+	return d
+}
+
+func (s *Scheduler) loop(t *task) {
+	if !t.Immediate {
+		time.Sleep(s.delay(t))
+	}
+
+	for {
+		s.run(t)
+		time.Sleep(s.delay(t))
+	}
+}
+
+// run runs a task once, unless it is cluster-wide and this replica is
+// not the leader.
+func (s *Scheduler) run(t *task) {
+	if t.ClusterWide && !s.isLeader() {
+		log.WithField("task", t.Name).Debug("skipping cluster-wide task on follower")
+
+		s.mu.Lock()
+		t.status.Skipped++
+		s.mu.Unlock()
+		return
+	}
+
+	start := time.Now()
+	err := t.Run(context.Background())
+	elapsed := time.Since(start)
+
+	entry := log.WithFields(log.Fields{
+		"task":     t.Name,
+		"duration": elapsed,
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t.status.Runs++
+	t.status.LastRun = &start
+	t.status.LastDuration = elapsed.Seconds()
+	t.status.LastError = ""
+
+	if err != nil {
+		entry.WithError(err).Error("periodic task failed")
+		t.status.Failures++
+		t.status.LastError = err.Error()
+	} else {
+		entry.Debug("periodic task completed")
+	}
+}
+
+// Status returns the status of all tasks, sorted by name.
+func (s *Scheduler) Status() api.SchedulerStatus {
+	if s == nil {
+		return api.SchedulerStatus{Leader: true, Tasks: []api.TaskStatus{}}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := api.SchedulerStatus{
+		Leader: s.isLeader(),
+		Tasks:  []api.TaskStatus{},
+	}
+
+	for _, t := range s.tasks {
+		status.Tasks = append(status.Tasks, t.status)
+	}
+
+	sort.Slice(status.Tasks, func(i, j int) bool {
+		return status.Tasks[i].Name < status.Tasks[j].Name
+	})
+
+	return status
+}
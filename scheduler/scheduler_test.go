@@ -0,0 +1,119 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type fixedLeader bool
+
+func (l fixedLeader) IsLeader() bool {
+	return bool(l)
+}
+
+func TestAddRejectsInvalidInterval(t *testing.T) {
+	s := New(nil)
+	for _, interval := range []time.Duration{0, -time.Minute} {
+		if err := s.Add(Task{Name: "broken", Interval: interval}); err == nil {
+			t.Errorf("task with interval %s was accepted", interval)
+		}
+	}
+
+	if len(s.Status().Tasks) != 0 {
+		t.Error("rejected task was registered")
+	}
+}
+
+func TestDelayJitter(t *testing.T) {
+	s := New(nil)
+	tk := &task{Task: Task{Name: "test", Interval: time.Minute}}
+
+	var min, max time.Duration
+	for i := 0; i < 1000; i++ {
+		d := s.delay(tk)
+		if i == 0 || d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+
+	if min < 54*time.Second || max > 66*time.Second {
+		t.Errorf("delay outside of jitter bounds: %s - %s", min, max)
+	}
+	if max-min < time.Second {
+		t.Errorf("delays are not spread out: %s - %s", min, max)
+	}
+	if tk.status.NextRun == nil {
+		t.Error("next run was not recorded")
+	}
+}
+
+func TestFollowerSkipsClusterWideTasks(t *testing.T) {
+	s := New(fixedLeader(false))
+
+	var runs []string
+	record := func(name string) func(context.Context) error {
+		return func(context.Context) error {
+			runs = append(runs, name)
+			return nil
+		}
+	}
+	s.Add(Task{Name: "gc", Interval: time.Minute, ClusterWide: true, Run: record("gc")})
+	s.Add(Task{Name: "quota-refresh", Interval: time.Minute, Run: record("quota-refresh")})
+
+	for _, tk := range s.tasks {
+		s.run(tk)
+	}
+
+	if len(runs) != 1 || runs[0] != "quota-refresh" {
+		t.Errorf("unexpected runs on follower: %v", runs)
+	}
+
+	status := s.Status()
+	if status.Leader {
+		t.Error("follower reported leadership")
+	}
+	if gc := status.Tasks[0]; gc.Name != "gc" || gc.Skipped != 1 || gc.Runs != 0 {
+		t.Errorf("unexpected status of skipped task: %+v", gc)
+	}
+}
+
+func TestStatusAccounting(t *testing.T) {
+	s := New(fixedLeader(true))
+
+	fail := true
+	s.Add(Task{Name: "flaky", Interval: time.Minute, ClusterWide: true, Run: func(context.Context) error {
+		if fail {
+			return errors.New("storage unavailable")
+		}
+		return nil
+	}})
+	tk := s.tasks[0]
+
+	s.run(tk)
+	status := s.Status().Tasks[0]
+	if status.Runs != 1 || status.Failures != 1 || status.LastError != "storage unavailable" || status.LastRun == nil {
+		t.Errorf("unexpected status after failure: %+v", status)
+	}
+
+	fail = false
+	s.run(tk)
+	status = s.Status().Tasks[0]
+	if status.Runs != 2 || status.Failures != 1 || status.LastError != "" {
+		t.Errorf("unexpected status after success: %+v", status)
+	}
+	if status.Interval != 60 || !status.ClusterWide {
+		t.Errorf("unexpected task configuration in status: %+v", status)
+	}
+
+	var nilScheduler *Scheduler
+	if status := nilScheduler.Status(); !status.Leader || len(status.Tasks) != 0 {
+		t.Errorf("unexpected status of nil scheduler: %+v", status)
+	}
+}
@@ -0,0 +1,22 @@
+#!/usr/bin/env bash
+set -eou pipefail
+
+# This test runs the pull category of the OCI distribution-spec
+# conformance suite against Nixery, serving a single seeded image from
+# the in-memory storage backend (see cmd/server/conformance_test.go).
+#
+# The suite is built from the distribution-spec repository at the
+# version given in $SPEC_VERSION, which requires network access.
+
+SPEC_VERSION="${SPEC_VERSION:-v1.1.0}"
+WORKDIR=$(mktemp -d)
+trap 'rm -rf "${WORKDIR}"' EXIT
+
+git clone --quiet --depth 1 --branch "${SPEC_VERSION}" \
+  https://github.com/opencontainers/distribution-spec "${WORKDIR}/distribution-spec"
+
+(cd "${WORKDIR}/distribution-spec/conformance" && go test -c -o "${WORKDIR}/conformance.test")
+echo "Built conformance suite ${SPEC_VERSION}"
+
+OCI_CONFORMANCE_SUITE="${WORKDIR}/conformance.test" \
+  go test -count=1 -v -run TestConformance ./cmd/server
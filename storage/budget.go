@@ -0,0 +1,124 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+// This file implements the memory budget of uploads to object stores.
+//
+// Chunked uploads (to GCS and S3) buffer a complete chunk in memory,
+// so dozens of concurrent layer uploads could use gigabytes of memory.
+// Each chunked upload therefore reserves its buffer from a budget that
+// is shared by all uploads of the instance before it starts, and waits
+// for other uploads to finish if the budget is exhausted. This applies
+// backpressure to the builds producing the layers instead of running
+// out of memory.
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/nixery/api"
+)
+
+// Default size of the chunks of uploads, which is the default of the
+// GCS client.
+const DefaultUploadChunkSize = 16 * 1024 * 1024
+
+// uploadBudget is the number of bytes available for upload buffers.
+type uploadBudget struct {
+	mu        sync.Mutex
+	total     int64
+	available int64
+
+	// Closed (and replaced) whenever a reservation is released.
+	released chan struct{}
+}
+
+var (
+	uploadChunkSize int64 = DefaultUploadChunkSize
+	uploads         *uploadBudget
+
+	// Number of uploads that waited for the budget
+	uploadWaits uint64
+)
+
+// SetUploadLimits sets the size of the chunks of uploads, and the
+// total memory that the buffers of concurrent uploads may use (0 =
+// unlimited). It must be called before any backend is used.
+func SetUploadLimits(chunkSize, memory int64) {
+	uploadChunkSize = chunkSize
+
+	uploads = nil
+	if memory > 0 {
+		uploads = &uploadBudget{
+			total:     memory,
+			available: memory,
+			released:  make(chan struct{}),
+		}
+	}
+}
+
+// reserveUpload reserves the buffer of a chunked upload, waiting until
+// enough of the budget is available. The returned function releases
+// the reservation.
+func reserveUpload(ctx context.Context) (func(), error) {
+	b := uploads
+	if b == nil {
+		return func() {}, nil
+	}
+
+	// A budget smaller than a chunk still permits one upload at a
+	// time.
+	n := uploadChunkSize
+	if n > b.total {
+		n = b.total
+	}
+
+	for waited := false; ; waited = true {
+		b.mu.Lock()
+		if b.available >= n {
+			b.available -= n
+			b.mu.Unlock()
+			break
+		}
+		released := b.released
+		b.mu.Unlock()
+
+		if !waited {
+			atomic.AddUint64(&uploadWaits, 1)
+		}
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			b.available += n
+			close(b.released)
+			b.released = make(chan struct{})
+			b.mu.Unlock()
+		})
+	}, nil
+}
+
+// uploadBuffers reports the memory reserved by running uploads.
+func uploadBuffers() api.UploadBuffers {
+	stats := api.UploadBuffers{
+		Waits: atomic.LoadUint64(&uploadWaits),
+	}
+
+	if b := uploads; b != nil {
+		b.mu.Lock()
+		stats.Reserved = b.total - b.available
+		stats.Budget = b.total
+		b.mu.Unlock()
+	}
+
+	return stats
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUploadBudget(t *testing.T) {
+	SetUploadLimits(10, 25)
+	defer SetUploadLimits(DefaultUploadChunkSize, 0)
+
+	ctx := context.Background()
+	first, _ := reserveUpload(ctx)
+	second, _ := reserveUpload(ctx)
+
+	if stats := uploadBuffers(); stats.Reserved != 20 || stats.Budget != 25 {
+		t.Fatalf("unexpected upload buffers %+v", stats)
+	}
+
+	// The third upload waits until another one finishes.
+	reserved := make(chan func())
+	go func() {
+		release, _ := reserveUpload(ctx)
+		reserved <- release
+	}()
+
+	select {
+	case <-reserved:
+		t.Fatal("upload exceeded the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first()
+	first() // releasing twice has no effect
+	third := <-reserved
+
+	if stats := uploadBuffers(); stats.Reserved != 20 || stats.Waits == 0 {
+		t.Errorf("unexpected upload buffers %+v", stats)
+	}
+
+	// Waiting uploads are abandoned with their context.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := reserveUpload(cancelled); err == nil {
+		t.Error("upload of cancelled context exceeded the budget")
+	}
+
+	second()
+	third()
+	if stats := uploadBuffers(); stats.Reserved != 0 {
+		t.Errorf("reservations were not released: %+v", stats)
+	}
+}
+
+func TestUploadBudgetSmallerThanChunk(t *testing.T) {
+	SetUploadLimits(10, 5)
+	defer SetUploadLimits(DefaultUploadChunkSize, 0)
+
+	release, err := reserveUpload(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
@@ -0,0 +1,564 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+// This file implements chunked storage of blobs (experimental), which
+// deduplicates the contents of layers below the level of whole layers.
+//
+// Layers are split into chunks using content-defined chunking, i.e.
+// chunk boundaries are determined by a rolling hash of the content
+// instead of fixed offsets. A small change in a large store path then
+// only changes the chunks around it, and all other chunks are found in
+// the backend and not uploaded again.
+//
+// Chunks are stored under `chunks/<sha256>`. In place of the blob, a
+// recipe listing its chunks is stored, which keeps all other code
+// (including garbage collection of blobs) working on the usual paths.
+// Blobs are reassembled from their chunks when they are served, which
+// means that they are always served by Nixery itself instead of the
+// backend (e.g. through redirects to GCS).
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nixery/logs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Bounds and average (as a mask of the rolling hash) of the
+	// chunk size. Changing these changes all chunk boundaries.
+	minChunkSize = 512 * 1024
+	maxChunkSize = 8 * 1024 * 1024
+	chunkMask    = 1<<21 - 1 // 2 MiB on average
+
+	// Header identifying recipes. Blobs are either gzipped tarballs
+	// or JSON documents, which can not start with this header.
+	recipeHeader = "nixery-chunked-blob\n"
+)
+
+// gear is the table of random values for the rolling hash. It is
+// derived deterministically, as chunk boundaries must not change
+// between versions.
+var gear [256]uint64
+
+func init() {
+	for i := range gear {
+		sum := sha256.Sum256([]byte("nixery-gear-" + strconv.Itoa(i)))
+		gear[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+}
+
+type chunkRef struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// recipe lists the chunks from which a blob is reassembled.
+type recipe struct {
+	ContentType string     `json:"contentType"`
+	Size        int64      `json:"size"`
+	Chunks      []chunkRef `json:"chunks"`
+}
+
+// ChunkedBackend stores layers in content-defined chunks in another
+// backend.
+type ChunkedBackend struct {
+	Backend
+
+	// Chunks referenced by uploads whose recipe is not stored yet,
+	// which must not be garbage-collected. The lock is held while
+	// chunks are deleted, so that an upload either finds a chunk
+	// that stays in place or uploads it again.
+	mu      sync.Mutex
+	pending map[string]int
+}
+
+// WithChunking returns a backend storing layers in chunks in the given
+// backend.
+func WithChunking(b Backend) *ChunkedBackend {
+	return &ChunkedBackend{
+		Backend: b,
+		pending: make(map[string]int),
+	}
+}
+
+func (b *ChunkedBackend) Name() string {
+	return b.Backend.Name() + " (chunked)"
+}
+
+func (b *ChunkedBackend) ListWithMetadata(ctx context.Context, prefix string) ([]Object, error) {
+	return ListWithMetadata(ctx, b.Backend, prefix)
+}
+
+// chunked reports whether an object is stored in chunks. Only layers
+// are chunked, which are written to `staging/` or (when copied between
+// environments) to `layers/`. Objects known to be smaller than a chunk
+// (e.g. manifests) are stored as they are.
+func chunked(ctx context.Context, path string) bool {
+	if hint := SizeHintFrom(ctx); hint > 0 && hint < minChunkSize {
+		return false
+	}
+
+	return strings.HasPrefix(path, "staging/") || strings.HasPrefix(path, "layers/")
+}
+
+func (b *ChunkedBackend) Persist(ctx context.Context, path, contentType string, f Persister) (string, int64, error) {
+	if !chunked(ctx, path) {
+		return b.Backend.Persist(ctx, path, contentType, f)
+	}
+
+	cw := &chunkWriter{ctx: ctx, b: b, stored: make(map[string]bool)}
+	defer func() { b.release(cw.recipe.Chunks) }()
+
+	hash, size, err := f(cw)
+	if err == nil {
+		err = cw.flush()
+	}
+	if err != nil {
+		return hash, size, err
+	}
+
+	cw.recipe.ContentType = contentType
+	cw.recipe.Size = cw.size
+
+	return hash, size, b.persistRecipe(ctx, path, &cw.recipe)
+}
+
+// persistRecipe stores the recipe of a blob in place of the blob.
+func (b *ChunkedBackend) persistRecipe(ctx context.Context, path string, rc *recipe) error {
+	j, _ := json.Marshal(rc)
+	data := append([]byte(recipeHeader), j...)
+
+	md := Metadata{MetadataChunks: strconv.Itoa(len(rc.Chunks))}
+	for k, v := range MetadataFrom(ctx) {
+		md[k] = v
+	}
+	ctx = WithSizeHint(WithMetadata(ctx, md), int64(len(data)))
+
+	_, _, err := b.Backend.Persist(ctx, path, rc.ContentType, func(w io.Writer) (string, int64, error) {
+		n, err := w.Write(data)
+		return "", int64(n), err
+	})
+
+	return err
+}
+
+// Copy copies a blob from another chunked backend, e.g. another
+// environment in the same bucket. Chunked blobs are copied as their
+// recipe and the chunks missing in this backend, instead of being
+// reassembled and split again. It returns the size of the blob.
+func (b *ChunkedBackend) Copy(ctx context.Context, from *ChunkedBackend, path, contentType string) (int64, error) {
+	rc, r, err := from.readRecipe(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+
+	if rc == nil {
+		defer r.Close()
+		_, size, err := b.Persist(ctx, path, contentType, func(w io.Writer) (string, int64, error) {
+			n, err := io.Copy(w, r)
+			return "", n, err
+		})
+		return size, err
+	}
+
+	b.mu.Lock()
+	for _, c := range rc.Chunks {
+		b.pending[c.Digest]++
+	}
+	b.mu.Unlock()
+	defer b.release(rc.Chunks)
+
+	copied := make(map[string]bool)
+	for _, c := range rc.Chunks {
+		if copied[c.Digest] {
+			continue
+		}
+		if err := b.copyChunk(ctx, from, c); err != nil {
+			return 0, err
+		}
+		copied[c.Digest] = true
+	}
+
+	return rc.Size, b.persistRecipe(ctx, path, rc)
+}
+
+// copyChunk copies a chunk from another chunked backend unless it
+// exists in this backend. The chunk must be marked as pending.
+func (b *ChunkedBackend) copyChunk(ctx context.Context, from *ChunkedBackend, c chunkRef) error {
+	path := "chunks/" + c.Digest
+	if b.exists(ctx, path) {
+		return nil
+	}
+
+	r, err := from.Backend.Fetch(ctx, path)
+	if err != nil {
+		return fmt.Errorf("failed to fetch chunk %s: %w", c.Digest, err)
+	}
+	defer r.Close()
+
+	_, _, err = b.Backend.Persist(WithSizeHint(ctx, c.Size), path, "application/octet-stream", func(w io.Writer) (string, int64, error) {
+		n, err := io.Copy(w, r)
+		return c.Digest, n, err
+	})
+	return err
+}
+
+// exists reports whether an object exists in the underlying backend.
+func (b *ChunkedBackend) exists(ctx context.Context, path string) bool {
+	r, err := b.Backend.Fetch(ctx, path)
+	if err != nil {
+		return false
+	}
+
+	r.Close()
+	return true
+}
+
+// persistChunk marks a chunk as pending until the recipe referencing it
+// is stored, and stores it unless it exists. Chunks in the given set
+// were already stored by the same upload.
+//
+// Existence is always checked in the backend, as chunks can be
+// garbage-collected by other instances at any time.
+func (b *ChunkedBackend) persistChunk(ctx context.Context, data []byte, stored map[string]bool) (chunkRef, error) {
+	ref := chunkRef{
+		Digest: fmt.Sprintf("%x", sha256.Sum256(data)),
+		Size:   int64(len(data)),
+	}
+
+	b.mu.Lock()
+	b.pending[ref.Digest]++
+	b.mu.Unlock()
+
+	path := "chunks/" + ref.Digest
+	if stored[ref.Digest] || b.exists(ctx, path) {
+		stored[ref.Digest] = true
+		return ref, nil
+	}
+
+	_, _, err := b.Backend.Persist(WithSizeHint(ctx, ref.Size), path, "application/octet-stream", func(w io.Writer) (string, int64, error) {
+		n, err := w.Write(data)
+		return ref.Digest, int64(n), err
+	})
+	if err != nil {
+		return ref, err
+	}
+
+	stored[ref.Digest] = true
+	return ref, nil
+}
+
+func (b *ChunkedBackend) release(chunks []chunkRef) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, c := range chunks {
+		if b.pending[c.Digest]--; b.pending[c.Digest] <= 0 {
+			delete(b.pending, c.Digest)
+		}
+	}
+}
+
+// chunkWriter splits the data written to it into chunks, which are
+// stored as soon as their boundary is found.
+type chunkWriter struct {
+	ctx    context.Context
+	b      *ChunkedBackend
+	buf    []byte
+	hash   uint64
+	size   int64
+	recipe recipe
+	stored map[string]bool
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	for i, c := range p {
+		w.buf = append(w.buf, c)
+		w.hash = w.hash<<1 + gear[c]
+
+		if len(w.buf) >= maxChunkSize || (len(w.buf) >= minChunkSize && w.hash&chunkMask == 0) {
+			if err := w.flush(); err != nil {
+				return i, err
+			}
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *chunkWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	ref, err := w.b.persistChunk(w.ctx, w.buf, w.stored)
+	if err != nil {
+		return err
+	}
+
+	w.recipe.Chunks = append(w.recipe.Chunks, ref)
+	w.size += ref.Size
+	w.buf = w.buf[:0]
+	w.hash = 0
+	return nil
+}
+
+// readRecipe returns the recipe of an object, or the object's reader if
+// it is not chunked.
+func (b *ChunkedBackend) readRecipe(ctx context.Context, path string) (*recipe, io.ReadCloser, error) {
+	r, err := b.Backend.Fetch(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(len(recipeHeader))
+	if string(header) != recipeHeader {
+		return nil, struct {
+			io.Reader
+			io.Closer
+		}{br, r}, nil
+	}
+	defer r.Close()
+
+	j, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rc recipe
+	if err := json.Unmarshal(j[len(recipeHeader):], &rc); err != nil {
+		return nil, nil, fmt.Errorf("invalid recipe %s: %s", path, err)
+	}
+
+	return &rc, nil, nil
+}
+
+// Fetch returns the content of an object, reassembling it from its
+// chunks if necessary.
+func (b *ChunkedBackend) Fetch(ctx context.Context, path string) (io.ReadCloser, error) {
+	rc, r, err := b.readRecipe(ctx, path)
+	if err != nil || rc == nil {
+		return r, err
+	}
+
+	return &chunkReader{ctx: ctx, b: b.Backend, recipe: rc}, nil
+}
+
+// Serve streams chunked blobs, and delegates all other blobs to the
+// underlying backend.
+func (b *ChunkedBackend) Serve(digest string, r *http.Request, w http.ResponseWriter) error {
+	rc, blob, err := b.readRecipe(r.Context(), "layers/"+digest)
+	if blob != nil {
+		blob.Close()
+	}
+	if err != nil || rc == nil {
+		return b.Backend.Serve(digest, r, w)
+	}
+
+	if !logs.Duplicate("serving chunked blob " + digest) {
+		log.WithFields(log.Fields{
+			"digest": digest,
+			"chunks": len(rc.Chunks),
+		}).Info("serving chunked blob")
+	}
+
+	cr := &chunkReader{ctx: r.Context(), b: b.Backend, recipe: rc}
+	defer cr.Close()
+
+	w.Header().Set("Content-Type", rc.ContentType)
+	http.ServeContent(w, r, "", time.Time{}, cr)
+	return nil
+}
+
+// chunkReader reassembles a blob from its chunks. It supports seeking,
+// which is required for range requests.
+type chunkReader struct {
+	ctx    context.Context
+	b      Backend
+	recipe *recipe
+	offset int64
+
+	current io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.offset >= r.recipe.Size {
+			return 0, io.EOF
+		}
+
+		if r.current == nil {
+			if err := r.open(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.current.Read(p)
+		r.offset += int64(n)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			err = nil
+		}
+
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// open opens the chunk containing the current offset, positioned at
+// the offset.
+func (r *chunkReader) open() error {
+	start := int64(0)
+	for _, c := range r.recipe.Chunks {
+		if r.offset < start+c.Size {
+			chunk, err := r.b.Fetch(r.ctx, "chunks/"+c.Digest)
+			if err != nil {
+				return fmt.Errorf("failed to fetch chunk %s: %w", c.Digest, err)
+			}
+
+			if _, err := io.CopyN(ioutil.Discard, chunk, r.offset-start); err != nil {
+				chunk.Close()
+				return err
+			}
+
+			r.current = chunk
+			return nil
+		}
+		start += c.Size
+	}
+
+	return io.EOF
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.recipe.Size
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid offset %d", offset)
+	}
+
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+
+	return offset, nil
+}
+
+func (r *chunkReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
+
+// CollectChunks deletes all chunks that are not referenced by any
+// recipe, were written before the cutoff and are not referenced by an
+// upload in progress. It returns the number of deleted chunks and the
+// number of bytes freed.
+//
+// Recipes are identified by their content, as object metadata is not
+// available in all backends.
+func (b *ChunkedBackend) CollectChunks(ctx context.Context, cutoff time.Time, dryRun bool) (int, int64, error) {
+	live := make(map[string]bool)
+	for _, prefix := range []string{"layers/", "staging/"} {
+		objects, err := b.Backend.List(ctx, prefix)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to list recipes: %s", err)
+		}
+
+		for _, obj := range objects {
+			// Any failure to read a recipe must abort the
+			// collection, as its chunks would otherwise be
+			// deleted. Objects deleted since they were listed
+			// no longer reference any chunks.
+			rc, r, err := b.readRecipe(ctx, obj.Path)
+			if r != nil {
+				r.Close()
+			}
+			if IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return 0, 0, fmt.Errorf("failed to read recipe %s: %v", obj.Path, err)
+			}
+			if rc == nil {
+				continue
+			}
+
+			for _, c := range rc.Chunks {
+				live[c.Digest] = true
+			}
+		}
+	}
+
+	chunks, err := b.Backend.List(ctx, "chunks/")
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list chunks: %s", err)
+	}
+
+	var deleted int
+	var freed int64
+	for _, obj := range chunks {
+		digest := strings.TrimPrefix(obj.Path, "chunks/")
+		if live[digest] || obj.Updated.After(cutoff) {
+			continue
+		}
+
+		n, err := b.collectChunk(ctx, obj, dryRun)
+		if err != nil {
+			return deleted, freed, err
+		}
+
+		deleted += n
+		freed += int64(n) * obj.Size
+	}
+
+	return deleted, freed, nil
+}
+
+// collectChunk deletes an unreferenced chunk unless an upload in
+// progress references it, and returns the number of deleted chunks.
+func (b *ChunkedBackend) collectChunk(ctx context.Context, obj Object, dryRun bool) (int, error) {
+	digest := strings.TrimPrefix(obj.Path, "chunks/")
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.pending[digest] > 0 {
+		return 0, nil
+	}
+
+	if !dryRun {
+		if err := b.Backend.Delete(ctx, obj.Path); err != nil {
+			return 0, fmt.Errorf("failed to delete chunk %s: %s", digest, err)
+		}
+	}
+
+	return 1, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func persistBytes(t *testing.T, b Backend, path string, data []byte) {
+	_, _, err := b.Persist(context.Background(), path, "application/octet-stream", func(w io.Writer) (string, int64, error) {
+		n, err := io.Copy(w, bytes.NewReader(data))
+		return "", n, err
+	})
+
+	if err != nil {
+		t.Fatalf("failed to persist %s: %s", path, err)
+	}
+}
+
+func TestChunkedBackend(t *testing.T) {
+	ctx := context.Background()
+	raw := NewMemoryBackend()
+	b := WithChunking(raw)
+
+	data := make([]byte, 20*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	persistBytes(t, b, "layers/a", data)
+
+	chunks, _ := raw.List(ctx, "chunks/")
+	if len(chunks) < 2 {
+		t.Fatalf("expected layer to be split into chunks, got %d", len(chunks))
+	}
+
+	// Changing a single byte must only add the chunk containing it.
+	changed := append([]byte{}, data...)
+	changed[len(changed)/2] ^= 0xff
+	persistBytes(t, b, "layers/b", changed)
+
+	after, _ := raw.List(ctx, "chunks/")
+	if len(after) != len(chunks)+1 {
+		t.Errorf("expected one new chunk, got %d", len(after)-len(chunks))
+	}
+
+	r, err := b.Fetch(ctx, "layers/b")
+	if err != nil {
+		t.Fatalf("failed to fetch chunked blob: %s", err)
+	}
+	fetched, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(fetched, changed) {
+		t.Errorf("reassembled blob differs from original")
+	}
+
+	// Range requests are answered from the matching chunks.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Range", "bytes=10000000-10000099")
+	w := httptest.NewRecorder()
+	if err := b.Serve("a", req, w); err != nil {
+		t.Fatalf("failed to serve chunked blob: %s", err)
+	}
+	if w.Code != 206 || !bytes.Equal(w.Body.Bytes(), data[10000000:10000100]) {
+		t.Errorf("unexpected range response %d", w.Code)
+	}
+
+	// Objects other than layers are stored as they are.
+	persistBytes(t, b, "manifests/small", []byte("{}"))
+	r, _ = raw.Fetch(ctx, "manifests/small")
+	small, _ := ioutil.ReadAll(r)
+	if string(small) != "{}" {
+		t.Errorf("expected manifest to be stored unchunked, got %q", small)
+	}
+
+	// Deleting a blob leaves only the chunks of the other one.
+	b.Delete(ctx, "layers/b")
+	deleted, _, err := b.CollectChunks(ctx, time.Now(), false)
+	if err != nil {
+		t.Fatalf("chunk collection failed: %s", err)
+	}
+	if deleted != 1 {
+		t.Errorf("expected one chunk to be collected, got %d", deleted)
+	}
+}
+
+func TestCollectChunks(t *testing.T) {
+	ctx := context.Background()
+	raw := NewMemoryBackend()
+
+	// Two instances sharing a bucket.
+	a := WithChunking(raw)
+	b := WithChunking(raw)
+
+	data := make([]byte, 4*1024*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	// Recipes are found without their metadata, which is not
+	// stored by all backends.
+	persistBytes(t, a, "layers/a", data)
+	r, _ := raw.Fetch(ctx, "layers/a")
+	stored, _ := ioutil.ReadAll(r)
+	r.Close()
+	persistBytes(t, raw, "layers/a", stored)
+
+	if deleted, _, err := b.CollectChunks(ctx, time.Now(), false); err != nil || deleted != 0 {
+		t.Fatalf("referenced chunks were collected: %d (%v)", deleted, err)
+	}
+
+	// Chunks referenced by uploads in progress are kept.
+	chunks, _ := raw.List(ctx, "chunks/")
+	raw.Delete(ctx, "layers/a")
+	digest := chunks[0].Path[len("chunks/"):]
+	b.pending[digest]++
+	deleted, _, err := b.CollectChunks(ctx, time.Now(), false)
+	if err != nil || deleted != len(chunks)-1 {
+		t.Fatalf("expected %d chunks to be collected, got %d (%v)", len(chunks)-1, deleted, err)
+	}
+	b.release([]chunkRef{{Digest: digest}})
+
+	// Chunks deleted by another instance are uploaded again.
+	persistBytes(t, a, "layers/b", data)
+	r, err = a.Fetch(ctx, "layers/b")
+	if err != nil {
+		t.Fatalf("failed to fetch chunked blob: %s", err)
+	}
+	fetched, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(fetched, data) {
+		t.Errorf("blob could not be reassembled after chunk collection: %v", err)
+	}
+}
@@ -11,11 +11,17 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 
+	"github.com/google/nixery/logs"
 	"github.com/pkg/xattr"
 	log "github.com/sirupsen/logrus"
 )
 
+// Prefix of the extended attributes holding object metadata.
+const metadataXattr = "user.nixery."
+
 type FSBackend struct {
 	path string
 }
@@ -40,6 +46,7 @@ func (b *FSBackend) Name() string {
 }
 
 func (b *FSBackend) Persist(ctx context.Context, key, contentType string, f Persister) (string, int64, error) {
+	countOperation(OpWrite, key)
 	full := path.Join(b.path, key)
 	dir := path.Dir(full)
 	err := os.MkdirAll(dir, 0755)
@@ -61,15 +68,26 @@ func (b *FSBackend) Persist(ctx context.Context, key, contentType string, f Pers
 		return "", 0, err
 	}
 
+	// Metadata is informational, failing to store it does not fail
+	// the write.
+	for k, v := range MetadataFrom(ctx) {
+		if err := xattr.Set(full, metadataXattr+k, []byte(v)); err != nil {
+			log.WithError(err).WithField("file", full).Warn("failed to store object metadata in xattrs")
+			break
+		}
+	}
+
 	return f(file)
 }
 
 func (b *FSBackend) Fetch(ctx context.Context, key string) (io.ReadCloser, error) {
+	countOperation(OpRead, key)
 	full := path.Join(b.path, key)
 	return os.Open(full)
 }
 
 func (b *FSBackend) Move(ctx context.Context, old, new string) error {
+	countOperation(OpCopy, old)
 	newpath := path.Join(b.path, new)
 	err := os.MkdirAll(path.Dir(newpath), 0755)
 	if err != nil {
@@ -80,12 +98,23 @@ func (b *FSBackend) Move(ctx context.Context, old, new string) error {
 }
 
 func (b *FSBackend) Serve(digest string, r *http.Request, w http.ResponseWriter) error {
-	p := path.Join(b.path, "layers", digest)
+	return b.serveObject("layers/"+digest, r, w)
+}
+
+func (b *FSBackend) serveObject(key string, r *http.Request, w http.ResponseWriter) error {
+	countOperation(OpRead, key)
+	p := path.Join(b.path, key)
 
-	log.WithFields(log.Fields{
-		"digest": digest,
-		"path":   p,
-	}).Info("serving blob from filesystem")
+	if !logs.Duplicate("serving blob from filesystem " + key) {
+		log.WithFields(log.Fields{
+			"object": key,
+			"path":   p,
+		}).Info("serving blob from filesystem")
+	}
+
+	if _, err := os.Stat(p); err != nil {
+		return err
+	}
 
 	contentType, err := xattr.Get(p, "user.mime_type")
 	if err != nil {
@@ -97,3 +126,70 @@ func (b *FSBackend) Serve(digest string, r *http.Request, w http.ResponseWriter)
 	http.ServeFile(w, r, p)
 	return nil
 }
+
+func (b *FSBackend) List(ctx context.Context, prefix string) ([]Object, error) {
+	countOperation(OpList, prefix)
+	var objects []Object
+
+	// Prefixes are matched against full paths, but only the
+	// directory containing them needs to be traversed.
+	root := path.Join(b.path, path.Dir(prefix+"x"))
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		key, err := filepath.Rel(b.path, p)
+		if err != nil {
+			return err
+		}
+
+		key = filepath.ToSlash(key)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, Object{
+				Path:     key,
+				Size:     info.Size(),
+				Updated:  info.ModTime(),
+				Metadata: fsMetadata(p),
+			})
+		}
+
+		return nil
+	})
+
+	return objects, err
+}
+
+func (b *FSBackend) Delete(ctx context.Context, key string) error {
+	countOperation(OpDelete, key)
+	return os.Remove(path.Join(b.path, key))
+}
+
+// fsMetadata reads the object metadata stored in the extended
+// attributes of a file.
+func fsMetadata(file string) Metadata {
+	names, err := xattr.List(file)
+	if err != nil {
+		return nil
+	}
+
+	md := make(Metadata)
+	for _, name := range names {
+		if !strings.HasPrefix(name, metadataXattr) {
+			continue
+		}
+
+		if v, err := xattr.Get(file, name); err == nil {
+			md[strings.TrimPrefix(name, metadataXattr)] = string(v)
+		}
+	}
+
+	return md
+}
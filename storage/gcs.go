@@ -5,7 +5,10 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,8 +18,11 @@ import (
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/google/nixery/logs"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iterator"
 )
 
 // HTTP client to use for direct calls to APIs that are not part of the SDK
@@ -25,10 +31,21 @@ var client = &http.Client{}
 // API scope needed for renaming objects in GCS
 const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
 
+// API scope needed for signing URLs with the IAM Credentials API
+const iamScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// Default validity of signed URLs
+const defaultSignedURLTTL = 5 * time.Minute
+
 type GCSBackend struct {
 	bucket  string
 	handle  *storage.BucketHandle
 	signing *storage.SignedURLOptions
+	ttl     time.Duration
+
+	// Token source for direct API calls, which caches tokens and
+	// refreshes them before they expire.
+	tokens oauth2.TokenSource
 }
 
 // Constructs a new GCS bucket backend based on the configured
@@ -52,16 +69,31 @@ func NewGCSBackend() (*GCSBackend, error) {
 		return nil, err
 	}
 
-	signing, err := signingOptsFromEnv()
+	tokens, err := google.DefaultTokenSource(ctx, gcsScope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find default credentials: %s", err)
+	}
+
+	signing, err := signingOptsFromEnv(ctx)
 	if err != nil {
 		log.WithError(err).Error("failed to configure GCS bucket signing")
 		return nil, err
 	}
 
+	ttl := defaultSignedURLTTL
+	if t := os.Getenv("GCS_SIGNED_URL_TTL"); t != "" {
+		ttl, err = time.ParseDuration(t)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid GCS_SIGNED_URL_TTL: %q", t)
+		}
+	}
+
 	return &GCSBackend{
 		bucket:  bucket,
 		handle:  handle,
 		signing: signing,
+		ttl:     ttl,
+		tokens:  tokens,
 	}, nil
 }
 
@@ -70,8 +102,28 @@ func (b *GCSBackend) Name() string {
 }
 
 func (b *GCSBackend) Persist(ctx context.Context, path, contentType string, f Persister) (string, int64, error) {
+	countOperation(OpWrite, path)
+
+	// Objects smaller than a chunk are uploaded in a single
+	// request, as every chunked writer buffers a full chunk, which
+	// is reserved from the upload budget.
+	chunked := true
+	if hint := SizeHintFrom(ctx); hint > 0 && hint < uploadChunkSize {
+		chunked = false
+	} else {
+		release, err := reserveUpload(ctx)
+		if err != nil {
+			return "", 0, err
+		}
+		defer release()
+	}
+
 	obj := b.handle.Object(path)
 	w := obj.NewWriter(ctx)
+	w.ChunkSize = 0
+	if chunked {
+		w.ChunkSize = int(uploadChunkSize)
+	}
 
 	hash, size, err := f(w)
 	if err != nil {
@@ -87,10 +139,30 @@ func (b *GCSBackend) Persist(ctx context.Context, path, contentType string, f Pe
 
 	// GCS natively supports content types for objects, which will be
 	// used when serving them back.
-	if contentType != "" {
-		_, err = obj.Update(ctx, storage.ObjectAttrsToUpdate{
-			ContentType: contentType,
-		})
+	// Blobs are served from the bucket, and never change once they
+	// are stored under their digest.
+	var cacheControl string
+	if class := objectClass(path); class == "layers" || class == "staging" {
+		cacheControl = ImmutableCacheControl
+	}
+
+	md := MetadataFrom(ctx)
+	if contentType != "" || len(md) > 0 || cacheControl != "" {
+		// Unset optional attributes are left alone, whereas empty
+		// values would clear them.
+		var attrs storage.ObjectAttrsToUpdate
+		if contentType != "" {
+			attrs.ContentType = contentType
+		}
+		if cacheControl != "" {
+			attrs.CacheControl = cacheControl
+		}
+		if len(md) > 0 {
+			attrs.Metadata = md
+		}
+
+		countOperation(OpWrite, path)
+		_, err = obj.Update(ctx, attrs)
 
 		if err != nil {
 			log.WithError(err).WithField("path", path).Error("failed to update object attrs")
@@ -105,11 +177,13 @@ func (b *GCSBackend) Fetch(ctx context.Context, path string) (io.ReadCloser, err
 	obj := b.handle.Object(path)
 
 	// Probe whether the file exists before trying to fetch it
+	countOperation(OpAttrs, path)
 	_, err := obj.Attrs(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	countOperation(OpRead, path)
 	return obj.NewReader(ctx)
 }
 
@@ -119,12 +193,7 @@ func (b *GCSBackend) Fetch(ctx context.Context, path string) (io.ReadCloser, err
 // The Go API for Cloud Storage does not support renaming objects, but
 // the HTTP API does. The code below makes the relevant call manually.
 func (b *GCSBackend) Move(ctx context.Context, old, new string) error {
-	creds, err := google.FindDefaultCredentials(ctx, gcsScope)
-	if err != nil {
-		return err
-	}
-
-	token, err := creds.TokenSource.Token()
+	token, err := b.tokens.Token()
 	if err != nil {
 		return err
 	}
@@ -136,6 +205,7 @@ func (b *GCSBackend) Move(ctx context.Context, old, new string) error {
 		url.PathEscape(b.bucket), url.PathEscape(new),
 	)
 
+	countOperation(OpCopy, old)
 	req, err := http.NewRequest("POST", url, nil)
 	req.Header.Add("Authorization", "Bearer "+token.AccessToken)
 	_, err = client.Do(req)
@@ -146,6 +216,7 @@ func (b *GCSBackend) Move(ctx context.Context, old, new string) error {
 	// It seems that 'rewriteTo' copies objects instead of
 	// renaming/moving them, hence a deletion call afterwards is
 	// required.
+	countOperation(OpDelete, old)
 	if err = b.handle.Object(old).Delete(ctx); err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"new": new,
@@ -159,26 +230,85 @@ func (b *GCSBackend) Move(ctx context.Context, old, new string) error {
 }
 
 func (b *GCSBackend) Serve(digest string, r *http.Request, w http.ResponseWriter) error {
-	url, err := b.constructLayerUrl(digest)
+	return b.serveObject("layers/"+digest, r, w)
+}
+
+func (b *GCSBackend) serveObject(object string, r *http.Request, w http.ResponseWriter) error {
+	url, err := b.constructLayerUrl(object)
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
-			"digest": digest,
+			"object": object,
 			"bucket": b.bucket,
 		}).Error("failed to sign GCS URL")
 
 		return err
 	}
 
-	log.WithField("digest", digest).Info("redirecting blob request to GCS bucket")
+	// The client reads the object from the bucket after following
+	// the redirect.
+	countOperation(OpRead, object)
+	if !logs.Duplicate("redirecting blob request " + object) {
+		log.WithField("object", object).Info("redirecting blob request to GCS bucket")
+	}
+
+	// Caches in front of Nixery may keep redirects to signed URLs
+	// for half of their validity, which leaves clients enough time
+	// to follow them.
+	if b.signing != nil {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(b.ttl.Seconds()/2)))
+	} else {
+		w.Header().Set("Cache-Control", ImmutableCacheControl)
+	}
 
 	w.Header().Set("Location", url)
 	w.WriteHeader(303)
 	return nil
 }
 
+func (b *GCSBackend) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+
+	countOperation(OpList, prefix)
+	it := b.handle.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, Object{
+			Path:     attrs.Name,
+			Size:     attrs.Size,
+			Updated:  attrs.Updated,
+			Metadata: attrs.Metadata,
+		})
+	}
+
+	return objects, nil
+}
+
+func (b *GCSBackend) Delete(ctx context.Context, path string) error {
+	countOperation(OpDelete, path)
+	return b.handle.Object(path).Delete(ctx)
+}
+
 // Configure GCS URL signing in the presence of a service account key
-// (toggled if the user has set GOOGLE_APPLICATION_CREDENTIALS).
-func signingOptsFromEnv() (*storage.SignedURLOptions, error) {
+// (toggled if the user has set GOOGLE_APPLICATION_CREDENTIALS), or of
+// a service account that signs URLs through the IAM Credentials API
+// (GCS_SIGNING_ACCOUNT).
+//
+// The latter requires no key files, which makes signing available with
+// GKE workload identity or workload identity federation (where
+// GOOGLE_APPLICATION_CREDENTIALS refers to an external account
+// configuration instead of a key).
+func signingOptsFromEnv(ctx context.Context) (*storage.SignedURLOptions, error) {
+	if account := os.Getenv("GCS_SIGNING_ACCOUNT"); account != "" {
+		return iamSigningOpts(ctx, account)
+	}
+
 	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
 	if path == "" {
 		// No credentials configured -> no URL signing
@@ -190,6 +320,17 @@ func signingOptsFromEnv() (*storage.SignedURLOptions, error) {
 		return nil, fmt.Errorf("failed to read service account key: %s", err)
 	}
 
+	// Credentials of external accounts (workload identity
+	// federation) contain no key to sign URLs with.
+	var credType struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(key, &credType)
+	if credType.Type != "service_account" {
+		log.WithField("type", credType.Type).Info("credentials contain no private key, GCS URL signing requires GCS_SIGNING_ACCOUNT")
+		return nil, nil
+	}
+
 	conf, err := google.JWTConfigFromJSON(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse service account key: %s", err)
@@ -205,6 +346,69 @@ func signingOptsFromEnv() (*storage.SignedURLOptions, error) {
 	}, nil
 }
 
+// iamSigningOpts configures URL signing with the given service account
+// through the IAM Credentials API, authenticated with the default
+// credentials. These must be allowed to create tokens for the account
+// (`roles/iam.serviceAccountTokenCreator`).
+func iamSigningOpts(ctx context.Context, account string) (*storage.SignedURLOptions, error) {
+	tokens, err := google.DefaultTokenSource(ctx, iamScope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find default credentials for signing: %s", err)
+	}
+
+	log.WithField("account", account).Info("GCS URL signing through IAM enabled")
+
+	return &storage.SignedURLOptions{
+		Scheme:         storage.SigningSchemeV4,
+		GoogleAccessID: account,
+		Method:         "GET",
+		SignBytes: func(payload []byte) ([]byte, error) {
+			return signBlob(tokens, account, payload)
+		},
+	}, nil
+}
+
+// signBlob signs a payload with the key of a service account managed by
+// Google, using the IAM Credentials API.
+func signBlob(tokens oauth2.TokenSource, account string, payload []byte) ([]byte, error) {
+	token, err := tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	body, _ := json.Marshal(map[string]string{
+		"payload": base64.StdEncoding.EncodeToString(payload),
+	})
+
+	url := fmt.Sprintf("https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:signBlob", url.PathEscape(account))
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("failed to sign URL with %s: %s: %s", account, resp.Status, msg)
+	}
+
+	var signed struct {
+		SignedBlob string `json:"signedBlob"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(signed.SignedBlob)
+}
+
 // layerRedirect constructs the public URL of the layer object in the Cloud
 // Storage bucket, signs it and redirects the user there.
 //
@@ -217,13 +421,14 @@ func signingOptsFromEnv() (*storage.SignedURLOptions, error) {
 //
 // The Docker client is known to follow redirects, but this might not be true
 // for all other registry clients.
-func (b *GCSBackend) constructLayerUrl(digest string) (string, error) {
-	log.WithField("layer", digest).Info("redirecting layer request to bucket")
-	object := "layers/" + digest
+func (b *GCSBackend) constructLayerUrl(object string) (string, error) {
+	if !logs.Duplicate("redirecting layer request " + object) {
+		log.WithField("object", object).Info("redirecting layer request to bucket")
+	}
 
 	if b.signing != nil {
 		opts := *b.signing
-		opts.Expires = time.Now().Add(5 * time.Minute)
+		opts.Expires = time.Now().Add(b.ttl)
 		return storage.SignedURL(b.bucket, object, &opts)
 	} else {
 		return ("https://storage.googleapis.com/" + b.bucket + "/" + object), nil
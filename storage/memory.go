@@ -0,0 +1,161 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// In-memory storage backend for Nixery.
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nixery/logs"
+	log "github.com/sirupsen/logrus"
+)
+
+type memoryObject struct {
+	data        []byte
+	contentType string
+	updated     time.Time
+	metadata    Metadata
+}
+
+// MemoryBackend keeps all objects in memory. It is intended for tests
+// and other short-lived instances, as all objects are lost when the
+// process exits.
+type MemoryBackend struct {
+	mu      sync.RWMutex
+	objects map[string]*memoryObject
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		objects: make(map[string]*memoryObject),
+	}
+}
+
+func (b *MemoryBackend) Name() string {
+	return "Memory"
+}
+
+func (b *MemoryBackend) get(op, key string) (*memoryObject, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	obj, ok := b.objects[path.Clean(key)]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+	}
+
+	return obj, nil
+}
+
+func (b *MemoryBackend) Persist(ctx context.Context, key, contentType string, f Persister) (string, int64, error) {
+	countOperation(OpWrite, key)
+	var buf bytes.Buffer
+	hash, size, err := f(&buf)
+	if err != nil {
+		return hash, size, err
+	}
+
+	b.mu.Lock()
+	b.objects[path.Clean(key)] = &memoryObject{
+		data:        buf.Bytes(),
+		contentType: contentType,
+		updated:     time.Now(),
+		metadata:    MetadataFrom(ctx),
+	}
+	b.mu.Unlock()
+
+	return hash, size, nil
+}
+
+func (b *MemoryBackend) Fetch(ctx context.Context, key string) (io.ReadCloser, error) {
+	countOperation(OpRead, key)
+	obj, err := b.get("fetch", key)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+func (b *MemoryBackend) Move(ctx context.Context, old, new string) error {
+	countOperation(OpCopy, old)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	obj, ok := b.objects[path.Clean(old)]
+	if !ok {
+		return &os.PathError{Op: "move", Path: old, Err: os.ErrNotExist}
+	}
+
+	delete(b.objects, path.Clean(old))
+	b.objects[path.Clean(new)] = obj
+	return nil
+}
+
+func (b *MemoryBackend) Serve(digest string, r *http.Request, w http.ResponseWriter) error {
+	return b.serveObject("layers/"+digest, r, w)
+}
+
+func (b *MemoryBackend) serveObject(key string, r *http.Request, w http.ResponseWriter) error {
+	countOperation(OpRead, key)
+	obj, err := b.get("serve", key)
+	if err != nil {
+		return err
+	}
+
+	if !logs.Duplicate("serving blob from memory " + key) {
+		log.WithField("object", key).Info("serving blob from memory")
+	}
+
+	w.Header().Set("Content-Type", obj.contentType)
+	http.ServeContent(w, r, "", obj.updated, bytes.NewReader(obj.data))
+	return nil
+}
+
+func (b *MemoryBackend) List(ctx context.Context, prefix string) ([]Object, error) {
+	countOperation(OpList, prefix)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var objects []Object
+	for key, obj := range b.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, Object{
+				Path:     key,
+				Size:     int64(len(obj.data)),
+				Updated:  obj.updated,
+				Metadata: obj.metadata,
+			})
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Path < objects[j].Path
+	})
+
+	return objects, nil
+}
+
+func (b *MemoryBackend) Delete(ctx context.Context, key string) error {
+	countOperation(OpDelete, key)
+	if _, err := b.get("delete", key); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	delete(b.objects, path.Clean(key))
+	b.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+import "context"
+
+// Metadata holds labels that are attached to stored objects, which
+// lets cloud cost tooling and lifecycle rules operate on them.
+type Metadata map[string]string
+
+// Keys of the metadata written by Nixery.
+const (
+	MetadataImage    = "nixery-image"
+	MetadataTenant   = "nixery-tenant"
+	MetadataRevision = "nixery-revision"
+	MetadataCreated  = "nixery-created"
+
+	// Marks recipes of chunked blobs, holding their number of chunks
+	MetadataChunks = "nixery-chunks"
+)
+
+type metadataKey struct{}
+
+// WithMetadata returns a context which causes all objects persisted
+// with it to be labeled with the given metadata.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// MetadataFrom returns the metadata attached to a context, if any.
+func MetadataFrom(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	return md
+}
+
+type sizeHintKey struct{}
+
+// WithSizeHint returns a context indicating the size of the objects
+// persisted with it, if it is known in advance. Backends use this to
+// avoid allocating upload buffers for small objects.
+func WithSizeHint(ctx context.Context, size int64) context.Context {
+	return context.WithValue(ctx, sizeHintKey{}, size)
+}
+
+// SizeHintFrom returns the size hint attached to a context, or zero.
+func SizeHintFrom(ctx context.Context) int64 {
+	size, _ := ctx.Value(sizeHintKey{}).(int64)
+	return size
+}
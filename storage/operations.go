@@ -0,0 +1,107 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+// This file implements counters for the calls made to storage backends,
+// labeled by the type of operation and the class of object involved.
+// For cloud storage, each of these calls is billed individually, so the
+// counters allow operators to attribute costs to Nixery's behaviours
+// (e.g. probing for cached layers vs. uploading them).
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nixery/api"
+)
+
+// Operation types, roughly corresponding to the billed API calls of
+// cloud storage.
+const (
+	OpAttrs  = "attrs"
+	OpRead   = "read"
+	OpWrite  = "write"
+	OpCopy   = "copy"
+	OpList   = "list"
+	OpDelete = "delete"
+)
+
+// objectClasses are the top-level directories of the storage layout,
+// which are used as object classes. Paths may be nested below an
+// environment prefix.
+var objectClasses = map[string]bool{
+	"builds":       true,
+	"catalog":      true,
+	"chunks":       true,
+	"closures":     true,
+	"contents":     true,
+	"layers":       true,
+	"leases":       true,
+	"manifests":    true,
+	"pin":          true,
+	"pins":         true,
+	"popularity":   true,
+	"profiles":     true,
+	"quarantine":   true,
+	"referrers":    true,
+	"refs":         true,
+	"scans":        true,
+	"spec-aliases": true,
+	"staging":      true,
+}
+
+var operations = struct {
+	sync.Mutex
+	since  time.Time
+	counts map[string]map[string]uint64
+}{
+	since:  time.Now(),
+	counts: make(map[string]map[string]uint64),
+}
+
+// objectClass returns the class of the object at the given path (or of
+// the objects below a listed prefix).
+func objectClass(path string) string {
+	for _, c := range strings.Split(path, "/") {
+		if objectClasses[c] {
+			return c
+		}
+	}
+
+	return "other"
+}
+
+// countOperation records a call to a storage backend.
+func countOperation(op, path string) {
+	class := objectClass(path)
+
+	operations.Lock()
+	defer operations.Unlock()
+
+	if operations.counts[op] == nil {
+		operations.counts[op] = make(map[string]uint64)
+	}
+	operations.counts[op][class]++
+}
+
+// Operations returns the number of storage backend calls made since
+// startup, by operation and object class.
+func Operations() api.StorageOperations {
+	operations.Lock()
+	defer operations.Unlock()
+
+	counts := make(map[string]map[string]uint64)
+	for op, classes := range operations.counts {
+		counts[op] = make(map[string]uint64)
+		for class, n := range classes {
+			counts[op][class] = n
+		}
+	}
+
+	return api.StorageOperations{
+		Since:   operations.since,
+		Counts:  counts,
+		Uploads: uploadBuffers(),
+	}
+}
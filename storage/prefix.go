@@ -0,0 +1,123 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// objectServer is implemented by backends that can serve arbitrary
+// objects, not only those below `layers/`.
+type objectServer interface {
+	serveObject(path string, r *http.Request, w http.ResponseWriter) error
+}
+
+// PrefixBackend stores all objects of a storage backend below a fixed
+// prefix. This allows several logical environments (e.g. staging and
+// production) to share a bucket without sharing their caches.
+type PrefixBackend struct {
+	backend Backend
+	prefix  string
+}
+
+// WithPrefix returns a backend storing its objects below `<prefix>/`
+// in the given backend.
+func WithPrefix(b Backend, prefix string) (*PrefixBackend, error) {
+	if prefix == "" || strings.ContainsAny(prefix, "/.") {
+		return nil, fmt.Errorf("invalid storage prefix %q", prefix)
+	}
+
+	if _, ok := b.(objectServer); !ok {
+		return nil, fmt.Errorf("storage backend %s does not support prefixes", b.Name())
+	}
+
+	return &PrefixBackend{
+		backend: b,
+		prefix:  prefix + "/",
+	}, nil
+}
+
+// Prefix returns the name of the prefix, without the trailing slash.
+func (b *PrefixBackend) Prefix() string {
+	return strings.TrimSuffix(b.prefix, "/")
+}
+
+// Sibling returns a backend for another prefix in the same underlying
+// backend.
+func (b *PrefixBackend) Sibling(prefix string) (*PrefixBackend, error) {
+	return WithPrefix(b.backend, prefix)
+}
+
+// ErrNoPrefix is returned by Sibling for backends without a prefix.
+var ErrNoPrefix = errors.New("no storage prefix is configured")
+
+// Sibling returns a backend for another prefix in the same underlying
+// backend as the given (possibly chunked) prefixed backend.
+func Sibling(b Backend, prefix string) (Backend, error) {
+	switch b := b.(type) {
+	case *PrefixBackend:
+		sibling, err := b.Sibling(prefix)
+		if err != nil {
+			return nil, err
+		}
+		return sibling, nil
+	case *ChunkedBackend:
+		sibling, err := Sibling(b.Backend, prefix)
+		if err != nil {
+			return nil, err
+		}
+		return WithChunking(sibling), nil
+	default:
+		return nil, ErrNoPrefix
+	}
+}
+
+func (b *PrefixBackend) Name() string {
+	return b.backend.Name() + " [" + b.Prefix() + "]"
+}
+
+func (b *PrefixBackend) Persist(ctx context.Context, path, contentType string, f Persister) (string, int64, error) {
+	return b.backend.Persist(ctx, b.prefix+path, contentType, f)
+}
+
+func (b *PrefixBackend) Fetch(ctx context.Context, path string) (io.ReadCloser, error) {
+	return b.backend.Fetch(ctx, b.prefix+path)
+}
+
+func (b *PrefixBackend) Move(ctx context.Context, old, new string) error {
+	return b.backend.Move(ctx, b.prefix+old, b.prefix+new)
+}
+
+func (b *PrefixBackend) Serve(digest string, r *http.Request, w http.ResponseWriter) error {
+	return b.backend.(objectServer).serveObject(b.prefix+"layers/"+digest, r, w)
+}
+
+// List returns the objects below the prefix, with paths relative to
+// the prefix.
+func (b *PrefixBackend) List(ctx context.Context, prefix string) ([]Object, error) {
+	objects, err := b.backend.List(ctx, b.prefix+prefix)
+	return b.relative(objects), err
+}
+
+func (b *PrefixBackend) ListWithMetadata(ctx context.Context, prefix string) ([]Object, error) {
+	objects, err := ListWithMetadata(ctx, b.backend, b.prefix+prefix)
+	return b.relative(objects), err
+}
+
+// relative strips the prefix from the paths of listed objects.
+func (b *PrefixBackend) relative(objects []Object) []Object {
+	for i := range objects {
+		objects[i].Path = strings.TrimPrefix(objects[i].Path, b.prefix)
+	}
+
+	return objects
+}
+
+func (b *PrefixBackend) Delete(ctx context.Context, path string) error {
+	return b.backend.Delete(ctx, b.prefix+path)
+}
@@ -0,0 +1,655 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// S3-compatible storage backend for Nixery, for AWS S3 and
+// self-hosted implementations such as MinIO.
+//
+// Requests are signed with AWS Signature Version 4 by Nixery itself,
+// and blobs are served by redirecting clients to pre-signed URLs.
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nixery/logs"
+	log "github.com/sirupsen/logrus"
+)
+
+// Number of concurrent requests retrieving object metadata while
+// listing, which S3 does not return in listings.
+const s3ListWorkers = 16
+
+// Hash of an empty payload, used for requests without a body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type s3Credentials struct {
+	accessKey string
+	secretKey string
+	token     string
+	expires   time.Time // Zero for static credentials
+}
+
+type S3Backend struct {
+	bucket    string
+	endpoint  *url.URL
+	region    string
+	pathStyle bool
+	creds     *s3CredentialProvider
+	ttl       time.Duration
+}
+
+// Constructs a new S3 backend based on the configured environment
+// variables.
+func NewS3Backend() (*S3Backend, error) {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET must be configured for S3 usage")
+	}
+
+	region := os.Getenv("S3_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT: %q", endpoint)
+	}
+
+	if (os.Getenv("AWS_ACCESS_KEY_ID") == "") != (os.Getenv("AWS_SECRET_ACCESS_KEY") == "") {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be configured together")
+	}
+	if os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") == "" {
+		return nil, fmt.Errorf("AWS_WEB_IDENTITY_TOKEN_FILE requires AWS_ROLE_ARN")
+	}
+
+	ttl := defaultSignedURLTTL
+	if t := os.Getenv("S3_SIGNED_URL_TTL"); t != "" {
+		ttl, err = time.ParseDuration(t)
+		if err != nil || ttl <= 0 || ttl > 7*24*time.Hour {
+			return nil, fmt.Errorf("invalid S3_SIGNED_URL_TTL: %q", t)
+		}
+	}
+
+	// Temporary credentials are refreshed while pre-signed URLs
+	// using them are still valid for their full TTL.
+	creds := s3CredentialsFromEnv(region, ttl+time.Minute)
+
+	b := &S3Backend{
+		bucket:    bucket,
+		endpoint:  u,
+		region:    region,
+		pathStyle: os.Getenv("S3_PATH_STYLE") == "true",
+		creds:     creds,
+		ttl:       ttl,
+	}
+
+	// Probe whether the bucket is accessible with the credentials.
+	resp, err := b.do(context.Background(), "HEAD", "", nil, nil, nil)
+	if err != nil {
+		log.WithError(err).WithField("bucket", bucket).Error("could not access configured bucket")
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return b, nil
+}
+
+func (b *S3Backend) Name() string {
+	return "S3 (" + b.bucket + ")"
+}
+
+// s3Escape encodes an object key for use in a URL path, as required
+// by the signature (all but unreserved characters are encoded).
+func s3Escape(s string, path bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' || (path && c == '/') {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// objectURL returns the URL of an object, or of the bucket if the key
+// is empty.
+func (b *S3Backend) objectURL(key string, query url.Values) *url.URL {
+	u := *b.endpoint
+	path := "/" + s3Escape(key, true)
+	if b.pathStyle {
+		path = "/" + b.bucket + path
+	} else {
+		u.Host = b.bucket + "." + u.Host
+	}
+
+	u.Path, _ = url.PathUnescape(path)
+	u.RawPath = path
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signature computes the signature of a canonical request at the given
+// time, and returns it with the credential scope.
+func (b *S3Backend) signature(creds s3Credentials, canonical string, t time.Time) (string, string) {
+	date := t.Format("20060102")
+	scope := date + "/" + b.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), date)
+	key = hmacSHA256(key, b.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, toSign)), scope
+}
+
+// sign adds the Authorization header to a request, signing all of its
+// headers.
+func (b *S3Backend) sign(req *http.Request, creds s3Credentials, payloadHash string, t time.Time) {
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+
+	sig, scope := b.signature(creds, canonical, t)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.accessKey, scope, signed, sig))
+}
+
+// presign returns a pre-signed URL to GET an object, which is valid
+// for the given duration from the given time.
+func (b *S3Backend) presign(creds s3Credentials, key string, t time.Time, ttl time.Duration) string {
+	date := t.Format("20060102")
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {creds.accessKey + "/" + date + "/" + b.region + "/s3/aws4_request"},
+		"X-Amz-Date":          {t.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {strconv.Itoa(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if creds.token != "" {
+		query.Set("X-Amz-Security-Token", creds.token)
+	}
+
+	u := b.objectURL(key, query)
+	canonical := strings.Join([]string{
+		"GET",
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	sig, _ := b.signature(creds, canonical, t)
+	return u.String() + "&X-Amz-Signature=" + sig
+}
+
+// s3Error is the error document returned by S3.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do performs a signed request against an object (or the bucket, if
+// the key is empty) and returns the response if it succeeded. Missing
+// objects are reported as os.ErrNotExist.
+func (b *S3Backend) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	creds, err := b.creds.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, b.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	b.sign(req, creds, payloadHash, time.Now().UTC())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == 404 {
+		resp.Body.Close()
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrNotExist}
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var e s3Error
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if xml.Unmarshal(msg, &e) == nil && e.Code != "" {
+			return nil, fmt.Errorf("S3 %s %s failed: %s: %s", method, key, e.Code, e.Message)
+		}
+		return nil, fmt.Errorf("S3 %s %s failed: %s", method, key, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// s3Writer uploads the data written to it, as a single object if it
+// fits into one part and as a multipart upload otherwise, which needs
+// no length in advance. Parts have the size of the chunks of uploads
+// (see SetUploadLimits), and S3 requires them to be at least 5 MiB.
+type s3Writer struct {
+	ctx    context.Context
+	b      *S3Backend
+	key    string
+	header http.Header
+
+	buf      bytes.Buffer
+	uploadID string
+	parts    []s3Part
+}
+
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	if int64(w.buf.Len()) >= uploadChunkSize {
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// flush uploads the buffered data as the next part, starting the
+// multipart upload if necessary.
+func (w *s3Writer) flush() error {
+	if w.uploadID == "" {
+		resp, err := w.b.do(w.ctx, "POST", w.key, url.Values{"uploads": {""}}, w.header, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		var created struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := xml.NewDecoder(resp.Body).Decode(&created); err != nil {
+			return err
+		}
+		w.uploadID = created.UploadID
+	}
+
+	part := len(w.parts) + 1
+	resp, err := w.b.do(w.ctx, "PUT", w.key, url.Values{
+		"partNumber": {strconv.Itoa(part)},
+		"uploadId":   {w.uploadID},
+	}, nil, w.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	w.parts = append(w.parts, s3Part{Number: part, ETag: resp.Header.Get("ETag")})
+	w.buf.Reset()
+	return nil
+}
+
+// Close completes the upload.
+func (w *s3Writer) Close() error {
+	if w.uploadID == "" {
+		resp, err := w.b.do(w.ctx, "PUT", w.key, nil, w.header, w.buf.Bytes())
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	if w.buf.Len() > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+
+	body, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: w.parts})
+
+	resp, err := w.b.do(w.ctx, "POST", w.key, url.Values{"uploadId": {w.uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Failures of the completion may be reported after a successful
+	// status, in the response body.
+	var e s3Error
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if xml.Unmarshal(msg, &e) == nil && e.Code != "" {
+		return fmt.Errorf("S3 multipart upload of %s failed: %s: %s", w.key, e.Code, e.Message)
+	}
+
+	return nil
+}
+
+// abort discards the parts of an unfinished multipart upload.
+func (w *s3Writer) abort() {
+	if w.uploadID == "" {
+		return
+	}
+
+	resp, err := w.b.do(context.Background(), "DELETE", w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil)
+	if err != nil {
+		log.WithError(err).WithField("path", w.key).Warn("failed to abort S3 multipart upload")
+		return
+	}
+	resp.Body.Close()
+}
+
+func (b *S3Backend) Persist(ctx context.Context, path, contentType string, f Persister) (string, int64, error) {
+	countOperation(OpWrite, path)
+
+	header := make(http.Header)
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+
+	// Blobs are served from the bucket, and never change once they
+	// are stored under their digest.
+	if class := objectClass(path); class == "layers" || class == "staging" {
+		header.Set("Cache-Control", ImmutableCacheControl)
+	}
+
+	for k, v := range MetadataFrom(ctx) {
+		header.Set("X-Amz-Meta-"+k, v)
+	}
+
+	// Objects smaller than a part are buffered without reserving
+	// a part from the upload budget.
+	if hint := SizeHintFrom(ctx); hint <= 0 || hint >= uploadChunkSize {
+		release, err := reserveUpload(ctx)
+		if err != nil {
+			return "", 0, err
+		}
+		defer release()
+	}
+
+	w := &s3Writer{ctx: ctx, b: b, key: path, header: header}
+	hash, size, err := f(w)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		w.abort()
+		log.WithError(err).WithField("path", path).Error("failed to write to S3")
+		return hash, size, err
+	}
+
+	return hash, size, nil
+}
+
+func (b *S3Backend) Fetch(ctx context.Context, path string) (io.ReadCloser, error) {
+	countOperation(OpRead, path)
+	resp, err := b.do(ctx, "GET", path, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Move copies an object to its new path and deletes the old one, as
+// S3 has no renaming operation. The metadata of the object is copied.
+func (b *S3Backend) Move(ctx context.Context, old, new string) error {
+	countOperation(OpCopy, old)
+	header := http.Header{"X-Amz-Copy-Source": {"/" + b.bucket + "/" + s3Escape(old, true)}}
+	resp, err := b.do(ctx, "PUT", new, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Copies can fail after a successful status, which is reported
+	// in the response body.
+	var e s3Error
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if xml.Unmarshal(msg, &e) == nil && e.Code != "" {
+		return fmt.Errorf("S3 copy of %s failed: %s: %s", old, e.Code, e.Message)
+	}
+
+	if err := b.Delete(ctx, old); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"new": new,
+			"old": old,
+		}).Warn("failed to delete renamed object")
+
+		// this error should not break renaming and is not returned
+	}
+
+	return nil
+}
+
+func (b *S3Backend) Serve(digest string, r *http.Request, w http.ResponseWriter) error {
+	object := "layers/" + digest
+	creds, err := b.creds.get(r.Context())
+	if err != nil {
+		return err
+	}
+
+	// The client reads the object from the bucket after following
+	// the redirect.
+	countOperation(OpRead, object)
+	if !logs.Duplicate("redirecting blob request " + object) {
+		log.WithField("object", object).Info("redirecting blob request to S3 bucket")
+	}
+
+	// Caches in front of Nixery may keep redirects to signed URLs
+	// for half of their validity, which leaves clients enough time
+	// to follow them.
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(b.ttl.Seconds()/2)))
+	w.Header().Set("Location", b.presign(creds, object, time.Now().UTC(), b.ttl))
+	w.WriteHeader(303)
+	return nil
+}
+
+// metadataFromHeader extracts the user metadata of an object from the
+// headers of a response.
+func metadataFromHeader(h http.Header) Metadata {
+	var md Metadata
+	for k, v := range h {
+		if name := strings.ToLower(k); strings.HasPrefix(name, "x-amz-meta-") && len(v) > 0 {
+			if md == nil {
+				md = make(Metadata)
+			}
+			md[strings.TrimPrefix(name, "x-amz-meta-")] = v[0]
+		}
+	}
+	return md
+}
+
+// List lists objects without their metadata, which is not contained in
+// the listings of S3.
+func (b *S3Backend) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		countOperation(OpList, prefix)
+		resp, err := b.do(ctx, "GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range page.Contents {
+			objects = append(objects, Object{
+				Path:    c.Key,
+				Size:    c.Size,
+				Updated: c.LastModified,
+			})
+		}
+
+		if !page.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+
+	return objects, nil
+}
+
+// ListWithMetadata lists objects along with their metadata, which is
+// retrieved for each object separately.
+func (b *S3Backend) ListWithMetadata(ctx context.Context, prefix string) ([]Object, error) {
+	objects, err := b.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	work := make(chan int)
+	for i := 0; i < s3ListWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range work {
+				countOperation(OpAttrs, objects[idx].Path)
+				resp, err := b.do(ctx, "HEAD", objects[idx].Path, nil, nil, nil)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil && !os.IsNotExist(err) {
+						firstErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				resp.Body.Close()
+				objects[idx].Metadata = metadataFromHeader(resp.Header)
+			}
+		}()
+	}
+	for idx := range objects {
+		work <- idx
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return objects, nil
+}
+
+func (b *S3Backend) Delete(ctx context.Context, path string) error {
+	countOperation(OpDelete, path)
+	resp, err := b.do(ctx, "DELETE", path, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
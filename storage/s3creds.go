@@ -0,0 +1,234 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+// This file implements the credentials with which requests to S3 are
+// signed. Credentials are read from (in order of precedence):
+//
+// 1. static keys in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+// 2. a role assumed with a web identity token (e.g. of a Kubernetes
+//    service account), configured with AWS_WEB_IDENTITY_TOKEN_FILE and
+//    AWS_ROLE_ARN
+// 3. the role of the EC2 instance, from the instance metadata service
+//
+// Temporary credentials are refreshed before they expire.
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Address of the EC2 instance metadata service.
+const imdsEndpoint = "http://169.254.169.254"
+
+// s3CredentialProvider returns the current credentials for S3,
+// fetching new ones when they are about to expire.
+type s3CredentialProvider struct {
+	// Source of new credentials, which is nil for static credentials
+	fetch func(ctx context.Context) (s3Credentials, error)
+
+	// Time before expiry at which credentials are refreshed, which
+	// must cover the validity of pre-signed URLs
+	margin time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	current s3Credentials
+}
+
+// get returns credentials that are valid for at least the margin of
+// the provider.
+func (p *s3CredentialProvider) get(ctx context.Context) (s3Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.fetch == nil || (p.current.accessKey != "" && p.now().Add(p.margin).Before(p.current.expires)) {
+		return p.current, nil
+	}
+
+	creds, err := p.fetch(ctx)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("failed to refresh S3 credentials: %w", err)
+	}
+
+	log.WithField("expires", creds.expires).Debug("refreshed S3 credentials")
+	p.current = creds
+	return creds, nil
+}
+
+// s3CredentialsFromEnv determines the source of S3 credentials from
+// the environment.
+func s3CredentialsFromEnv(region string, margin time.Duration) *s3CredentialProvider {
+	p := &s3CredentialProvider{
+		margin: margin,
+		now:    time.Now,
+	}
+
+	if key := os.Getenv("AWS_ACCESS_KEY_ID"); key != "" {
+		p.current = s3Credentials{
+			accessKey: key,
+			secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			token:     os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		return p
+	}
+
+	if file := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); file != "" {
+		endpoint := "https://sts." + region + ".amazonaws.com"
+		role := os.Getenv("AWS_ROLE_ARN")
+		session := os.Getenv("AWS_ROLE_SESSION_NAME")
+		if session == "" {
+			session = "nixery"
+		}
+
+		p.fetch = func(ctx context.Context) (s3Credentials, error) {
+			return assumeRoleWithWebIdentity(ctx, endpoint, role, session, file)
+		}
+		return p
+	}
+
+	p.fetch = func(ctx context.Context) (s3Credentials, error) {
+		return instanceRoleCredentials(ctx, imdsEndpoint)
+	}
+	return p
+}
+
+type stsResponse struct {
+	Credentials struct {
+		AccessKeyId     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+// assumeRoleWithWebIdentity exchanges the web identity token in the
+// given file for temporary credentials of a role. The file is read on
+// every refresh, as the token is rotated by the platform.
+func assumeRoleWithWebIdentity(ctx context.Context, endpoint, role, session, file string) (s3Credentials, error) {
+	token, err := ioutil.ReadFile(file)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("failed to read web identity token: %w", err)
+	}
+
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	body, err := credentialsRequest(req)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("failed to assume role %s: %w", role, err)
+	}
+
+	var resp stsResponse
+	if err := xml.Unmarshal(body, &resp); err != nil || resp.Credentials.AccessKeyId == "" {
+		return s3Credentials{}, fmt.Errorf("invalid response assuming role %s", role)
+	}
+
+	return s3Credentials{
+		accessKey: resp.Credentials.AccessKeyId,
+		secretKey: resp.Credentials.SecretAccessKey,
+		token:     resp.Credentials.SessionToken,
+		expires:   resp.Credentials.Expiration,
+	}, nil
+}
+
+type imdsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+// instanceRoleCredentials returns the credentials of the role of the
+// EC2 instance, using version 2 of the instance metadata service.
+func instanceRoleCredentials(ctx context.Context, endpoint string) (s3Credentials, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+
+	token, err := credentialsRequest(req)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("failed to access instance metadata: %w", err)
+	}
+
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"/latest/meta-data/iam/security-credentials/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return credentialsRequest(req)
+	}
+
+	roles, err := get("")
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("failed to list instance roles: %w", err)
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return s3Credentials{}, fmt.Errorf("no role is attached to the instance")
+	}
+
+	body, err := get(role)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("failed to fetch credentials of instance role %s: %w", role, err)
+	}
+
+	var creds imdsCredentials
+	if err := json.Unmarshal(body, &creds); err != nil || creds.AccessKeyId == "" {
+		return s3Credentials{}, fmt.Errorf("invalid credentials of instance role %s", role)
+	}
+
+	return s3Credentials{
+		accessKey: creds.AccessKeyId,
+		secretKey: creds.SecretAccessKey,
+		token:     creds.Token,
+		expires:   creds.Expiration,
+	}, nil
+}
+
+// credentialsRequest performs a request to a credentials endpoint and
+// returns the response body if it succeeded.
+func credentialsRequest(req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return body, nil
+}
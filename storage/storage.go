@@ -8,12 +8,35 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net/http"
+	"os"
+	"time"
+
+	gcs "cloud.google.com/go/storage"
 )
 
+// ImmutableCacheControl is the Cache-Control header for content that
+// is addressed by its digest, which never changes.
+const ImmutableCacheControl = "public, max-age=31536000, immutable"
+
 type Persister = func(io.Writer) (string, int64, error)
 
+// IsNotExist reports whether an error returned by a storage backend
+// indicates that the requested object does not exist.
+func IsNotExist(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, gcs.ErrObjectNotExist)
+}
+
+// Object describes an object stored in a storage backend.
+type Object struct {
+	Path     string    // Full path of the object
+	Size     int64     // Size of the object in bytes
+	Updated  time.Time // Time at which the object was last written
+	Metadata Metadata  // Labels attached to the object, if any
+}
+
 type Backend interface {
 	// Name returns the name of the storage backend, for use in
 	// log messages and such.
@@ -25,6 +48,9 @@ type Backend interface {
 	// It needs to return the SHA256 hash of the data written as
 	// well as the total number of bytes, as those are required
 	// for the image manifest.
+	//
+	// Metadata attached to the context with WithMetadata is stored
+	// with the object.
 	Persist(ctx context.Context, path, contentType string, f Persister) (string, int64, error)
 
 	// Fetch retrieves data from the storage backend.
@@ -37,4 +63,31 @@ type Backend interface {
 	// Serve provides a handler function to serve HTTP requests
 	// for objects in the storage backend.
 	Serve(digest string, r *http.Request, w http.ResponseWriter) error
+
+	// List returns all objects whose path starts with the given
+	// prefix. This is used for garbage collection. The metadata of
+	// objects is only included if it is available without further
+	// requests (see ListWithMetadata).
+	List(ctx context.Context, prefix string) ([]Object, error)
+
+	// Delete removes an object from the storage backend.
+	Delete(ctx context.Context, path string) error
+}
+
+// metadataLister is implemented by backends whose listings do not
+// contain the metadata of objects, which can be retrieved separately
+// at the cost of additional requests.
+type metadataLister interface {
+	ListWithMetadata(ctx context.Context, prefix string) ([]Object, error)
+}
+
+// ListWithMetadata lists all objects whose path starts with the given
+// prefix along with their metadata, for callers that need it (e.g.
+// accounting usage by tenant).
+func ListWithMetadata(ctx context.Context, b Backend, prefix string) ([]Object, error) {
+	if l, ok := b.(metadataLister); ok {
+		return l.ListWithMetadata(ctx, prefix)
+	}
+
+	return b.List(ctx, prefix)
 }
@@ -0,0 +1,40 @@
+// Copyright 2022 The TVL Contributors
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+import (
+	"context"
+
+	"github.com/google/nixery/api"
+)
+
+// DefaultTenant is the name under which objects that are not labeled
+// with a tenant are reported.
+const DefaultTenant = "default"
+
+// Usage describes the storage used by a single tenant.
+type Usage = api.Usage
+
+// UsageByTenant aggregates the size of all objects in a storage
+// backend by the tenant they are labeled with.
+func UsageByTenant(ctx context.Context, b Backend) (map[string]Usage, error) {
+	objects, err := ListWithMetadata(ctx, b, "")
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[string]Usage)
+	for _, obj := range objects {
+		tenant := obj.Metadata[MetadataTenant]
+		if tenant == "" {
+			tenant = DefaultTenant
+		}
+
+		u := usage[tenant]
+		u.Objects++
+		u.Bytes += obj.Size
+		usage[tenant] = u
+	}
+
+	return usage, nil
+}